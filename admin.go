@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/metalmatze/signal/internalserver"
+)
+
+// adminRoute describes an endpoint registered on the internal server.
+type adminRoute struct {
+	Path        string   `json:"path"`
+	Methods     []string `json:"methods"`
+	Description string   `json:"description"`
+}
+
+// adminRoutes registers endpoints on the internal server and keeps the listing served
+// at /admin in sync with them. Every endpoint requires token as a bearer token, and is
+// refused to everyone when token is nil.
+type adminRoutes struct {
+	h      *internalserver.Handler
+	token  *teams.SecretFile
+	routes []adminRoute
+}
+
+func newAdminRoutes(h *internalserver.Handler, token *teams.SecretFile) *adminRoutes {
+	a := &adminRoutes{h: h, token: token}
+	a.add("/admin", []string{http.MethodGet}, "Lists the admin endpoints, their methods and descriptions", a.serveIndex)
+	return a
+}
+
+// add registers handler at path, listing it with its methods and description. Requests of
+// other methods are answered 405.
+func (a *adminRoutes) add(path string, methods []string, description string, handler http.HandlerFunc) {
+	a.h.AddEndpoint(path, description, a.authorize(allowMethods(methods, handler)))
+	a.routes = append(a.routes, adminRoute{Path: path, Methods: methods, Description: description})
+}
+
+// authorize rejects the requests to next without the admin token.
+func (a *adminRoutes) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == nil {
+			http.Error(w, "the admin endpoints require --admin-token-file", http.StatusForbidden)
+			return
+		}
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(a.token.Value())) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// allowMethods rejects the requests to next of methods other than methods.
+func allowMethods(methods []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *adminRoutes) serveIndex(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(a.routes)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/metalmatze/signal/internalserver"
+)
+
+// newAdminToken returns a SecretFile holding token.
+func newAdminToken(t *testing.T, token string) *teams.SecretFile {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(path, []byte(token+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := teams.NewSecretFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAdminRoutesAuthorization(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		token         *teams.SecretFile
+		authorization string
+		status        int
+	}{
+		{name: "valid token", token: newAdminToken(t, "secret"), authorization: "Bearer secret", status: http.StatusOK},
+		{name: "invalid token", token: newAdminToken(t, "secret"), authorization: "Bearer other", status: http.StatusUnauthorized},
+		{name: "other scheme", token: newAdminToken(t, "secret"), authorization: "Basic c2VjcmV0", status: http.StatusUnauthorized},
+		{name: "no token sent", token: newAdminToken(t, "secret"), status: http.StatusUnauthorized},
+		{name: "no token configured", authorization: "Bearer secret", status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := internalserver.NewHandler()
+			admin := newAdminRoutes(h, tc.token)
+			var called bool
+			admin.add("/cache/", []string{http.MethodGet}, "Evicts", func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+
+			// the index is protected like the endpoints it lists
+			for _, path := range []string{"/admin", "/cache/1"} {
+				r := httptest.NewRequest(http.MethodGet, path, nil)
+				if tc.authorization != "" {
+					r.Header.Set("Authorization", tc.authorization)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != tc.status {
+					t.Errorf("%s: status = %d, want %d: %s", path, w.Code, tc.status, w.Body)
+				}
+			}
+			if called != (tc.status == http.StatusOK) {
+				t.Errorf("endpoint called = %v with status %d", called, tc.status)
+			}
+		})
+	}
+}
+
+func TestAdminRoutesMethods(t *testing.T) {
+	h := internalserver.NewHandler()
+	admin := newAdminRoutes(h, newAdminToken(t, "secret"))
+	var called bool
+	admin.add("/freeze/", []string{http.MethodGet, http.MethodPut, http.MethodDelete}, "Freezes", func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{method: http.MethodGet, status: http.StatusOK},
+		{method: http.MethodPut, status: http.StatusOK},
+		{method: http.MethodDelete, status: http.StatusOK},
+		{method: http.MethodPost, status: http.StatusMethodNotAllowed},
+		{method: http.MethodPatch, status: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			called = false
+			r := httptest.NewRequest(tc.method, "/freeze/team-a", nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if called != (tc.status == http.StatusOK) {
+				t.Errorf("endpoint called = %v", called)
+			}
+			if allow := w.Header().Get("Allow"); tc.status == http.StatusMethodNotAllowed && allow != "GET, PUT, DELETE" {
+				t.Errorf("Allow = %q, want %q", allow, "GET, PUT, DELETE")
+			}
+		})
+	}
+}
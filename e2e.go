@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams/teamstest"
+	"github.com/urfave/cli/v2"
+)
+
+// e2eFixtureUsers are the Grafana users of the e2e fixture, mapped to their teams.
+var e2eFixtureUsers = map[string][]teams.Team{
+	"1": {{ID: 1, OrgID: 1, Name: "team-a"}, {ID: 2, OrgID: 1, Name: "team-b"}, {ID: 3, OrgID: 2, Name: "team-c"}},
+	"2": {},
+}
+
+// e2eFixture describes the fake servers started by the e2e-fixture command.
+type e2eFixture struct {
+	GrafanaURL    string            `json:"grafana_url"`
+	PrometheusURL string            `json:"prometheus_url"`
+	AdminUser     string            `json:"admin_user"`
+	AdminPass     string            `json:"admin_pass"`
+	Tokens        map[string]string `json:"tokens"`
+}
+
+// e2eFixtureCommand starts a fake Grafana and a fake Prometheus for black-box tests of the
+// proxy binary, printing their addresses as JSON and serving them until SIGINT or SIGTERM.
+var e2eFixtureCommand = &cli.Command{
+	Name:   "e2e-fixture",
+	Usage:  "Start a fake Grafana and a fake Prometheus echoing the queries it receives, for end-to-end tests.",
+	Hidden: true,
+	Action: func(cliCtx *cli.Context) error {
+		g, err := teamstest.NewGrafana()
+		if err != nil {
+			return err
+		}
+		defer g.Close()
+
+		p := httptest.NewServer(http.HandlerFunc(echoPrometheus))
+		defer p.Close()
+
+		fixture := e2eFixture{
+			GrafanaURL:    g.URL,
+			PrometheusURL: p.URL,
+			AdminUser:     teamstest.AdminUser,
+			AdminPass:     teamstest.AdminPass,
+			Tokens:        map[string]string{},
+		}
+		for user, t := range e2eFixtureUsers {
+			g.SetTeams(user, t...)
+			token, err := g.Token(user, 1, 24*time.Hour)
+			if err != nil {
+				return fmt.Errorf("sign token for user %s: %w", user, err)
+			}
+			fixture.Tokens[user] = token
+		}
+		if err := json.NewEncoder(os.Stdout).Encode(fixture); err != nil {
+			return err
+		}
+
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		return nil
+	},
+}
+
+// echoPrometheus answers every request with the path and parameters it received, so
+// tests can assert on the query the proxy forwarded.
+func echoPrometheus(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data": map[string]any{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"params": r.Form,
+		},
+	})
+}
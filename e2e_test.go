@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so that black-box tests
+// can start it as the proxy binary.
+const runMainEnv = "LBAC_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// startBinary starts the test binary as the proxy binary with args, stopped when t ends.
+func startBinary(t *testing.T, env []string, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(append(os.Environ(), runMainEnv+"=1"), env...)
+	t.Cleanup(func() {
+		if cmd.Process != nil {
+			cmd.Process.Signal(syscall.SIGTERM)
+			cmd.Wait()
+		}
+	})
+	return cmd
+}
+
+// freeAddress returns a local address nothing listens on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// TestE2E is a black-box test of the proxy binary against the e2e-fixture command, and a
+// template for further ones: it starts the fake Grafana and Prometheus, runs the proxy
+// against them and asserts on the query the fake Prometheus received.
+func TestE2E(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts the proxy binary")
+	}
+
+	fixtureCmd := startBinary(t, nil, "e2e-fixture")
+	stdout, err := fixtureCmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fixtureCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var fixture e2eFixture
+	if err := json.NewDecoder(stdout).Decode(&fixture); err != nil {
+		t.Fatalf("read the fixture: %v", err)
+	}
+
+	listen := freeAddress(t)
+	proxyCmd := startBinary(t,
+		[]string{"GRAFANA_ADMIN_USER=" + fixture.AdminUser, "GRAFANA_ADMIN_PASS=" + fixture.AdminPass},
+		"--insecure-listen-address="+listen,
+		"--upstream="+fixture.PrometheusURL,
+		"--grafana-url="+fixture.GrafanaURL,
+		"--label=team",
+	)
+	if err := proxyCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// query sends an instant query of up as user, with no token when user is empty
+	query := func(user string) (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/api/v1/query?query=up", listen), nil)
+		if err != nil {
+			return nil, err
+		}
+		if user != "" {
+			req.Header.Set("X-Grafana-Id", fixture.Tokens[user])
+		}
+		return http.DefaultClient.Do(req)
+	}
+	var resp *http.Response
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		if resp, err = query("1"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy not listening: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// user 1 is a member of team-a and team-b in org 1
+	var echo struct {
+		Data struct {
+			Params map[string][]string `json:"params"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&echo)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := echo.Data.Params["query"], `up{team=~"team-a|team-b"}`; len(got) != 1 || got[0] != want {
+		t.Errorf("query sent upstream = %q, want %q", got, want)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		user   string
+		status int
+	}{
+		{name: "user without teams", user: "2", status: http.StatusNotFound},
+		{name: "no token", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := query(tc.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tc.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/proxy"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/urfave/cli/v2"
+)
+
+// options holds the values of the command line flags.
+type options struct {
+	insecureListenAddress   string
+	internalListenAddress   string
+	adminTokenFile          string
+	upstream                string
+	label                   string
+	enableLabelAPIs         bool
+	unsafePassthroughPaths  string // Comma-delimited string.
+	uiPassthroughPaths      string // Comma-delimited string.
+	errorOnReplace          bool
+	errorOnReplaceEndpoints string // Comma-delimited string.
+	headerUsesListSyntax    bool
+	rulesWithActiveAlerts   bool
+	grafanaUrl              string
+	requireClaims           string // Comma-delimited string.
+	teamsLookupIdentity     string
+	jwksURLs                cli.StringSlice
+	jwksStartupRetries      int
+	jwksStartupTimeout      time.Duration
+	jwksMaxStaleness        time.Duration
+	labelClaim              string
+	labelClaimAllowedLabels string // Comma-delimited string.
+	allowedLabelOverrides   string // Comma-delimited string.
+	orgLabels               string // Comma-delimited string.
+	rejectUnmappedOrgs      bool
+	labelSource             string
+	labelValueTemplate      string
+	folderLabelField        string
+	enableDebugHeaders      bool
+	debugHeadersTeams       string // Comma-delimited string.
+	enableTenantHeaders     bool
+	recentDecisionsSize     int
+	defaultSeriesLimit      int
+	maxSeriesLimit          int
+	rejectUnlimitedSeries   bool
+	grafanaMaxResponseBytes int64
+	captureClients          bool
+	clientReportWindow      time.Duration
+	trustForwardedHeaders   bool
+	maxClientConcurrency    int
+	upstreamAuthBearerFile  string
+	upstreamAuthBasicFile   string
+	mirrorUpstreamAuth      bool
+	trustedProxies          string
+	accessRemovalGrace      time.Duration
+	expectedAzp             string
+	inferOrgFromTeams       bool
+	expandTeamHierarchy     bool
+	teamHierarchy           string // Comma-delimited string.
+	upstreamProbeInterval   time.Duration
+	upstreamProbePath       string
+	readyRequiresUpstream   bool
+	grafanaPassFile         string
+	grafanaToken            string
+	configFile              string
+	enableCORS              bool
+	corsAllowedOrigins      string
+	corsAllowedMethods      string
+	corsAllowedHeaders      string
+	grafanaRetryDecode      bool
+	cacheStateFile          string
+	secondaryPathPrefix     string
+	secondaryUpstream       string
+	secondaryLabel          string
+	maxTokenBytes           int
+	jwtHeader               string
+	teamsCacheTTL           time.Duration
+	cacheCleanupInterval    time.Duration
+	allowBearerToken        bool
+	cacheMaxBytes           int64
+	cacheMaxEntries         int
+	cacheIdleTimeout        time.Duration
+	decisionLogFile         string
+	decisionLogMaxBytes     int64
+	canaryTokenFile         string
+	canaryInterval          time.Duration
+	selftestTokenFiles      string // Comma-delimited string.
+	selftestMetric          string
+	selftestInterval        time.Duration
+	notFoundIsolation       bool
+	mirrorUpstream          string
+	mirrorSamplePercent     float64
+	mirrorTimeout           time.Duration
+	mirrorMaxConcurrency    int
+	allowOpaqueToken        bool
+	introspectionPath       string
+	maxQueryRange           time.Duration
+	minQueryStep            time.Duration
+	datasourceUpstreams     string // Comma-delimited string.
+	datasourceClaim         string
+	rejectUnknownDatasource bool
+	streamFlushInterval     time.Duration
+	maxTokenAge             time.Duration
+	breakGlassTeams         string // Comma-delimited string.
+	breakGlassWebhook       string
+	enableServerTiming      bool
+	emptyTeamsRevalidation  time.Duration
+	slowRequestThreshold    time.Duration
+	strictRequests          bool
+	endpointRateLimits      string // Comma-delimited string.
+	tenantRateLimit         string
+	tenantRateLimitOverride string // Comma-delimited string.
+	bulkTeamsPath           string
+	healthCheckQueries      string // Comma-delimited string.
+	grafanaSourcesFile      string
+	grafanaIssuer           string
+	grafanaPinnedSHA256     string // Comma-delimited string.
+	enableLandingPage       bool
+	setEnforcementMarker    bool
+	matcherStyle            string
+	upstreamFlavor          string
+	rulerUpstream           string
+	alwaysMatchers          cli.StringSlice
+	tokenCacheTTL           time.Duration
+	enableWhoAmI            bool
+	enforcementMarkerPeers  string // Comma-delimited string.
+}
+
+// newFlags returns the command line flags, storing their values in o.
+func newFlags(o *options) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name: "config-file",
+			Usage: "YAML file mapping the names of flags to their values, lists being allowed for the flags taking several values, along with the Grafana credentials under " +
+				"\"grafana-admin-user\" and \"grafana-admin-pass\". Flags set on the command line take precedence over the file, which takes precedence over the environment. Unknown names are rejected. " +
+				"On SIGHUP the file is read again: changes to the rate limit flags are applied, changes to any other option are logged as taking a restart.",
+			Destination: &o.configFile,
+		},
+		&cli.StringFlag{
+			Name:        "insecure-listen-address",
+			Usage:       "The address the prom-label-proxy HTTP server should listen on.",
+			Destination: &o.insecureListenAddress,
+		},
+		&cli.StringFlag{
+			Name:        "internal-listen-address",
+			Usage:       "The address the internal prom-label-proxy HTTP server should listen on to expose metrics about itself.",
+			Destination: &o.internalListenAddress,
+		},
+		&cli.StringFlag{
+			Name: "admin-token-file",
+			Usage: "File holding the bearer token the admin endpoints of --internal-listen-address, listed at /admin, require in the Authorization header. " +
+				"Without it they are refused to everyone. The file is re-read every 30s so rotated tokens are picked up without a restart.",
+			Destination: &o.adminTokenFile,
+		},
+		&cli.StringFlag{
+			Name:        "upstream",
+			Usage:       "The upstream URL to proxy to.",
+			Destination: &o.upstream,
+		},
+		&cli.StringFlag{
+			Name:        "label",
+			Usage:       "The label name to enforce in all proxied PromQL queries.",
+			Destination: &o.label,
+		},
+		&cli.BoolFlag{
+			Name: "enable-label-apis",
+			Usage: "When specified proxy allows to inject label to label APIs like /api/v1/labels and /api/v1/label/<name>/values. " +
+				"NOTE: Enable with care because filtering by matcher is not implemented in older versions of Prometheus (>= v2.24.0 required) and Thanos (>= v0.18.0 required, >= v0.23.0 recommended). If enabled and " +
+				"any labels endpoint does not support selectors, the injected matcher will have no effect.",
+			Value:       false,
+			Destination: &o.enableLabelAPIs,
+		},
+		&cli.StringFlag{
+			Name: "unsafe-passthrough-paths",
+			Usage: "Comma delimited allow list of exact HTTP path segments that should be allowed to hit upstream URL without any enforcement. " +
+				"Paths equal to, below or above an enforced API path, like /api/v1/labels even with --enable-label-apis unset, or /api, are rejected at startup. Use carefully as it can easily cause a data leak if the provided path is an important " +
+				"API (like /api/v1/configuration) which isn't enforced by prom-label-proxy. NOTE: \"all\" matching paths like \"/\" or \"\" and regex are not allowed.",
+			Destination: &o.unsafePassthroughPaths,
+		},
+		&cli.StringFlag{
+			Name: "ui-passthrough-paths",
+			Usage: "Comma delimited list of Prometheus web UI paths, like /graph or /static/, passed through to the upstream for GET and HEAD requests carrying a valid X-Grafana-Id token, without label enforcement. " +
+				"Paths ending with a slash match every path below them. The API requests of the UI remain enforced; paths under /api and /federate are not allowed.",
+			Destination: &o.uiPassthroughPaths,
+		},
+		&cli.BoolFlag{
+			Name:        "error-on-replace",
+			Usage:       "When specified, the proxy will return HTTP status code 400 if the query already contains a label matcher that differs from the one the proxy would inject.",
+			Value:       false,
+			Destination: &o.errorOnReplace,
+		},
+		&cli.StringFlag{
+			Name: "error-on-replace-endpoints",
+			Usage: "Comma delimited list of endpoint classes (query, query_range, query_exemplars, labels) that return HTTP status code 400 if the query already contains a label matcher that differs from the one the proxy would inject. " +
+				"Other endpoints silently replace the matcher. The labels class covers the match[] selectors of /api/v1/labels and /api/v1/label/<name>/values, " +
+				"which are otherwise combined with the injected matcher. When empty, --error-on-replace applies to all endpoints.",
+			Destination: &o.errorOnReplaceEndpoints,
+		},
+		&cli.BoolFlag{
+			Name:        "header-uses-list-syntax",
+			Usage:       "When specified, the header line value will be parsed as a comma-separated list. This allows a single tenant header line to specify multiple tenant names.",
+			Value:       false,
+			Destination: &o.headerUsesListSyntax,
+		},
+		&cli.BoolFlag{
+			Name:        "rules-with-active-alert",
+			Usage:       "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels.",
+			Value:       false,
+			Destination: &o.rulesWithActiveAlerts,
+		},
+		&cli.StringFlag{
+			Name:        "grafana-url",
+			Usage:       "Grafana URL used to fetch teams, JWKS. May include the sub-path Grafana is served under.",
+			Destination: &o.grafanaUrl,
+		},
+		&cli.StringFlag{
+			Name:        "require-claims",
+			Usage:       "Comma delimited list of claim names that must be present in the X-Grafana-Id token. Tokens missing any of them are rejected with HTTP status code 401.",
+			Destination: &o.requireClaims,
+		},
+		&cli.StringFlag{
+			Name: "teams-lookup-identity",
+			Usage: "Identity used to look up the requestor's teams in Grafana. \"admin\" uses --grafana-token or GRAFANA_ADMIN_USER/GRAFANA_ADMIN_PASS against /api/users/<id>/teams, " +
+				"\"self\" forwards the requestor's own X-Grafana-Id, Authorization and Cookie headers to /api/user/teams and requires no admin credentials.",
+			Value:       string(teams.LookupAsAdmin),
+			Destination: &o.teamsLookupIdentity,
+		},
+		&cli.StringFlag{
+			Name: "grafana-sources-file",
+			Usage: "JSON file listing additional Grafana instances sharing the proxy, as [{\"name\", \"url\", \"issuer\", \"jwksPath\", \"adminUser\", \"adminPassFile\", \"pinnedSha256\"}]. " +
+				"Requests are authenticated by the instance whose issuer, defaulting to its URL, matches the iss claim of their token, with its own signing keys, teams cache and metrics. " +
+				"Tokens issued by no instance are rejected with HTTP status code 401.",
+			Destination: &o.grafanaSourcesFile,
+		},
+		&cli.StringFlag{
+			Name: "grafana-pinned-sha256",
+			Usage: "Comma-separated list of SHA-256 fingerprints, in hex or base64, of the SubjectPublicKeyInfo or DER encoding of certificates of --grafana-url. " +
+				"On top of the usual verification, connections to Grafana are rejected unless a certificate of the verified chain matches one of them. Requires an https --grafana-url.",
+			Destination: &o.grafanaPinnedSHA256,
+		},
+		&cli.StringFlag{
+			Name:        "grafana-issuer",
+			Usage:       "iss claim of the tokens of --grafana-url when --grafana-sources-file is set. Defaults to --grafana-url.",
+			Destination: &o.grafanaIssuer,
+		},
+		&cli.StringFlag{
+			Name: "bulk-teams-path",
+			Usage: "Grafana path of an endpoint answering a user along with their teams as {\"user\": {\"id\": ...}, \"teams\": [...]}, e.g. exposed by a plugin or an API gateway, " +
+				"used instead of the team endpoints to look up teams in a single call. {id} is replaced with the user id. Falls back to the team endpoints when it answers with HTTP status code 404.",
+			Destination: &o.bulkTeamsPath,
+		},
+		&cli.StringSliceFlag{
+			Name: "jwks-url",
+			Usage: "URL of a JWKS the tokens of --grafana-url are validated against, fetched with the same TLS settings as Grafana. Repeat it to accept tokens signed by a key of any of them, " +
+				"e.g. while migrating between Grafana instances; each URL is refreshed on its own, so one failing does not affect the keys of the others. Defaults to the signing keys of --grafana-url.",
+			Destination: &o.jwksURLs,
+		},
+		&cli.IntFlag{
+			Name:        "jwks-startup-retries",
+			Usage:       "Number of times the initial Grafana JWKS fetch is retried, with jittered exponential backoff, before falling back to the background refresh.",
+			Value:       5,
+			Destination: &o.jwksStartupRetries,
+		},
+		&cli.DurationFlag{
+			Name:        "cache-ttl",
+			Usage:       "How long the teams resolved for a user are cached. 0 disables the cache, looking up the teams of every request in Grafana.",
+			Value:       5 * time.Minute,
+			Destination: &o.teamsCacheTTL,
+		},
+		&cli.DurationFlag{
+			Name:        "cache-cleanup-interval",
+			Usage:       "Interval at which expired entries are removed from the teams cache.",
+			Value:       10 * time.Minute,
+			Destination: &o.cacheCleanupInterval,
+		},
+		&cli.DurationFlag{
+			Name:        "jwks-startup-timeout",
+			Usage:       "Maximum time spent on the initial Grafana JWKS fetch and its retries.",
+			Value:       time.Minute,
+			Destination: &o.jwksStartupTimeout,
+		},
+		&cli.DurationFlag{
+			Name: "jwks-max-staleness",
+			Usage: "Maximum time the last fetched Grafana JWKS keeps validating tokens while refreshing it fails. " +
+				"Past that, tokens are rejected and the readiness check fails. 0 keeps the keys indefinitely, " +
+				"without ever failing the readiness check once they were fetched.",
+			Value:       24 * time.Hour,
+			Destination: &o.jwksMaxStaleness,
+		},
+		&cli.StringFlag{
+			Name:        "label-claim",
+			Usage:       "Name of a token claim selecting the label name to enforce on a per-request basis. Requests without the claim enforce --label.",
+			Destination: &o.labelClaim,
+		},
+		&cli.StringFlag{
+			Name:        "label-claim-allowed-labels",
+			Usage:       "Comma delimited allow list of label names that --label-claim may select. Requests selecting any other label are rejected with HTTP status code 403.",
+			Destination: &o.labelClaimAllowedLabels,
+		},
+		&cli.StringFlag{
+			Name: "allowed-label-overrides",
+			Usage: "Comma delimited allow list of label names that the " + teams.LabelHeader + " request header may select to enforce instead of --label, e.g. while renaming the label. " +
+				"The header takes precedence over --label-claim and --org-labels. Requests selecting any other label are rejected with HTTP status code 403.",
+			Destination: &o.allowedLabelOverrides,
+		},
+		&cli.StringFlag{
+			Name:        "org-labels",
+			Usage:       "Comma delimited list of <orgId>=<label> pairs selecting the label name enforced for requests of a Grafana org. Requests of other orgs enforce --label.",
+			Destination: &o.orgLabels,
+		},
+		&cli.BoolFlag{
+			Name:        "reject-unmapped-orgs",
+			Usage:       "Reject requests of Grafana orgs not in --org-labels with HTTP status code 403 instead of enforcing --label.",
+			Destination: &o.rejectUnmappedOrgs,
+		},
+		&cli.StringFlag{
+			Name: "label-source",
+			Usage: "What the enforced label values are derived from. \"teams\" uses the names of the requestor's teams, " +
+				"\"folders\" uses the folders the requestor can access and requires --teams-lookup-identity=self, " +
+				"\"claims\" renders a single value from the claims of the requestor's token with --label-value-template, without looking anything up in Grafana.",
+			Value:       string(teams.LabelSourceTeams),
+			Destination: &o.labelSource,
+		},
+		&cli.StringFlag{
+			Name: "label-value-template",
+			Usage: "Go text/template over the claims of the requestor's token rendering the enforced label value, e.g. '{{.org}}-{{.team}}'. Selects --label-source=claims. " +
+				"Requests whose token lacks a claim referenced, or for which it renders an empty value, are rejected with HTTP status code 403.",
+			Destination: &o.labelValueTemplate,
+		},
+		&cli.StringFlag{
+			Name:        "folder-label-field",
+			Usage:       "Folder field used as label value with --label-source=folders, either \"title\" or \"uid\".",
+			Value:       "title",
+			Destination: &o.folderLabelField,
+		},
+		&cli.BoolFlag{
+			Name: "enable-debug-headers",
+			Usage: "When specified, authenticated requests carrying the \"X-LBAC-Debug: query\" header receive the query sent upstream, after label injection, " +
+				"in the X-LBAC-Enforced-Query response header.",
+			Value:       false,
+			Destination: &o.enableDebugHeaders,
+		},
+		&cli.StringFlag{
+			Name:        "debug-headers-teams",
+			Usage:       "Comma delimited list of teams allowed to request debug headers. When empty, any authenticated user can.",
+			Destination: &o.debugHeadersTeams,
+		},
+		&cli.BoolFlag{
+			Name: "enable-tenant-headers",
+			Usage: "When specified, successful proxied responses carry the enforced label values in X-LBAC-Tenant and the enforcement decision in X-LBAC-Decision. " +
+				"NOTE: this reveals the requestor's authorization scope to anything that can read the response.",
+			Value:       false,
+			Destination: &o.enableTenantHeaders,
+		},
+		&cli.IntFlag{
+			Name:        "recent-decisions-size",
+			Usage:       "Number of recent authorization decisions kept in memory and exposed on the internal server at /admin/recent. 0 disables it.",
+			Value:       100,
+			Destination: &o.recentDecisionsSize,
+		},
+		&cli.IntFlag{
+			Name:        "default-series-limit",
+			Usage:       "Limit set on series, label names and label values requests that do not pass one. 0 leaves it unset.",
+			Destination: &o.defaultSeriesLimit,
+		},
+		&cli.IntFlag{
+			Name:        "max-series-limit",
+			Usage:       "Maximum limit allowed on series, label names and label values requests. Larger and unlimited (limit=0) requests are clamped to it. 0 disables clamping.",
+			Destination: &o.maxSeriesLimit,
+		},
+		&cli.BoolFlag{
+			Name:        "reject-unlimited-series",
+			Usage:       "Reject series, label names and label values requests explicitly passing limit=0.",
+			Destination: &o.rejectUnlimitedSeries,
+		},
+		&cli.Int64Flag{
+			Name:        "grafana-max-response-bytes",
+			Usage:       "Maximum size of a Grafana API response. Larger responses fail the request. 0 disables the limit.",
+			Value:       10 << 20,
+			Destination: &o.grafanaMaxResponseBytes,
+		},
+		&cli.StringFlag{
+			Name: "upstream-auth-bearer-file",
+			Usage: "File holding a bearer token sent in the Authorization header of every request to the upstreams, replacing any sent by the client. " +
+				"The file is re-read every 30s so rotated tokens are picked up without a restart.",
+			Destination: &o.upstreamAuthBearerFile,
+		},
+		&cli.StringFlag{
+			Name:        "upstream-auth-basic-file",
+			Usage:       "Like --upstream-auth-bearer-file, for a file holding <user>:<password> sent with the Basic scheme.",
+			Destination: &o.upstreamAuthBasicFile,
+		},
+		&cli.BoolFlag{
+			Name:        "trust-forwarded-headers",
+			Usage:       "Honor X-Forwarded-Proto and X-Forwarded-Host from --trusted-proxies. The headers are removed from requests of any other peer.",
+			Destination: &o.trustForwardedHeaders,
+		},
+		&cli.StringFlag{
+			Name:        "trusted-proxies",
+			Usage:       "Comma-separated list of CIDRs of the peers trusted by --trust-forwarded-headers.",
+			Value:       "127.0.0.1/32,::1/128",
+			Destination: &o.trustedProxies,
+		},
+		&cli.IntFlag{
+			Name: "max-concurrent-requests-per-client",
+			Usage: "Maximum number of requests served at once for a single client IP. Requests over it are answered with HTTP status code 429. " +
+				"With --trust-forwarded-headers, the client IP of requests from --trusted-proxies is taken from X-Forwarded-For. 0 disables the limit.",
+			Destination: &o.maxClientConcurrency,
+		},
+		&cli.DurationFlag{
+			Name:        "access-removal-grace-period",
+			Usage:       "Keep honoring teams (or folders) a user lost for this long after the removal is observed. 0 revokes access immediately.",
+			Destination: &o.accessRemovalGrace,
+		},
+		&cli.StringFlag{
+			Name:        "expected-azp",
+			Usage:       "Reject tokens whose azp (authorized party) claim does not match this value.",
+			Destination: &o.expectedAzp,
+		},
+		&cli.BoolFlag{
+			Name: "infer-org-from-teams",
+			Usage: "When the orgId cannot be parsed from the aud claim of a token, proceed with the org of the teams of the user, provided they all belong to a single org. " +
+				"Requests of users with teams in several orgs are still rejected. Only applies to --label-source=teams.",
+			Destination: &o.inferOrgFromTeams,
+		},
+		&cli.BoolFlag{
+			Name: "expand-team-hierarchy",
+			Usage: "Grant the members of a team the label values of its descendant teams in --team-hierarchy. Only applies to --label-source=teams. " +
+				"Teams are matched by name, so anyone able to create or join a team named after a parent is granted its whole subtree, " +
+				"and the descendant teams count as teams of the user for --debug-headers-teams. --break-glass-teams only ever checks the Grafana teams of the user.",
+			Destination: &o.expandTeamHierarchy,
+		},
+		&cli.StringFlag{
+			Name:        "team-hierarchy",
+			Usage:       "Comma-separated list of <parent>=<child> team names expanded with --expand-team-hierarchy. A child may itself be the parent of other teams.",
+			Destination: &o.teamHierarchy,
+		},
+		&cli.DurationFlag{
+			Name:        "upstream-probe-interval",
+			Usage:       "Interval at which the upstream health endpoint is probed. 0 disables probing.",
+			Destination: &o.upstreamProbeInterval,
+		},
+		&cli.StringFlag{
+			Name:        "upstream-probe-path",
+			Usage:       "Path of the upstream health endpoint.",
+			Value:       "/-/healthy",
+			Destination: &o.upstreamProbePath,
+		},
+		&cli.BoolFlag{
+			Name:        "ready-requires-upstream",
+			Usage:       "Report not ready while the upstream probe fails. Requires --upstream-probe-interval.",
+			Destination: &o.readyRequiresUpstream,
+		},
+		&cli.StringFlag{
+			Name:        "grafana-pass-file",
+			Usage:       "File containing the Grafana admin password, used instead of GRAFANA_ADMIN_PASS. The file is re-read every 30s to pick up rotated passwords.",
+			Destination: &o.grafanaPassFile,
+		},
+		&cli.StringFlag{
+			Name: "grafana-token",
+			Usage: "Grafana service account token used to look up teams with --teams-lookup-identity=admin, sent as a bearer token instead of the basic auth credentials of " +
+				"GRAFANA_ADMIN_USER/GRAFANA_ADMIN_PASS, which it takes precedence over. Defaults to GRAFANA_SERVICE_TOKEN, which should be preferred.",
+			Destination: &o.grafanaToken,
+		},
+		&cli.BoolFlag{
+			Name:        "enable-cors",
+			Usage:       "Answer CORS preflight requests without requiring a token and add CORS headers to responses of allowed origins.",
+			Destination: &o.enableCORS,
+		},
+		&cli.StringFlag{
+			Name:        "cors-allowed-origins",
+			Usage:       "Comma delimited list of origins allowed by --enable-cors. \"*\" allows any origin.",
+			Value:       "*",
+			Destination: &o.corsAllowedOrigins,
+		},
+		&cli.StringFlag{
+			Name:        "cors-allowed-methods",
+			Usage:       "Comma delimited list of methods allowed by --enable-cors.",
+			Value:       "GET,POST",
+			Destination: &o.corsAllowedMethods,
+		},
+		&cli.StringFlag{
+			Name:        "cors-allowed-headers",
+			Usage:       "Comma delimited list of request headers allowed by --enable-cors.",
+			Value:       "Content-Type,X-Grafana-Id",
+			Destination: &o.corsAllowedHeaders,
+		},
+		&cli.BoolFlag{
+			Name:        "grafana-retry-on-decode-error",
+			Usage:       "Retry a Grafana API request once when its response cannot be decoded, e.g. because it was truncated.",
+			Destination: &o.grafanaRetryDecode,
+		},
+		&cli.StringFlag{
+			Name:        "cache-state-file",
+			Usage:       "File the teams cache is saved to on shutdown and loaded from on startup. Entries are kept until their original expiry.",
+			Destination: &o.cacheStateFile,
+		},
+		&cli.StringFlag{
+			Name:        "secondary-path-prefix",
+			Usage:       "Path prefix (e.g. /metrics-b) of requests enforced with --secondary-label and sent to --secondary-upstream, with the prefix stripped. The upstream must expose the Prometheus HTTP API.",
+			Destination: &o.secondaryPathPrefix,
+		},
+		&cli.StringFlag{
+			Name:        "secondary-upstream",
+			Usage:       "Upstream URL of requests under --secondary-path-prefix. Defaults to --upstream.",
+			Destination: &o.secondaryUpstream,
+		},
+		&cli.StringFlag{
+			Name:        "secondary-label",
+			Usage:       "Label name enforced on requests under --secondary-path-prefix.",
+			Destination: &o.secondaryLabel,
+		},
+		&cli.StringFlag{
+			Name:        "jwt-header",
+			Usage:       "Header carrying the token of the user in place of X-Grafana-Id, e.g. when a gateway in front forwards it under another name. A \"Bearer \" prefix is trimmed from its value.",
+			Value:       teams.DefaultTokenHeader,
+			Destination: &o.jwtHeader,
+		},
+		&cli.BoolFlag{
+			Name: "allow-bearer-token",
+			Usage: "Accept the token of requests without --jwt-header from an Authorization bearer token, for clients other than Grafana. The Authorization header is then not forwarded upstream. " +
+				"Requests carrying --jwt-header are authenticated by it alone.",
+			Destination: &o.allowBearerToken,
+		},
+		&cli.IntFlag{
+			Name:        "max-token-bytes",
+			Usage:       "Maximum size of the X-Grafana-Id token. Larger tokens are rejected before being decoded. 0 disables the limit.",
+			Value:       8 << 10,
+			Destination: &o.maxTokenBytes,
+		},
+		&cli.Int64Flag{
+			Name:        "cache-max-bytes",
+			Usage:       "Approximate byte budget of the teams cache. The oldest entries are evicted once it is exceeded. 0 disables the budget.",
+			Destination: &o.cacheMaxBytes,
+		},
+		&cli.IntFlag{
+			Name:        "teams-cache-max-entries",
+			Usage:       "Maximum number of entries of the teams cache. The least recently used entries are evicted once it is exceeded. 0 disables the bound.",
+			Destination: &o.cacheMaxEntries,
+		},
+		&cli.DurationFlag{
+			Name:        "teams-cache-idle-timeout",
+			Usage:       "Evict the entries of the teams cache not used for this long, whatever their expiration. 0 keeps them until they expire.",
+			Destination: &o.cacheIdleTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "decision-log-file",
+			Usage:       "File every authorization decision is appended to as one JSON object per line, including the enforced matcher, for audits and replay.",
+			Destination: &o.decisionLogFile,
+		},
+		&cli.Int64Flag{
+			Name:        "decision-log-max-bytes",
+			Usage:       "Size past which the --decision-log-file is rotated to <file>.1, replacing the previous rotation. 0 never rotates it.",
+			Value:       100 << 20,
+			Destination: &o.decisionLogMaxBytes,
+		},
+		&cli.BoolFlag{
+			Name:        "capture-client-fingerprints",
+			Usage:       "Record the User-Agent of every request and a hash of it with the /24 (IPv4) or /48 (IPv6) subnet of the client in the authorization decisions, count requests by user agent product and report the top clients of a tenant on /reports/clients of the internal server. Off by default as it keeps client details.",
+			Destination: &o.captureClients,
+		},
+		&cli.DurationFlag{
+			Name:        "client-report-window",
+			Usage:       "Rolling window over which /reports/clients counts the requests of clients.",
+			Value:       time.Hour,
+			Destination: &o.clientReportWindow,
+		},
+		&cli.StringFlag{
+			Name:        "canary-token-file",
+			Usage:       "File holding a long-lived X-Grafana-Id token validated every --canary-interval. Readiness fails while it does not validate.",
+			Destination: &o.canaryTokenFile,
+		},
+		&cli.DurationFlag{
+			Name:        "canary-interval",
+			Usage:       "Interval between validations of the --canary-token-file.",
+			Value:       time.Minute,
+			Destination: &o.canaryInterval,
+		},
+		&cli.StringFlag{
+			Name: "selftest-token-files",
+			Usage: "Comma delimited pair of files holding long-lived X-Grafana-Id tokens of users of two distinct tenants, enabling the enforcement self-test served on POST /selftest/enforcement of the internal server. " +
+				"It queries --selftest-metric through the proxy with each token and fails unless each user sees series of its own tenant and none of the other one.",
+			Destination: &o.selftestTokenFiles,
+		},
+		&cli.StringFlag{
+			Name:        "selftest-metric",
+			Usage:       "Canary metric queried by the enforcement self-test, with series carrying --label for each of the two tenants.",
+			Destination: &o.selftestMetric,
+		},
+		&cli.DurationFlag{
+			Name:        "selftest-interval",
+			Usage:       "Interval between enforcement self-tests, reported by lbac_selftest_success. 0 only runs them on request.",
+			Destination: &o.selftestInterval,
+		},
+		&cli.BoolFlag{
+			Name: "not-found-isolation",
+			Usage: "Answer requests the upstream answers with 404 or rejected for selecting label values the caller may not access (error-on-replace) " +
+				"with the empty result a tenant without data gets, so probing cannot tell missing label values from other tenants' ones. Requests denied by the proxy itself are still rejected.",
+			Destination: &o.notFoundIsolation,
+		},
+		&cli.BoolFlag{
+			Name:        "enable-landing-page",
+			Usage:       "Answer GET requests to / without authentication with a page naming the service and its version, in HTML or JSON depending on the Accept header.",
+			Destination: &o.enableLandingPage,
+		},
+		&cli.StringFlag{
+			Name:        "mirror-upstream",
+			Usage:       "Upstream URL a sample of the enforced requests is mirrored to, with their rewritten query. Responses are discarded.",
+			Destination: &o.mirrorUpstream,
+		},
+		&cli.BoolFlag{
+			Name:        "mirror-upstream-auth",
+			Usage:       "Send the credential of --upstream-auth-bearer-file or --upstream-auth-basic-file to the --mirror-upstream as well. Mirrored requests are sent without it by default.",
+			Destination: &o.mirrorUpstreamAuth,
+		},
+		&cli.Float64Flag{
+			Name:        "mirror-sample-percent",
+			Usage:       "Percentage of the enforced requests mirrored to the --mirror-upstream.",
+			Value:       100,
+			Destination: &o.mirrorSamplePercent,
+		},
+		&cli.DurationFlag{
+			Name:        "mirror-timeout",
+			Usage:       "Timeout of the requests mirrored to the --mirror-upstream.",
+			Value:       5 * time.Second,
+			Destination: &o.mirrorTimeout,
+		},
+		&cli.IntFlag{
+			Name:        "mirror-max-concurrency",
+			Usage:       "Maximum number of mirrored requests in flight. Requests beyond it are not mirrored.",
+			Value:       16,
+			Destination: &o.mirrorMaxConcurrency,
+		},
+		&cli.BoolFlag{
+			Name:        "allow-opaque-token",
+			Usage:       "Resolve X-Grafana-Id values that are not JWTs by sending them as a bearer token to the Grafana --opaque-token-introspection-path.",
+			Destination: &o.allowOpaqueToken,
+		},
+		&cli.StringFlag{
+			Name:        "opaque-token-introspection-path",
+			Usage:       "Grafana path resolving opaque tokens to the JSON user they belong to, with its id and orgId.",
+			Value:       "/api/user",
+			Destination: &o.introspectionPath,
+		},
+		&cli.DurationFlag{
+			Name:        "max-query-range",
+			Usage:       "Maximum range between start and end of range queries. Wider ones are rejected with 400. 0 leaves it unbounded.",
+			Destination: &o.maxQueryRange,
+		},
+		&cli.DurationFlag{
+			Name:        "min-query-step",
+			Usage:       "Minimum step of range queries. Finer ones are rejected with 400. 0 accepts any step.",
+			Destination: &o.minQueryStep,
+		},
+		&cli.StringFlag{
+			Name: "datasource-upstreams",
+			Usage: "Comma-separated list of <datasourceUID>=<upstream URL> pairs routing requests to an upstream by the Grafana datasource their token identifies " +
+				"(see --datasource-claim). The same enforcement applies to every upstream.",
+			Destination: &o.datasourceUpstreams,
+		},
+		&cli.StringFlag{
+			Name:        "datasource-claim",
+			Usage:       "X-Grafana-Id token claim holding the datasource UID used by --datasource-upstreams.",
+			Value:       "azp",
+			Destination: &o.datasourceClaim,
+		},
+		&cli.BoolFlag{
+			Name:        "reject-unknown-datasource",
+			Usage:       "Reject requests whose token identifies a datasource not in --datasource-upstreams instead of sending them to --upstream.",
+			Destination: &o.rejectUnknownDatasource,
+		},
+		&cli.DurationFlag{
+			Name:        "stream-flush-interval",
+			Usage:       "Maximum time range query and series response bytes are buffered before being flushed to the client. 0 leaves flushing to the server buffers, a negative value flushes every write.",
+			Value:       100 * time.Millisecond,
+			Destination: &o.streamFlushInterval,
+		},
+		&cli.BoolFlag{
+			Name: "set-enforcement-marker",
+			Usage: "Add the " + proxy.EnforcementMarkerHeader + " header, carrying the enforced label values, to the enforced requests sent upstream, " +
+				"so that a prom-grafana-lbac chained behind this one and trusting it with --enforcement-marker-peers does not enforce them again.",
+			Destination: &o.setEnforcementMarker,
+		},
+		&cli.StringFlag{
+			Name: "enforcement-marker-peers",
+			Usage: "Comma-separated list of CIDRs of the prom-grafana-lbac instances in front of this one, whose requests to the enforced API paths carrying the " + proxy.EnforcementMarkerHeader + " header are sent upstream without enforcing them again. " +
+				"The header alone grants full access to the upstream on these paths, whatever the token of the request. It is removed from the requests of any other peer. Only list peers that enforce every request they forward, as any of their clients could otherwise skip enforcement.",
+			Destination: &o.enforcementMarkerPeers,
+		},
+		&cli.StringFlag{
+			Name: "matcher-style",
+			Usage: "How the matcher of several label values is sent upstream. \"auto\" and \"regex-plain\" send label=~\"a|b\", " +
+				"\"regex-anchored\" sends label=~\"^(?:a|b)$\" for upstreams that do not anchor regular expressions, " +
+				"\"repeat-equals\" sends one equality matcher per value for upstreams with slow or restricted regular expressions: " +
+				"query selectors become (x{label=\"a\"} or x{label=\"b\"}) and match[] selectors are repeated, " +
+				"while queries with the matcher under a range vector or subquery keep the regular expression.",
+			Value:       string(teams.MatcherStyleAuto),
+			Destination: &o.matcherStyle,
+		},
+		&cli.StringFlag{
+			Name: "upstream-flavor",
+			Usage: "Kind of the upstreams, either \"prometheus\" or \"victoriametrics\". With \"victoriametrics\", the query, query_range, series, labels, label values and federate requests " +
+				"are enforced with a single extra_filters[] parameter instead of rewriting their selectors, and any extra_filters or extra_label sent by the client is removed. " +
+				"Other endpoints are still rewritten, and selectors of other label values select nothing instead of being rejected with error-on-replace.",
+			Value:       string(teams.UpstreamPrometheus),
+			Destination: &o.upstreamFlavor,
+		},
+		&cli.StringFlag{
+			Name: "ruler-upstream",
+			Usage: "Upstream URL of the Mimir or Cortex ruler, enabling its configuration API under /prometheus/config/v1/rules and below /api/v1/rules. " +
+				"Requests are sent with " + teams.ScopeOrgIDHeader + " set to the label value of the caller, selected with the " + teams.TargetTenantHeader + " header by callers with several, " +
+				"and rule groups are rejected unless every rule sets --label to that label value. Label values that are not valid Mimir tenant IDs are rejected.",
+			Destination: &o.rulerUpstream,
+		},
+		&cli.StringSliceFlag{
+			Name: "always-matcher",
+			Usage: "<name>=<value> matcher added to every selector of the enforced requests alongside the enforced label values, e.g. cluster=prod. Can be repeated. " +
+				"Any matcher of the client on the same label is replaced. " +
+				"The matchers are not applied to the rules and alerts endpoints, nor to requests bypassing enforcement.",
+			Destination: &o.alwaysMatchers,
+		},
+		&cli.DurationFlag{
+			Name: "token-cache-ttl",
+			Usage: "How long a token whose signature was verified is accepted again without verifying it, never beyond its exp claim. 0 verifies every request. " +
+				"Tokens signed with a key removed from the JWKS keep being accepted for up to this long, so keep it short, e.g. 30s.",
+			Destination: &o.tokenCacheTTL,
+		},
+		&cli.BoolFlag{
+			Name: "enable-whoami",
+			Usage: "Answer GET " + teams.WhoAmIPath + " with the user, org, teams, enforced label and label values resolved for the X-Grafana-Id token of the caller, " +
+				"without sending anything upstream, so that users can check the scope of their own access.",
+			Destination: &o.enableWhoAmI,
+		},
+		&cli.DurationFlag{
+			Name:        "max-token-age",
+			Usage:       "Reject tokens whose iat (issued at) claim is older than this, even if they have not expired, and tokens without an iat claim. 0 leaves the age unbounded.",
+			Destination: &o.maxTokenAge,
+		},
+		&cli.StringFlag{
+			Name: "break-glass-teams",
+			Usage: "Comma delimited list of teams whose members may skip enforcement of a single query or range query by sending a justification in the X-LBAC-Break-Glass header. " +
+				"Membership is checked against the Grafana teams of the user in the org of the token, whatever the --label-source. " +
+				"These requests are sent to --upstream untouched and audited. Requests with the header from anyone else are rejected with HTTP status code 403.",
+			Destination: &o.breakGlassTeams,
+		},
+		&cli.StringFlag{
+			Name:        "break-glass-webhook",
+			Usage:       "URL every allowed break-glass request is posted to as JSON, with the user, query and justification.",
+			Destination: &o.breakGlassWebhook,
+		},
+		&cli.BoolFlag{
+			Name: "enable-server-timing",
+			Usage: "When specified, responses carry the time spent validating the token, resolving teams (and whether they were cached) and waiting for the upstream in the Server-Timing header. " +
+				"NOTE: this reveals internal timings to anything that can read the response.",
+			Destination: &o.enableServerTiming,
+		},
+		&cli.StringFlag{
+			Name: "health-check-queries",
+			Usage: "Comma-separated list of /api/v1/query queries treated as datasource health checks, e.g. '1+1' as sent by Grafana's \"Save & test\". " +
+				"Their responses carry the " + teams.EnforcementHeader + ", " + teams.TenantCountHeader + " and " + teams.VersionHeader + " headers, and " + teams.TenantsHeader + " when the caller passes the --enable-debug-headers gate.",
+			Destination: &o.healthCheckQueries,
+		},
+		&cli.DurationFlag{
+			Name: "empty-teams-revalidation-interval",
+			Usage: "Refresh a cached empty team set in the background when it is used, at most once per interval for each user, so an empty answer caused by a transient Grafana issue heals before the cache TTL. " +
+				"0 disables it.",
+			Destination: &o.emptyTeamsRevalidation,
+		},
+		&cli.DurationFlag{
+			Name:        "slow-request-threshold",
+			Usage:       "Log enforced requests taking longer than this with the time spent in each phase (auth, teams, enforce, upstream, write). 0 disables the log.",
+			Destination: &o.slowRequestThreshold,
+		},
+		&cli.BoolFlag{
+			Name: "strict-request-validation",
+			Usage: "Validate requests to the enforced endpoints before enforcing them: POST bodies must be form encoded (JSON for silences) or are rejected with HTTP status code 415, " +
+				"bodies of GET, HEAD and DELETE requests are dropped, and errors are answered in the JSON shape of the Prometheus API.",
+			Destination: &o.strictRequests,
+		},
+		&cli.StringFlag{
+			Name: "endpoint-rate-limits",
+			Usage: "Comma-separated list of <path pattern>=<requests per second>[:<burst>] rate limits applied to the enforced requests of each tenant, e.g. '/api/v1/query_range=1:5,/api/v1/label/*/values=10'. " +
+				"Patterns are matched against the API path, the first matching one applies. Requests over the limit are answered with HTTP status code 429 and a Retry-After header.",
+			Destination: &o.endpointRateLimits,
+		},
+		&cli.StringFlag{
+			Name: "tenant-rate-limit",
+			Usage: "<requests per second>[:<burst>] rate limit applied to the enforced requests of each tenant, a label value enforced on them, across all endpoints. " +
+				"A request enforcing several label values counts against the limit of each of them. Requests over the limit are answered with HTTP status code 429 and a Retry-After header.",
+			Destination: &o.tenantRateLimit,
+		},
+		&cli.StringFlag{
+			Name:        "tenant-rate-limit-overrides",
+			Usage:       "Comma-separated list of <label value>=<requests per second>[:<burst>] rate limits overriding --tenant-rate-limit for the tenants listed, e.g. 'team-a=50:100,team-b=1'.",
+			Destination: &o.tenantRateLimitOverride,
+		},
+	}
+}
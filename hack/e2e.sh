@@ -0,0 +1,56 @@
+#!/usr/bin/env bash
+# Black-box end-to-end test of the compiled binary, and a template for further ones.
+#
+# Starts the hidden e2e-fixture command (fake Grafana and fake Prometheus), runs the proxy
+# against it and asserts on the query the fake Prometheus received. Requires curl and jq.
+set -euo pipefail
+
+tmp=$(mktemp -d)
+trap 'kill $(jobs -p) 2>/dev/null; wait; rm -rf "$tmp"' EXIT
+bin=${BIN:-$tmp/prom-grafana-lbac}
+listen=${LISTEN:-127.0.0.1:18080}
+
+if [[ -z ${BIN:-} ]]; then
+	go build -o "$bin" .
+fi
+
+"$bin" e2e-fixture >"$tmp/fixture.json" &
+for _ in $(seq 50); do
+	[[ -s $tmp/fixture.json ]] && break
+	sleep 0.1
+done
+fixture=$(cat "$tmp/fixture.json")
+
+GRAFANA_ADMIN_USER=$(jq -r .admin_user <<<"$fixture") \
+GRAFANA_ADMIN_PASS=$(jq -r .admin_pass <<<"$fixture") \
+	"$bin" \
+	--insecure-listen-address="$listen" \
+	--upstream="$(jq -r .prometheus_url <<<"$fixture")" \
+	--grafana-url="$(jq -r .grafana_url <<<"$fixture")" \
+	--label=team >"$tmp/proxy.log" 2>&1 &
+for _ in $(seq 50); do
+	curl -fso /dev/null "http://$listen/api/v1/query?query=up" -H "X-Grafana-Id: $(jq -r '.tokens["1"]' <<<"$fixture")" && break
+	sleep 0.1
+done
+
+fail() {
+	echo "FAIL: $*" >&2
+	cat "$tmp/proxy.log" >&2
+	exit 1
+}
+
+# user 1 is a member of team-a and team-b in org 1
+got=$(curl -fsS "http://$listen/api/v1/query?query=up" -H "X-Grafana-Id: $(jq -r '.tokens["1"]' <<<"$fixture")" |
+	jq -r '.data.params.query[0]')
+want='up{team=~"team-a|team-b"}'
+[[ $got == "$want" ]] || fail "query: got $got, want $want"
+
+# user 2 is not a member of any team
+code=$(curl -so /dev/null -w '%{http_code}' "http://$listen/api/v1/query?query=up" -H "X-Grafana-Id: $(jq -r '.tokens["2"]' <<<"$fixture")")
+[[ $code == 404 ]] || fail "user without teams: got status $code, want 404"
+
+# requests without a token are rejected
+code=$(curl -so /dev/null -w '%{http_code}' "http://$listen/api/v1/query?query=up")
+[[ $code == 401 ]] || fail "no token: got status $code, want 401"
+
+echo PASS
@@ -2,140 +2,314 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/fs"
 	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/config"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/proxy"
 	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
 	"github.com/urfave/cli/v2"
 
-	"github.com/MicahParks/keyfunc/v3"
+	"github.com/metalmatze/signal/healthcheck"
 	"github.com/metalmatze/signal/internalserver"
 	"github.com/oklog/run"
 	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
 
 	"github.com/prometheus-community/prom-label-proxy/injectproxy"
 )
 
 var (
 	grafanaJWKSPath = "/api/signing-keys/keys"
+	// version is set at build time.
+	version = "dev"
 )
 
-var (
-	insecureListenAddress  string
-	internalListenAddress  string
-	upstream               string
-	label                  string
-	enableLabelAPIs        bool
-	unsafePassthroughPaths string // Comma-delimited string.
-	errorOnReplace         bool
-	headerUsesListSyntax   bool
-	rulesWithActiveAlerts  bool
-	grafanaUrl             string
-)
-
-var flags = []cli.Flag{
-	&cli.StringFlag{
-		Name:        "insecure-listen-address",
-		Usage:       "The address the prom-label-proxy HTTP server should listen on.",
-		Destination: &insecureListenAddress,
-	},
-	&cli.StringFlag{
-		Name:        "internal-listen-address",
-		Usage:       "The address the internal prom-label-proxy HTTP server should listen on to expose metrics about itself.",
-		Destination: &internalListenAddress,
-	},
-	&cli.StringFlag{
-		Name:        "upstream",
-		Usage:       "The upstream URL to proxy to.",
-		Destination: &upstream,
-	},
-	&cli.StringFlag{
-		Name:        "label",
-		Usage:       "The label name to enforce in all proxied PromQL queries.",
-		Destination: &label,
-	},
-	&cli.BoolFlag{
-		Name: "enable-label-apis",
-		Usage: "When specified proxy allows to inject label to label APIs like /api/v1/labels and /api/v1/label/<name>/values. " +
-			"NOTE: Enable with care because filtering by matcher is not implemented in older versions of Prometheus (>= v2.24.0 required) and Thanos (>= v0.18.0 required, >= v0.23.0 recommended). If enabled and " +
-			"any labels endpoint does not support selectors, the injected matcher will have no effect.",
-		Value:       false,
-		Destination: &enableLabelAPIs,
-	},
-	&cli.StringFlag{
-		Name: "unsafe-passthrough-paths",
-		Usage: "Comma delimited allow list of exact HTTP path segments that should be allowed to hit upstream URL without any enforcement. " +
-			"This option is checked after Prometheus APIs, you cannot override enforced API endpoints to be not enforced with this option. Use carefully as it can easily cause a data leak if the provided path is an important " +
-			"API (like /api/v1/configuration) which isn't enforced by prom-label-proxy. NOTE: \"all\" matching paths like \"/\" or \"\" and regex are not allowed.",
-		Destination: &unsafePassthroughPaths,
-	},
-	&cli.BoolFlag{
-		Name:        "error-on-replace",
-		Usage:       "When specified, the proxy will return HTTP status code 400 if the query already contains a label matcher that differs from the one the proxy would inject.",
-		Value:       false,
-		Destination: &errorOnReplace,
-	},
-	&cli.BoolFlag{
-		Name:        "header-uses-list-syntax",
-		Usage:       "When specified, the header line value will be parsed as a comma-separated list. This allows a single tenant header line to specify multiple tenant names.",
-		Value:       false,
-		Destination: &headerUsesListSyntax,
-	},
-	&cli.BoolFlag{
-		Name:        "rules-with-active-alert",
-		Usage:       "When true, the proxy will return alerting rules with active alerts matching the tenant label even when the tenant label isn't present in the rule's labels.",
-		Value:       false,
-		Destination: &rulesWithActiveAlerts,
-	},
-	&cli.StringFlag{
-		Name:        "grafana-url",
-		Usage:       "Grafana URL used to fetch teams, JWKS.",
-		Destination: &grafanaUrl,
-	},
+// errorOnReplacePaths maps the endpoint classes accepted by --error-on-replace-endpoints
+// to the injectproxy paths they cover.
+var errorOnReplacePaths = map[string]string{
+	"query":           "/api/v1/query",
+	"query_range":     "/api/v1/query_range",
+	"query_exemplars": "/api/v1/query_exemplars",
 }
 
 func main() {
 	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
 
+	o := &options{}
+	flags := newFlags(o)
 	app := &cli.App{
-		Name:  "prom-grafana-lbac",
-		Usage: "A label-based access control proxy to enable multi-tenant read access in Prometheus by enforcing label restrictions based on Grafana teams membership.",
-		Flags: flags,
-		Action: func(*cli.Context) error {
-			if os.Getenv("GRAFANA_ADMIN_USER") == "" {
-				log.Fatalf("GRAFANA_ADMIN_USER not present")
+		Name:    "prom-grafana-lbac",
+		Version: version,
+		Usage:   "A label-based access control proxy to enable multi-tenant read access in Prometheus by enforcing label restrictions based on Grafana teams membership.",
+		Flags:   flags,
+		Commands: []*cli.Command{
+			e2eFixtureCommand,
+		},
+		Action: func(cliCtx *cli.Context) error {
+			grafanaAdminUser, grafanaAdminPass := os.Getenv("GRAFANA_ADMIN_USER"), os.Getenv("GRAFANA_ADMIN_PASS")
+			// the flags set on the command line, whose values in the configuration file are ignored
+			var commandLine []string
+			for _, f := range flags {
+				if cliCtx.IsSet(f.Names()[0]) {
+					commandLine = append(commandLine, f.Names()[0])
+				}
+			}
+			var cfg *config.Config
+			if o.configFile != "" {
+				var err error
+				cfg, err = config.Load(o.configFile)
+				if err != nil {
+					log.Fatalf("Failed to load --config-file: %v", err)
+				}
+				if err := applyConfig(cliCtx, cfg); err != nil {
+					log.Fatalf("Invalid --config-file %q: %v", o.configFile, err)
+				}
+				if cfg.GrafanaAdminUser != "" {
+					grafanaAdminUser = cfg.GrafanaAdminUser
+				}
+				if cfg.GrafanaAdminPass != "" {
+					grafanaAdminPass = cfg.GrafanaAdminPass
+				}
+			}
+			if o.grafanaToken == "" {
+				o.grafanaToken = os.Getenv("GRAFANA_SERVICE_TOKEN")
+			}
+
+			if o.jwtHeader == "" {
+				log.Fatalf("--jwt-header must not be empty")
+			}
+			if o.teamsCacheTTL < 0 {
+				log.Fatalf("Invalid --cache-ttl %s, expected a positive duration or 0", o.teamsCacheTTL)
+			}
+			if o.cacheCleanupInterval <= 0 {
+				log.Fatalf("Invalid --cache-cleanup-interval %s, expected a positive duration", o.cacheCleanupInterval)
+			}
+			if o.allowBearerToken && http.CanonicalHeaderKey(o.jwtHeader) == "Authorization" {
+				log.Fatalf("--allow-bearer-token is redundant with --jwt-header=Authorization")
+			}
+
+			var labelTemplate *teams.LabelValueTemplate
+			if o.labelValueTemplate != "" {
+				if cliCtx.IsSet("label-source") && teams.LabelSource(o.labelSource) != teams.LabelSourceClaims {
+					log.Fatalf("--label-value-template requires --label-source=claims")
+				}
+				o.labelSource = string(teams.LabelSourceClaims)
+				var err error
+				if labelTemplate, err = teams.ParseLabelValueTemplate(o.labelValueTemplate); err != nil {
+					log.Fatalf("Invalid --label-value-template %q: %v", o.labelValueTemplate, err)
+				}
+			}
+
+			switch teams.LookupIdentity(o.teamsLookupIdentity) {
+			case teams.LookupAsAdmin:
+				// label values derived from the claims are not looked up in Grafana
+				if teams.LabelSource(o.labelSource) == teams.LabelSourceClaims {
+					break
+				}
+				basicAuth := grafanaAdminUser != "" && (grafanaAdminPass != "" || o.grafanaPassFile != "")
+				switch {
+				case o.grafanaToken != "" && basicAuth:
+					slog.Warn("both a Grafana service account token and admin credentials are configured, using the token")
+				case o.grafanaToken == "" && !basicAuth:
+					log.Fatalf("No Grafana credentials present, set GRAFANA_SERVICE_TOKEN or GRAFANA_ADMIN_USER and GRAFANA_ADMIN_PASS")
+				}
+			case teams.LookupAsSelf:
+			default:
+				log.Fatalf("Invalid --teams-lookup-identity %q, only 'admin' and 'self' are supported", o.teamsLookupIdentity)
+			}
+
+			switch teams.LabelSource(o.labelSource) {
+			case teams.LabelSourceTeams:
+			case teams.LabelSourceFolders:
+				if teams.LookupIdentity(o.teamsLookupIdentity) != teams.LookupAsSelf {
+					log.Fatalf("--label-source=folders requires --teams-lookup-identity=self")
+				}
+				if o.folderLabelField != "title" && o.folderLabelField != "uid" {
+					log.Fatalf("Invalid --folder-label-field %q, only 'title' and 'uid' are supported", o.folderLabelField)
+				}
+			case teams.LabelSourceClaims:
+				if labelTemplate == nil {
+					log.Fatalf("--label-source=claims requires --label-value-template")
+				}
+			default:
+				log.Fatalf("Invalid --label-source %q, only 'teams', 'folders' and 'claims' are supported", o.labelSource)
+			}
+
+			switch teams.MatcherStyle(o.matcherStyle) {
+			case teams.MatcherStyleAuto, teams.MatcherStyleRegexAnchored, teams.MatcherStyleRegexPlain, teams.MatcherStyleRepeatEquals:
+			default:
+				log.Fatalf("Invalid --matcher-style %q, only 'auto', 'regex-anchored', 'regex-plain' and 'repeat-equals' are supported", o.matcherStyle)
+			}
+
+			switch teams.UpstreamFlavor(o.upstreamFlavor) {
+			case teams.UpstreamPrometheus, teams.UpstreamVictoriaMetrics:
+			default:
+				log.Fatalf("Invalid --upstream-flavor %q, only 'prometheus' and 'victoriametrics' are supported", o.upstreamFlavor)
 			}
 
-			if os.Getenv("GRAFANA_ADMIN_PASS") == "" {
-				log.Fatalf("GRAFANA_ADMIN_PASS not present")
+			if o.readyRequiresUpstream && o.upstreamProbeInterval <= 0 {
+				log.Fatalf("--ready-requires-upstream requires --upstream-probe-interval")
 			}
 
-			upstreamURL, err := url.Parse(upstream)
+			if o.defaultSeriesLimit < 0 || o.maxSeriesLimit < 0 {
+				log.Fatalf("--default-series-limit and --max-series-limit must not be negative")
+			}
+			if o.maxSeriesLimit > 0 && o.defaultSeriesLimit > o.maxSeriesLimit {
+				log.Fatalf("--default-series-limit %d exceeds --max-series-limit %d", o.defaultSeriesLimit, o.maxSeriesLimit)
+			}
+
+			var trusted []netip.Prefix
+			if o.trustForwardedHeaders {
+				for _, cidr := range strings.Split(o.trustedProxies, ",") {
+					p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+					if err != nil {
+						log.Fatalf("Invalid --trusted-proxies CIDR %q: %v", cidr, err)
+					}
+					trusted = append(trusted, p)
+				}
+			}
+
+			var markerPeers []netip.Prefix
+			if o.enforcementMarkerPeers != "" {
+				for _, cidr := range strings.Split(o.enforcementMarkerPeers, ",") {
+					p, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+					if err != nil {
+						log.Fatalf("Invalid --enforcement-marker-peers CIDR %q: %v", cidr, err)
+					}
+					markerPeers = append(markerPeers, p)
+				}
+			}
+
+			upstreamURL, err := url.Parse(o.upstream)
 			if err != nil {
 				log.Fatalf("Failed to build parse upstream URL: %v", err)
 			}
 
 			if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
-				log.Fatalf("Invalid scheme for upstream URL %q, only 'http' and 'https' are supported", upstream)
+				log.Fatalf("Invalid scheme for upstream URL %q, only 'http' and 'https' are supported", o.upstream)
+			}
+
+			secondaryURL := upstreamURL
+			if o.secondaryPathPrefix != "" {
+				if !strings.HasPrefix(o.secondaryPathPrefix, "/") || strings.HasSuffix(o.secondaryPathPrefix, "/") || strings.HasPrefix(o.secondaryPathPrefix+"/", "/api/") {
+					log.Fatalf("Invalid --secondary-path-prefix %q, it must start with '/', not end with '/' and not be under /api", o.secondaryPathPrefix)
+				}
+				if o.secondaryLabel == "" {
+					log.Fatalf("--secondary-path-prefix requires --secondary-label")
+				}
+				if o.secondaryUpstream != "" {
+					secondaryURL, err = url.Parse(o.secondaryUpstream)
+					if err != nil {
+						log.Fatalf("Failed to build parse secondary upstream URL: %v", err)
+					}
+					if secondaryURL.Scheme != "http" && secondaryURL.Scheme != "https" {
+						log.Fatalf("Invalid scheme for secondary upstream URL %q, only 'http' and 'https' are supported", o.secondaryUpstream)
+					}
+				}
+			}
+
+			var injectedMatchers []*labels.Matcher
+			for _, m := range o.alwaysMatchers.Value() {
+				matcher, err := teams.ParseAlwaysMatcher(m)
+				if err != nil {
+					log.Fatalf("Invalid --always-matcher: %v", err)
+				}
+				if matcher.Name == o.label || matcher.Name == o.secondaryLabel {
+					log.Fatalf("Invalid --always-matcher %q, it cannot match the enforced label", m)
+				}
+				injectedMatchers = append(injectedMatchers, matcher)
+			}
+
+			var rulerURL *url.URL
+			if o.rulerUpstream != "" {
+				rulerURL, err = url.Parse(o.rulerUpstream)
+				if err != nil {
+					log.Fatalf("Failed to build parse ruler upstream URL: %v", err)
+				}
+				if rulerURL.Scheme != "http" && rulerURL.Scheme != "https" {
+					log.Fatalf("Invalid scheme for ruler upstream URL %q, only 'http' and 'https' are supported", o.rulerUpstream)
+				}
+			}
+
+			datasourceURLs := map[string]*url.URL{}
+			if o.datasourceUpstreams != "" {
+				for _, pair := range strings.Split(o.datasourceUpstreams, ",") {
+					uid, u, found := strings.Cut(strings.TrimSpace(pair), "=")
+					if !found || uid == "" {
+						log.Fatalf("Invalid --datasource-upstreams entry %q, expected <datasourceUID>=<upstream URL>", pair)
+					}
+					if uid == "default" {
+						log.Fatalf("Invalid --datasource-upstreams entry %q, the datasource UID 'default' is reserved for --upstream", pair)
+					}
+					dsURL, err := url.Parse(u)
+					if err != nil {
+						log.Fatalf("Failed to build parse upstream URL of datasource %q: %v", uid, err)
+					}
+					if dsURL.Scheme != "http" && dsURL.Scheme != "https" {
+						log.Fatalf("Invalid scheme for upstream URL %q of datasource %q, only 'http' and 'https' are supported", u, uid)
+					}
+					datasourceURLs[uid] = dsURL
+				}
 			}
 
-			url, err := url.Parse(grafanaUrl)
+			grafanaURL, err := url.Parse(o.grafanaUrl)
 			if err != nil {
 				log.Fatalf("Failed to build parse grafana URL: %v", err)
 			}
 
-			if url.Scheme != "http" && url.Scheme != "https" {
-				log.Fatalf("Invalid scheme for grafana URL %q, only 'http' and 'https' are supported", upstream)
+			if grafanaURL.Scheme != "http" && grafanaURL.Scheme != "https" {
+				log.Fatalf("Invalid scheme for grafana URL %q, only 'http' and 'https' are supported", o.grafanaUrl)
+			}
+
+			// http.DefaultTransport is replaced below for injectproxy, which offers no way to
+			// configure the transport it proxies through, so every other client is given its
+			// transport explicitly, built upon the one in place before
+			baseTransport := http.DefaultTransport
+			grafanaTransport := baseTransport
+			if o.grafanaPinnedSHA256 != "" {
+				if grafanaURL.Scheme != "https" {
+					log.Fatalf("--grafana-pinned-sha256 requires an https --grafana-url")
+				}
+				var pins [][]byte
+				for _, fp := range strings.Split(o.grafanaPinnedSHA256, ",") {
+					pin, err := teams.ParsePin(fp)
+					if err != nil {
+						log.Fatalf("Invalid --grafana-pinned-sha256 entry: %v", err)
+					}
+					pins = append(pins, pin)
+				}
+				grafanaTransport = teams.PinnedTransport(pins)
+			}
+
+			if o.grafanaIssuer == "" {
+				o.grafanaIssuer = o.grafanaUrl
+			}
+			var sources []grafanaSource
+			if o.grafanaSourcesFile != "" {
+				sources, err = loadGrafanaSources(o.grafanaSourcesFile, o.grafanaIssuer, grafanaJWKSPath, teams.LookupIdentity(o.teamsLookupIdentity))
+				if err != nil {
+					log.Fatalf("Invalid --grafana-sources-file: %v", err)
+				}
 			}
 
 			reg := prometheus.NewRegistry()
@@ -143,60 +317,521 @@ func main() {
 				collectors.NewGoCollector(),
 				collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 			)
+			// the metrics of each Grafana instance are told apart by label when there are several
+			grafanaReg := prometheus.Registerer(reg)
+			if len(sources) > 0 {
+				grafanaReg = prometheus.WrapRegistererWith(prometheus.Labels{"grafana": "default"}, reg)
+			}
 
-			opts := []injectproxy.Option{injectproxy.WithPrometheusRegistry(reg)}
-			if enableLabelAPIs {
+			var strictPaths []string
+			strictLabels := o.errorOnReplace && len(o.errorOnReplaceEndpoints) == 0
+			if len(o.errorOnReplaceEndpoints) > 0 {
+				for _, class := range strings.Split(o.errorOnReplaceEndpoints, ",") {
+					if strings.TrimSpace(class) == "labels" {
+						// injectproxy combines the selectors of the labels endpoints, they are checked by the enforcer
+						strictLabels = true
+						continue
+					}
+					path, ok := errorOnReplacePaths[strings.TrimSpace(class)]
+					if !ok {
+						log.Fatalf("Invalid endpoint class %q in --error-on-replace-endpoints", class)
+					}
+					strictPaths = append(strictPaths, path)
+				}
+			}
+
+			var opts []injectproxy.Option
+			if o.enableLabelAPIs {
 				opts = append(opts, injectproxy.WithEnabledLabelsAPI())
 			}
 
-			if len(unsafePassthroughPaths) > 0 {
-				opts = append(opts, injectproxy.WithPassthroughPaths(strings.Split(unsafePassthroughPaths, ",")))
+			if len(o.unsafePassthroughPaths) > 0 {
+				passthroughPaths := strings.Split(o.unsafePassthroughPaths, ",")
+				enforcedPaths := slices.Clone(proxy.EnforcedPaths)
+				if rulerURL != nil {
+					enforcedPaths = append(enforcedPaths, "/prometheus/config/v1/rules")
+				}
+				if o.secondaryPathPrefix != "" {
+					enforcedPaths = append(enforcedPaths, o.secondaryPathPrefix)
+				}
+				if err := proxy.ValidatePassthroughPaths(passthroughPaths, enforcedPaths); err != nil {
+					log.Fatalf("Invalid --unsafe-passthrough-paths: %v", err)
+				}
+				opts = append(opts, injectproxy.WithPassthroughPaths(passthroughPaths))
+			}
+
+			var uiPaths []string
+			if o.uiPassthroughPaths != "" {
+				uiPaths = strings.Split(o.uiPassthroughPaths, ",")
+				if err := teams.ValidateUIPaths(uiPaths); err != nil {
+					log.Fatalf("Invalid --ui-passthrough-paths: %v", err)
+				}
 			}
 
-			if errorOnReplace {
+			if o.errorOnReplace && len(o.errorOnReplaceEndpoints) == 0 {
 				opts = append(opts, injectproxy.WithErrorOnReplace())
 			}
 
-			if rulesWithActiveAlerts {
+			if o.rulesWithActiveAlerts {
 				opts = append(opts, injectproxy.WithActiveAlerts())
 			}
 
-			k, err := keyfunc.NewDefaultCtx(context.Background(), []string{url.JoinPath(grafanaJWKSPath).String()})
+			keyURLs := []string{grafanaURL.JoinPath(grafanaJWKSPath).String()}
+			if len(o.jwksURLs.Value()) > 0 {
+				keyURLs = nil
+				for _, raw := range o.jwksURLs.Value() {
+					u, err := url.Parse(raw)
+					if err != nil {
+						log.Fatalf("Invalid --jwks-url %q: %v", raw, err)
+					}
+					if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+						log.Fatalf("Invalid --jwks-url %q, only absolute 'http' and 'https' URLs are supported", raw)
+					}
+					if slices.Contains(keyURLs, u.String()) {
+						log.Fatalf("Duplicate --jwks-url %q", raw)
+					}
+					keyURLs = append(keyURLs, u.String())
+				}
+			}
+			k, err := teams.NewKeyfunc(context.Background(), keyURLs, teams.JWKSOptions{
+				StartupRetries: o.jwksStartupRetries,
+				StartupTimeout: o.jwksStartupTimeout,
+				MaxStaleness:   o.jwksMaxStaleness,
+				Registerer:     grafanaReg,
+				Transport:      grafanaTransport,
+			})
 			if err != nil {
 				log.Fatalf("failed to create a keyfunc.Keyfunc from url: %v", err)
 			}
 
-			c := cache.New(5*time.Minute, 10*time.Minute)
+			effective, hash := effectiveConfig(cliCtx)
+			promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+				Name: "lbac_config_hash",
+				Help: "Hash of the effective configuration. Replicas reporting different hashes run different configurations.",
+			}, []string{"hash"}).WithLabelValues(hash).Set(1)
+
+			registerConfigInfo(cliCtx, o, reg)
+
+			healthchecks := healthcheck.NewMetricsHandler(healthcheck.NewHandler(), reg)
+			healthchecks.AddReadinessCheck("jwks", k.Ready)
+
+			c := cache.New(o.teamsCacheTTL, o.cacheCleanupInterval)
+			evictions := teams.NewCacheEvictions(c, grafanaReg)
+			if o.cacheStateFile != "" {
+				if n, err := teams.LoadCacheState(c, o.cacheStateFile, hash); errors.Is(err, fs.ErrNotExist) {
+					slog.Info("no cache state to load", "path", o.cacheStateFile)
+				} else if err != nil {
+					slog.Warn("ignoring cache state file", "path", o.cacheStateFile, "error", err)
+				} else {
+					slog.Info("loaded cache state", "path", o.cacheStateFile, "entries", n)
+				}
+			}
 
 			extractLabeler := teams.GrafanaTeamsEnforcer{
 				KeyFunc: k,
 				Cache:   *c,
+				NoCache: o.teamsCacheTTL == 0,
 				Client: http.Client{
-					Timeout: 5 * time.Second,
+					Transport: grafanaTransport,
+					Timeout:   5 * time.Second,
 				},
-				GrafanaUrl:  *url,
-				GrafanaUser: os.Getenv("GRAFANA_ADMIN_USER"),
-				GrafanaPass: os.Getenv("GRAFANA_ADMIN_PASS"),
+				GrafanaUrl:           *grafanaURL,
+				GrafanaUser:          grafanaAdminUser,
+				GrafanaPass:          grafanaAdminPass,
+				GrafanaToken:         o.grafanaToken,
+				Freezer:              teams.NewFreezer(reg),
+				LookupIdentity:       teams.LookupIdentity(o.teamsLookupIdentity),
+				LabelSource:          teams.LabelSource(o.labelSource),
+				LabelTemplate:        labelTemplate,
+				FolderLabelField:     o.folderLabelField,
+				MaxResponseBytes:     o.grafanaMaxResponseBytes,
+				ExpectedAzp:          o.expectedAzp,
+				InferOrgFromTeams:    o.inferOrgFromTeams,
+				RetryOnDecodeError:   o.grafanaRetryDecode,
+				MaxTokenBytes:        o.maxTokenBytes,
+				TokenHeader:          o.jwtHeader,
+				MaxTokenAge:          o.maxTokenAge,
+				AllowOpaqueToken:     o.allowOpaqueToken,
+				IntrospectionPath:    o.introspectionPath,
+				Outcomes:             teams.NewOutcomeCounter(reg),
+				RejectedClaims:       teams.NewRejectedClaimsCounter(reg),
+				GrafanaLatency:       teams.NewGrafanaLatency(grafanaReg),
+				CredentialsRejected:  teams.NewCredentialsRejected(grafanaReg),
+				ErrorOnReplaceLabels: strictLabels,
+				ServerTiming:         o.enableServerTiming,
+				CaptureClients:       o.captureClients,
+				Phases:               teams.NewPhaseMetrics(o.slowRequestThreshold, reg),
+			}
+
+			if o.tokenCacheTTL > 0 {
+				extractLabeler.TokenCache = teams.NewTokenCache(o.tokenCacheTTL, reg)
+			}
+			if o.expandTeamHierarchy {
+				if o.teamHierarchy == "" {
+					log.Fatalf("--expand-team-hierarchy requires --team-hierarchy")
+				}
+				if teams.LabelSource(o.labelSource) != teams.LabelSourceTeams {
+					log.Fatalf("--expand-team-hierarchy requires --label-source=teams")
+				}
+				if extractLabeler.TeamHierarchy, err = teams.ParseTeamHierarchy(o.teamHierarchy); err != nil {
+					log.Fatalf("Invalid --team-hierarchy: %v", err)
+				}
+			}
+			if o.healthCheckQueries != "" {
+				extractLabeler.HealthCheck = &teams.HealthCheck{Queries: strings.Split(o.healthCheckQueries, ","), Version: version}
+			}
+
+			if o.bulkTeamsPath != "" {
+				if !strings.HasPrefix(o.bulkTeamsPath, "/") {
+					log.Fatalf("Invalid --bulk-teams-path %q, expected an absolute path", o.bulkTeamsPath)
+				}
+				extractLabeler.TeamResolver = teams.NewBulkTeamResolver(o.bulkTeamsPath)
+			}
+
+			if o.grafanaPassFile != "" {
+				extractLabeler.GrafanaPassFile, err = teams.NewSecretFile(o.grafanaPassFile)
+				if err != nil {
+					log.Fatalf("Failed to read --grafana-pass-file: %v", err)
+				}
+			}
+
+			if o.cacheMaxBytes > 0 {
+				extractLabeler.CacheBudget = teams.NewCacheBudget(c, evictions, o.cacheMaxBytes, grafanaReg)
+			}
+
+			if o.cacheMaxEntries > 0 || o.cacheIdleTimeout > 0 {
+				extractLabeler.CacheRecency = teams.NewCacheRecency(c, evictions, o.cacheMaxEntries, o.cacheIdleTimeout)
+			}
+
+			if o.emptyTeamsRevalidation > 0 {
+				extractLabeler.EmptyRevalidation = teams.NewEmptyRevalidation(o.emptyTeamsRevalidation, grafanaReg)
+			}
+
+			if o.accessRemovalGrace > 0 {
+				extractLabeler.RemovalGrace = teams.NewRemovalGrace(o.accessRemovalGrace, o.teamsCacheTTL, grafanaReg)
+			}
+
+			if len(o.requireClaims) > 0 {
+				extractLabeler.RequiredClaims = strings.Split(o.requireClaims, ",")
+			}
+
+			if o.enableDebugHeaders {
+				extractLabeler.DebugHeaders = true
+				if len(o.debugHeadersTeams) > 0 {
+					extractLabeler.DebugTeams = strings.Split(o.debugHeadersTeams, ",")
+				}
+			}
+
+			var recent *teams.RecentDecisions
+			if o.recentDecisionsSize > 0 {
+				recent = teams.NewRecentDecisions(o.recentDecisionsSize)
+				extractLabeler.Recorders = append(extractLabeler.Recorders, recent)
+			}
+
+			var clients *teams.ClientTracker
+			if o.captureClients {
+				clients = teams.NewClientTracker(o.clientReportWindow, reg)
+				extractLabeler.Recorders = append(extractLabeler.Recorders, clients)
+			}
+
+			if o.decisionLogFile != "" {
+				decisionLog, err := teams.NewDecisionLog(o.decisionLogFile, o.decisionLogMaxBytes)
+				if err != nil {
+					log.Fatalf("Failed to open --decision-log-file: %v", err)
+				}
+				defer decisionLog.Close()
+				extractLabeler.Recorders = append(extractLabeler.Recorders, decisionLog)
+			}
+
+			sourceEnforcers := make([]teams.GrafanaTeamsEnforcer, len(sources))
+			for i, src := range sources {
+				el, keys, err := src.enforcer(extractLabeler, o, baseTransport, prometheus.WrapRegistererWith(prometheus.Labels{"grafana": src.Name}, reg))
+				if err != nil {
+					log.Fatalf("Invalid Grafana source %q: %v", src.Name, err)
+				}
+				healthchecks.AddReadinessCheck("jwks-"+src.Name, keys.Ready)
+				sourceEnforcers[i] = el
+			}
+
+			grafanaVersion := "unknown"
+			if v, err := extractLabeler.GrafanaVersion(context.Background()); err != nil {
+				slog.Warn("unable to detect the Grafana version", "error", err)
+			} else {
+				grafanaVersion = v
+			}
+			slog.Info("starting prom-grafana-lbac",
+				"version", version,
+				"config_hash", hash,
+				"upstream", upstreamURL.Redacted(),
+				"label", o.label,
+				"grafana_url", grafanaURL.Redacted(),
+				"grafana_version", grafanaVersion,
+				"cache_ttl", o.teamsCacheTTL.String(),
+				"enabled", enabledFlags(cliCtx),
+				"org_labels", len(strings.FieldsFunc(o.orgLabels, func(r rune) bool { return r == ',' })),
+				"config", effective,
+			)
+
+			var upstreamCredential *teams.SecretFile
+			switch {
+			case o.upstreamAuthBearerFile != "" && o.upstreamAuthBasicFile != "":
+				log.Fatalf("--upstream-auth-bearer-file and --upstream-auth-basic-file are mutually exclusive")
+			case o.upstreamAuthBearerFile != "":
+				if upstreamCredential, err = teams.NewSecretFile(o.upstreamAuthBearerFile); err != nil {
+					log.Fatalf("Failed to read --upstream-auth-bearer-file: %v", err)
+				}
+			case o.upstreamAuthBasicFile != "":
+				if upstreamCredential, err = teams.NewSecretFile(o.upstreamAuthBasicFile); err != nil {
+					log.Fatalf("Failed to read --upstream-auth-basic-file: %v", err)
+				}
+				if !strings.Contains(upstreamCredential.Value(), ":") {
+					log.Fatalf("--upstream-auth-basic-file must hold <user>:<password>")
+				}
+			}
+			if o.mirrorUpstreamAuth && upstreamCredential == nil {
+				log.Fatalf("--mirror-upstream-auth requires --upstream-auth-bearer-file or --upstream-auth-basic-file")
+			}
+
+			var mirror *proxy.Mirror
+			if o.mirrorUpstream != "" {
+				mirrorURL, err := url.Parse(o.mirrorUpstream)
+				if err != nil {
+					log.Fatalf("Failed to build mirror upstream URL: %v", err)
+				}
+				if mirrorURL.Scheme != "http" && mirrorURL.Scheme != "https" {
+					log.Fatalf("Invalid scheme for mirror upstream URL %q, only 'http' and 'https' are supported", o.mirrorUpstream)
+				}
+				if mirrorURL.Host == upstreamURL.Host {
+					log.Fatalf("--mirror-upstream must differ from --upstream")
+				}
+				if o.mirrorSamplePercent <= 0 || o.mirrorSamplePercent > 100 {
+					log.Fatalf("--mirror-sample-percent must be within (0, 100]")
+				}
+				if o.mirrorMaxConcurrency <= 0 {
+					log.Fatalf("--mirror-max-concurrency must be positive")
+				}
+				mirrorTransport := baseTransport
+				if upstreamCredential != nil {
+					// the mirror gets neither the credential of the client nor, by default, the upstream one
+					mirrorAuth := proxy.UpstreamAuth{Hosts: []string{mirrorURL.Host}, Basic: o.upstreamAuthBasicFile != "", Next: mirrorTransport}
+					if o.mirrorUpstreamAuth {
+						mirrorAuth.Credential = upstreamCredential
+					}
+					mirrorTransport = mirrorAuth
+				}
+				mirror = proxy.NewMirror(mirrorURL, o.mirrorSamplePercent, o.mirrorTimeout, o.mirrorMaxConcurrency, mirrorTransport, reg)
+			}
+
+			var rateLimiter *proxy.EndpointRateLimiter
+			// with a configuration file, the limits may be set by reloading it
+			if o.endpointRateLimits != "" || o.tenantRateLimit != "" || o.tenantRateLimitOverride != "" || o.configFile != "" {
+				limits, err := parseRateLimits(o.endpointRateLimits, o.tenantRateLimit, o.tenantRateLimitOverride)
+				if err != nil {
+					log.Fatalf("%v", err)
+				}
+				rateLimiter = proxy.NewEndpointRateLimiter(limits, reg)
+			}
+
+			upstreamHosts := []string{upstreamURL.Host}
+			for _, u := range append([]*url.URL{secondaryURL}, slices.Collect(maps.Values(datasourceURLs))...) {
+				if !slices.Contains(upstreamHosts, u.Host) {
+					upstreamHosts = append(upstreamHosts, u.Host)
+				}
+			}
+			if rulerURL != nil && !slices.Contains(upstreamHosts, rulerURL.Host) {
+				upstreamHosts = append(upstreamHosts, rulerURL.Host)
+			}
+			// break-glass requests and requests enforced by a proxy in front skip enforcement, and
+			// with it the transports of enforced requests
+			rawTransport := baseTransport
+			if upstreamCredential != nil {
+				// mirrored requests copy the headers of the requests before it runs, and so
+				// never carry the credential unless --mirror-upstream-auth is set
+				rawTransport = proxy.UpstreamAuth{Hosts: upstreamHosts, Basic: o.upstreamAuthBasicFile != "", Credential: upstreamCredential, Next: rawTransport}
+			}
+
+			var upstreamTransport http.RoundTripper = proxy.Transport{
+				Upstream:       upstreamURL,
+				Next:           rawTransport,
+				TenantHeaders:  o.enableTenantHeaders,
+				Outcomes:       extractLabeler.Outcomes,
+				Mirror:         mirror,
+				RateLimiter:    rateLimiter,
+				SetMarker:      o.setEnforcementMarker,
+				MatcherStyle:   teams.MatcherStyle(o.matcherStyle),
+				AlwaysMatchers: injectedMatchers,
+			}
+			transportHosts := []string{upstreamURL.Host}
+			for _, u := range append([]*url.URL{secondaryURL}, slices.Collect(maps.Values(datasourceURLs))...) {
+				if slices.Contains(transportHosts, u.Host) {
+					continue
+				}
+				transportHosts = append(transportHosts, u.Host)
+				upstreamTransport = proxy.Transport{
+					Upstream:       u,
+					Next:           upstreamTransport,
+					TenantHeaders:  o.enableTenantHeaders,
+					Outcomes:       extractLabeler.Outcomes,
+					RateLimiter:    rateLimiter,
+					SetMarker:      o.setEnforcementMarker,
+					MatcherStyle:   teams.MatcherStyle(o.matcherStyle),
+					AlwaysMatchers: injectedMatchers,
+				}
+			}
+			// injectproxy proxies through http.DefaultTransport and offers no way to configure it
+			http.DefaultTransport = upstreamTransport
+
+			var adminToken *teams.SecretFile
+			if o.adminTokenFile != "" {
+				if adminToken, err = teams.NewSecretFile(o.adminTokenFile); err != nil {
+					log.Fatalf("Failed to read --admin-token-file: %v", err)
+				}
 			}
 
 			var g run.Group
 
+			if adminToken != nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					return adminToken.Run(ctx, 30*time.Second)
+				}, func(error) {
+					cancel()
+				})
+			}
+
+			if upstreamCredential != nil {
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					return upstreamCredential.Run(ctx, 30*time.Second)
+				}, func(error) {
+					cancel()
+				})
+			}
+
+			if o.cacheIdleTimeout > 0 {
+				for _, el := range append([]teams.GrafanaTeamsEnforcer{extractLabeler}, sourceEnforcers...) {
+					ctx, cancel := context.WithCancel(context.Background())
+					g.Add(func() error {
+						return el.CacheRecency.Run(ctx, min(o.cacheIdleTimeout, time.Minute))
+					}, func(error) {
+						cancel()
+					})
+				}
+			}
+
+			for _, el := range append([]teams.GrafanaTeamsEnforcer{extractLabeler}, sourceEnforcers...) {
+				if el.GrafanaPassFile == nil {
+					continue
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					return el.GrafanaPassFile.Run(ctx, 30*time.Second)
+				}, func(error) {
+					cancel()
+				})
+			}
+
+			if o.upstreamProbeInterval > 0 {
+				probed := maps.Clone(datasourceURLs)
+				probed["default"] = upstreamURL
+				for name, u := range probed {
+					var probeReg prometheus.Registerer = reg
+					check := "upstream"
+					if len(datasourceURLs) > 0 {
+						// tell the upstreams apart in the probe metrics and readiness checks
+						probeReg = prometheus.WrapRegistererWith(prometheus.Labels{"upstream": name}, reg)
+						if name != "default" {
+							check = "upstream-" + name
+						}
+					}
+					prober := proxy.NewProber(u, o.upstreamProbePath, o.upstreamProbeInterval, upstreamTransport, probeReg)
+					if o.readyRequiresUpstream {
+						healthchecks.AddReadinessCheck(check, prober.Ready)
+					}
+
+					ctx, cancel := context.WithCancel(context.Background())
+					g.Add(func() error {
+						return prober.Run(ctx)
+					}, func(error) {
+						cancel()
+					})
+				}
+			}
+
+			if o.canaryTokenFile != "" {
+				canary, err := teams.NewCanary(extractLabeler, o.canaryTokenFile)
+				if err != nil {
+					log.Fatalf("Failed to read --canary-token-file: %v", err)
+				}
+				healthchecks.AddReadinessCheck("canary", canary.Ready)
+
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					return canary.Run(ctx, o.canaryInterval)
+				}, func(error) {
+					cancel()
+				})
+			}
+
+			if o.selftestTokenFiles != "" && o.selftestMetric == "" {
+				log.Fatalf("--selftest-token-files requires --selftest-metric")
+			}
+			var selftest *teams.SelfTest
+
 			{
 				// Run the insecure HTTP server.
-				routes, err := injectproxy.NewRoutes(upstreamURL, label, extractLabeler, opts...)
+				rl, err := parseRouteLabels(o)
 				if err != nil {
-					log.Fatalf("Failed to create injectproxy Routes: %v", err)
+					log.Fatalf("%v", err)
+				}
+				b := &routeBuilder{
+					o:           o,
+					labels:      rl,
+					upstream:    upstreamURL,
+					secondary:   secondaryURL,
+					ruler:       rulerURL,
+					datasources: datasourceURLs,
+					sources:     sources,
+					strictPaths: strictPaths,
+					opts:        opts,
+					uiPaths:     uiPaths,
+					trusted:     trusted,
+					markerPeers: markerPeers,
+					transport:   upstreamTransport,
+					raw:         rawTransport,
+					base:        baseTransport,
+					outcomes:    proxy.NewEnforcementOutcomes(reg),
+					reg:         reg,
+				}
+				mux, err := b.routes(extractLabeler, sourceEnforcers)
+				if err != nil {
+					log.Fatalf("Failed to create the enforced routes: %v", err)
 				}
 
-				mux := http.NewServeMux()
-				mux.Handle("/", routes)
-
-				l, err := net.Listen("tcp", insecureListenAddress)
+				l, err := net.Listen("tcp", o.insecureListenAddress)
 				if err != nil {
 					log.Fatalf("Failed to listen on insecure address: %v", err)
 				}
 
-				srv := &http.Server{Handler: mux}
+				handler := b.handler(mux, extractLabeler.Outcomes)
+
+				if o.selftestTokenFiles != "" {
+					selftest, err = teams.NewSelfTest(handler, o.label, o.selftestMetric, strings.Split(o.selftestTokenFiles, ","), reg)
+					if err != nil {
+						log.Fatalf("Failed to create the enforcement self-test: %v", err)
+					}
+					selftest.TokenHeader = o.jwtHeader
+					if o.selftestInterval > 0 {
+						ctx, cancel := context.WithCancel(context.Background())
+						g.Add(func() error {
+							return selftest.Run(ctx, o.selftestInterval)
+						}, func(error) {
+							cancel()
+						})
+					}
+				}
+
+				srv := &http.Server{Handler: handler}
 
 				g.Add(func() error {
 					log.Printf("Listening insecurely on %v", l.Addr())
@@ -210,15 +845,33 @@ func main() {
 				})
 			}
 
-			if internalListenAddress != "" {
+			if o.internalListenAddress != "" {
 				// Run the internal HTTP server.
 				h := internalserver.NewHandler(
 					internalserver.WithName("Internal prom-label-proxy API"),
+					internalserver.WithHealthchecks(healthchecks),
 					internalserver.WithPrometheusRegistry(reg),
 					internalserver.WithPProf(),
 				)
+				admin := newAdminRoutes(h, adminToken)
+				admin.add("/config", []string{http.MethodGet}, "Exposes the effective configuration and its hash", func(w http.ResponseWriter, _ *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					_ = json.NewEncoder(w).Encode(map[string]any{"hash": hash, "config": effective})
+				})
+				if recent != nil {
+					admin.add("/admin/recent", []string{http.MethodGet}, "Exposes the most recent authorization decisions", recent.ServeHTTP)
+				}
+				if clients != nil {
+					admin.add("/reports/clients", []string{http.MethodGet}, "Exposes the clients of ?tenant= with the most requests over --client-report-window", clients.ServeHTTP)
+				}
+				if selftest != nil {
+					admin.add("/selftest/enforcement", []string{http.MethodPost}, "Runs the enforcement self-test and exposes its report", selftest.ServeHTTP)
+				}
+				admin.add("/cache/", []string{http.MethodDelete}, "Evicts the cached teams and folders of /cache/<userId>", evictions.ServeHTTP)
+				admin.add("/freeze/", []string{http.MethodGet, http.MethodPut, http.MethodDelete},
+					"Lists (GET), freezes (PUT with a duration body) and unfreezes (DELETE) tenants at /freeze/<tenant>", extractLabeler.Freezer.ServeHTTP)
 				// Run the HTTP server.
-				l, err := net.Listen("tcp", internalListenAddress)
+				l, err := net.Listen("tcp", o.internalListenAddress)
 				if err != nil {
 					log.Fatalf("Failed to listen on internal address: %v", err)
 				}
@@ -237,6 +890,20 @@ func main() {
 				})
 			}
 
+			if o.configFile != "" {
+				// only the rate limits are applied while running, the other options are threaded
+				// through the handlers built above
+				reloader := config.NewReloader(o.configFile, cfg, rateLimitFlags, commandLine, func(cfg *config.Config) error {
+					return reloadRateLimits(cliCtx, commandLine, rateLimiter, cfg)
+				})
+				ctx, cancel := context.WithCancel(context.Background())
+				g.Add(func() error {
+					return reloader.Run(ctx)
+				}, func(error) {
+					cancel()
+				})
+			}
+
 			g.Add(run.SignalHandler(context.Background(), syscall.SIGINT, syscall.SIGTERM))
 
 			if err := g.Run(); err != nil {
@@ -246,6 +913,12 @@ func main() {
 				}
 				log.Print("Caught signal; exiting gracefully...")
 			}
+
+			if o.cacheStateFile != "" {
+				if err := teams.SaveCacheState(c, o.cacheStateFile, hash); err != nil {
+					slog.Error("failed to save cache state", "path", o.cacheStateFile, "error", err)
+				}
+			}
 			return nil
 		},
 	}
@@ -254,3 +927,144 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// applyConfig sets the flags not set on the command line to their values in cfg, which
+// may only name known flags.
+func applyConfig(cliCtx *cli.Context, cfg *config.Config) error {
+	flags := cliCtx.App.Flags
+	for _, name := range slices.Sorted(maps.Keys(cfg.Flags)) {
+		i := slices.IndexFunc(flags, func(f cli.Flag) bool { return slices.Contains(f.Names(), name) })
+		if i < 0 || name == "config-file" {
+			return fmt.Errorf("unknown option %q", name)
+		}
+		if cliCtx.IsSet(name) {
+			continue
+		}
+		values := cfg.Flags[name]
+		if _, ok := flags[i].(*cli.StringSliceFlag); !ok {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := cliCtx.Set(name, v); err != nil {
+				return fmt.Errorf("option %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rateLimitFlags are the flags setting the limits of the EndpointRateLimiter, which are
+// reloadable.
+var rateLimitFlags = []string{"endpoint-rate-limits", "tenant-rate-limit", "tenant-rate-limit-overrides"}
+
+// parseRateLimits parses the values of the rateLimitFlags.
+func parseRateLimits(endpoints, tenant, overrides string) (proxy.RateLimits, error) {
+	var limits proxy.RateLimits
+	if endpoints != "" {
+		for _, entry := range strings.Split(endpoints, ",") {
+			limit, err := proxy.ParseEndpointLimit(entry)
+			if err != nil {
+				return proxy.RateLimits{}, fmt.Errorf("invalid --endpoint-rate-limits entry %q: %w", entry, err)
+			}
+			limits.Endpoints = append(limits.Endpoints, limit)
+		}
+	}
+	if tenant != "" {
+		l, err := proxy.ParseTenantLimit(tenant)
+		if err != nil {
+			return proxy.RateLimits{}, fmt.Errorf("invalid --tenant-rate-limit %q: %w", tenant, err)
+		}
+		limits.Tenant = &l
+	}
+	if overrides != "" {
+		var err error
+		if limits.TenantOverrides, err = proxy.ParseTenantLimitOverrides(overrides); err != nil {
+			return proxy.RateLimits{}, fmt.Errorf("invalid --tenant-rate-limit-overrides: %w", err)
+		}
+	}
+	return limits, nil
+}
+
+// reloadRateLimits applies the rateLimitFlags of cfg to l, but for those in commandLine,
+// the flags set on the command line.
+func reloadRateLimits(cliCtx *cli.Context, commandLine []string, l *proxy.EndpointRateLimiter, cfg *config.Config) error {
+	values := make([]string, len(rateLimitFlags))
+	for i, name := range rateLimitFlags {
+		if slices.Contains(commandLine, name) {
+			values[i] = cliCtx.String(name)
+		} else {
+			values[i] = strings.Join(cfg.Flags[name], ",")
+		}
+	}
+	limits, err := parseRateLimits(values[0], values[1], values[2])
+	if err != nil {
+		return err
+	}
+	l.SetLimits(limits)
+	return nil
+}
+
+// secretFlags are the flags holding secrets, redacted by effectiveConfig.
+var secretFlags = []string{"grafana-token"}
+
+// effectiveConfig returns the value of every flag along with a stable hash of them.
+// Secrets are passed through the environment and are not part of it. The secretFlags are
+// redacted from the returned values and left out of the hash, so that it cannot be used to
+// guess them, while passwords in URLs are only redacted from the returned values.
+func effectiveConfig(cliCtx *cli.Context) (map[string]string, string) {
+	config := make(map[string]string, len(cliCtx.App.Flags))
+	for _, f := range cliCtx.App.Flags {
+		name := f.Names()[0]
+		config[name] = fmt.Sprint(cliCtx.Value(name))
+		if _, ok := f.(*cli.StringSliceFlag); ok {
+			config[name] = strings.Join(cliCtx.StringSlice(name), ",")
+		}
+	}
+
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(config)) {
+		if slices.Contains(secretFlags, name) {
+			continue
+		}
+		fmt.Fprintf(h, "%s=%q\n", name, config[name])
+	}
+
+	for name, v := range config {
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			config[name] = u.Redacted()
+		}
+		if v != "" && slices.Contains(secretFlags, name) {
+			config[name] = "xxxxx"
+		}
+	}
+	return config, hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// enabledFlags returns the names of the boolean flags that are set.
+func enabledFlags(cliCtx *cli.Context) []string {
+	var enabled []string
+	for _, f := range cliCtx.App.Flags {
+		if _, ok := f.(*cli.BoolFlag); ok && cliCtx.Bool(f.Names()[0]) {
+			enabled = append(enabled, f.Names()[0])
+		}
+	}
+	return enabled
+}
+
+// registerConfigInfo registers the lbac_config_info metric, labelled with the key settings
+// of o, the flags of cliCtx, with reg.
+func registerConfigInfo(cliCtx *cli.Context, o *options, reg prometheus.Registerer) {
+	enforcementMode := "replace"
+	switch {
+	case o.errorOnReplace && len(o.errorOnReplaceEndpoints) == 0:
+		enforcementMode = "error"
+	case len(o.errorOnReplaceEndpoints) > 0:
+		enforcementMode = "error-on-endpoints"
+	}
+	promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lbac_config_info",
+		Help: "Key settings of the effective configuration, set to 1. features lists the boolean flags enabled.",
+	}, []string{"version", "label", "label_source", "lookup_identity", "enforcement_mode", "cache_ttl", "features"}).WithLabelValues(
+		version, o.label, o.labelSource, o.teamsLookupIdentity, enforcementMode, o.teamsCacheTTL.String(), strings.Join(enabledFlags(cliCtx), ","),
+	).Set(1)
+}
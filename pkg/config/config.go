@@ -0,0 +1,99 @@
+// Package config loads the options of the proxy from a YAML file.
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Keys of the Grafana credentials, otherwise only read from the environment.
+const (
+	GrafanaAdminUserKey = "grafana-admin-user"
+	GrafanaAdminPassKey = "grafana-admin-pass"
+)
+
+// Config holds the options read from a configuration file, a YAML mapping of the names of
+// the command-line flags to their values, along with the Grafana credentials.
+type Config struct {
+	// Flags holds the values of the flags by name. A flag taking a list may be given a YAML
+	// sequence, any other flag holds a single value.
+	Flags map[string][]string
+	// GrafanaAdminUser and GrafanaAdminPass, when set, take precedence over
+	// GRAFANA_ADMIN_USER and GRAFANA_ADMIN_PASS.
+	GrafanaAdminUser string
+	GrafanaAdminPass string
+}
+
+// Load reads the Config in the YAML file at path. The values must be scalars or, for the
+// flags taking lists, sequences of scalars. Whether the names are known flags is left to
+// the caller.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid YAML in %s: %w", path, err)
+	}
+
+	c := &Config{Flags: map[string][]string{}}
+	if len(doc.Content) == 0 {
+		// empty file
+		return c, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s:%d: expected a mapping of option names to values", path, root.Line)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+		if seen[key.Value] {
+			return nil, fmt.Errorf("%s:%d: option %q is set more than once", path, key.Line, key.Value)
+		}
+		seen[key.Value] = true
+		values, err := scalars(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: option %q: %w", path, value.Line, key.Value, err)
+		}
+
+		switch key.Value {
+		case GrafanaAdminUserKey, GrafanaAdminPassKey:
+			if len(values) != 1 {
+				return nil, fmt.Errorf("%s:%d: option %q: expected a single value", path, value.Line, key.Value)
+			}
+			if key.Value == GrafanaAdminUserKey {
+				c.GrafanaAdminUser = values[0]
+			} else {
+				c.GrafanaAdminPass = values[0]
+			}
+		default:
+			c.Flags[key.Value] = values
+		}
+	}
+	return c, nil
+}
+
+// scalars returns the values of n, a scalar or a sequence of scalars.
+func scalars(n *yaml.Node) ([]string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return []string{n.Value}, nil
+	case yaml.SequenceNode:
+		values := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("expected a list of scalars")
+			}
+			values = append(values, item.Value)
+		}
+		return values, nil
+	case yaml.AliasNode:
+		return scalars(n.Alias)
+	default:
+		return nil, fmt.Errorf("expected a scalar or a list of scalars")
+	}
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// Reloader reloads a configuration file, applying the changes to the options that can
+// change while running and reporting the changes to the others, which take a restart.
+type Reloader struct {
+	path       string
+	reloadable []string
+	ignored    []string
+	apply      func(*Config) error
+
+	mu sync.Mutex
+	// running holds the values in effect, those loaded at startup but for the reloadable
+	// options applied since
+	running *Config
+}
+
+// NewReloader creates a Reloader of the file at path, from which loaded was loaded at
+// startup. Changes to the reloadable options are passed to apply, which must leave the
+// previous values in effect when it fails. Changes to the ignored options, e.g. as they
+// are set on the command line, are left out.
+func NewReloader(path string, loaded *Config, reloadable, ignored []string, apply func(*Config) error) *Reloader {
+	return &Reloader{
+		path:       path,
+		reloadable: reloadable,
+		ignored:    ignored,
+		apply:      apply,
+		running:    loaded,
+	}
+}
+
+// Reload loads the file again and, when one of the reloadable options changed, passes it
+// to apply. It returns the options whose values differ from those in effect but take a
+// restart to apply. When loading or applying fails, the values in effect are kept.
+func (r *Reloader) Reload() ([]string, error) {
+	cfg, err := Load(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var reload, restart []string
+	for _, name := range r.changed(cfg) {
+		if slices.Contains(r.reloadable, name) {
+			reload = append(reload, name)
+		} else {
+			restart = append(restart, name)
+		}
+	}
+	if len(reload) > 0 {
+		if err := r.apply(cfg); err != nil {
+			return nil, err
+		}
+		running := &Config{
+			Flags:            maps.Clone(r.running.Flags),
+			GrafanaAdminUser: r.running.GrafanaAdminUser,
+			GrafanaAdminPass: r.running.GrafanaAdminPass,
+		}
+		for _, name := range r.reloadable {
+			if values, found := cfg.Flags[name]; found {
+				running.Flags[name] = values
+			} else {
+				delete(running.Flags, name)
+			}
+		}
+		r.running = running
+	}
+	return restart, nil
+}
+
+// changed returns the sorted names of the options whose values in cfg differ from those in
+// effect, but for the ignored ones. r.mu must be held.
+func (r *Reloader) changed(cfg *Config) []string {
+	var changed []string
+	for name := range r.running.Flags {
+		if _, found := cfg.Flags[name]; !found {
+			changed = append(changed, name)
+		}
+	}
+	for name, values := range cfg.Flags {
+		if !slices.Equal(values, r.running.Flags[name]) {
+			changed = append(changed, name)
+		}
+	}
+	if cfg.GrafanaAdminUser != r.running.GrafanaAdminUser {
+		changed = append(changed, GrafanaAdminUserKey)
+	}
+	if cfg.GrafanaAdminPass != r.running.GrafanaAdminPass {
+		changed = append(changed, GrafanaAdminPassKey)
+	}
+	changed = slices.DeleteFunc(changed, func(name string) bool { return slices.Contains(r.ignored, name) })
+	slices.Sort(changed)
+	return changed
+}
+
+// Run reloads the file whenever the process receives SIGHUP, until ctx is done.
+func (r *Reloader) Run(ctx context.Context) error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sig:
+		}
+		restart, err := r.Reload()
+		if err != nil {
+			slog.Error("failed to reload the configuration file, keeping the configuration in effect", "path", r.path, "error", err)
+			continue
+		}
+		for _, name := range restart {
+			slog.Warn("option changed in the configuration file takes a restart to apply", "path", r.path, "option", name)
+		}
+		slog.Info("reloaded the configuration file", "path", r.path)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeConfig writes data to the configuration file at path.
+func writeConfig(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "label: team\ntenant-rate-limit: \"10\"\nupstream: http://prometheus:9090\n")
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var applied []*Config
+	fail := false
+	r := NewReloader(path, loaded, []string{"tenant-rate-limit", "endpoint-rate-limits"}, []string{"upstream"}, func(cfg *Config) error {
+		if fail {
+			return errors.New("invalid")
+		}
+		applied = append(applied, cfg)
+		return nil
+	})
+
+	for _, tc := range []struct {
+		name    string
+		data    string
+		fail    bool
+		applied int
+		restart []string
+		err     bool
+	}{
+		{
+			name: "unchanged",
+			data: "label: team\ntenant-rate-limit: \"10\"\nupstream: http://prometheus:9090\n",
+		},
+		{
+			name:    "reloadable options changed",
+			data:    "label: team\ntenant-rate-limit: \"20\"\nendpoint-rate-limits: /api/v1/query=1\nupstream: http://prometheus:9090\n",
+			applied: 1,
+		},
+		{
+			name:    "options taking a restart changed",
+			data:    "label: tenant\ntenant-rate-limit: \"20\"\nendpoint-rate-limits: /api/v1/query=1\nupstream: http://prometheus:9090\ngrafana-admin-pass: secret\n",
+			applied: 1,
+			restart: []string{GrafanaAdminPassKey, "label"},
+		},
+		{
+			name:    "ignored options changed",
+			data:    "label: team\ntenant-rate-limit: \"20\"\nendpoint-rate-limits: /api/v1/query=1\nupstream: http://thanos:9090\n",
+			applied: 1,
+		},
+		{
+			name:    "both changed",
+			data:    "label: tenant\nupstream: http://prometheus:9090\n",
+			applied: 2,
+			restart: []string{"label"},
+		},
+		{
+			name:    "applying fails",
+			data:    "label: team\ntenant-rate-limit: \"5\"\n",
+			fail:    true,
+			applied: 2,
+			err:     true,
+		},
+		{
+			// the failed change is still pending
+			name:    "applying succeeds again",
+			data:    "label: team\ntenant-rate-limit: \"5\"\n",
+			applied: 3,
+		},
+		{
+			name:    "invalid file",
+			data:    "label: [team\n",
+			applied: 3,
+			err:     true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			writeConfig(t, path, tc.data)
+			fail = tc.fail
+			restart, err := r.Reload()
+			if (err != nil) != tc.err {
+				t.Fatalf("Reload() error = %v, want error %t", err, tc.err)
+			}
+			if !slices.Equal(restart, tc.restart) {
+				t.Errorf("Reload() = %q, want %q", restart, tc.restart)
+			}
+			if len(applied) != tc.applied {
+				t.Errorf("applied %d times, want %d", len(applied), tc.applied)
+			}
+		})
+	}
+	if got := applied[len(applied)-1].Flags["tenant-rate-limit"]; !slices.Equal(got, []string{"5"}) {
+		t.Errorf("tenant-rate-limit applied = %q, want 5", got)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ClientConcurrency bounds the number of requests served at once for a single client IP,
+// answering the requests over Max with 429 so that one client cannot hold every
+// connection of the proxy.
+//
+// The client IP is the address of the peer, unless the peer is one of Trusted: the
+// X-Forwarded-For header is then walked from the right, skipping the trusted proxies, and
+// the first address not trusted is the client.
+type ClientConcurrency struct {
+	Max     int
+	Trusted []netip.Prefix
+	Next    http.Handler
+
+	mu       sync.Mutex
+	inflight map[netip.Addr]int
+	rejected prometheus.Counter
+}
+
+// NewClientConcurrency creates a ClientConcurrency registering its metrics with reg.
+func NewClientConcurrency(max int, trusted []netip.Prefix, next http.Handler, reg prometheus.Registerer) *ClientConcurrency {
+	return &ClientConcurrency{
+		Max:      max,
+		Trusted:  trusted,
+		Next:     next,
+		inflight: map[netip.Addr]int{},
+		rejected: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "lbac_client_concurrency_rejected_requests_total",
+			Help: "Total number of requests rejected as their client IP already had the maximum number of requests in flight.",
+		}),
+	}
+}
+
+func (cc *ClientConcurrency) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client, ok := cc.clientIP(r)
+	if !ok {
+		cc.Next.ServeHTTP(w, r)
+		return
+	}
+	if !cc.acquire(client) {
+		cc.rejected.Inc()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"status":    "error",
+			"errorType": "prom-grafana-lbac",
+			"error":     fmt.Sprintf("too many concurrent requests from %s", client),
+		})
+		return
+	}
+	defer cc.release(client)
+	cc.Next.ServeHTTP(w, r)
+}
+
+func (cc *ClientConcurrency) acquire(client netip.Addr) bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.inflight[client] >= cc.Max {
+		return false
+	}
+	cc.inflight[client]++
+	return true
+}
+
+func (cc *ClientConcurrency) release(client netip.Addr) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.inflight[client]--; cc.inflight[client] <= 0 {
+		delete(cc.inflight, client)
+	}
+}
+
+// clientIP returns the IP of the client of r. It fails only when the peer address cannot
+// be parsed, in which case the request is not limited.
+func (cc *ClientConcurrency) clientIP(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	client := peer.Unmap()
+	if !trustedAddr(cc.Trusted, client) {
+		return client, true
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// a malformed hop was not written by a trusted proxy, stop at the last known one
+			break
+		}
+		client = addr.Unmap()
+		if !trustedAddr(cc.Trusted, client) {
+			break
+		}
+	}
+	return client, true
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClientConcurrency(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	// requests to /block are held until release is closed
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			entered <- struct{}{}
+			<-release
+		}
+	})
+	cc := NewClientConcurrency(2, []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, next, prometheus.NewRegistry())
+
+	request := func(path, remoteAddr, forwardedFor string) *http.Request {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return r
+	}
+
+	// saturate the requests of 10.0.0.1, one of them through a trusted proxy
+	var wg sync.WaitGroup
+	for _, r := range []*http.Request{
+		request("/block", "10.0.0.1:1234", ""),
+		request("/block", "10.1.0.1:1234", "10.0.0.1"),
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+		<-entered
+	}
+
+	for _, tc := range []struct {
+		name   string
+		r      *http.Request
+		status int
+	}{
+		{name: "saturated client", r: request("/", "10.0.0.1:5678", ""), status: http.StatusTooManyRequests},
+		{name: "saturated IPv4-mapped client", r: request("/", "[::ffff:10.0.0.1]:5678", ""), status: http.StatusTooManyRequests},
+		{name: "saturated client through a trusted proxy", r: request("/", "10.1.0.2:5678", "10.0.0.1, 10.1.0.1"), status: http.StatusTooManyRequests},
+		{name: "other client", r: request("/", "10.0.0.2:5678", ""), status: http.StatusOK},
+		{name: "forwarded for the saturated client by an untrusted peer", r: request("/", "10.0.0.3:5678", "10.0.0.1"), status: http.StatusOK},
+		{name: "unparsable peer address", r: request("/", "pipe", ""), status: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			cc.ServeHTTP(w, tc.r)
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d", w.Code, tc.status)
+			}
+			if tc.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After header")
+			}
+		})
+	}
+	if got := testutil.ToFloat64(cc.rejected); got != 3 {
+		t.Errorf("rejected requests = %v, want 3", got)
+	}
+
+	// the client is served again once its requests are over
+	close(release)
+	wg.Wait()
+	w := httptest.NewRecorder()
+	cc.ServeHTTP(w, request("/", "10.0.0.1:5678", ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d after the requests were over, want 200", w.Code)
+	}
+	if len(cc.inflight) != 0 {
+		t.Errorf("requests in flight = %v, want none", cc.inflight)
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// teapot stands for the enforcement the requests not answered by a handler go through.
+var teapot = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusTeapot)
+})
+
+func TestCORS(t *testing.T) {
+	c := CORS{
+		AllowedOrigins: []string{"https://grafana.example.com"},
+		AllowedMethods: []string{"GET", "POST"},
+		AllowedHeaders: []string{"X-Grafana-Id"},
+		Next:           teapot,
+	}
+
+	for _, tc := range []struct {
+		name          string
+		method        string
+		origin        string
+		requestMethod string
+		status        int
+		allowOrigin   string
+		allowMethods  string
+	}{
+		{name: "preflight", method: "OPTIONS", origin: "https://grafana.example.com", requestMethod: "POST", status: http.StatusNoContent, allowOrigin: "https://grafana.example.com", allowMethods: "GET, POST"},
+		{name: "preflight of another origin", method: "OPTIONS", origin: "https://evil.example.com", requestMethod: "POST", status: http.StatusForbidden},
+		{name: "OPTIONS without preflight", method: "OPTIONS", origin: "https://grafana.example.com", status: http.StatusTeapot, allowOrigin: "https://grafana.example.com"},
+		{name: "request of an allowed origin", method: "GET", origin: "https://grafana.example.com", status: http.StatusTeapot, allowOrigin: "https://grafana.example.com"},
+		{name: "request of another origin", method: "GET", origin: "https://evil.example.com", status: http.StatusTeapot},
+		{name: "same origin request", method: "GET", status: http.StatusTeapot},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, "/api/v1/query", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.requestMethod != "" {
+				r.Header.Set("Access-Control-Request-Method", tc.requestMethod)
+			}
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Errorf("status = %d, want %d", w.Code, tc.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tc.allowOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Methods"); got != tc.allowMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", got, tc.allowMethods)
+			}
+		})
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	c := CORS{AllowedOrigins: []string{"*"}, Next: teapot}
+	r := httptest.NewRequest("OPTIONS", "/api/v1/query", nil)
+	r.Header.Set("Origin", "https://grafana.example.com")
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "https://grafana.example.com" {
+		t.Errorf("preflight answered %d with origin %q", w.Code, w.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
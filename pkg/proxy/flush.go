@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Flush streams the responses of range queries and series requests to the client,
+// flushing what was written at most Interval after it was written instead of leaving it
+// in the server buffers until they fill up. injectproxy builds its reverse proxies
+// itself, so their FlushInterval cannot be set.
+//
+// Responses of unknown length are already flushed on every write by the reverse proxy.
+// The upstream request shares the context of the incoming one, so it is cancelled as
+// soon as the client goes away.
+type Flush struct {
+	// Interval is the maximum latency of written bytes. A negative interval flushes after
+	// every write.
+	Interval time.Duration
+	Next     http.Handler
+}
+
+func (f Flush) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch isolatedEndpoint(r.URL.Path) {
+	case "/api/v1/query_range", "/api/v1/series":
+	default:
+		f.Next.ServeHTTP(w, r)
+		return
+	}
+
+	fw := &flushingWriter{ResponseWriter: w, rc: http.NewResponseController(w), interval: f.Interval}
+	defer fw.stop()
+	f.Next.ServeHTTP(fw, r)
+}
+
+// flushingWriter flushes the bytes written to it at most interval after they were written.
+type flushingWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+	done    bool
+}
+
+func (fw *flushingWriter) WriteHeader(code int) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.ResponseWriter.WriteHeader(code)
+}
+
+func (fw *flushingWriter) Write(b []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.ResponseWriter.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if fw.interval < 0 {
+		_ = fw.rc.Flush()
+		return n, nil
+	}
+	if fw.pending {
+		return n, nil
+	}
+	fw.pending = true
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.interval, fw.flush)
+	} else {
+		fw.timer.Reset(fw.interval)
+	}
+	return n, nil
+}
+
+// flush flushes the bytes written since the last flush, unless the handler returned.
+func (fw *flushingWriter) flush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.done || !fw.pending {
+		return
+	}
+	fw.pending = false
+	_ = fw.rc.Flush()
+}
+
+// FlushError serializes the flushes of the reverse proxy with the timed ones.
+func (fw *flushingWriter) FlushError() error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.pending = false
+	return fw.rc.Flush()
+}
+
+// stop cancels any pending flush, the server flushes the rest once the handler returns.
+func (fw *flushingWriter) stop() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.done = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (fw *flushingWriter) Unwrap() http.ResponseWriter {
+	return fw.ResponseWriter
+}
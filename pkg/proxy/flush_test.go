@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFlush(t *testing.T) {
+	for name, interval := range map[string]time.Duration{"interval": 10 * time.Millisecond, "every write": -1} {
+		t.Run(name, func(t *testing.T) {
+			// the handler only writes the rest once the client read the first line, which it
+			// cannot unless it was flushed
+			read := make(chan struct{})
+			s := httptest.NewServer(Flush{Interval: interval, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("first\n"))
+				select {
+				case <-read:
+				case <-time.After(5 * time.Second):
+				}
+				w.Write([]byte("second\n"))
+			})})
+			defer s.Close()
+
+			resp, err := http.Get(s.URL + "/api/v1/query_range?query=up")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			lines := make(chan string)
+			go func() {
+				line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				lines <- line
+			}()
+			select {
+			case line := <-lines:
+				if line != "first\n" {
+					t.Errorf("read %q, want %q", line, "first\n")
+				}
+			case <-time.After(time.Second):
+				t.Error("first line not flushed")
+			}
+			close(read)
+		})
+	}
+}
+
+func TestFlushOtherEndpoints(t *testing.T) {
+	f := Flush{Interval: time.Second, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, wrapped := w.(*flushingWriter); wrapped {
+			w.WriteHeader(http.StatusTeapot)
+		}
+	})}
+	for path, status := range map[string]int{
+		"/api/v1/query_range": http.StatusTeapot,
+		"/api/v1/series":      http.StatusTeapot,
+		"/api/v1/query":       http.StatusOK,
+		"/api/v1/labels":      http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Errorf("%s: status = %d, want %d", path, w.Code, status)
+		}
+	}
+}
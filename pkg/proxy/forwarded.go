@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ForwardedHeaders honors X-Forwarded-Proto and X-Forwarded-Host set by trusted peers,
+// typically a TLS terminating load balancer, and removes them from requests of any other
+// peer so they are neither trusted nor forwarded upstream.
+type ForwardedHeaders struct {
+	// Trusted lists the peers whose forwarded headers are honored.
+	Trusted []netip.Prefix
+	Next    http.Handler
+}
+
+func (f ForwardedHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if trustedPeer(f.Trusted, r.RemoteAddr) {
+		if v := firstValue(r.Header.Get("X-Forwarded-Proto")); v == "http" || v == "https" {
+			scheme = v
+		}
+		if v := firstValue(r.Header.Get("X-Forwarded-Host")); v != "" {
+			host = v
+		}
+	} else {
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+
+	// the scheme and host of incoming requests are otherwise empty, the reverse proxy
+	// replaces them with the upstream ones
+	r.URL.Scheme, r.URL.Host = scheme, host
+	slog.Debug("request received", "method", r.Method, "url", r.URL.String(), "remote", r.RemoteAddr)
+
+	f.Next.ServeHTTP(w, r)
+}
+
+// trustedPeer reports whether the peer at remoteAddr is within one of the trusted prefixes.
+func trustedPeer(trusted []netip.Prefix, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return trustedAddr(trusted, addr)
+}
+
+// trustedAddr reports whether addr is within one of the trusted prefixes.
+func trustedAddr(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstValue returns the first entry of a comma-separated header value, as set by the
+// proxy closest to the client.
+func firstValue(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	return strings.TrimSpace(v)
+}
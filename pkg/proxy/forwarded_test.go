@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for _, tc := range []struct {
+		name   string
+		remote string
+		proto  string
+		host   string
+		url    string
+		header bool
+	}{
+		{name: "trusted peer", remote: "10.1.2.3:1234", proto: "https", host: "lbac.example.com", url: "https://lbac.example.com/api/v1/query", header: true},
+		{name: "closest proxy", remote: "10.1.2.3:1234", proto: "https, http", host: "lbac.example.com, internal", url: "https://lbac.example.com/api/v1/query", header: true},
+		{name: "IPv4-mapped trusted peer", remote: "[::ffff:10.1.2.3]:1234", proto: "https", url: "https://example.com/api/v1/query", header: true},
+		{name: "invalid scheme", remote: "10.1.2.3:1234", proto: "ftp", url: "http://example.com/api/v1/query", header: true},
+		{name: "untrusted peer", remote: "192.168.1.1:1234", proto: "https", host: "lbac.example.com", url: "http://example.com/api/v1/query"},
+		{name: "invalid peer", remote: "unix", proto: "https", url: "http://example.com/api/v1/query"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *http.Request
+			f := ForwardedHeaders{Trusted: trusted, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r })}
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.RemoteAddr = tc.remote
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+			if tc.host != "" {
+				r.Header.Set("X-Forwarded-Host", tc.host)
+			}
+			f.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got.URL.String() != tc.url {
+				t.Errorf("URL = %q, want %q", got.URL, tc.url)
+			}
+			if has := got.Header.Get("X-Forwarded-Proto") != ""; has != tc.header {
+				t.Errorf("X-Forwarded-Proto forwarded: %t, want %t", has, tc.header)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// maxHeldBodySize bounds how much of a held back response is kept to replay it.
+const maxHeldBodySize = 64 << 10
+
+// emptyResults holds, per enforced endpoint, the response a tenant without any data gets.
+var emptyResults = map[string]struct{ contentType, body string }{
+	"/federate":               {"text/plain; version=0.0.4", ""},
+	"/api/v1/query":           {"application/json", `{"status":"success","data":{"resultType":"vector","result":[]}}`},
+	"/api/v1/query_range":     {"application/json", `{"status":"success","data":{"resultType":"matrix","result":[]}}`},
+	"/api/v1/query_exemplars": {"application/json", `{"status":"success","data":[]}`},
+	"/api/v1/series":          {"application/json", `{"status":"success","data":[]}`},
+	"/api/v1/labels":          {"application/json", `{"status":"success","data":[]}`},
+	"/api/v1/label/values":    {"application/json", `{"status":"success","data":[]}`},
+	"/api/v1/rules":           {"application/json", `{"status":"success","data":{"groups":[]}}`},
+	"/api/v1/alerts":          {"application/json", `{"status":"success","data":{"alerts":[]}}`},
+	"/api/v2/silences":        {"application/json", `[]`},
+	"/api/v2/alerts/groups":   {"application/json", `[]`},
+	"/api/v2/alerts":          {"application/json", `[]`},
+}
+
+// NotFoundIsolation answers requests denied because of what the caller may see with the
+// empty result a tenant without any data would get, so probing cannot tell a label value
+// that does not exist from one that belongs to another tenant.
+//
+// Requests to the endpoints in emptyResults answered by the upstream with 404, or with 400
+// because the query selects a label value the caller may not access, are normalized. The
+// responses of the proxy itself pass through, so missing or invalid tokens and callers
+// denied access with 403 are still rejected, as are requests for single silences and any
+// other endpoint.
+type NotFoundIsolation struct {
+	Next http.Handler
+}
+
+func (nfi NotFoundIsolation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	empty, found := emptyResults[isolatedEndpoint(r.URL.Path)]
+	if !found || r.Method == http.MethodOptions {
+		nfi.Next.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, reached := withUpstreamMark(r.Context())
+	hw := &holdingWriter{ResponseWriter: w}
+	nfi.Next.ServeHTTP(hw, r.WithContext(ctx))
+	if !hw.held {
+		return
+	}
+
+	illegalMatcher := hw.status == http.StatusBadRequest && bytes.Contains(hw.body.Bytes(), []byte(injectproxy.ErrIllegalLabelMatcher.Error()))
+	notFound := hw.status == http.StatusNotFound && *reached
+	if !illegalMatcher && !notFound {
+		w.WriteHeader(hw.status)
+		w.Write(hw.body.Bytes())
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Del("X-Content-Type-Options")
+	h.Set("Content-Type", empty.contentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(empty.body))
+	}
+}
+
+// isolatedEndpoint returns the key of path in emptyResults, ignoring any prefix in front
+// of the API path and folding label values endpoints together.
+func isolatedEndpoint(path string) string {
+	for _, root := range []string{"/api/", "/federate"} {
+		if i := strings.Index(path, root); i >= 0 {
+			path = path[i:]
+			break
+		}
+	}
+	if strings.HasPrefix(path, "/api/v1/label/") && strings.HasSuffix(path, "/values") {
+		return "/api/v1/label/values"
+	}
+	return path
+}
+
+// holdingWriter holds back 400 and 404 responses, keeping the beginning of their body, and
+// passes any other response through.
+type holdingWriter struct {
+	http.ResponseWriter
+	status int
+	held   bool
+	body   bytes.Buffer
+}
+
+func (hw *holdingWriter) WriteHeader(code int) {
+	if hw.status != 0 {
+		return
+	}
+	hw.status = code
+	switch code {
+	case http.StatusBadRequest, http.StatusNotFound:
+		hw.held = true
+	default:
+		hw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (hw *holdingWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if hw.held {
+		if hw.body.Len() < maxHeldBodySize {
+			hw.body.Write(b[:min(len(b), maxHeldBodySize-hw.body.Len())])
+		}
+		return len(b), nil
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (hw *holdingWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+func TestNotFoundIsolation(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		status   int
+		body     string
+		upstream bool
+		// wantStatus and wantBody are the response of the client
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "upstream 404", path: "/api/v1/query", status: 404, body: "not found", upstream: true, wantStatus: 200, wantBody: emptyResults["/api/v1/query"].body},
+		{name: "upstream 404 of label values", path: "/api/v1/label/job/values", status: 404, upstream: true, wantStatus: 200, wantBody: emptyResults["/api/v1/label/values"].body},
+		{name: "illegal matcher", path: "/api/v1/series", status: 400, body: injectproxy.ErrIllegalLabelMatcher.Error(), wantStatus: 200, wantBody: emptyResults["/api/v1/series"].body},
+		{name: "other bad request", path: "/api/v1/query", status: 400, body: "bad query", upstream: true, wantStatus: 400, wantBody: "bad query"},
+		{name: "proxy 403", path: "/api/v1/query", status: 403, body: "forbidden", wantStatus: 403, wantBody: "forbidden"},
+		{name: "upstream 403", path: "/api/v1/query", status: 403, body: "forbidden", upstream: true, wantStatus: 403, wantBody: "forbidden"},
+		{name: "proxy 404", path: "/api/v1/query", status: 404, body: "no teams", wantStatus: 404, wantBody: "no teams"},
+		{name: "success", path: "/api/v1/query", status: 200, body: "ok", upstream: true, wantStatus: 200, wantBody: "ok"},
+		{name: "other endpoint", path: "/api/v1/silence/1", status: 404, body: "not found", upstream: true, wantStatus: 404, wantBody: "not found"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nfi := NotFoundIsolation{Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.upstream {
+					markUpstream(r.Context())
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})}
+			w := httptest.NewRecorder()
+			nfi.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+			if w.Code != tc.wantStatus || w.Body.String() != tc.wantBody {
+				t.Errorf("response = %d %q, want %d %q", w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+			}
+		})
+	}
+}
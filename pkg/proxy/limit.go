@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SeriesLimit enforces the limit parameter on the series, label names and label values
+// endpoints before passing requests to Next.
+type SeriesLimit struct {
+	// Default is set as limit when the client did not pass one. Zero leaves it unset.
+	Default int
+	// Max clamps the limit requested by the client, including unlimited requests. Zero
+	// disables clamping.
+	Max int
+	// RejectUnlimited rejects requests explicitly passing limit=0.
+	RejectUnlimited bool
+	Next            http.Handler
+}
+
+func (s SeriesLimit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isMetadataPath(r.URL.Path) {
+		s.Next.ServeHTTP(w, r)
+		return
+	}
+
+	// for POST requests a missing limit is set in the body only
+	q := r.URL.Query()
+	inURL := q.Has("limit")
+	if err := s.enforce(q, r.Method != http.MethodPost); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.URL.RawQuery = q.Encode()
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to parse the form: %v", err), http.StatusBadRequest)
+			return
+		}
+		q = r.PostForm
+		if err := s.enforce(q, !inURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// ParseForm read the whole body, replace it with the rewritten form
+		_ = r.Body.Close()
+		body := q.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+		// let the next handler parse the rewritten body again
+		r.Form, r.PostForm = nil, nil
+	}
+
+	s.Next.ServeHTTP(w, r)
+}
+
+// enforce rewrites the limit parameter in q, setting the default when withDefault is true.
+func (s SeriesLimit) enforce(q url.Values, withDefault bool) error {
+	v := q.Get("limit")
+	if v == "" {
+		if withDefault && s.Default > 0 {
+			q.Set("limit", strconv.Itoa(s.Default))
+		}
+		return nil
+	}
+
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 0 {
+		return fmt.Errorf("invalid limit %q", v)
+	}
+	if limit == 0 && s.RejectUnlimited {
+		return fmt.Errorf("unlimited requests (limit=0) are not allowed")
+	}
+	if s.Max > 0 && (limit == 0 || limit > s.Max) {
+		limit = s.Max
+	}
+	q.Set("limit", strconv.Itoa(limit))
+	return nil
+}
+
+// isMetadataPath reports whether path is one of the endpoints accepting a limit.
+func isMetadataPath(path string) bool {
+	if path == "/api/v1/series" || path == "/api/v1/labels" {
+		return true
+	}
+	name, ok := strings.CutPrefix(path, "/api/v1/label/")
+	return ok && strings.HasSuffix(name, "/values")
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// formHandler answers the query string and the POST form of the requests it receives.
+var formHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.RawQuery
+	r.ParseForm()
+	w.Write([]byte(query + "|" + r.PostForm.Encode()))
+})
+
+func TestSeriesLimit(t *testing.T) {
+	s := SeriesLimit{Default: 100, Max: 1000, Next: formHandler}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		want   string
+	}{
+		{name: "default", method: "GET", target: "/api/v1/series?match[]=up", status: http.StatusOK, want: "limit=100&match%5B%5D=up|"},
+		{name: "within max", method: "GET", target: "/api/v1/labels?limit=10", status: http.StatusOK, want: "limit=10|"},
+		{name: "over max", method: "GET", target: "/api/v1/label/job/values?limit=5000", status: http.StatusOK, want: "limit=1000|"},
+		{name: "unlimited", method: "GET", target: "/api/v1/labels?limit=0", status: http.StatusOK, want: "limit=1000|"},
+		{name: "invalid", method: "GET", target: "/api/v1/labels?limit=-1", status: http.StatusBadRequest},
+		{name: "other endpoint", method: "GET", target: "/api/v1/query?query=up", status: http.StatusOK, want: "query=up|"},
+		{name: "POST default in body", method: "POST", target: "/api/v1/series", body: "match[]=up", status: http.StatusOK, want: "|limit=100&match%5B%5D=up"},
+		{name: "POST over max in body", method: "POST", target: "/api/v1/series", body: "match[]=up&limit=5000", status: http.StatusOK, want: "|limit=1000&match%5B%5D=up"},
+		{name: "POST limit in URL", method: "POST", target: "/api/v1/series?limit=10", body: "match[]=up", status: http.StatusOK, want: "limit=10|match%5B%5D=up"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.method == "POST" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("forwarded %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestSeriesLimitRejectUnlimited(t *testing.T) {
+	s := SeriesLimit{RejectUnlimited: true, Next: formHandler}
+	for target, status := range map[string]int{
+		"/api/v1/labels?limit=0":  http.StatusBadRequest,
+		"/api/v1/labels?limit=10": http.StatusOK,
+		"/api/v1/labels":          http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != status {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, status)
+		}
+	}
+}
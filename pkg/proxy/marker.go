@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EnforcementMarkerHeader is set by Transport, when SetMarker is enabled, on the enforced
+// requests it sends upstream, with the label values enforced serialized with
+// teams.JoinTenants. An instance of the proxy chained behind this one may then skip
+// enforcing them again.
+const EnforcementMarkerHeader = "X-LBAC-Enforced"
+
+// EnforcementMarker handles the EnforcementMarkerHeader of incoming requests. Requests
+// from Trusted peers carrying it were enforced by a proxy in front of this one and are
+// sent to Upstream untouched, provided they are for an enforced API path with a method it
+// accepts. The header is removed from the requests of any other peer, and from requests
+// for any other path or method, which go to Next and are routed as usual, so that clients
+// can neither skip enforcement here nor on the proxies behind this one.
+//
+// The marker alone grants full access to the upstream on the enforced API paths: neither
+// the token of the request nor the label values listed in the marker are checked. It is
+// only as trustworthy as the network path to this proxy: Trusted must only list the
+// proxies in front of it, and these must remove the header from the requests of their own
+// clients, which an EnforcementMarker does.
+type EnforcementMarker struct {
+	Trusted  []netip.Prefix
+	Upstream http.Handler
+	Next     http.Handler
+	// Outcomes, when set, counts the requests sent upstream without enforcement.
+	Outcomes *prometheus.CounterVec
+}
+
+func (em EnforcementMarker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(r.Header.Values(EnforcementMarkerHeader)) == 0 {
+		em.Next.ServeHTTP(w, r)
+		return
+	}
+	if !trustedPeer(em.Trusted, r.RemoteAddr) {
+		slog.Debug("removing enforcement marker of untrusted peer", "remote", r.RemoteAddr)
+		r.Header.Del(EnforcementMarkerHeader)
+		em.Next.ServeHTTP(w, r)
+		return
+	}
+	if !markedMethod(r) {
+		slog.Debug("removing enforcement marker of request not for an enforced endpoint", "method", r.Method, "path", r.URL.Path)
+		r.Header.Del(EnforcementMarkerHeader)
+		em.Next.ServeHTTP(w, r)
+		return
+	}
+
+	slog.Debug("request already enforced upstream of this proxy", "path", r.URL.Path, "tenants", r.Header.Get(EnforcementMarkerHeader))
+	if em.Outcomes != nil {
+		em.Outcomes.WithLabelValues(teams.OutcomeBypassed).Inc()
+	}
+	em.Upstream.ServeHTTP(w, r)
+}
+
+// markedMethod reports whether r is for an enforced API path with a method it accepts,
+// HEAD standing for GET, and so may skip enforcement when marked.
+func markedMethod(r *http.Request) bool {
+	allowed := enforcedMethods(r.URL.Path)
+	return slices.Contains(allowed, r.Method) || r.Method == http.MethodHead && slices.Contains(allowed, http.MethodGet)
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestEnforcementMarker(t *testing.T) {
+	em := EnforcementMarker{
+		Trusted: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		Upstream: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("upstream"))
+		}),
+		Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if v := r.Header.Get(EnforcementMarkerHeader); v != "" {
+				t.Errorf("marker %q handed to Next", v)
+			}
+			w.Write([]byte("next"))
+		}),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		remote string
+		method string
+		path   string
+		marker bool
+		want   string
+	}{
+		{name: "trusted peer", remote: "10.0.0.1:1234", method: "GET", path: "/api/v1/query", marker: true, want: "upstream"},
+		{name: "trusted peer POST", remote: "10.0.0.1:1234", method: "POST", path: "/api/v1/series", marker: true, want: "upstream"},
+		{name: "trusted peer HEAD", remote: "10.0.0.1:1234", method: "HEAD", path: "/api/v1/label/job/values", marker: true, want: "upstream"},
+		{name: "trusted peer without marker", remote: "10.0.0.1:1234", method: "GET", path: "/api/v1/query", want: "next"},
+		{name: "untrusted peer", remote: "192.168.0.1:1234", method: "GET", path: "/api/v1/query", marker: true, want: "next"},
+		{name: "path not enforced", remote: "10.0.0.1:1234", method: "GET", path: "/api/v1/status/config", marker: true, want: "next"},
+		{name: "unknown path", remote: "10.0.0.1:1234", method: "GET", path: "/admin", marker: true, want: "next"},
+		{name: "method not accepted", remote: "10.0.0.1:1234", method: "DELETE", path: "/api/v1/query", marker: true, want: "next"},
+		{name: "OPTIONS", remote: "10.0.0.1:1234", method: "OPTIONS", path: "/api/v1/query", marker: true, want: "next"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			r.RemoteAddr = tc.remote
+			if tc.marker {
+				r.Header.Set(EnforcementMarkerHeader, "team-a")
+			}
+			w := httptest.NewRecorder()
+			em.ServeHTTP(w, r)
+			if got := w.Body.String(); got != tc.want {
+				t.Errorf("request handled by %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
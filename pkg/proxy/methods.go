@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Methods defines the methods accepted by the enforced endpoints before they reach
+// injectproxy, whose method checks only run after the request was authenticated.
+//
+// HEAD requests are enforced like GET requests; the server discards the response body
+// and keeps the headers, including Content-Length. OPTIONS requests are answered with
+// the allowed methods without authentication, CORS preflights are expected to be
+// answered earlier by CORS. Any other method not accepted by an endpoint is answered
+// with 405. Requests for other paths are passed to Next untouched.
+//
+// With Strict, requests are also validated before reaching the enforcement code: request
+// bodies are only accepted in the content type the endpoint parses, anything else is
+// answered with 415, bodies sent with GET, HEAD and DELETE are dropped, and errors are
+// answered in the JSON shape of the Prometheus API.
+type Methods struct {
+	Strict bool
+	Next   http.Handler
+}
+
+func (m Methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	allowed := enforcedMethods(r.URL.Path)
+	if allowed == nil {
+		m.Next.ServeHTTP(w, r)
+		return
+	}
+	if slices.Contains(allowed, http.MethodGet) {
+		allowed = append(allowed, http.MethodHead)
+	}
+	allow := strings.Join(append(allowed, http.MethodOptions), ", ")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.Header().Set("Allow", allow)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead && slices.Contains(allowed, http.MethodHead):
+		r = r.Clone(r.Context())
+		r.Method = http.MethodGet
+		m.Next.ServeHTTP(w, r)
+	case slices.Contains(allowed, r.Method):
+		if m.Strict && !m.validBody(w, r) {
+			return
+		}
+		m.Next.ServeHTTP(w, r)
+	default:
+		w.Header().Set("Allow", allow)
+		m.error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// validBody drops the body of requests whose method carries none and rejects bodies not
+// in the content type the endpoint parses. It reports whether the request may proceed.
+func (m Methods) validBody(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body.Close()
+		}
+		r.Body, r.ContentLength = http.NoBody, 0
+		r.Header.Del("Content-Type")
+		r.Header.Del("Content-Length")
+		return true
+	}
+
+	ct := r.Header.Get("Content-Type")
+	if ct == "" && r.ContentLength == 0 {
+		return true
+	}
+	want := "application/x-www-form-urlencoded"
+	if r.URL.Path == "/api/v2/silences" {
+		want = "application/json"
+	}
+	if mt, _, err := mime.ParseMediaType(ct); err != nil || mt != want {
+		m.error(w, fmt.Sprintf("unsupported content type %q, %s requires %s", ct, r.URL.Path, want), http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+// error answers with msg, in the JSON shape of the Prometheus API with Strict.
+func (m Methods) error(w http.ResponseWriter, msg string, code int) {
+	if !m.Strict {
+		http.Error(w, msg, code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": "prom-grafana-lbac",
+		"error":     msg,
+	})
+}
+
+// enforcedMethods returns the methods injectproxy accepts on path, or nil when path is
+// not an enforced endpoint.
+func enforcedMethods(path string) []string {
+	switch path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars", "/api/v1/series", "/api/v1/labels",
+		"/api/v2/silences":
+		return []string{http.MethodGet, http.MethodPost}
+	case "/federate", "/api/v1/alerts", "/api/v1/rules", "/api/v2/alerts/groups", "/api/v2/alerts":
+		return []string{http.MethodGet}
+	}
+	if strings.HasPrefix(path, "/api/v1/label/") {
+		return []string{http.MethodGet}
+	}
+	if strings.HasPrefix(path, "/api/v2/silence/") {
+		return []string{http.MethodDelete}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// echoHandler answers the method, content type and body of the requests it receives.
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Write([]byte(r.Method + "|" + r.Header.Get("Content-Type") + "|" + string(body)))
+})
+
+func TestMethods(t *testing.T) {
+	const form = "application/x-www-form-urlencoded"
+	for _, tc := range []struct {
+		name        string
+		strict      bool
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		// queries accept GET and POST forms
+		{name: "query GET", method: "GET", path: "/api/v1/query", status: http.StatusOK, want: "GET||"},
+		{name: "query HEAD", method: "HEAD", path: "/api/v1/query", status: http.StatusOK},
+		{name: "query POST form", method: "POST", path: "/api/v1/query", contentType: form, body: "query=up", status: http.StatusOK, want: "POST|" + form + "|query=up"},
+		{name: "query PUT", method: "PUT", path: "/api/v1/query", status: http.StatusMethodNotAllowed},
+		{name: "query OPTIONS", method: "OPTIONS", path: "/api/v1/query", status: http.StatusNoContent},
+		{name: "query_range POST JSON lenient", method: "POST", path: "/api/v1/query_range", contentType: "application/json", body: "{}", status: http.StatusOK, want: "POST|application/json|{}"},
+		{name: "query_range POST JSON strict", strict: true, method: "POST", path: "/api/v1/query_range", contentType: "application/json", body: "{}", status: http.StatusUnsupportedMediaType},
+		{name: "query POST form with charset strict", strict: true, method: "POST", path: "/api/v1/query", contentType: form + "; charset=utf-8", body: "query=up", status: http.StatusOK, want: "POST|" + form + "; charset=utf-8|query=up"},
+		{name: "query POST malformed content type strict", strict: true, method: "POST", path: "/api/v1/query", contentType: "form;;", body: "query=up", status: http.StatusUnsupportedMediaType},
+		{name: "query POST without body strict", strict: true, method: "POST", path: "/api/v1/query", status: http.StatusOK, want: "POST||"},
+		{name: "query POST body without content type strict", strict: true, method: "POST", path: "/api/v1/query", body: "query=up", status: http.StatusUnsupportedMediaType},
+		{name: "query GET body lenient", method: "GET", path: "/api/v1/query", contentType: form, body: "query=up", status: http.StatusOK, want: "GET|" + form + "|query=up"},
+		{name: "query GET body dropped strict", strict: true, method: "GET", path: "/api/v1/query", contentType: form, body: "query=up", status: http.StatusOK, want: "GET||"},
+		{name: "series POST form strict", strict: true, method: "POST", path: "/api/v1/series", contentType: form, body: "match[]=up", status: http.StatusOK, want: "POST|" + form + "|match[]=up"},
+		// labels accept POST forms, label values GET only
+		{name: "labels POST form strict", strict: true, method: "POST", path: "/api/v1/labels", contentType: form, body: "match[]=up", status: http.StatusOK, want: "POST|" + form + "|match[]=up"},
+		{name: "labels POST multipart strict", strict: true, method: "POST", path: "/api/v1/labels", contentType: "multipart/form-data; boundary=x", body: "--x--", status: http.StatusUnsupportedMediaType},
+		{name: "label values GET", method: "GET", path: "/api/v1/label/job/values", status: http.StatusOK, want: "GET||"},
+		{name: "label values POST", method: "POST", path: "/api/v1/label/job/values", contentType: form, status: http.StatusMethodNotAllowed},
+		{name: "federate POST", method: "POST", path: "/federate", contentType: form, status: http.StatusMethodNotAllowed},
+		{name: "rules GET", method: "GET", path: "/api/v1/rules", status: http.StatusOK, want: "GET||"},
+		// silences are created from JSON and deleted by ID
+		{name: "silences POST JSON strict", strict: true, method: "POST", path: "/api/v2/silences", contentType: "application/json", body: "{}", status: http.StatusOK, want: "POST|application/json|{}"},
+		{name: "silences POST form strict", strict: true, method: "POST", path: "/api/v2/silences", contentType: form, body: "a=b", status: http.StatusUnsupportedMediaType},
+		{name: "silence DELETE body dropped strict", strict: true, method: "DELETE", path: "/api/v2/silence/1", contentType: "application/json", body: "{}", status: http.StatusOK, want: "DELETE||"},
+		{name: "silence GET", method: "GET", path: "/api/v2/silence/1", status: http.StatusMethodNotAllowed},
+		// other paths are not validated
+		{name: "other path PUT strict", strict: true, method: "PUT", path: "/api/v1/status/config", contentType: "text/plain", body: "x", status: http.StatusOK, want: "PUT|text/plain|x"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+			Methods{Strict: tc.strict, Next: echoHandler}.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.want != "" && w.Body.String() != tc.want {
+				t.Errorf("forwarded %q, want %q", w.Body, tc.want)
+			}
+			if tc.status == http.StatusMethodNotAllowed || tc.status == http.StatusNoContent {
+				if w.Header().Get("Allow") == "" {
+					t.Error("no Allow header")
+				}
+			}
+		})
+	}
+}
+
+func TestMethodsStrictErrorShape(t *testing.T) {
+	for name, r := range map[string]*http.Request{
+		"method":       httptest.NewRequest("PUT", "/api/v1/query", nil),
+		"content type": httptest.NewRequest("POST", "/api/v1/query", strings.NewReader("{}")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			Methods{Strict: true, Next: echoHandler}.ServeHTTP(w, r)
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var body struct {
+				Status    string `json:"status"`
+				ErrorType string `json:"errorType"`
+				Error     string `json:"error"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != "error" || body.ErrorType == "" || body.Error == "" {
+				t.Errorf("error body = %+v, want the shape of the Prometheus API", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ShadowHeader marks the requests sent to the mirror upstream.
+const ShadowHeader = "X-LBAC-Shadow"
+
+// Mirror sends a sample of the enforced upstream requests to a second upstream, discarding
+// the responses. Mirrored requests never delay nor fail the requests they copy.
+type Mirror struct {
+	upstream  *url.URL
+	percent   float64
+	timeout   time.Duration
+	transport http.RoundTripper
+	// slots bounds the number of mirrored requests in flight
+	slots chan struct{}
+
+	mirrored prometheus.Counter
+	errors   *prometheus.CounterVec
+}
+
+// NewMirror creates a Mirror sending percent of the requests to upstream through transport,
+// with at most concurrency of them in flight, each bounded by timeout.
+func NewMirror(upstream *url.URL, percent float64, timeout time.Duration, concurrency int, transport http.RoundTripper, reg prometheus.Registerer) *Mirror {
+	factory := promauto.With(reg)
+	m := &Mirror{
+		upstream:  upstream,
+		percent:   percent,
+		timeout:   timeout,
+		transport: transport,
+		slots:     make(chan struct{}, concurrency),
+		mirrored: factory.NewCounter(prometheus.CounterOpts{
+			Name: "lbac_mirror_requests_total",
+			Help: "Total number of enforced requests mirrored to the mirror upstream.",
+		}),
+		errors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_mirror_errors_total",
+			Help: "Total number of mirrored requests that failed or were dropped, by reason.",
+		}, []string{"reason"}),
+	}
+	for _, reason := range []string{"dropped", "request", "status"} {
+		m.errors.WithLabelValues(reason)
+	}
+	return m
+}
+
+// send mirrors a sample of the requests, path being the path of req relative to the
+// primary upstream. body is the already read body of req.
+func (m *Mirror) send(req *http.Request, path string, body []byte) {
+	if rand.Float64()*100 >= m.percent {
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.errors.WithLabelValues("dropped").Inc()
+		return
+	}
+
+	u := *m.upstream
+	u.Path = m.upstream.JoinPath(path).Path
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	shadow, err := http.NewRequestWithContext(ctx, req.Method, u.String(), nil)
+	if err != nil {
+		cancel()
+		<-m.slots
+		m.errors.WithLabelValues("request").Inc()
+		return
+	}
+	shadow.Header = req.Header.Clone()
+	shadow.Header.Set(ShadowHeader, "true")
+	if body != nil {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+		shadow.ContentLength = int64(len(body))
+	}
+
+	m.mirrored.Inc()
+	go func() {
+		defer func() { <-m.slots }()
+		defer cancel()
+
+		resp, err := m.transport.RoundTrip(shadow)
+		if err != nil {
+			slog.Debug("mirrored request failed", "url", u.Redacted(), "error", err)
+			m.errors.WithLabelValues("request").Inc()
+			return
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode >= 500 {
+			m.errors.WithLabelValues("status").Inc()
+		}
+	}()
+}
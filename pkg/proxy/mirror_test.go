@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// mirroredRequest is a request received by the mirror upstream.
+type mirroredRequest struct {
+	path   string
+	query  string
+	body   string
+	header http.Header
+}
+
+// mirrorUpstream starts a mirror upstream sending the requests it receives to received,
+// answering them once release is closed.
+func mirrorUpstream(t *testing.T, received chan<- mirroredRequest, release <-chan struct{}) *url.URL {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- mirroredRequest{path: r.URL.Path, query: r.URL.RawQuery, body: string(body), header: r.Header}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// waitFor waits for cond to hold, failing t after 5s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestMirror(t *testing.T) {
+	ctx := enforcedContext(t)
+	received := make(chan mirroredRequest, 1)
+	release := make(chan struct{})
+	defer close(release)
+	m := NewMirror(mirrorUpstream(t, received, release), 100, 100*time.Millisecond, 1, http.DefaultTransport, prometheus.NewRegistry())
+	upstream, _ := url.Parse("http://prometheus:9090/prometheus")
+	next := &recordingTransport{}
+	tr := Transport{
+		Upstream:       upstream,
+		Next:           next,
+		Mirror:         m,
+		AlwaysMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")},
+	}
+
+	// the query as injectproxy enforced it
+	body := url.Values{"query": {`up{team=~"team-a|team-b"}`}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://prometheus:9090/prometheus/api/v1/query?time=1", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	start := time.Now()
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the mirror answers only once released, after the request times out
+	if resp.StatusCode != http.StatusOK || time.Since(start) > 50*time.Millisecond {
+		t.Errorf("primary request answered %d after %v, want 200 without waiting for the mirror", resp.StatusCode, time.Since(start))
+	}
+
+	var shadow mirroredRequest
+	select {
+	case shadow = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+	if shadow.path != "/api/v1/query" || shadow.query != "time=1" {
+		t.Errorf("mirrored %s?%s, want /api/v1/query?time=1", shadow.path, shadow.query)
+	}
+	if shadow.header.Get(ShadowHeader) != "true" {
+		t.Errorf("%s header = %q, want true", ShadowHeader, shadow.header.Get(ShadowHeader))
+	}
+	// the mirror and the primary upstream get the same enforced query
+	form, err := url.ParseQuery(shadow.body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := form.Get("query"); !strings.Contains(q, `team=~"team-a|team-b"`) || !strings.Contains(q, `env="prod"`) {
+		t.Errorf("mirrored query = %q, want the enforced matchers", q)
+	}
+	if shadow.body != next.body {
+		t.Errorf("mirrored body = %q, primary body = %q", shadow.body, next.body)
+	}
+	if next.req.Header.Get(ShadowHeader) != "" {
+		t.Errorf("%s header sent to the primary upstream", ShadowHeader)
+	}
+
+	// the slow mirrored request times out, counted as failed
+	waitFor(t, "the mirrored request to time out", func() bool {
+		return testutil.ToFloat64(m.errors.WithLabelValues("request")) == 1
+	})
+	if got := testutil.ToFloat64(m.mirrored); got != 1 {
+		t.Errorf("mirrored requests = %v, want 1", got)
+	}
+}
+
+func TestMirrorFailures(t *testing.T) {
+	ctx := enforcedContext(t)
+	upstream, _ := url.Parse("http://prometheus:9090")
+
+	t.Run("mirror down", func(t *testing.T) {
+		down := httptest.NewServer(http.NotFoundHandler())
+		mirrorURL, _ := url.Parse(down.URL)
+		down.Close()
+		m := NewMirror(mirrorURL, 100, time.Second, 1, http.DefaultTransport, prometheus.NewRegistry())
+		tr := Transport{Upstream: upstream, Next: &recordingTransport{}, Mirror: m}
+
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://prometheus:9090/api/v1/query?query=up", nil)
+		if resp, err := tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("RoundTrip() = %v, want the primary response", err)
+		}
+		waitFor(t, "the mirrored request to fail", func() bool {
+			return testutil.ToFloat64(m.errors.WithLabelValues("request")) == 1
+		})
+	})
+
+	t.Run("mirror busy", func(t *testing.T) {
+		received := make(chan mirroredRequest, 2)
+		release := make(chan struct{})
+		defer close(release)
+		m := NewMirror(mirrorUpstream(t, received, release), 100, time.Minute, 1, http.DefaultTransport, prometheus.NewRegistry())
+		tr := Transport{Upstream: upstream, Next: &recordingTransport{}, Mirror: m}
+
+		// the second request finds the only slot taken by the first one
+		for range 2 {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://prometheus:9090/api/v1/query?query=up", nil)
+			if resp, err := tr.RoundTrip(req); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("RoundTrip() = %v, want the primary response", err)
+			}
+		}
+		if got := testutil.ToFloat64(m.errors.WithLabelValues("dropped")); got != 1 {
+			t.Errorf("dropped mirrored requests = %v, want 1", got)
+		}
+	})
+
+	t.Run("not enforced", func(t *testing.T) {
+		received := make(chan mirroredRequest, 1)
+		release := make(chan struct{})
+		close(release)
+		m := NewMirror(mirrorUpstream(t, received, release), 100, time.Second, 1, http.DefaultTransport, prometheus.NewRegistry())
+		tr := Transport{Upstream: upstream, Next: &recordingTransport{}, Mirror: m}
+
+		req, _ := http.NewRequest(http.MethodGet, "http://prometheus:9090/api/v1/status/buildinfo", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := testutil.ToFloat64(m.mirrored); got != 0 {
+			t.Errorf("mirrored requests = %v, want 0", got)
+		}
+	})
+}
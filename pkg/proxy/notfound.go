@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// serviceName is the name the landing page gives the proxy.
+const serviceName = "prom-grafana-lbac"
+
+// notFoundBody is what http.NotFound, which injectproxy answers paths and methods it does
+// not serve with, writes.
+const notFoundBody = "404 page not found\n"
+
+// maxUnknownPrefixes bounds the number of prefixes unknown paths are counted by, past
+// which they are counted as "other".
+const maxUnknownPrefixes = 100
+
+var landingPage = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Service}}</title></head>
+<body><h1>{{.Service}}</h1><p>Version {{.Version}}. Label-based access control proxy for the Prometheus API, authenticated with Grafana identity tokens.</p></body>
+</html>
+`))
+
+// UnknownPaths answers requests to paths and methods no route serves with a 404 in the
+// JSON shape of the Prometheus API errors instead of the plain text one of injectproxy,
+// counting them by path prefix. With Landing, GET requests to / are answered with a page,
+// in HTML or JSON depending on the Accept header, naming the service and its version.
+type UnknownPaths struct {
+	Landing bool
+	Version string
+	Next    http.Handler
+
+	hits     *prometheus.CounterVec
+	mu       sync.Mutex
+	prefixes map[string]struct{}
+}
+
+// NewUnknownPaths creates an UnknownPaths registering its metrics with reg.
+func NewUnknownPaths(landing bool, version string, next http.Handler, reg prometheus.Registerer) *UnknownPaths {
+	return &UnknownPaths{
+		Landing: landing,
+		Version: version,
+		Next:    next,
+		hits: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_unknown_path_requests_total",
+			Help: "Total number of requests to paths or with methods no route serves, by path prefix.",
+		}, []string{"prefix"}),
+		prefixes: map[string]struct{}{},
+	}
+}
+
+func (up *UnknownPaths) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if up.Landing && r.URL.Path == "/" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		up.serveLanding(w, r)
+		return
+	}
+
+	reached := new(bool)
+	nw := &notFoundWriter{ResponseWriter: w}
+	up.Next.ServeHTTP(nw, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, reached)))
+	if !nw.held {
+		return
+	}
+	if *reached || nw.body.String() != notFoundBody {
+		w.WriteHeader(nw.status)
+		w.Write(nw.body.Bytes())
+		return
+	}
+
+	up.hits.WithLabelValues(up.prefix(r.URL.Path)).Inc()
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"errorType": "not_found",
+		"error":     fmt.Sprintf("%s %s is not served by %s", r.Method, r.URL.Path, serviceName),
+	})
+}
+
+func (up *UnknownPaths) serveLanding(w http.ResponseWriter, r *http.Request) {
+	page := struct {
+		Service string `json:"service"`
+		Version string `json:"version"`
+	}{serviceName, up.Version}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		landingPage.Execute(w, page)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// prefix returns the prefix path is counted by: its first segment, or its first two for
+// /api/<version>, so clients sending requests under a wrong base URL stand out.
+func (up *UnknownPaths) prefix(path string) string {
+	segments := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 3)
+	prefix := "/" + segments[0]
+	if segments[0] == "api" && len(segments) > 1 {
+		prefix += "/" + segments[1]
+	}
+
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	if _, found := up.prefixes[prefix]; !found {
+		if len(up.prefixes) >= maxUnknownPrefixes {
+			return "other"
+		}
+		up.prefixes[prefix] = struct{}{}
+	}
+	return prefix
+}
+
+// notFoundWriter holds back plain text 404 responses, keeping the beginning of their
+// body, and passes any other response through.
+type notFoundWriter struct {
+	http.ResponseWriter
+	status int
+	held   bool
+	body   bytes.Buffer
+}
+
+func (nw *notFoundWriter) WriteHeader(code int) {
+	if nw.status != 0 {
+		return
+	}
+	nw.status = code
+	if code == http.StatusNotFound && strings.HasPrefix(nw.Header().Get("Content-Type"), "text/plain") {
+		nw.held = true
+		return
+	}
+	nw.ResponseWriter.WriteHeader(code)
+}
+
+func (nw *notFoundWriter) Write(b []byte) (int, error) {
+	if nw.status == 0 {
+		nw.WriteHeader(http.StatusOK)
+	}
+	if nw.held {
+		if nw.body.Len() < maxHeldBodySize {
+			nw.body.Write(b[:min(len(b), maxHeldBodySize-nw.body.Len())])
+		}
+		return len(b), nil
+	}
+	return nw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (nw *notFoundWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
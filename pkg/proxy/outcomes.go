@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// OutcomeInjected is recorded when the enforced matcher was added to selectors without one.
+	OutcomeInjected = "injected"
+	// OutcomeReplaced is recorded when selectors already matching on the label were rewritten.
+	OutcomeReplaced = "replaced"
+	// OutcomeRejected is recorded when a conflicting matcher was rejected by error-on-replace.
+	OutcomeRejected = "rejected"
+
+	// maxErrorBodySize bounds how much of an error response is kept to classify it.
+	maxErrorBodySize = 1024
+)
+
+type upstreamKey struct{}
+
+// withUpstreamMark returns ctx recording whether the request is sent upstream through a
+// Transport, along with the flag set once it is. The flag of ctx is reused when it already
+// records it, so that every handler in the chain sees the request reach the upstream.
+func withUpstreamMark(ctx context.Context) (context.Context, *bool) {
+	if reached, ok := ctx.Value(upstreamKey{}).(*bool); ok {
+		return ctx, reached
+	}
+	reached := new(bool)
+	return context.WithValue(ctx, upstreamKey{}, reached), reached
+}
+
+// markUpstream records on the request context that the request was sent upstream.
+func markUpstream(ctx context.Context) {
+	if reached, ok := ctx.Value(upstreamKey{}).(*bool); ok {
+		*reached = true
+	}
+}
+
+// EnforcementOutcomes counts how the label was enforced on the query and matcher endpoints.
+type EnforcementOutcomes struct {
+	outcomes *prometheus.CounterVec
+}
+
+// NewEnforcementOutcomes creates EnforcementOutcomes and registers its metric with reg.
+func NewEnforcementOutcomes(reg prometheus.Registerer) *EnforcementOutcomes {
+	return &EnforcementOutcomes{
+		outcomes: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_enforcement_outcomes_total",
+			Help: "Total number of enforced requests by outcome and endpoint.",
+		}, []string{"outcome", "endpoint"}),
+	}
+}
+
+// Instrument wraps the injectproxy routes enforcing label. Requests that reach the upstream
+// are classified by inspecting the original selectors; rejections are recognized from the
+// error injectproxy answers with.
+//
+// The upstream requests must go through a Transport for outcomes to be recorded.
+func (e *EnforcementOutcomes) Instrument(label string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint, param := enforcedEndpoint(r.URL.Path)
+		if endpoint == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		values, err := requestValues(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx, reached := withUpstreamMark(r.Context())
+		cw := &capturingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+
+		switch {
+		case *reached && selectsLabel(values[param], param == "query", label):
+			e.outcomes.WithLabelValues(OutcomeReplaced, endpoint).Inc()
+		case *reached:
+			e.outcomes.WithLabelValues(OutcomeInjected, endpoint).Inc()
+		case cw.status == http.StatusBadRequest && bytes.Contains(cw.body.Bytes(), []byte(injectproxy.ErrIllegalLabelMatcher.Error())):
+			e.outcomes.WithLabelValues(OutcomeRejected, endpoint).Inc()
+		}
+	})
+}
+
+// enforcedEndpoint returns the endpoint name used in metrics for path and the parameter
+// carrying its selectors. It returns an empty name for endpoints that are not enforced
+// by rewriting selectors.
+func enforcedEndpoint(path string) (string, string) {
+	switch path {
+	case "/api/v1/query", "/api/v1/query_range", "/api/v1/query_exemplars":
+		return strings.TrimPrefix(path, "/api/v1/"), "query"
+	case "/api/v1/series", "/api/v1/labels":
+		return strings.TrimPrefix(path, "/api/v1/"), "match[]"
+	}
+	if isMetadataPath(path) {
+		return "label_values", "match[]"
+	}
+	return "", ""
+}
+
+// selectsLabel reports whether any selector in exprs already has a matcher on label.
+// exprs are parsed as PromQL expressions when query is true and as series selectors
+// otherwise. Unparseable expressions are ignored.
+func selectsLabel(exprs []string, query bool, label string) bool {
+	hasLabel := func(ms []*labels.Matcher) bool {
+		for _, m := range ms {
+			if m.Name == label {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, s := range exprs {
+		if !query {
+			if ms, err := parser.ParseMetricSelector(s); err == nil && hasLabel(ms) {
+				return true
+			}
+			continue
+		}
+
+		expr, err := parser.ParseExpr(s)
+		if err != nil {
+			continue
+		}
+		found := false
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok && hasLabel(vs.LabelMatchers) {
+				found = true
+			}
+			return nil
+		})
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// capturingWriter records the status code and the beginning of error responses.
+type capturingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (cw *capturingWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *capturingWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.status >= 400 && cw.body.Len() < maxErrorBodySize {
+		cw.body.Write(b[:min(len(b), maxErrorBodySize-cw.body.Len())])
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *capturingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// upstreamHandler marks the requests it receives as sent upstream.
+var upstreamHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	markUpstream(r.Context())
+})
+
+// rejectingHandler answers the error injectproxy answers conflicting matchers with.
+var rejectingHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, injectproxy.ErrIllegalLabelMatcher.Error(), http.StatusBadRequest)
+})
+
+func TestEnforcementOutcomes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		next     http.Handler
+		target   string
+		outcome  string
+		endpoint string
+	}{
+		{name: "injected", next: upstreamHandler, target: "/api/v1/query?query=" + url.QueryEscape(`up`), outcome: OutcomeInjected, endpoint: "query"},
+		{name: "replaced", next: upstreamHandler, target: "/api/v1/query_range?query=" + url.QueryEscape(`sum(up{team="a"})`), outcome: OutcomeReplaced, endpoint: "query_range"},
+		{name: "replaced selector", next: upstreamHandler, target: "/api/v1/series?match[]=" + url.QueryEscape(`{team="a"}`), outcome: OutcomeReplaced, endpoint: "series"},
+		{name: "label values", next: upstreamHandler, target: "/api/v1/label/job/values", outcome: OutcomeInjected, endpoint: "label_values"},
+		{name: "rejected", next: rejectingHandler, target: "/api/v1/query?query=" + url.QueryEscape(`up{team="a"}`), outcome: OutcomeRejected, endpoint: "query"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := NewEnforcementOutcomes(prometheus.NewRegistry())
+			e.Instrument("team", tc.next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tc.target, nil))
+			if got := testutil.ToFloat64(e.outcomes.WithLabelValues(tc.outcome, tc.endpoint)); got != 1 {
+				t.Errorf("%s requests to %s = %v, want 1", tc.outcome, tc.endpoint, got)
+			}
+			if n := testutil.CollectAndCount(e.outcomes); n != 1 {
+				t.Errorf("%d outcomes recorded, want 1", n)
+			}
+		})
+	}
+}
+
+func TestEnforcementOutcomesIgnoresOtherPaths(t *testing.T) {
+	e := NewEnforcementOutcomes(prometheus.NewRegistry())
+	e.Instrument("team", upstreamHandler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/rules", nil))
+	if n := testutil.CollectAndCount(e.outcomes); n != 0 {
+		t.Errorf("%d outcomes recorded, want 0", n)
+	}
+}
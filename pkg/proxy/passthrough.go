@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnforcedPaths are the paths injectproxy enforces, the label APIs included whether or
+// not they are enabled: a passthrough path cannot expose them when they are disabled.
+var EnforcedPaths = []string{
+	"/federate",
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/label",
+	"/api/v1/alerts",
+	"/api/v1/rules",
+	"/api/v2/silences",
+	"/api/v2/silence",
+	"/api/v2/alerts",
+}
+
+// ValidatePassthroughPaths checks none of the unsafe passthrough paths overlaps one of
+// enforced: neither equal to it, nor below it, nor above it. injectproxy only rejects the
+// paths below the paths it enforces, and a path above them would pass through the
+// enforced APIs it does not serve, e.g. the label APIs while they are disabled. Paths the
+// routes in front of injectproxy enforce would instead never reach the passthrough.
+func ValidatePassthroughPaths(paths, enforced []string) error {
+	for _, p := range paths {
+		p = strings.TrimSuffix(p, "/")
+		for _, e := range enforced {
+			if p == e || strings.HasPrefix(p, e+"/") || strings.HasPrefix(e, p+"/") {
+				return fmt.Errorf("passthrough path %q overlaps the enforced path %s", p, e)
+			}
+		}
+	}
+	return nil
+}
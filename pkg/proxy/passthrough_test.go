@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestValidatePassthroughPaths(t *testing.T) {
+	enforced := append(slices.Clone(EnforcedPaths), "/prometheus/config/v1/rules")
+	for _, tc := range []struct {
+		path  string
+		valid bool
+	}{
+		{path: "/api/v1/status/config", valid: true},
+		{path: "/api/v1/query_log", valid: true},
+		{path: "/-/healthy", valid: true},
+		{path: "/api/v1/query", valid: false},
+		{path: "/api/v1/query/", valid: false},
+		{path: "/api/v1/labels", valid: false},
+		{path: "/api/v1/label/job/values", valid: false},
+		{path: "/api/v2/silence/1", valid: false},
+		{path: "/api", valid: false},
+		{path: "/api/v1", valid: false},
+		{path: "/prometheus", valid: false},
+		{path: "/prometheus/config/v1/rules/ns", valid: false},
+	} {
+		if err := ValidatePassthroughPaths([]string{"/-/ready", tc.path}, enforced); (err == nil) != tc.valid {
+			t.Errorf("ValidatePassthroughPaths(%q) = %v, want valid %t", tc.path, err, tc.valid)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxProbeBackoff bounds how far the probe interval grows while the upstream is down.
+const maxProbeBackoff = 5 * time.Minute
+
+// probeKey marks the requests sent by the Prober.
+type probeKey struct{}
+
+// Prober periodically checks the health endpoint of the upstream.
+type Prober struct {
+	url      string
+	client   *http.Client
+	interval time.Duration
+
+	up      prometheus.Gauge
+	latency prometheus.Gauge
+
+	mu   sync.Mutex
+	last error
+}
+
+// NewProber creates a Prober checking path on upstream every interval through transport,
+// registering its metrics with reg.
+func NewProber(upstream *url.URL, path string, interval time.Duration, transport http.RoundTripper, reg prometheus.Registerer) *Prober {
+	factory := promauto.With(reg)
+	return &Prober{
+		url:      upstream.JoinPath(path).String(),
+		client:   &http.Client{Transport: transport, Timeout: interval},
+		interval: interval,
+		up: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "lbac_upstream_up",
+			Help: "Whether the last probe of the upstream health endpoint succeeded.",
+		}),
+		latency: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "lbac_upstream_probe_duration_seconds",
+			Help: "Duration of the last probe of the upstream health endpoint.",
+		}),
+		last: errors.New("upstream has not been probed yet"),
+	}
+}
+
+// Run probes the upstream until ctx is done. While the upstream is down the interval
+// doubles up to maxProbeBackoff.
+func (p *Prober) Run(ctx context.Context) error {
+	wait := p.interval
+	for {
+		if err := p.probe(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Warn("upstream probe failed", "url", p.url, "error", err)
+			wait = min(wait*2, max(maxProbeBackoff, p.interval))
+		} else {
+			wait = p.interval
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Ready returns the error of the last probe.
+func (p *Prober) Ready() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last
+}
+
+func (p *Prober) probe(ctx context.Context) (err error) {
+	defer func() {
+		p.mu.Lock()
+		p.last = err
+		p.mu.Unlock()
+		if err != nil {
+			p.up.Set(0)
+		} else {
+			p.up.Set(1)
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, probeKey{}, true), http.MethodGet, p.url, nil)
+	if err != nil {
+		return fmt.Errorf("create request failed: %w", err)
+	}
+
+	start := time.Now()
+	r, err := p.client.Do(req)
+	p.latency.Set(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexepected status: %d", r.StatusCode)
+	}
+	return nil
+}
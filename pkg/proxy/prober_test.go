@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProber(t *testing.T) {
+	var healthy atomic.Bool
+	var paths atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path)
+		if !healthy.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+	upstream, _ := url.Parse(s.URL + "/prometheus")
+
+	p := NewProber(upstream, "/-/ready", 10*time.Millisecond, http.DefaultTransport, prometheus.NewRegistry())
+	if p.Ready() == nil {
+		t.Fatal("Ready() = nil before the first probe")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	ready := func(want bool) {
+		t.Helper()
+		waitFor(t, "the readiness to change", func() bool { return (p.Ready() == nil) == want })
+		up := 0.0
+		if want {
+			up = 1
+		}
+		if got := testutil.ToFloat64(p.up); got != up {
+			t.Errorf("lbac_upstream_up = %v, want %v", got, up)
+		}
+	}
+
+	// the upstream flips between unhealthy and healthy
+	ready(false)
+	healthy.Store(true)
+	ready(true)
+	healthy.Store(false)
+	ready(false)
+	healthy.Store(true)
+	ready(true)
+
+	if got := paths.Load(); got != "/prometheus/-/ready" {
+		t.Errorf("probed %v, want /prometheus/-/ready", got)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run() did not return once the context was done")
+	}
+}
+
+func TestProberUpstreamDown(t *testing.T) {
+	s := httptest.NewServer(http.NotFoundHandler())
+	upstream, _ := url.Parse(s.URL)
+	s.Close()
+
+	p := NewProber(upstream, "/-/ready", time.Second, http.DefaultTransport, prometheus.NewRegistry())
+	if err := p.probe(context.Background()); err == nil {
+		t.Fatal("probe() = nil, want an error")
+	}
+	if p.Ready() == nil {
+		t.Error("Ready() = nil with the upstream down")
+	}
+	if got := testutil.ToFloat64(p.up); got != 0 {
+		t.Errorf("lbac_upstream_up = %v, want 0", got)
+	}
+}
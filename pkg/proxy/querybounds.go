@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// QueryRangeBounds rejects range queries wider than MaxRange or with a step finer than
+// MinStep before passing requests to Next.
+type QueryRangeBounds struct {
+	// MaxRange bounds end - start. Zero leaves the range unbounded.
+	MaxRange time.Duration
+	// MinStep is the finest step accepted. Zero accepts any step.
+	MinStep time.Duration
+	Next    http.Handler
+}
+
+func (b QueryRangeBounds) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/query_range" {
+		b.Next.ServeHTTP(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("failed to parse the form: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := b.check(r.Form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		// ParseForm read the whole body, restore it for the next handler
+		body := r.PostForm.Encode()
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	r.Form, r.PostForm = nil, nil
+
+	b.Next.ServeHTTP(w, r)
+}
+
+// check validates the start, end and step parameters in q. Malformed parameters are left
+// for the upstream to report.
+func (b QueryRangeBounds) check(q url.Values) error {
+	if b.MaxRange > 0 {
+		start, serr := parseTime(q.Get("start"))
+		end, eerr := parseTime(q.Get("end"))
+		if serr == nil && eerr == nil && end.Sub(start) > b.MaxRange {
+			return fmt.Errorf("query range %s exceeds the maximum of %s", end.Sub(start), b.MaxRange)
+		}
+	}
+
+	if b.MinStep > 0 {
+		step, err := parseDuration(q.Get("step"))
+		if err == nil && step < b.MinStep {
+			return fmt.Errorf("query step %s is finer than the minimum of %s", step, b.MinStep)
+		}
+	}
+	return nil
+}
+
+// parseTime parses a Prometheus API timestamp, either RFC 3339 or a unix timestamp in
+// seconds.
+func parseTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+		}
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseDuration parses a Prometheus API duration, either a number of seconds or a
+// duration like 15s.
+func parseDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(d) || math.IsInf(d, 0) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	return time.Duration(d), err
+}
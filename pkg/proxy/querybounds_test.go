@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryRangeBounds(t *testing.T) {
+	b := QueryRangeBounds{MaxRange: 24 * time.Hour, MinStep: 15 * time.Second, Next: formHandler}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		want   string
+	}{
+		{name: "within bounds", method: "GET", target: "/api/v1/query_range?query=up&start=0&end=3600&step=15", status: http.StatusOK, want: "query=up&start=0&end=3600&step=15|"},
+		{name: "range too wide", method: "GET", target: "/api/v1/query_range?query=up&start=0&end=172800&step=60", status: http.StatusBadRequest},
+		{name: "RFC 3339 range too wide", method: "GET", target: "/api/v1/query_range?query=up&start=2024-01-01T00:00:00Z&end=2024-01-03T00:00:00Z&step=60s", status: http.StatusBadRequest},
+		{name: "step too fine", method: "GET", target: "/api/v1/query_range?query=up&start=0&end=3600&step=1", status: http.StatusBadRequest},
+		{name: "duration step too fine", method: "GET", target: "/api/v1/query_range?query=up&start=0&end=3600&step=500ms", status: http.StatusBadRequest},
+		{name: "malformed parameters left upstream", method: "GET", target: "/api/v1/query_range?query=up&start=now&end=3600&step=x", status: http.StatusOK, want: "query=up&start=now&end=3600&step=x|"},
+		{name: "other endpoint", method: "GET", target: "/api/v1/query?query=up&step=1", status: http.StatusOK, want: "query=up&step=1|"},
+		{name: "POST within bounds", method: "POST", target: "/api/v1/query_range", body: "query=up&start=0&end=3600&step=15", status: http.StatusOK, want: "|end=3600&query=up&start=0&step=15"},
+		{name: "POST range too wide", method: "POST", target: "/api/v1/query_range", body: "query=up&start=0&end=172800&step=60", status: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.method == "POST" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			w := httptest.NewRecorder()
+			b.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("forwarded %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// EndpointLimit limits the rate of the requests to the endpoints matching Pattern.
+type EndpointLimit struct {
+	// Pattern is matched against the API path with path.Match, e.g. /api/v1/label/*/values.
+	Pattern string
+	// Rate is the number of requests per second.
+	Rate  float64
+	Burst int
+}
+
+// ParseEndpointLimit parses a limit formatted as <pattern>=<requests per second>[:<burst>].
+// The burst defaults to the rate, rounded up.
+func ParseEndpointLimit(s string) (EndpointLimit, error) {
+	pattern, spec, found := strings.Cut(strings.TrimSpace(s), "=")
+	if !found || !strings.HasPrefix(pattern, "/") {
+		return EndpointLimit{}, fmt.Errorf("expected <path pattern>=<requests per second>[:<burst>]")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return EndpointLimit{}, fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+	}
+
+	rate, burst, err := parseRate(spec)
+	if err != nil {
+		return EndpointLimit{}, err
+	}
+	return EndpointLimit{Pattern: pattern, Rate: rate, Burst: burst}, nil
+}
+
+// parseRate parses a <requests per second>[:<burst>] rate, the burst defaulting to the
+// rate, rounded up.
+func parseRate(spec string) (float64, int, error) {
+	r, b, hasBurst := strings.Cut(spec, ":")
+	rate, err := strconv.ParseFloat(r, 64)
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return 0, 0, fmt.Errorf("invalid rate %q", r)
+	}
+	burst := int(math.Ceil(rate))
+	if hasBurst {
+		if burst, err = strconv.Atoi(b); err != nil || burst <= 0 {
+			return 0, 0, fmt.Errorf("invalid burst %q", b)
+		}
+	}
+	return rate, burst, nil
+}
+
+// TenantLimit limits the rate of the requests of a tenant.
+type TenantLimit struct {
+	// Rate is the number of requests per second.
+	Rate  float64
+	Burst int
+}
+
+// ParseTenantLimit parses a limit formatted as <requests per second>[:<burst>]. The burst
+// defaults to the rate, rounded up.
+func ParseTenantLimit(s string) (TenantLimit, error) {
+	rate, burst, err := parseRate(strings.TrimSpace(s))
+	if err != nil {
+		return TenantLimit{}, err
+	}
+	return TenantLimit{Rate: rate, Burst: burst}, nil
+}
+
+// ParseTenantLimitOverrides parses a comma-separated list of <tenant>=<requests per
+// second>[:<burst>] limits.
+func ParseTenantLimitOverrides(s string) (map[string]TenantLimit, error) {
+	overrides := map[string]TenantLimit{}
+	for _, entry := range strings.Split(s, ",") {
+		tenant, spec, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || tenant == "" {
+			return nil, fmt.Errorf("invalid entry %q, expected <tenant>=<requests per second>[:<burst>]", entry)
+		}
+		limit, err := ParseTenantLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", entry, err)
+		}
+		overrides[tenant] = limit
+	}
+	return overrides, nil
+}
+
+// RateLimits are the limits applied by an EndpointRateLimiter.
+type RateLimits struct {
+	// Endpoints limit the requests of each tenant, the set of label values enforced on them,
+	// to the endpoints matching their pattern. The first matching one applies.
+	Endpoints []EndpointLimit
+	// Tenant, when set, limits the requests of each label value across all endpoints. A
+	// request enforcing several label values counts against the limit of each of them, so
+	// a tenant is limited however its values are combined.
+	Tenant *TenantLimit
+	// TenantOverrides replace Tenant for the label values listed.
+	TenantOverrides map[string]TenantLimit
+}
+
+// tenantLimit returns the limit of the label value tenant, or nil when it has none.
+func (rl RateLimits) tenantLimit(tenant string) *TenantLimit {
+	if limit, found := rl.TenantOverrides[tenant]; found {
+		return &limit
+	}
+	return rl.Tenant
+}
+
+// EndpointRateLimiter limits the rate of the enforced requests sent upstream with token
+// buckets, kept for each tenant and endpoint pattern of the RateLimits.Endpoints and for
+// each label value with a tenant limit. A request takes a token from each of the buckets
+// applying to it, or none of them when one is empty.
+type EndpointRateLimiter struct {
+	mu        sync.Mutex
+	limits    RateLimits
+	buckets   map[bucketKey]*bucket
+	lastPrune time.Time
+	limited   *prometheus.CounterVec
+	// tenantLimited counts the requests over the limit of one of their label values
+	tenantLimited prometheus.Counter
+}
+
+// bucketKey identifies a token bucket. The buckets of the tenant limits have no pattern.
+type bucketKey struct {
+	tenant  string
+	pattern string
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	last    time.Time
+}
+
+// NewEndpointRateLimiter creates an EndpointRateLimiter applying limits, registering its
+// metrics with reg.
+func NewEndpointRateLimiter(limits RateLimits, reg prometheus.Registerer) *EndpointRateLimiter {
+	factory := promauto.With(reg)
+	l := &EndpointRateLimiter{
+		limits:    limits,
+		buckets:   map[bucketKey]*bucket{},
+		lastPrune: time.Now(),
+		limited: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_endpoint_rate_limited_requests_total",
+			Help: "Total number of enforced requests rejected by the rate limit of their endpoint, by endpoint pattern.",
+		}, []string{"pattern"}),
+		tenantLimited: factory.NewCounter(prometheus.CounterOpts{
+			Name: "lbac_tenant_rate_limited_requests_total",
+			Help: "Total number of enforced requests rejected by the rate limit of their tenants.",
+		}),
+	}
+	for _, limit := range limits.Endpoints {
+		l.limited.WithLabelValues(limit.Pattern)
+	}
+	return l
+}
+
+// SetLimits replaces the limits applied by l. The buckets are dropped, so that every
+// tenant starts over with a full bucket of its new limits.
+func (l *EndpointRateLimiter) SetLimits(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+	l.buckets = map[bucketKey]*bucket{}
+	for _, limit := range limits.Endpoints {
+		l.limited.WithLabelValues(limit.Pattern)
+	}
+}
+
+// reserve takes a token from each of the buckets applying to a request for the endpoint at
+// apiPath enforcing tenants. When one of them is empty, it takes none and returns false
+// along with a description of the limit exceeded and the time until its bucket holds a
+// token.
+func (l *EndpointRateLimiter) reserve(tenants []string, apiPath string) (string, time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	var reservations []*rate.Reservation
+	// take reserves a token from the bucket of key, created with limit
+	take := func(key bucketKey, limit TenantLimit) (time.Duration, bool) {
+		b, found := l.buckets[key]
+		if !found {
+			b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+			l.buckets[key] = b
+		}
+		b.last = now
+		r := b.limiter.ReserveN(now, 1)
+		if d := r.DelayFrom(now); d > 0 {
+			r.CancelAt(now)
+			for _, r := range reservations {
+				r.CancelAt(now)
+			}
+			return d, false
+		}
+		reservations = append(reservations, r)
+		return 0, true
+	}
+
+	for _, limit := range l.limits.Endpoints {
+		if ok, _ := path.Match(limit.Pattern, apiPath); !ok {
+			continue
+		}
+		// label values hold no control characters, so they are joined unambiguously
+		key := bucketKey{tenant: strings.Join(tenants, "\n"), pattern: limit.Pattern}
+		if d, ok := take(key, TenantLimit{Rate: limit.Rate, Burst: limit.Burst}); !ok {
+			l.limited.WithLabelValues(limit.Pattern).Inc()
+			return limit.Pattern, d, false
+		}
+		break
+	}
+	for _, tenant := range tenants {
+		limit := l.limits.tenantLimit(tenant)
+		if limit == nil {
+			continue
+		}
+		if d, ok := take(bucketKey{tenant: tenant}, *limit); !ok {
+			l.tenantLimited.Inc()
+			return fmt.Sprintf("tenant %q", tenant), d, false
+		}
+	}
+	return "", 0, true
+}
+
+// prune drops, at most once a minute, the buckets idle for long enough to be full again,
+// as they do not differ from new ones. l.mu must be held.
+func (l *EndpointRateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for k, b := range l.buckets {
+		refill := time.Duration(float64(b.limiter.Burst()) / float64(b.limiter.Limit()) * float64(time.Second))
+		if now.Sub(b.last) > refill {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// tooManyRequests builds the 429 response answering req in place of the upstream, limited
+// naming the rate limit exceeded.
+func tooManyRequests(req *http.Request, retryAfter time.Duration, limited string) *http.Response {
+	body, _ := json.Marshal(map[string]string{
+		"status":    "error",
+		"errorType": "prom-grafana-lbac",
+		"error":     fmt.Sprintf("rate limit of %s exceeded", limited),
+	})
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests)),
+		StatusCode:    http.StatusTooManyRequests,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseEndpointLimit(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want EndpointLimit
+		err  bool
+	}{
+		{spec: "/api/v1/query_range=1:5", want: EndpointLimit{Pattern: "/api/v1/query_range", Rate: 1, Burst: 5}},
+		{spec: "/api/v1/label/*/values=2.5", want: EndpointLimit{Pattern: "/api/v1/label/*/values", Rate: 2.5, Burst: 3}},
+		{spec: "api/v1/query=1", err: true},
+		{spec: "/api/v1/query", err: true},
+		{spec: "/api/v1/[=1", err: true},
+		{spec: "/api/v1/query=0", err: true},
+		{spec: "/api/v1/query=1:0", err: true},
+	} {
+		got, err := ParseEndpointLimit(tc.spec)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("ParseEndpointLimit(%q) = %+v, %v, want %+v, error %t", tc.spec, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestParseTenantLimitOverrides(t *testing.T) {
+	got, err := ParseTenantLimitOverrides("team-a=50:100, team-b=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["team-a"] != (TenantLimit{Rate: 50, Burst: 100}) || got["team-b"] != (TenantLimit{Rate: 1, Burst: 1}) {
+		t.Errorf("ParseTenantLimitOverrides() = %+v", got)
+	}
+	for _, spec := range []string{"team-a", "=1", "team-a=x"} {
+		if _, err := ParseTenantLimitOverrides(spec); err == nil {
+			t.Errorf("ParseTenantLimitOverrides(%q) accepted", spec)
+		}
+	}
+}
+
+func TestEndpointRateLimits(t *testing.T) {
+	l := NewEndpointRateLimiter(RateLimits{Endpoints: []EndpointLimit{
+		{Pattern: "/api/v1/query_range", Rate: 0.001, Burst: 2},
+		{Pattern: "/api/v1/*", Rate: 0.001, Burst: 1},
+	}}, prometheus.NewRegistry())
+	a, b := []string{"team-a"}, []string{"team-b"}
+
+	for i, tc := range []struct {
+		tenants []string
+		path    string
+		allowed bool
+	}{
+		{tenants: a, path: "/api/v1/query_range", allowed: true},
+		{tenants: a, path: "/api/v1/query_range", allowed: true},
+		{tenants: a, path: "/api/v1/query_range"},
+		// the first matching pattern applies, the others keep their own bucket
+		{tenants: a, path: "/api/v1/query", allowed: true},
+		{tenants: a, path: "/api/v1/series"},
+		// other tenants are not affected
+		{tenants: b, path: "/api/v1/query_range", allowed: true},
+		{tenants: b, path: "/api/v1/query", allowed: true},
+		// nor are the tenants of several label values
+		{tenants: []string{"team-a", "team-b"}, path: "/api/v1/query", allowed: true},
+		// paths without a limit are not limited
+		{tenants: a, path: "/federate", allowed: true},
+	} {
+		limited, retryAfter, ok := l.reserve(tc.tenants, tc.path)
+		if ok != tc.allowed {
+			t.Fatalf("request %d of %q to %s allowed %t, want %t", i, tc.tenants, tc.path, ok, tc.allowed)
+		}
+		if !ok && (limited == "" || retryAfter <= 0) {
+			t.Errorf("request %d limited by %q, retry after %s", i, limited, retryAfter)
+		}
+	}
+}
+
+func TestTenantRateLimits(t *testing.T) {
+	l := NewEndpointRateLimiter(RateLimits{
+		Tenant:          &TenantLimit{Rate: 0.001, Burst: 1},
+		TenantOverrides: map[string]TenantLimit{"team-big": {Rate: 0.001, Burst: 3}},
+	}, prometheus.NewRegistry())
+
+	for i, tc := range []struct {
+		tenants []string
+		allowed bool
+		limited string
+	}{
+		{tenants: []string{"team-a"}, allowed: true},
+		{tenants: []string{"team-a"}, limited: `tenant "team-a"`},
+		// one tenant's limit does not affect another's
+		{tenants: []string{"team-b"}, allowed: true},
+		// a request of several label values counts against each of them
+		{tenants: []string{"team-c", "team-b"}, limited: `tenant "team-b"`},
+		// and takes no token when one of them is limited, team-c keeping its own
+		{tenants: []string{"team-c"}, allowed: true},
+		{tenants: []string{"team-big"}, allowed: true},
+		{tenants: []string{"team-big"}, allowed: true},
+		{tenants: []string{"team-big"}, allowed: true},
+		{tenants: []string{"team-big"}, limited: `tenant "team-big"`},
+	} {
+		limited, _, ok := l.reserve(tc.tenants, "/api/v1/query")
+		if ok != tc.allowed || limited != tc.limited {
+			t.Fatalf("request %d of %q allowed %t limited by %q, want %t %q", i, tc.tenants, ok, limited, tc.allowed, tc.limited)
+		}
+	}
+}
+
+func TestTenantLimitsOnlyForListedTenants(t *testing.T) {
+	l := NewEndpointRateLimiter(RateLimits{TenantOverrides: map[string]TenantLimit{"team-a": {Rate: 0.001, Burst: 1}}}, prometheus.NewRegistry())
+	for i := range 3 {
+		if _, _, ok := l.reserve([]string{"team-b"}, "/api/v1/query"); !ok {
+			t.Fatalf("request %d of a tenant without limit limited", i)
+		}
+	}
+	l.reserve([]string{"team-a"}, "/api/v1/query")
+	if _, _, ok := l.reserve([]string{"team-a"}, "/api/v1/query"); ok {
+		t.Error("tenant over its override not limited")
+	}
+}
+
+func TestSetLimits(t *testing.T) {
+	l := NewEndpointRateLimiter(RateLimits{}, prometheus.NewRegistry())
+	tenants := []string{"team-a"}
+	for range 3 {
+		if _, _, ok := l.reserve(tenants, "/api/v1/query"); !ok {
+			t.Fatal("request limited without limits")
+		}
+	}
+
+	l.SetLimits(RateLimits{Tenant: &TenantLimit{Rate: 0.001, Burst: 1}})
+	if _, _, ok := l.reserve(tenants, "/api/v1/query"); !ok {
+		t.Error("first request limited by the new limits")
+	}
+	if _, _, ok := l.reserve(tenants, "/api/v1/query"); ok {
+		t.Error("request over the new limits allowed")
+	}
+
+	l.SetLimits(RateLimits{})
+	if _, _, ok := l.reserve(tenants, "/api/v1/query"); !ok {
+		t.Error("request limited once the limits are removed")
+	}
+}
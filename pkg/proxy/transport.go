@@ -0,0 +1,200 @@
+// Package proxy holds the HTTP plumbing around the injectproxy routes.
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+const (
+	// EnforcedQueryHeader carries the query sent upstream when debug headers are requested.
+	EnforcedQueryHeader = "X-LBAC-Enforced-Query"
+	// TenantHeader carries the label values enforced on the request, serialized with
+	// teams.JoinTenants.
+	TenantHeader = "X-LBAC-Tenant"
+	// DecisionHeader carries the enforcement decision taken for the request.
+	DecisionHeader = "X-LBAC-Decision"
+
+	maxEnforcedQueryLength = 4096
+)
+
+// Transport is a http.RoundTripper for the requests injectproxy sends to the upstream.
+// Requests to any other host are passed to Next untouched, so it can be installed as
+// http.DefaultTransport.
+type Transport struct {
+	Upstream *url.URL
+	Next     http.RoundTripper
+	// TenantHeaders adds the enforced tenants and decision to successful responses.
+	TenantHeaders bool
+	// Outcomes, when set, counts the requests sent upstream without enforcement.
+	Outcomes *prometheus.CounterVec
+	// Mirror, when set, receives a copy of a sample of the enforced requests.
+	Mirror *Mirror
+	// RateLimiter, when set, answers enforced requests over the rate limit of their endpoint
+	// or of one of their tenants with 429 instead of sending them upstream.
+	RateLimiter *EndpointRateLimiter
+	// SetMarker adds the EnforcementMarkerHeader to enforced requests.
+	SetMarker bool
+	// MatcherStyle rewrites the matcher of several label values enforced by injectproxy.
+	MatcherStyle teams.MatcherStyle
+	// AlwaysMatchers are added to the selectors of every enforced request.
+	AlwaysMatchers []*labels.Matcher
+}
+
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.Upstream.Host {
+		return t.Next.RoundTrip(req)
+	}
+	markUpstream(req.Context())
+	if _, probe := req.Context().Value(probeKey{}).(bool); !probe && t.Outcomes != nil && teams.TenantsFromContext(req.Context()) == nil {
+		t.Outcomes.WithLabelValues(teams.OutcomePassthrough).Inc()
+	}
+
+	var joined string
+	if tenants := teams.TenantsFromContext(req.Context()); tenants != nil {
+		var err error
+		if joined, err = teams.JoinTenants(tenants); err != nil {
+			return nil, err
+		}
+	}
+
+	if tenants := teams.TenantsFromContext(req.Context()); t.RateLimiter != nil && tenants != nil {
+		if limited, retryAfter, ok := t.RateLimiter.reserve(tenants, strings.TrimPrefix(req.URL.Path, t.Upstream.Path)); !ok {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return tooManyRequests(req, retryAfter, limited), nil
+		}
+	}
+
+	if teams.TenantsFromContext(req.Context()) != nil {
+		// a RoundTripper must not modify the request it is given, and enforced requests are
+		// rewritten below
+		var err error
+		if req, err = cloneRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if tenants := teams.TenantsFromContext(req.Context()); len(t.AlwaysMatchers) > 0 && tenants != nil {
+		if err := teams.InjectAlwaysMatchers(req, t.AlwaysMatchers); err != nil {
+			return nil, err
+		}
+	}
+	if tenants := teams.TenantsFromContext(req.Context()); len(tenants) > 1 {
+		if err := teams.RestyleMatcher(req, t.MatcherStyle); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.Mirror != nil && teams.TenantsFromContext(req.Context()) != nil {
+		body, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+		t.Mirror.send(req, strings.TrimPrefix(req.URL.Path, t.Upstream.Path), body)
+	}
+
+	if tenants := teams.TenantsFromContext(req.Context()); t.SetMarker && tenants != nil {
+		req.Header.Set(EnforcementMarkerHeader, joined)
+	}
+
+	var query string
+	if teams.DebugRequested(req.Context()) {
+		var err error
+		if query, err = enforcedQuery(req); err != nil {
+			return nil, err
+		}
+	}
+
+	teams.StartPhase(req.Context(), teams.PhaseUpstream)
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	teams.StartPhase(req.Context(), teams.PhaseWrite)
+
+	if query != "" {
+		resp.Header.Set(EnforcedQueryHeader, query)
+	}
+	if t.TenantHeaders && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if tenants := teams.TenantsFromContext(req.Context()); tenants != nil {
+			resp.Header.Set(TenantHeader, joined)
+			resp.Header.Set(DecisionHeader, "enforced")
+		}
+	}
+	return resp, nil
+}
+
+// enforcedQuery returns the query (or series matchers) of the rewritten upstream request,
+// truncated to a length that is safe to send as a header.
+func enforcedQuery(req *http.Request) (string, error) {
+	values, err := requestValues(req)
+	if err != nil {
+		return "", err
+	}
+
+	q := strings.Join(values["query"], ", ")
+	if q == "" {
+		q = strings.Join(values["match[]"], ", ")
+	}
+	if len(q) > maxEnforcedQueryLength {
+		q = q[:maxEnforcedQueryLength]
+	}
+	// header values cannot carry line breaks
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(q), nil
+}
+
+// requestValues returns the query string and POST form values of req, leaving its body
+// readable.
+func requestValues(req *http.Request) (url.Values, error) {
+	values := req.URL.Query()
+	if req.Method == http.MethodPost {
+		body, err := bufferBody(req)
+		if err != nil {
+			return nil, err
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			for k, v := range form {
+				values[k] = append(values[k], v...)
+			}
+		}
+	}
+	return values, nil
+}
+
+// cloneRequest returns a copy of req whose body is an in-memory copy of the body of req,
+// so that the copy can be rewritten without modifying req. The copy has no GetBody, which
+// would return the body before it is rewritten.
+func cloneRequest(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	clone.GetBody = nil
+	if _, err := bufferBody(clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// bufferBody reads the body of req, replacing it with an in-memory copy. It returns nil
+// for requests without a body.
+func bufferBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body.Close()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
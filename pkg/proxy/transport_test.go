@@ -0,0 +1,200 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams/teamstest"
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// recordingTransport answers every request with 200, recording it along with its body.
+type recordingTransport struct {
+	req  *http.Request
+	body string
+}
+
+func (rt *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.req = req
+	if req.Body != nil {
+		b, _ := io.ReadAll(req.Body)
+		rt.body = string(b)
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody, Request: req}, nil
+}
+
+// enforcedContext returns the context of a request of user 1, a member of team-a and
+// team-b, enforced on the team label.
+func enforcedContext(t *testing.T) context.Context {
+	t.Helper()
+	g, err := teamstest.NewGrafana()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	g.SetTeams("1", teams.Team{ID: 1, OrgID: 1, Name: "team-a"}, teams.Team{ID: 2, OrgID: 1, Name: "team-b"})
+	token, err := g.Token("1", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := teams.NewKeyfunc(context.Background(), []string{g.URL + "/api/signing-keys/keys"}, teams.JWKSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(g.URL)
+	gte := teams.GrafanaTeamsEnforcer{
+		Label:       "team",
+		KeyFunc:     k,
+		Cache:       *cache.New(time.Minute, time.Minute),
+		GrafanaUrl:  *u,
+		GrafanaUser: teamstest.AdminUser,
+		GrafanaPass: teamstest.AdminPass,
+	}
+
+	var ctx context.Context
+	r := httptest.NewRequest("GET", "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", token)
+	w := httptest.NewRecorder()
+	gte.ExtractLabel(func(w http.ResponseWriter, r *http.Request) { ctx = r.Context() }).ServeHTTP(w, r)
+	if ctx == nil {
+		t.Fatalf("request not enforced: %d %s", w.Code, w.Body.String())
+	}
+	return ctx
+}
+
+func TestTransportDoesNotModifyItsRequest(t *testing.T) {
+	ctx := enforcedContext(t)
+	upstream, _ := url.Parse("http://prometheus:9090")
+	next := &recordingTransport{}
+	tr := Transport{
+		Upstream:       upstream,
+		Next:           next,
+		SetMarker:      true,
+		MatcherStyle:   teams.MatcherStyleRepeatEquals,
+		AlwaysMatchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "env", "prod")},
+	}
+
+	const query = `query=up{team=~"team-a|team-b"}`
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://prometheus:9090/api/v1/query?"+query, strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+
+	if next.req == req {
+		t.Fatal("the request sent upstream is the request given to RoundTrip")
+	}
+	if req.URL.RawQuery != query {
+		t.Errorf("query of the request given to RoundTrip rewritten to %q", req.URL.RawQuery)
+	}
+	if v := req.Header.Get(EnforcementMarkerHeader); v != "" {
+		t.Errorf("marker %q set on the request given to RoundTrip", v)
+	}
+
+	if got := next.req.Header.Get(EnforcementMarkerHeader); got != "team-a,team-b" {
+		t.Errorf("marker sent upstream = %q, want team-a,team-b", got)
+	}
+	for name, values := range map[string]string{"query string": next.req.URL.RawQuery, "body": next.body} {
+		form, err := url.ParseQuery(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := form.Get("query")
+		if !strings.Contains(q, `env="prod"`) || !strings.Contains(q, `team="team-a"`) || !strings.Contains(q, `team="team-b"`) {
+			t.Errorf("query of the %s sent upstream = %q, want the always matcher and one equality matcher per team", name, q)
+		}
+	}
+}
+
+func TestTransportRateLimit(t *testing.T) {
+	ctx := enforcedContext(t)
+	upstream, _ := url.Parse("http://prometheus:9090")
+	tr := Transport{
+		Upstream:    upstream,
+		Next:        &recordingTransport{},
+		RateLimiter: NewEndpointRateLimiter(RateLimits{Tenant: &TenantLimit{Rate: 0.5, Burst: 1}}, prometheus.NewRegistry()),
+	}
+
+	send := func() *http.Response {
+		req, err := http.NewRequestWithContext(ctx, "GET", "http://prometheus:9090/api/v1/query?query=up", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	if resp := send(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want the first request sent upstream", resp.StatusCode)
+	}
+	resp := send()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+}
+
+func TestTransportPassesOtherHostsThrough(t *testing.T) {
+	upstream, _ := url.Parse("http://prometheus:9090")
+	next := &recordingTransport{}
+	tr := Transport{Upstream: upstream, Next: next, SetMarker: true}
+
+	req := httptest.NewRequest("GET", "http://grafana:3000/api/health", nil)
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatal(err)
+	}
+	if next.req != req {
+		t.Error("request to another host not passed to Next untouched")
+	}
+}
+
+func TestTransportTenantHeaders(t *testing.T) {
+	ctx := enforcedContext(t)
+	upstream, _ := url.Parse("http://prometheus:9090")
+
+	for _, tc := range []struct {
+		name     string
+		enabled  bool
+		ctx      context.Context
+		tenant   string
+		decision string
+	}{
+		{name: "enforced", enabled: true, ctx: ctx, tenant: "team-a,team-b", decision: "enforced"},
+		{name: "disabled", ctx: ctx},
+		{name: "not enforced", enabled: true, ctx: context.Background()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := Transport{Upstream: upstream, Next: &recordingTransport{}, TenantHeaders: tc.enabled}
+			req, err := http.NewRequestWithContext(tc.ctx, "GET", "http://prometheus:9090/api/v1/query?query=up", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resp.Header.Get(TenantHeader); got != tc.tenant {
+				t.Errorf("%s = %q, want %q", TenantHeader, got, tc.tenant)
+			}
+			if got := resp.Header.Get(DecisionHeader); got != tc.decision {
+				t.Errorf("%s = %q, want %q", DecisionHeader, got, tc.decision)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"slices"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+// UpstreamAuth is a http.RoundTripper setting the Authorization header of the requests to
+// Hosts from Credential, replacing any sent by the client. Requests to any other host are
+// passed to Next untouched.
+type UpstreamAuth struct {
+	Hosts []string
+	// Basic sends Credential, holding <user>:<password>, with the Basic scheme instead of
+	// as a bearer token.
+	Basic bool
+	// Credential, when nil, only removes the Authorization header sent by the client.
+	Credential *teams.SecretFile
+	Next       http.RoundTripper
+}
+
+func (ua UpstreamAuth) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !slices.Contains(ua.Hosts, req.URL.Host) {
+		return ua.Next.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the request it is given
+	req = req.Clone(req.Context())
+	switch {
+	case ua.Credential == nil:
+		req.Header.Del("Authorization")
+	case ua.Basic:
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(ua.Credential.Value())))
+	default:
+		req.Header.Set("Authorization", "Bearer "+ua.Credential.Value())
+	}
+	return ua.Next.RoundTrip(req)
+}
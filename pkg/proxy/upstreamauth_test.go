@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+// secretFile returns a SecretFile holding secret.
+func secretFile(t *testing.T, secret string) *teams.SecretFile {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := teams.NewSecretFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUpstreamAuth(t *testing.T) {
+	// upstream answers the Authorization header it receives
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		auth   UpstreamAuth
+		client string
+		want   string
+	}{
+		{
+			name:   "bearer token",
+			auth:   UpstreamAuth{Hosts: []string{u.Host}, Credential: secretFile(t, "upstream-token")},
+			client: "Bearer client-token",
+			want:   "Bearer upstream-token",
+		},
+		{
+			name:   "basic credentials",
+			auth:   UpstreamAuth{Hosts: []string{u.Host}, Basic: true, Credential: secretFile(t, "prometheus:secret")},
+			client: "Bearer client-token",
+			want:   "Basic " + base64.StdEncoding.EncodeToString([]byte("prometheus:secret")),
+		},
+		{
+			name: "bearer token without client credentials",
+			auth: UpstreamAuth{Hosts: []string{u.Host}, Credential: secretFile(t, "upstream-token")},
+			want: "Bearer upstream-token",
+		},
+		{
+			name:   "no credential",
+			auth:   UpstreamAuth{Hosts: []string{u.Host}},
+			client: "Bearer client-token",
+		},
+		{
+			// requests to other hosts, e.g. Grafana, are left alone
+			name:   "other host",
+			auth:   UpstreamAuth{Hosts: []string{"prometheus.example.com"}, Credential: secretFile(t, "upstream-token")},
+			client: "Bearer client-token",
+			want:   "Bearer client-token",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.auth.Next = http.DefaultTransport
+			client := http.Client{Transport: tc.auth}
+			req, err := http.NewRequest(http.MethodGet, upstream.URL+"/api/v1/query?query=up", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.client != "" {
+				req.Header.Set("Authorization", tc.client)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("Authorization header sent upstream = %q, want %q", got, tc.want)
+			}
+			// the request of the client is left as it was
+			if got := req.Header.Get("Authorization"); got != tc.client {
+				t.Errorf("Authorization header of the request given = %q, want %q", got, tc.client)
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package teams
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// ParseAlwaysMatcher parses a <name>=<value> equality matcher for InjectAlwaysMatchers.
+func ParseAlwaysMatcher(s string) (*labels.Matcher, error) {
+	name, value, found := strings.Cut(s, "=")
+	if !found || !model.LabelName(name).IsValid() {
+		return nil, fmt.Errorf("invalid matcher %q, expected <name>=<value>", s)
+	}
+	return labels.NewMatcher(labels.MatchEqual, name, value)
+}
+
+// InjectAlwaysMatchers ANDs matchers into every selector of the query and match[]
+// parameters of req, an enforced upstream request, alongside the enforced label values.
+// Any matcher of the client on the same labels is replaced. Matchers on the label
+// enforced on req are skipped, so they cannot override the label values.
+func InjectAlwaysMatchers(req *http.Request, matchers []*labels.Matcher) error {
+	label := EnforcedLabel(req.Context())
+	matchers = slices.DeleteFunc(slices.Clone(matchers), func(m *labels.Matcher) bool { return m.Name == label })
+	if len(matchers) == 0 {
+		return nil
+	}
+	e := injectproxy.NewPromQLEnforcer(false, matchers...)
+
+	return rewriteParams(req, func(v url.Values) bool {
+		changed := false
+		for i, q := range v["query"] {
+			enforced, err := e.Enforce(q)
+			if err != nil {
+				// left for the upstream to report
+				slog.Debug("cannot inject matchers into query", "query", q, "error", err)
+				continue
+			}
+			v["query"][i], changed = enforced, true
+		}
+		for i, s := range v[matchersParam] {
+			ms, err := parser.ParseMetricSelector(s)
+			if err != nil {
+				continue
+			}
+			if ms, err = e.EnforceMatchers(ms); err != nil {
+				continue
+			}
+			v[matchersParam][i], changed = (&parser.VectorSelector{LabelMatchers: ms}).String(), true
+		}
+		return changed
+	})
+}
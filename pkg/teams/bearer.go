@@ -0,0 +1,32 @@
+package teams
+
+import (
+	"net/http"
+	"strings"
+)
+
+// BearerToken lets clients other than Grafana send their token as an Authorization bearer
+// token. Requests without a TokenHeader get the bearer token moved to it, removing the
+// Authorization header so it is not forwarded upstream, and are then verified and
+// resolved like any other request. Requests carrying a TokenHeader are left untouched
+// whatever their Authorization header, which Grafana may set for the upstream, e.g. when
+// forwarding the OAuth identity of users.
+type BearerToken struct {
+	// TokenHeader is the header the token is moved to. Defaults to DefaultTokenHeader.
+	TokenHeader string
+	Next        http.Handler
+}
+
+func (bt BearerToken) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	header := bt.TokenHeader
+	if header == "" {
+		header = DefaultTokenHeader
+	}
+	auth := r.Header.Get("Authorization")
+	if r.Header.Get(header) == "" && len(auth) > len(bearerPrefix) && strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		r = r.Clone(r.Context())
+		r.Header.Del("Authorization")
+		r.Header.Set(header, auth[len(bearerPrefix):])
+	}
+	bt.Next.ServeHTTP(w, r)
+}
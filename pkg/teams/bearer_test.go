@@ -0,0 +1,66 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestBearerToken(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	// upstream answers the tenants enforced, then the Authorization header forwarded to it
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantsHandler(w, r)
+		w.Write([]byte("authorization: " + r.Header.Get("Authorization")))
+	})
+	h := teams.BearerToken{Next: gte.ExtractLabel(upstream)}
+	org1, org2 := token(t, g, "1", 1), token(t, g, "1", 2)
+
+	for _, tc := range []struct {
+		name          string
+		grafanaID     string
+		authorization string
+		status        int
+		body          string
+	}{
+		{name: "token header", grafanaID: org1, status: http.StatusOK, body: "team-a\nteam-b\nauthorization: "},
+		{name: "bearer token", authorization: "Bearer " + org2, status: http.StatusOK, body: "team-c\nauthorization: "},
+		{name: "bearer scheme in lower case", authorization: "bearer " + org2, status: http.StatusOK, body: "team-c\nauthorization: "},
+		{
+			// the token header wins, the Authorization header being Grafana's to set upstream
+			name:          "both disagreeing",
+			grafanaID:     org1,
+			authorization: "Bearer " + org2,
+			status:        http.StatusOK,
+			body:          "team-a\nteam-b\nauthorization: Bearer " + org2,
+		},
+		{name: "bearer token of a user without teams", authorization: "Bearer " + token(t, g, "2", 1), status: http.StatusNotFound},
+		{name: "invalid bearer token", authorization: "Bearer invalid", status: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic YWRtaW46YWRtaW4=", status: http.StatusUnauthorized},
+		{name: "no token", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			if tc.grafanaID != "" {
+				r.Header.Set(teams.DefaultTokenHeader, tc.grafanaID)
+			}
+			if tc.authorization != "" {
+				r.Header.Set("Authorization", tc.authorization)
+			}
+			w := serve(h, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.body {
+				t.Errorf("body = %q, want %q", w.Body, tc.body)
+			}
+			// the request given is left as it was
+			if got := r.Header.Get("Authorization"); got != tc.authorization {
+				t.Errorf("Authorization header of the request given = %q, want %q", got, tc.authorization)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package teams
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// BreakGlassHeader carries the justification of a request asking to skip enforcement.
+const BreakGlassHeader = "X-LBAC-Break-Glass"
+
+// maxJustificationLength bounds the justification kept in audit entries and notifications.
+const maxJustificationLength = 1024
+
+// breakGlassPaths are the endpoints break-glass requests may be sent to.
+var breakGlassPaths = []string{"/api/v1/query", "/api/v1/query_range"}
+
+// BreakGlass lets members of the Grafana teams Teams run a single query without
+// enforcement by sending a justification in the BreakGlassHeader. Such requests are
+// authenticated as usual and sent to Upstream untouched instead of Next. Every one of
+// them, allowed or not, is logged, recorded by the Recorders of Enforcer along with its
+// justification and, when a Webhook is set, notified to it.
+type BreakGlass struct {
+	Enforcer GrafanaTeamsEnforcer
+	Teams    []string
+	// Webhook, when set, receives a JSON notification of every allowed request.
+	Webhook  string
+	Client   http.Client
+	Next     http.Handler
+	Upstream http.Handler
+
+	requests *prometheus.CounterVec
+}
+
+// NewBreakGlass creates a BreakGlass with its metrics registered with reg.
+func NewBreakGlass(enforcer GrafanaTeamsEnforcer, teams []string, webhook string, next, upstream http.Handler, reg prometheus.Registerer) *BreakGlass {
+	bg := &BreakGlass{
+		Enforcer: enforcer,
+		Teams:    teams,
+		Webhook:  webhook,
+		Client:   http.Client{Timeout: 5 * time.Second},
+		Next:     next,
+		Upstream: upstream,
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_break_glass_requests_total",
+			Help: "Total number of requests asking to skip enforcement, by result.",
+		}, []string{"result"}),
+	}
+	for _, result := range []string{"allowed", "rejected"} {
+		bg.requests.WithLabelValues(result)
+	}
+	return bg
+}
+
+func (bg *BreakGlass) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if len(r.Header.Values(BreakGlassHeader)) == 0 {
+		bg.Next.ServeHTTP(rw, r)
+		return
+	}
+	justification := strings.TrimSpace(r.Header.Get(BreakGlassHeader))
+	if len(justification) > maxJustificationLength {
+		justification = justification[:maxJustificationLength]
+	}
+	r.Header.Del(BreakGlassHeader)
+
+	w := &statusWriter{ResponseWriter: rw}
+	var query string
+	d := &Decision{Time: time.Now(), Method: r.Method, Path: r.URL.Path, Label: bg.Enforcer.Label, Justification: justification}
+	bg.Enforcer.captureClient(d, r)
+	defer func() {
+		d.Status = w.status
+		if !d.bypassed {
+			bg.requests.WithLabelValues("rejected").Inc()
+		}
+		slog.Warn("break-glass request", "userId", d.UserID, "orgId", d.OrgID, "teams", d.Teams,
+			"method", d.Method, "path", d.Path, "query", query, "justification", justification, "allowed", d.bypassed, "status", d.Status)
+		for _, rec := range bg.Enforcer.Recorders {
+			rec.Record(*d)
+		}
+		if bg.Enforcer.Outcomes != nil {
+			if d.bypassed {
+				bg.Enforcer.Outcomes.WithLabelValues(OutcomeBypassed).Inc()
+			} else {
+				bg.Enforcer.Outcomes.WithLabelValues(rejectedOutcome(d.Status)).Inc()
+			}
+		}
+	}()
+
+	if !slices.Contains(breakGlassPaths, r.URL.Path) {
+		http.Error(w, fmt.Sprintf("%s is only accepted on %s", BreakGlassHeader, strings.Join(breakGlassPaths, ", ")), http.StatusBadRequest)
+		return
+	}
+	if justification == "" {
+		http.Error(w, fmt.Sprintf("%s requires a justification", BreakGlassHeader), http.StatusBadRequest)
+		return
+	}
+	query, err := requestQuery(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the query: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	h := bg.Enforcer.Authenticate(bg.Enforcer.ResolveTenants(bg.bypass(query)))
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), decisionKey, d)))
+}
+
+// bypass sends the request of an authenticated caller to Upstream when they are a member
+// of any of the break-glass teams in their org. Membership is checked against the Grafana
+// teams of the caller, not the label values resolved for them, which may come from
+// folders or claims, or be granted by a TeamHierarchy or a RemovalGrace.
+func (bg *BreakGlass) bypass(query string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := decisionFromContext(r.Context())
+		teams, err := bg.Enforcer.fetchTeamsForUser(r, d.UserID)
+		if err != nil {
+			if !lookupFailed(w, r, d.UserID, err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if !slices.ContainsFunc(teams, func(t Team) bool {
+			return t.OrgID == d.OrgID && slices.Contains(bg.Teams, t.Name)
+		}) {
+			http.Error(w, fmt.Sprintf("userId=%s is not a member of any break-glass team in orgId=%d", d.UserID, d.OrgID), http.StatusForbidden)
+			return
+		}
+
+		d.bypassed = true
+		bg.requests.WithLabelValues("allowed").Inc()
+		if bg.Webhook != "" {
+			go bg.notify(*d, query)
+		}
+
+		// the upstream request must not look enforced to the transports
+		bg.Upstream.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantsKey, []string(nil))))
+	}
+}
+
+// requestQuery returns the query parameter of r, from its URL or its POST form, leaving
+// its body readable.
+func requestQuery(r *http.Request) (string, error) {
+	if q := r.URL.Query().Get("query"); q != "" || r.Method != http.MethodPost {
+		return q, nil
+	}
+	if r.Body == nil {
+		return "", nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return "", err
+	}
+	return form.Get("query"), nil
+}
+
+// notify posts an allowed break-glass request to the Webhook. Failures are logged only.
+func (bg *BreakGlass) notify(d Decision, query string) {
+	b, err := json.Marshal(struct {
+		Time          time.Time `json:"time"`
+		UserID        string    `json:"userId"`
+		OrgID         int64     `json:"orgId"`
+		Teams         []string  `json:"teams"`
+		Method        string    `json:"method"`
+		Path          string    `json:"path"`
+		Query         string    `json:"query"`
+		Justification string    `json:"justification"`
+	}{d.Time, d.UserID, d.OrgID, d.Teams, d.Method, d.Path, query, d.Justification})
+	if err != nil {
+		slog.Error("failed to encode break-glass notification", "error", err)
+		return
+	}
+
+	resp, err := bg.Client.Post(bg.Webhook, "application/json", bytes.NewReader(b))
+	if err != nil {
+		slog.Error("failed to send break-glass notification", "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Error("break-glass notification rejected", "status", resp.StatusCode)
+	}
+}
@@ -0,0 +1,129 @@
+package teams_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBreakGlass(t *testing.T) {
+	g := newGrafana(t)
+	claimsTemplate, err := teams.ParseLabelValueTemplate("{{.tenant}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upstream answers the query it receives unenforced, next those it enforces
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream: " + r.URL.Query().Get("query")))
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("next"))
+	})
+
+	for _, tc := range []struct {
+		name          string
+		source        teams.LabelSource
+		token         string
+		path          string
+		justification []string
+		status        int
+		body          string
+		allowed       float64
+	}{
+		{name: "member", token: token(t, g, "1", 1), justification: []string{"SEV1"}, status: http.StatusOK, body: "upstream: up", allowed: 1},
+		{name: "no header", token: token(t, g, "1", 1), status: http.StatusOK, body: "next"},
+		{name: "member in another org", token: token(t, g, "1", 2), justification: []string{"SEV1"}, status: http.StatusForbidden},
+		{
+			// the label value resolved from the claims is named like the break-glass team,
+			// which the user is not a member of in Grafana
+			name:          "label value named like the team",
+			source:        teams.LabelSourceClaims,
+			token:         tokenWithClaims(t, g, "1", 2, jwt.MapClaims{"tenant": "team-a"}),
+			justification: []string{"SEV1"},
+			status:        http.StatusForbidden,
+		},
+		{name: "user without teams", token: token(t, g, "2", 1), justification: []string{"SEV1"}, status: http.StatusNotFound},
+		{name: "no token", justification: []string{"SEV1"}, status: http.StatusUnauthorized},
+		{name: "empty justification", token: token(t, g, "1", 1), justification: []string{" "}, status: http.StatusBadRequest},
+		{name: "other path", token: token(t, g, "1", 1), path: "/api/v1/series", justification: []string{"SEV1"}, status: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			notified := make(chan map[string]any, 1)
+			webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var n map[string]any
+				json.NewDecoder(r.Body).Decode(&n)
+				notified <- n
+			}))
+			defer webhook.Close()
+			rec := &decisionRecorder{}
+			gte := newEnforcer(t, g)
+			gte.LabelSource = tc.source
+			gte.LabelTemplate = claimsTemplate
+			gte.Recorders = []teams.DecisionRecorder{rec}
+			reg := prometheus.NewRegistry()
+			bg := teams.NewBreakGlass(gte, []string{"team-a"}, webhook.URL, next, upstream, reg)
+
+			path := tc.path
+			if path == "" {
+				path = "/api/v1/query"
+			}
+			r := httptest.NewRequest(http.MethodGet, path+"?query=up", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Grafana-Id", tc.token)
+			}
+			for _, j := range tc.justification {
+				r.Header.Add(teams.BreakGlassHeader, j)
+			}
+			w := serve(bg, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.body != "" && w.Body.String() != tc.body {
+				t.Errorf("body = %q, want %q", w.Body, tc.body)
+			}
+			// every break-glass request is counted and audited, allowed or not
+			var rejected float64
+			if tc.justification != nil {
+				rejected = 1 - tc.allowed
+			}
+			want := fmt.Sprintf(`
+# HELP lbac_break_glass_requests_total Total number of requests asking to skip enforcement, by result.
+# TYPE lbac_break_glass_requests_total counter
+lbac_break_glass_requests_total{result="allowed"} %v
+lbac_break_glass_requests_total{result="rejected"} %v
+`, tc.allowed, rejected)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "lbac_break_glass_requests_total"); err != nil {
+				t.Error(err)
+			}
+			if tc.justification == nil {
+				return
+			}
+			if len(rec.decisions) != 1 || rec.decisions[0].Status != tc.status {
+				t.Fatalf("decisions recorded = %+v, want 1 of status %d", rec.decisions, tc.status)
+			}
+			if tc.allowed == 0 {
+				return
+			}
+			if got := rec.decisions[0].Justification; got != tc.justification[0] {
+				t.Errorf("justification recorded = %q, want %q", got, tc.justification[0])
+			}
+			select {
+			case n := <-notified:
+				if n["justification"] != tc.justification[0] || n["query"] != "up" || n["userId"] != "1" {
+					t.Errorf("notification = %v", n)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("webhook not notified")
+			}
+		})
+	}
+}
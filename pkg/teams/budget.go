@@ -0,0 +1,147 @@
+package teams
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// entryOverhead approximates the bytes used by a cache entry besides its key and value.
+const entryOverhead = 64
+
+// CacheBudget bounds the approximate size of the values stored in a cache, evicting the
+// oldest entries once the budget is exceeded.
+type CacheBudget struct {
+	c         *cache.Cache
+	evictions *CacheEvictions
+	max       int64
+
+	mu    sync.Mutex
+	total int64
+	seq   uint64
+	// entries holds the size and insertion sequence of each accounted key
+	entries map[string]budgetEntry
+	// order holds keys by insertion; stale positions are skipped on eviction
+	order []budgetKey
+
+	evicted prometheus.Counter
+}
+
+type budgetEntry struct {
+	size int64
+	seq  uint64
+}
+
+type budgetKey struct {
+	key string
+	seq uint64
+}
+
+// NewCacheBudget accounts the values stored in c through Set against max bytes,
+// registering its metrics with reg. The entries leaving c are learned from evictions.
+func NewCacheBudget(c *cache.Cache, evictions *CacheEvictions, max int64, reg prometheus.Registerer) *CacheBudget {
+	b := &CacheBudget{
+		c:         c,
+		evictions: evictions,
+		max:       max,
+		entries:   map[string]budgetEntry{},
+		evicted: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "lbac_cache_budget_evictions_total",
+			Help: "Total number of cache entries evicted to stay within the cache byte budget.",
+		}),
+	}
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lbac_cache_bytes",
+		Help: "Approximate size in bytes of the cached teams and folders.",
+	}, func() float64 {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return float64(b.total)
+	})
+	evictions.Listen(b.forget)
+
+	// account the entries already cached, e.g. loaded from a state file, oldest first
+	items := c.Items()
+	keys := slices.SortedFunc(maps.Keys(items), func(a, b string) int {
+		return cmp.Compare(items[a].Expiration, items[b].Expiration)
+	})
+	for _, k := range keys {
+		b.account(k, items[k].Object)
+	}
+	return b
+}
+
+// Set stores v in the cache under key, evicting the oldest entries while the budget is
+// exceeded. The entry being set is never evicted, even when it alone exceeds the budget.
+func (b *CacheBudget) Set(key string, v any, d time.Duration) {
+	b.c.Set(key, v, d)
+
+	b.mu.Lock()
+	b.account(key, v)
+
+	var evict []string
+	for b.total > b.max && len(b.order) > 0 {
+		k := b.order[0]
+		if k.key == key && k.seq == b.seq {
+			break
+		}
+		b.order = b.order[1:]
+		if e, found := b.entries[k.key]; !found || e.seq != k.seq {
+			continue
+		}
+		b.total -= b.entries[k.key].size
+		delete(b.entries, k.key)
+		evict = append(evict, k.key)
+	}
+	b.mu.Unlock()
+
+	// the eviction is forgotten through the listener, which takes the lock again
+	for _, k := range evict {
+		b.evictions.Delete(k, EvictionBudget)
+		b.evicted.Inc()
+	}
+}
+
+// account adds the size of v to the budget. b.mu must be held, or b not shared yet.
+func (b *CacheBudget) account(key string, v any) {
+	if old, found := b.entries[key]; found {
+		b.total -= old.size
+	}
+	b.seq++
+	size := approxSize(key, v)
+	b.entries[key] = budgetEntry{size: size, seq: b.seq}
+	b.order = append(b.order, budgetKey{key: key, seq: b.seq})
+	b.total += size
+}
+
+// forget stops accounting key once it left the cache.
+func (b *CacheBudget) forget(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, found := b.entries[key]; found {
+		b.total -= e.size
+		delete(b.entries, key)
+	}
+}
+
+// approxSize approximates the bytes held by a cache entry.
+func approxSize(key string, v any) int64 {
+	size := int64(entryOverhead + len(key))
+	switch v := v.(type) {
+	case []Team:
+		for _, t := range v {
+			size += int64(16 + 16 + len(t.Name))
+		}
+	case []string:
+		for _, s := range v {
+			size += int64(16 + len(s))
+		}
+	}
+	return size
+}
@@ -0,0 +1,78 @@
+package teams
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCacheBudget(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	reg := prometheus.NewRegistry()
+	evictions := NewCacheEvictions(c, reg)
+	// each entry takes 88 bytes, so that two of them fit
+	b := NewCacheBudget(c, evictions, 200, reg)
+
+	b.Set("u1", []string{"team-a"}, time.Minute)
+	b.Set("u2", []string{"team-b"}, time.Minute)
+	if _, found := c.Get("u1"); !found {
+		t.Fatal("u1 evicted within the budget")
+	}
+
+	b.Set("u3", []string{"team-c"}, time.Minute)
+	if _, found := c.Get("u1"); found {
+		t.Error("oldest entry kept over the budget")
+	}
+	for _, k := range []string{"u2", "u3"} {
+		if _, found := c.Get(k); !found {
+			t.Errorf("%s evicted", k)
+		}
+	}
+	if got := testutil.ToFloat64(b.evicted); got != 1 {
+		t.Errorf("budget evictions = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(evictions.evictions.WithLabelValues(EvictionBudget)); got != 1 {
+		t.Errorf("evictions by budget = %v, want 1", got)
+	}
+
+	// replacing an entry accounts it once
+	b.Set("u2", []string{"team-b"}, time.Minute)
+	if _, found := c.Get("u3"); !found {
+		t.Error("u3 evicted by replacing u2")
+	}
+
+	// entries deleted otherwise are no longer accounted
+	evictions.Delete("u2", EvictionManual)
+	evictions.Delete("u3", EvictionManual)
+	b.mu.Lock()
+	total := b.total
+	b.mu.Unlock()
+	if total != 0 {
+		t.Errorf("%d bytes accounted for an empty cache", total)
+	}
+
+	// an entry over the budget on its own is kept
+	b.Set("u4", []string{string(make([]byte, 500))}, time.Minute)
+	if _, found := c.Get("u4"); !found {
+		t.Error("entry over the budget evicted")
+	}
+}
+
+func TestCacheBudgetAccountsCachedEntries(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	c.Set("old", []string{"team-a"}, time.Minute)
+	c.Set("new", []string{"team-b"}, 2*time.Minute)
+	reg := prometheus.NewRegistry()
+	b := NewCacheBudget(c, NewCacheEvictions(c, reg), 200, reg)
+
+	b.Set("u1", []string{"team-c"}, time.Minute)
+	if _, found := c.Get("old"); found {
+		t.Error("entry expiring first kept over the budget")
+	}
+	if _, found := c.Get("new"); !found {
+		t.Error("entry expiring last evicted")
+	}
+}
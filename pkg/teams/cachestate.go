@@ -0,0 +1,159 @@
+package teams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// cacheStateVersion is bumped whenever the layout of the state file changes. Changes to
+// the values of the entries bump their own version instead, see cacheEntryCodecs.
+const cacheStateVersion = 2
+
+type cacheState struct {
+	Version int `json:"version"`
+	// Fingerprint identifies the configuration the entries were resolved with.
+	Fingerprint string            `json:"fingerprint"`
+	Entries     []cacheStateEntry `json:"entries"`
+}
+
+// cacheStateEntry is the versioned envelope a cache value is saved in, so that entries
+// written by another release can be told apart and skipped rather than mis-decoded.
+type cacheStateEntry struct {
+	Key        string          `json:"key"`
+	Kind       string          `json:"kind"`
+	Version    int             `json:"version"`
+	Data       json.RawMessage `json:"data"`
+	Expiration time.Time       `json:"expiration"`
+}
+
+// cacheEntryCodec serializes the cache values of one kind.
+type cacheEntryCodec struct {
+	// version is bumped whenever the serialized form of the values changes.
+	version int
+	decode  func(json.RawMessage) (any, error)
+}
+
+// cacheEntryCodecs holds the codecs of the kinds of values saved to the state file.
+var cacheEntryCodecs = map[string]cacheEntryCodec{
+	"teams":   {version: 1, decode: decodeCacheValue[[]Team]},
+	"folders": {version: 1, decode: decodeCacheValue[[]string]},
+}
+
+func decodeCacheValue[T any](data json.RawMessage) (any, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// cacheEntryKind returns the kind of a cache value, or false for values that are not
+// saved, e.g. the users resolved from opaque tokens.
+func cacheEntryKind(v any) (string, bool) {
+	switch v.(type) {
+	case []Team:
+		return "teams", true
+	case []string:
+		return "folders", true
+	}
+	return "", false
+}
+
+// SaveCacheState writes the unexpired teams and folders entries of c to path, readable
+// by the owner only. fingerprint identifies the configuration the entries were resolved
+// with; LoadCacheState ignores files written with another one.
+func SaveCacheState(c *cache.Cache, path, fingerprint string) error {
+	state := cacheState{Version: cacheStateVersion, Fingerprint: fingerprint}
+	for k, item := range c.Items() {
+		kind, ok := cacheEntryKind(item.Object)
+		if !ok {
+			continue
+		}
+		data, err := json.Marshal(item.Object)
+		if err != nil {
+			return err
+		}
+		state.Entries = append(state.Entries, cacheStateEntry{
+			Key:        k,
+			Kind:       kind,
+			Version:    cacheEntryCodecs[kind].version,
+			Data:       data,
+			Expiration: time.Unix(0, item.Expiration),
+		})
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial state file
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0o600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCacheState adds the entries saved in path that have not expired yet to c,
+// returning how many were loaded. Entries of an unknown kind or version are skipped.
+func LoadCacheState(c *cache.Cache, path, fingerprint string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var state cacheState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return 0, fmt.Errorf("corrupt cache state: %w", err)
+	}
+	if state.Version != cacheStateVersion {
+		return 0, fmt.Errorf("unsupported cache state version %d", state.Version)
+	}
+	if state.Fingerprint != fingerprint {
+		return 0, fmt.Errorf("cache state was saved with a different configuration")
+	}
+
+	loaded, skipped := 0, 0
+	for _, e := range state.Entries {
+		ttl := time.Until(e.Expiration)
+		if ttl <= 0 {
+			continue
+		}
+		codec, ok := cacheEntryCodecs[e.Kind]
+		if !ok || codec.version != e.Version {
+			skipped++
+			continue
+		}
+		v, err := codec.decode(e.Data)
+		if err != nil {
+			slog.Warn("skipping undecodable cache state entry", "kind", e.Kind, "error", err)
+			skipped++
+			continue
+		}
+		c.Set(e.Key, v, ttl)
+		loaded++
+	}
+	if skipped > 0 {
+		slog.Info("skipped incompatible cache state entries", "entries", skipped)
+	}
+	return loaded, nil
+}
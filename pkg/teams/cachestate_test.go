@@ -0,0 +1,148 @@
+package teams
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// writeCacheState writes state to a file, returning its path.
+func writeCacheState(t *testing.T, state cacheState) string {
+	t.Helper()
+	b, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "cache-state.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCacheStateRoundTrip(t *testing.T) {
+	saved := cache.New(time.Minute, time.Minute)
+	teams := []Team{{ID: 1, OrgID: 1, Name: "team-a"}}
+	saved.Set("1", teams, time.Minute)
+	saved.Set(folderCacheKey("1"), []string{"folder"}, time.Minute)
+	// identities of opaque tokens are not saved
+	saved.Set("opaque:abc", opaqueIdentity{ID: 1, OrgID: 1}, time.Minute)
+	path := filepath.Join(t.TempDir(), "cache-state.json")
+	if err := SaveCacheState(saved, path, "fingerprint"); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("file mode = %v, want 0600", mode)
+	}
+
+	loaded := cache.New(time.Minute, time.Minute)
+	n, err := LoadCacheState(loaded, path, "fingerprint")
+	if err != nil || n != 2 {
+		t.Fatalf("LoadCacheState() = %d, %v, want 2 entries", n, err)
+	}
+	if v, found := loaded.Get("1"); !found || !reflect.DeepEqual(v, teams) {
+		t.Errorf("teams of user 1 = %v, want %v", v, teams)
+	}
+	if v, found := loaded.Get(folderCacheKey("1")); !found || !reflect.DeepEqual(v, []string{"folder"}) {
+		t.Errorf("folders of user 1 = %v, want [folder]", v)
+	}
+
+	if _, err := LoadCacheState(cache.New(time.Minute, time.Minute), path, "other"); err == nil {
+		t.Error("LoadCacheState() = nil error for a state saved with another configuration")
+	}
+}
+
+func TestLoadCacheStateVersions(t *testing.T) {
+	expiration := time.Now().Add(time.Minute)
+	teams := json.RawMessage(`[{"id": 1, "orgId": 1, "name": "team-a"}]`)
+	state := cacheState{Version: cacheStateVersion, Fingerprint: "fingerprint", Entries: []cacheStateEntry{
+		{Key: "1", Kind: "teams", Version: 1, Data: teams, Expiration: expiration},
+		// written by an older release
+		{Key: "2", Kind: "teams", Version: 0, Data: json.RawMessage(`["team-a"]`), Expiration: expiration},
+		{Key: "3", Kind: "roles", Version: 1, Data: json.RawMessage(`[]`), Expiration: expiration},
+		{Key: "4", Kind: "teams", Version: 1, Data: teams, Expiration: time.Now().Add(-time.Minute)},
+	}}
+
+	c := cache.New(time.Minute, time.Minute)
+	n, err := LoadCacheState(c, writeCacheState(t, state), "fingerprint")
+	if err != nil || n != 1 {
+		t.Fatalf("LoadCacheState() = %d, %v, want 1 entry", n, err)
+	}
+	for key, want := range map[string]bool{"1": true, "2": false, "3": false, "4": false} {
+		if _, found := c.Get(key); found != want {
+			t.Errorf("entry %s loaded = %v, want %v", key, found, want)
+		}
+	}
+
+	// a file of an older layout is ignored altogether
+	state.Version = cacheStateVersion - 1
+	if n, err := LoadCacheState(cache.New(time.Minute, time.Minute), writeCacheState(t, state), "fingerprint"); err == nil || n != 0 {
+		t.Errorf("LoadCacheState() = %d, %v for version %d, want an error", n, err, state.Version)
+	}
+}
+
+func TestLoadCacheStateCorrupt(t *testing.T) {
+	for name, content := range map[string]string{
+		"truncated": `{"version": 2, "fingerprint": "fingerprint", "entries": [{"key": "1"`,
+		"not JSON":  "\x00\x01garbage",
+		"empty":     "",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache-state.json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			c := cache.New(time.Minute, time.Minute)
+			if n, err := LoadCacheState(c, path, "fingerprint"); err == nil || n != 0 {
+				t.Errorf("LoadCacheState() = %d, %v, want an error", n, err)
+			}
+			if c.ItemCount() != 0 {
+				t.Errorf("%d entries loaded from a corrupt file", c.ItemCount())
+			}
+		})
+	}
+
+	// an undecodable entry is skipped, the others are loaded
+	state := cacheState{Version: cacheStateVersion, Fingerprint: "fingerprint", Entries: []cacheStateEntry{
+		{Key: "1", Kind: "teams", Version: 1, Data: json.RawMessage(`[{"id": 1, "orgId": 1, "name": "team-a"}]`), Expiration: time.Now().Add(time.Minute)},
+		{Key: "2", Kind: "teams", Version: 1, Data: json.RawMessage(`"team-a"`), Expiration: time.Now().Add(time.Minute)},
+	}}
+	if n, err := LoadCacheState(cache.New(time.Minute, time.Minute), writeCacheState(t, state), "fingerprint"); err != nil || n != 1 {
+		t.Errorf("LoadCacheState() = %d, %v, want 1 entry", n, err)
+	}
+}
+
+func TestSaveCacheStateUnwritable(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	c.Set("1", []Team{{ID: 1, OrgID: 1, Name: "team-a"}}, time.Minute)
+
+	dir := t.TempDir()
+	if err := SaveCacheState(c, filepath.Join(dir, "missing", "cache-state.json"), "fingerprint"); err == nil {
+		t.Error("SaveCacheState() = nil error in a missing directory")
+	}
+
+	// the temporary file is removed when it cannot replace the state file
+	path := filepath.Join(dir, "cache-state.json")
+	if err := os.Mkdir(path, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveCacheState(c, path, "fingerprint"); err == nil {
+		t.Error("SaveCacheState() = nil error over a directory")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("files left behind: %v", entries)
+	}
+}
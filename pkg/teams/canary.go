@@ -0,0 +1,70 @@
+package teams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Canary periodically validates a known token through the same parsing and key
+// validation as requests, proving the JWKS can actually verify tokens.
+type Canary struct {
+	enforcer GrafanaTeamsEnforcer
+	token    *SecretFile
+
+	mu   sync.Mutex
+	last error
+}
+
+// NewCanary creates a Canary validating the token read from path with enforcer.
+func NewCanary(enforcer GrafanaTeamsEnforcer, path string) (*Canary, error) {
+	token, err := NewSecretFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Canary{enforcer: enforcer, token: token, last: errors.New("canary token has not been validated yet")}, nil
+}
+
+// Run validates the canary token every interval until ctx is done, re-reading the token
+// file each time so it can be rotated.
+func (c *Canary) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := c.token.reload(); err != nil {
+				slog.Warn("unable to re-read canary token file, keeping the previous token", "path", c.token.path, "error", err)
+			}
+		}
+	}
+}
+
+// Ready returns the error of the last validation of the canary token.
+func (c *Canary) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+func (c *Canary) check(ctx context.Context) {
+	_, err := c.enforcer.parseToken(ctx, c.token.Value())
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		err = fmt.Errorf("canary token failed to validate: %w", err)
+		slog.Warn("canary token check failed", "error", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last = err
+}
@@ -0,0 +1,62 @@
+package teams_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+// waitReady polls c until Ready returns an error, or nil, as wantErr, failing t after a
+// second.
+func waitReady(t *testing.T, c *teams.Canary, wantErr bool) {
+	t.Helper()
+	var err error
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = c.Ready(); (err != nil) == wantErr {
+			return
+		}
+	}
+	t.Fatalf("Ready() = %v, want error %t", err, wantErr)
+}
+
+func TestCanary(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	expired, err := g.Token("1", 1, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "canary")
+	if err := os.WriteFile(path, []byte(expired), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := teams.NewCanary(gte, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ready(); err == nil {
+		t.Fatal("Ready() = nil before the canary token was validated")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx, 10*time.Millisecond)
+	waitReady(t, c, true)
+
+	// the token file is re-read, so a rotated token is picked up
+	if err := os.WriteFile(path, []byte(token(t, g, "1", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitReady(t, c, false)
+}
+
+func TestNewCanaryMissingFile(t *testing.T) {
+	g := newGrafana(t)
+	if _, err := teams.NewCanary(newEnforcer(t, g), filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("NewCanary() = nil error for a missing token file")
+	}
+}
@@ -0,0 +1,196 @@
+package teams
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// maxClientEntries bounds the number of (tenant, fingerprint) pairs a ClientTracker
+	// keeps; new pairs are not tracked past it until older ones leave the window.
+	maxClientEntries = 10000
+	// maxUserAgentProducts bounds the number of user agent products counted apart.
+	maxUserAgentProducts = 50
+	// maxUserAgentLength bounds the user agent kept in decisions.
+	maxUserAgentLength = 256
+	// clientReportSize is the number of fingerprints reported per tenant.
+	clientReportSize = 20
+)
+
+// clientFingerprint hashes the user agent of r with the subnet of its peer, /24 for IPv4
+// and /48 for IPv6, so clients can be told apart without keeping their address.
+func clientFingerprint(r *http.Request) string {
+	subnet := ""
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			addr = addr.Unmap()
+			bits := 48
+			if addr.Is4() {
+				bits = 24
+			}
+			if p, err := addr.Prefix(bits); err == nil {
+				subnet = p.String()
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(r.UserAgent() + "\n" + subnet))
+	return hex.EncodeToString(sum[:8])
+}
+
+// captureClient records the user agent and client fingerprint of r in d when
+// CaptureClients is set.
+func (gte GrafanaTeamsEnforcer) captureClient(d *Decision, r *http.Request) {
+	if !gte.CaptureClients {
+		return
+	}
+	ua := r.UserAgent()
+	if len(ua) > maxUserAgentLength {
+		ua = ua[:maxUserAgentLength]
+	}
+	d.UserAgent, d.ClientFingerprint = ua, clientFingerprint(r)
+}
+
+// ClientTracker keeps, for each tenant, the client fingerprints of the decisions taken
+// over a rolling window, and counts requests by user agent product. It is a
+// DecisionRecorder.
+type ClientTracker struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	clients map[clientKey]*clientEntry
+	// products holds the user agent products counted apart
+	products map[string]struct{}
+
+	requests *prometheus.CounterVec
+}
+
+type clientKey struct {
+	tenant      string
+	fingerprint string
+}
+
+type clientEntry struct {
+	userAgent string
+	// hits holds the time of the requests within the window, oldest first
+	hits []time.Time
+}
+
+// NewClientTracker creates a ClientTracker reporting over window, registering its metrics
+// with reg.
+func NewClientTracker(window time.Duration, reg prometheus.Registerer) *ClientTracker {
+	return &ClientTracker{
+		window:   window,
+		clients:  map[clientKey]*clientEntry{},
+		products: map[string]struct{}{},
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_client_requests_total",
+			Help: "Total number of requests by user agent product, the first token of the User-Agent header. Products past the first 50 seen are counted as other.",
+		}, []string{"product"}),
+	}
+}
+
+// Record implements DecisionRecorder.
+func (ct *ClientTracker) Record(d Decision) {
+	if d.ClientFingerprint == "" {
+		return
+	}
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.requests.WithLabelValues(ct.product(d.UserAgent)).Inc()
+	ct.prune(d.Time)
+	for _, tenant := range d.Teams {
+		k := clientKey{tenant: tenant, fingerprint: d.ClientFingerprint}
+		e, found := ct.clients[k]
+		if !found {
+			if len(ct.clients) >= maxClientEntries {
+				continue
+			}
+			e = &clientEntry{userAgent: d.UserAgent}
+			ct.clients[k] = e
+		}
+		e.hits = append(e.hits, d.Time)
+	}
+}
+
+// product returns the label value counting requests of userAgent. ct.mu must be held.
+func (ct *ClientTracker) product(userAgent string) string {
+	p, _, _ := strings.Cut(userAgent, "/")
+	p = strings.TrimSpace(p)
+	if p == "" {
+		return "none"
+	}
+	if _, found := ct.products[p]; !found {
+		if len(ct.products) >= maxUserAgentProducts {
+			return "other"
+		}
+		ct.products[p] = struct{}{}
+	}
+	return p
+}
+
+// prune drops the hits older than the window as of now. ct.mu must be held.
+func (ct *ClientTracker) prune(now time.Time) {
+	since := now.Add(-ct.window)
+	for k, e := range ct.clients {
+		i, _ := slices.BinarySearchFunc(e.hits, since, func(t, since time.Time) int { return t.Compare(since) })
+		if i == len(e.hits) {
+			delete(ct.clients, k)
+			continue
+		}
+		e.hits = e.hits[i:]
+	}
+}
+
+// ClientReport summarizes a client of a tenant over the window.
+type ClientReport struct {
+	Fingerprint string    `json:"fingerprint"`
+	UserAgent   string    `json:"userAgent"`
+	Requests    int       `json:"requests"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+// Report returns the clients of tenant with the most requests within the window.
+func (ct *ClientTracker) Report(tenant string) []ClientReport {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.prune(time.Now())
+
+	reports := []ClientReport{}
+	for k, e := range ct.clients {
+		if k.tenant == tenant {
+			reports = append(reports, ClientReport{Fingerprint: k.fingerprint, UserAgent: e.userAgent, Requests: len(e.hits), LastSeen: e.hits[len(e.hits)-1]})
+		}
+	}
+	slices.SortFunc(reports, func(a, b ClientReport) int {
+		return cmp.Or(cmp.Compare(b.Requests, a.Requests), strings.Compare(a.Fingerprint, b.Fingerprint))
+	})
+	return reports[:min(len(reports), clientReportSize)]
+}
+
+// ServeHTTP exposes the report of the tenant given by the tenant parameter as JSON.
+func (ct *ClientTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		http.Error(w, "the tenant parameter is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"tenant":  tenant,
+		"window":  ct.window.String(),
+		"clients": ct.Report(tenant),
+	})
+}
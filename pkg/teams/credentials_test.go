@@ -0,0 +1,78 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestExtractLabelCredentialsRejected(t *testing.T) {
+	g := newGrafana(t)
+
+	for _, tc := range []struct {
+		name     string
+		enforcer func(*testing.T, teams.GrafanaTeamsEnforcer) teams.GrafanaTeamsEnforcer
+		status   int
+		rejected float64
+	}{
+		{
+			name: "wrong admin password",
+			enforcer: func(t *testing.T, gte teams.GrafanaTeamsEnforcer) teams.GrafanaTeamsEnforcer {
+				gte.GrafanaPass = "wrong"
+				return gte
+			},
+			status:   http.StatusBadGateway,
+			rejected: 1,
+		},
+		{
+			name: "admin without permission",
+			enforcer: func(t *testing.T, gte teams.GrafanaTeamsEnforcer) teams.GrafanaTeamsEnforcer {
+				return withGrafanaAPI(t, gte, func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "permission denied", http.StatusForbidden)
+				})
+			},
+			status:   http.StatusBadGateway,
+			rejected: 1,
+		},
+		{
+			name: "other error",
+			enforcer: func(t *testing.T, gte teams.GrafanaTeamsEnforcer) teams.GrafanaTeamsEnforcer {
+				return withGrafanaAPI(t, gte, func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				})
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			// looking up as the user, Grafana rejects the token of the user, not the proxy's
+			// credentials
+			name: "looking up as the user",
+			enforcer: func(t *testing.T, gte teams.GrafanaTeamsEnforcer) teams.GrafanaTeamsEnforcer {
+				gte.LookupIdentity = teams.LookupAsSelf
+				return withGrafanaAPI(t, gte, func(w http.ResponseWriter, r *http.Request) {
+					http.Error(w, "invalid token", http.StatusUnauthorized)
+				})
+			},
+			status: http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.CredentialsRejected = teams.NewCredentialsRejected(prometheus.NewRegistry())
+			gte = tc.enforcer(t, gte)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if got := testutil.ToFloat64(gte.CredentialsRejected); got != tc.rejected {
+				t.Errorf("credentials rejected = %v, want %v", got, tc.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package teams
+
+import (
+	"context"
+	"net/http"
+	"slices"
+)
+
+const (
+	// DebugHeader is the request header asking for debug information in the response.
+	DebugHeader = "X-LBAC-Debug"
+	// DebugQuery is the DebugHeader value requesting the enforced query.
+	DebugQuery = "query"
+)
+
+// TenantsFromContext returns the label values enforced on the request.
+func TenantsFromContext(ctx context.Context) []string {
+	v, _ := ctx.Value(tenantsKey).([]string)
+	return v
+}
+
+// DebugRequested reports whether the authenticated caller asked for debug response headers.
+func DebugRequested(ctx context.Context) bool {
+	v, _ := ctx.Value(debugKey).(bool)
+	return v
+}
+
+// withDebug marks the request context for debug response headers when they are
+// enabled, asked for, and the caller is allowed to see them.
+func (gte GrafanaTeamsEnforcer) withDebug(r *http.Request, teamNames []string) context.Context {
+	if !gte.DebugHeaders || r.Header.Get(DebugHeader) != DebugQuery {
+		return r.Context()
+	}
+	r.Header.Del(DebugHeader)
+
+	if !gte.debugAllowed(teamNames) {
+		return r.Context()
+	}
+	return context.WithValue(r.Context(), debugKey, true)
+}
+
+// debugAllowed reports whether a caller with the label values teamNames may see debug
+// response headers.
+func (gte GrafanaTeamsEnforcer) debugAllowed(teamNames []string) bool {
+	return gte.DebugHeaders && (len(gte.DebugTeams) == 0 || slices.ContainsFunc(teamNames, func(t string) bool {
+		return slices.Contains(gte.DebugTeams, t)
+	}))
+}
@@ -0,0 +1,121 @@
+package teams
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Decision describes the outcome of authorizing a single request.
+type Decision struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	UserID string    `json:"userId,omitempty"`
+	OrgID  int64     `json:"orgId,omitempty"`
+	Teams  []string  `json:"teams,omitempty"`
+	Label  string    `json:"label,omitempty"`
+	// Datasource is the datasource UID the request was routed by, if any.
+	Datasource string `json:"datasource,omitempty"`
+	// Matcher is the label matcher enforced on the request.
+	Matcher string `json:"matcher,omitempty"`
+	// EnforcedMatcher is Matcher in a canonical form, its values sorted and deduplicated.
+	EnforcedMatcher string `json:"enforcedMatcher,omitempty"`
+	Status          int    `json:"status"`
+	// Justification is the reason given for a break-glass request.
+	Justification string `json:"justification,omitempty"`
+	// UserAgent and ClientFingerprint identify the client when CaptureClients is set.
+	UserAgent         string `json:"userAgent,omitempty"`
+	ClientFingerprint string `json:"clientFingerprint,omitempty"`
+
+	// forwarded is set once the request is handed over with its label values enforced.
+	forwarded bool
+	// bypassed is set once a break-glass request is handed over without enforcement.
+	bypassed bool
+}
+
+// DecisionRecorder is notified of every authorization decision taken by ExtractLabel.
+type DecisionRecorder interface {
+	Record(Decision)
+}
+
+// statusWriter records the status code written to the wrapped http.ResponseWriter and,
+// when a timer is set, adds the phases that are over to the response headers. onHeader,
+// when set, may add more headers before they are written.
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	timer    *requestTimer
+	onHeader func(http.Header)
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+		if sw.timer != nil {
+			sw.timer.writeTo(sw.Header())
+		}
+		if sw.onHeader != nil {
+			sw.onHeader(sw.Header())
+		}
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// RecentDecisions keeps the last decisions in a fixed-size ring buffer.
+type RecentDecisions struct {
+	mu   sync.Mutex
+	buf  []Decision
+	next int
+	full bool
+}
+
+// NewRecentDecisions creates a RecentDecisions holding up to size decisions.
+func NewRecentDecisions(size int) *RecentDecisions {
+	return &RecentDecisions{buf: make([]Decision, size)}
+}
+
+// Record implements DecisionRecorder.
+func (rd *RecentDecisions) Record(d Decision) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.buf[rd.next] = d
+	rd.next = (rd.next + 1) % len(rd.buf)
+	if rd.next == 0 {
+		rd.full = true
+	}
+}
+
+// List returns the recorded decisions, newest first.
+func (rd *RecentDecisions) List() []Decision {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	n := rd.next
+	if rd.full {
+		n = len(rd.buf)
+	}
+	out := make([]Decision, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, rd.buf[(rd.next-i+len(rd.buf))%len(rd.buf)])
+	}
+	return out
+}
+
+// ServeHTTP exposes the recorded decisions as JSON.
+func (rd *RecentDecisions) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rd.List())
+}
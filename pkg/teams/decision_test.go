@@ -0,0 +1,158 @@
+package teams_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+// decisionRecorder keeps the decisions it is notified of.
+type decisionRecorder struct {
+	mu        sync.Mutex
+	decisions []teams.Decision
+}
+
+func (dr *decisionRecorder) Record(d teams.Decision) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	dr.decisions = append(dr.decisions, d)
+}
+
+func TestDecisionEnforcedMatcher(t *testing.T) {
+	g := newGrafana(t)
+	// user 3 is listed in team-b before team-a, and twice in team-b of another ID
+	g.SetTeams("3",
+		teams.Team{ID: 2, OrgID: 1, Name: "team-b"},
+		teams.Team{ID: 1, OrgID: 1, Name: "team-a"},
+		teams.Team{ID: 4, OrgID: 1, Name: "team-b"},
+	)
+	gte := newEnforcer(t, g)
+
+	for _, tc := range []struct {
+		name    string
+		user    string
+		org     int64
+		matcher string
+	}{
+		{name: "sorted", user: "1", org: 1, matcher: `team=~"team-a|team-b"`},
+		{name: "unsorted with duplicates", user: "3", org: 1, matcher: `team=~"team-a|team-b"`},
+		{name: "single team", user: "1", org: 2, matcher: `team="team-c"`},
+		{name: "denied", user: "2", org: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &decisionRecorder{}
+			gte := gte
+			gte.Recorders = []teams.DecisionRecorder{rec}
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, tc.user, tc.org))
+			serve(gte.ExtractLabel(tenantsHandler), r)
+
+			if len(rec.decisions) != 1 {
+				t.Fatalf("%d decisions recorded, want 1", len(rec.decisions))
+			}
+			d := rec.decisions[0]
+			if d.EnforcedMatcher != tc.matcher {
+				t.Errorf("enforced matcher = %q, want %q", d.EnforcedMatcher, tc.matcher)
+			}
+			// the matcher as enforced is kept alongside, in the order the teams resolved in
+			if (d.Matcher == "") != (tc.matcher == "") {
+				t.Errorf("matcher = %q with enforced matcher %q", d.Matcher, d.EnforcedMatcher)
+			}
+		})
+	}
+}
+
+// userIDs returns the users of decisions.
+func userIDs(decisions []teams.Decision) []string {
+	ids := make([]string, 0, len(decisions))
+	for _, d := range decisions {
+		ids = append(ids, d.UserID)
+	}
+	return ids
+}
+
+func TestRecentDecisions(t *testing.T) {
+	rd := teams.NewRecentDecisions(3)
+	for i, want := range [][]string{
+		{"1"},
+		{"2", "1"},
+		{"3", "2", "1"},
+		// the oldest decisions are overwritten once full
+		{"4", "3", "2"},
+		{"5", "4", "3"},
+		{"6", "5", "4"},
+		{"7", "6", "5"},
+	} {
+		rd.Record(teams.Decision{UserID: fmt.Sprint(i + 1)})
+		if got := userIDs(rd.List()); !slices.Equal(got, want) {
+			t.Errorf("after %d decisions: List() = %q, want %q", i+1, got, want)
+		}
+	}
+
+	var listed []teams.Decision
+	w := serve(rd, httptest.NewRequest(http.MethodGet, "/debug/decisions", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if got := userIDs(listed); !slices.Equal(got, []string{"7", "6", "5"}) {
+		t.Errorf("served %q, want the last 3 decisions newest first", got)
+	}
+}
+
+func TestRecentDecisionsConcurrent(t *testing.T) {
+	const size, writers, records = 16, 8, 200
+	rd := teams.NewRecentDecisions(size)
+
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range records {
+				rd.Record(teams.Decision{UserID: fmt.Sprintf("%d-%d", i, j)})
+			}
+		}()
+	}
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range records {
+				var listed []teams.Decision
+				w := serve(rd, httptest.NewRequest(http.MethodGet, "/debug/decisions", nil))
+				if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+					t.Error(err)
+					return
+				}
+				if len(listed) > size {
+					t.Errorf("served %d decisions, want at most %d", len(listed), size)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the decisions of each writer are listed newest first, each once
+	listed := rd.List()
+	if len(listed) != size {
+		t.Fatalf("%d decisions kept, want %d", len(listed), size)
+	}
+	last := map[int]int{}
+	for _, d := range listed {
+		var i, j int
+		if _, err := fmt.Sscanf(d.UserID, "%d-%d", &i, &j); err != nil {
+			t.Fatal(err)
+		}
+		if prev, found := last[i]; found && j >= prev {
+			t.Errorf("decisions listed out of order: %q", userIDs(listed))
+		}
+		last[i] = j
+	}
+}
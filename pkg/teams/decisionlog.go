@@ -0,0 +1,150 @@
+package teams
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// decisionLogVersion is bumped whenever the decision log schema changes incompatibly.
+const decisionLogVersion = 1
+
+// decisionLogEntry is the schema of a decision log line. It is kept apart from Decision so
+// the file format only changes deliberately.
+type decisionLogEntry struct {
+	Version int       `json:"v"`
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	UserID  string    `json:"userId"`
+	OrgID   int64     `json:"orgId"`
+	Teams   []string  `json:"teams"`
+	Label   string    `json:"label"`
+	// Datasource is the datasource UID the request was routed by, empty for the default upstream.
+	Datasource string `json:"datasource"`
+	// Matcher is the label matcher enforced on the request, empty when it was denied.
+	Matcher string `json:"matcher"`
+	// EnforcedMatcher is Matcher in a canonical form, its values sorted and deduplicated, so
+	// requests restricted to the same scope log the same matcher. Empty when it was denied.
+	EnforcedMatcher string `json:"enforcedMatcher"`
+	Status          int    `json:"status"`
+	// Justification is the reason given for a break-glass request, which skipped enforcement.
+	Justification string `json:"justification"`
+	// UserAgent and ClientFingerprint are empty unless client capture is enabled.
+	UserAgent         string `json:"userAgent"`
+	ClientFingerprint string `json:"clientFingerprint"`
+}
+
+// DecisionLog appends every decision to a file as one JSON object per line. Once the file
+// grows past maxBytes it is rotated to <path>.1, replacing the previous rotation.
+type DecisionLog struct {
+	path     string
+	maxBytes int64
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewDecisionLog opens path for appending, creating it readable by the owner only.
+// A maxBytes of zero never rotates the file.
+func NewDecisionLog(path string, maxBytes int64) (*DecisionLog, error) {
+	dl := &DecisionLog{path: path, maxBytes: maxBytes}
+	if err := dl.open(); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func (dl *DecisionLog) open() error {
+	f, err := os.OpenFile(dl.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	dl.f, dl.size = f, fi.Size()
+	return nil
+}
+
+// Record implements DecisionRecorder.
+func (dl *DecisionLog) Record(d Decision) {
+	if d.Teams == nil {
+		d.Teams = []string{}
+	}
+	b, err := json.Marshal(decisionLogEntry{
+		Version:           decisionLogVersion,
+		Time:              d.Time,
+		Method:            d.Method,
+		Path:              d.Path,
+		UserID:            d.UserID,
+		OrgID:             d.OrgID,
+		Teams:             d.Teams,
+		Label:             d.Label,
+		Datasource:        d.Datasource,
+		Matcher:           d.Matcher,
+		EnforcedMatcher:   d.EnforcedMatcher,
+		Status:            d.Status,
+		Justification:     d.Justification,
+		UserAgent:         d.UserAgent,
+		ClientFingerprint: d.ClientFingerprint,
+	})
+	if err != nil {
+		slog.Error("failed to encode decision", "error", err)
+		return
+	}
+	b = append(b, '\n')
+
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.f == nil {
+		return
+	}
+	if dl.maxBytes > 0 && dl.size > 0 && dl.size+int64(len(b)) > dl.maxBytes {
+		if err := dl.rotate(); err != nil {
+			slog.Error("failed to rotate decision log", "path", dl.path, "error", err)
+			if dl.f == nil {
+				return
+			}
+		}
+	}
+	n, err := dl.f.Write(b)
+	dl.size += int64(n)
+	if err != nil {
+		slog.Error("failed to write decision log", "path", dl.path, "error", err)
+	}
+}
+
+// rotate moves the current file to <path>.1 and starts a new one.
+func (dl *DecisionLog) rotate() error {
+	if err := dl.f.Close(); err != nil {
+		return err
+	}
+	dl.f = nil
+	if err := os.Rename(dl.path, dl.path+".1"); err != nil {
+		// keep appending to the current file rather than losing decisions
+		if oerr := dl.open(); oerr != nil {
+			return fmt.Errorf("%w, and reopening failed: %v", err, oerr)
+		}
+		return err
+	}
+	return dl.open()
+}
+
+// Close closes the file. Decisions recorded afterwards are dropped.
+func (dl *DecisionLog) Close() error {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if dl.f == nil {
+		return nil
+	}
+	err := dl.f.Close()
+	dl.f = nil
+	return err
+}
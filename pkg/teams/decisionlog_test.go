@@ -0,0 +1,96 @@
+package teams
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readDecisionLog returns the entries of the decision log file at path.
+func readDecisionLog(t *testing.T, path string) []decisionLogEntry {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []decisionLogEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var e decisionLogEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", s.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestDecisionLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	dl, err := NewDecisionLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	dl.Record(Decision{Time: now, Method: "GET", Path: "/api/v1/query", UserID: "1", OrgID: 1, Teams: []string{"team-a"}, Label: "team", Matcher: `team="team-a"`, EnforcedMatcher: `team="team-a"`, Status: 200})
+	dl.Record(Decision{Time: now, Method: "GET", Path: "/api/v1/query", UserID: "2", OrgID: 1, Status: 404})
+	if err := dl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// decisions recorded once closed are dropped
+	dl.Record(Decision{Time: now, Status: 200})
+
+	entries := readDecisionLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("%d entries logged, want 2", len(entries))
+	}
+	if e := entries[0]; e.Version != decisionLogVersion || !e.Time.Equal(now) || e.UserID != "1" || e.Matcher != `team="team-a"` || e.EnforcedMatcher != `team="team-a"` || e.Status != 200 {
+		t.Errorf("first entry = %+v", e)
+	}
+	// denied requests log an empty list of teams, not null
+	if e := entries[1]; e.Teams == nil || len(e.Teams) != 0 || e.Status != 404 {
+		t.Errorf("second entry = %+v", e)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0o600 {
+		t.Errorf("file mode = %v, want 0600", mode)
+	}
+}
+
+func TestDecisionLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decisions.log")
+	dl, err := NewDecisionLog(path, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	for i := range 5 {
+		dl.Record(Decision{Time: time.Now(), Method: "GET", Path: "/api/v1/query", Status: 200 + i})
+	}
+
+	rotated, current := readDecisionLog(t, path+".1"), readDecisionLog(t, path)
+	if len(rotated) == 0 || len(current) == 0 {
+		t.Fatalf("%d rotated and %d current entries, want both", len(rotated), len(current))
+	}
+	if len(rotated)+len(current) > 5 {
+		t.Errorf("%d entries logged, want at most 5", len(rotated)+len(current))
+	}
+	if last := current[len(current)-1]; last.Status != 204 {
+		t.Errorf("last entry status = %d, want 204", last.Status)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() > 400 {
+		t.Errorf("file of %d bytes, over the 400 bytes it is rotated at", fi.Size())
+	}
+}
@@ -1,18 +1,24 @@
 package teams
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
-	"strconv"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/MicahParks/keyfunc/v3"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/patrickmn/go-cache"
-	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
 )
 
 type Team struct {
@@ -21,110 +27,469 @@ type Team struct {
 	Name  string `json:"name"`
 }
 
+// LookupIdentity selects the identity used to look up a user's teams in Grafana.
+type LookupIdentity string
+
+const (
+	// LookupAsAdmin looks up teams via /api/users/{id}/teams using the Grafana admin credentials.
+	LookupAsAdmin LookupIdentity = "admin"
+	// LookupAsSelf looks up teams via /api/user/teams by forwarding the caller's own Grafana identity.
+	LookupAsSelf LookupIdentity = "self"
+)
+
+type ctxKey int
+
+const (
+	// tokenKey holds a token already verified earlier in the request chain.
+	tokenKey ctxKey = iota
+	debugKey
+	tenantsKey
+	principalKey
+	decisionKey
+	datasourceKey
+	timingsKey
+)
+
+// maxDiagnosticBytes bounds how much of an unexpected Grafana response is reported.
+const maxDiagnosticBytes = 256
+
+// ErrGrafanaDependency is wrapped by errors caused by Grafana misbehaving rather than by
+// the request, e.g. an auth proxy answering in its place.
+var ErrGrafanaDependency = errors.New("grafana dependency failure")
+
+// ErrGrafanaCredentials is wrapped by the errors of the lookups Grafana answered with HTTP
+// status code 401 or 403 as LookupAsAdmin: the credentials of the proxy are rejected, not
+// the token of the user.
+var ErrGrafanaCredentials = fmt.Errorf("%w: Grafana rejected the credentials of the proxy", ErrGrafanaDependency)
+
+// forwardedIdentityHeaders are copied from the incoming request when looking up teams as
+// the caller, along with the TokenHeader.
+var forwardedIdentityHeaders = []string{"Authorization", "Cookie"}
+
 // GrafanaTeamsEnforcer enforces label values based on the Grafana teams a user is a member of.
 type GrafanaTeamsEnforcer struct {
+	// Label is the name of the label enforced, used to describe decisions.
+	Label       string
 	KeyFunc     keyfunc.Keyfunc
 	Cache       cache.Cache
 	Client      http.Client
 	GrafanaUrl  url.URL
 	GrafanaUser string
 	GrafanaPass string
+	// GrafanaPassFile, when set, provides the Grafana admin password instead of GrafanaPass.
+	GrafanaPassFile *SecretFile
+	// GrafanaToken, when set, is a service account token authenticating the lookups as
+	// LookupAsAdmin instead of GrafanaUser and GrafanaPass.
+	GrafanaToken string
+	// LookupIdentity selects how teams are looked up. Defaults to LookupAsAdmin.
+	LookupIdentity LookupIdentity
+	// LabelTemplate renders the label value of LabelSourceClaims.
+	LabelTemplate *LabelValueTemplate
+	// TeamResolver looks up the teams of users. Defaults to RESTTeamResolver.
+	TeamResolver TeamResolver
+	// RequiredClaims lists claim names that must be present in the token.
+	RequiredClaims []string
+	// ExpectedAzp, when set, must match the azp (authorized party) claim of the token.
+	ExpectedAzp string
+	// LabelSource selects what label values are derived from. Defaults to LabelSourceTeams.
+	LabelSource LabelSource
+	// FolderLabelField selects the folder field used as label value, "title" or "uid".
+	FolderLabelField string
+	// Freezer, when set, rejects requests for frozen tenants.
+	Freezer *Freezer
+	// DebugHeaders allows authenticated callers to request debug response headers.
+	DebugHeaders bool
+	// DebugTeams, when not empty, restricts debug response headers to members of these teams.
+	DebugTeams []string
+	// Recorders are notified of every authorization decision.
+	Recorders []DecisionRecorder
+	// NoCache bypasses Cache, looking up the teams of every request in Grafana.
+	NoCache bool
+	// CacheBudget, when set, bounds the approximate size of the values stored in Cache.
+	CacheBudget *CacheBudget
+	// CacheRecency, when set, bounds the number of entries of Cache and evicts the idle ones.
+	CacheRecency *CacheRecency
+	// Outcomes, when set, counts the requests enforced and denied.
+	Outcomes *prometheus.CounterVec
+	// RejectedClaims, when set, counts the tokens rejected for a malformed sub or aud claim.
+	RejectedClaims *prometheus.CounterVec
+	// CredentialsRejected, when set, counts the lookups failing with ErrGrafanaCredentials.
+	CredentialsRejected prometheus.Counter
+	// GrafanaLatency, when set, observes the durations of the team lookups sent to Grafana.
+	GrafanaLatency *prometheus.HistogramVec
+	// EmptyRevalidation, when set, refreshes cached empty team sets in the background.
+	EmptyRevalidation *EmptyRevalidation
+	// RemovalGrace, when set, keeps honoring label values a user lost for a grace period.
+	RemovalGrace *RemovalGrace
+	// RetryOnDecodeError retries Grafana requests once when the response cannot be decoded.
+	RetryOnDecodeError bool
+	// AllowOpaqueToken resolves X-Grafana-Id values that are not JWTs through IntrospectionPath.
+	AllowOpaqueToken bool
+	// IntrospectionPath is the Grafana path resolving opaque tokens to a user, e.g. /api/user.
+	IntrospectionPath string
+	// ErrorOnReplaceLabels rejects match[] selectors of the labels endpoints conflicting
+	// with the enforced matcher instead of combining them with it.
+	ErrorOnReplaceLabels bool
+	// Phases, when set, records the durations of the phases of every request.
+	Phases *PhaseMetrics
+	// HealthCheck, when set, adds diagnostics to the responses of datasource health checks.
+	HealthCheck *HealthCheck
+	// ServerTiming adds the durations of token validation, team resolution and the upstream
+	// request to responses in the Server-Timing header.
+	ServerTiming bool
+	// MaxTokenAge rejects tokens issued longer ago than it, whatever their expiry. Zero
+	// leaves the age unbounded.
+	MaxTokenAge time.Duration
+	// TokenHeader is the header carrying the token of the user, optionally prefixed with
+	// "Bearer ". Defaults to DefaultTokenHeader.
+	TokenHeader string
+	// MaxTokenBytes bounds the size of the X-Grafana-Id token. Zero leaves it unbounded.
+	MaxTokenBytes int
+	// MaxResponseBytes bounds the size of Grafana responses. Zero leaves them unbounded.
+	MaxResponseBytes int64
+	// InferOrgFromTeams proceeds with the org of the teams of the user when it cannot be
+	// read from the aud claim of the token, provided the teams all belong to a single org.
+	// It only applies to LabelSourceTeams.
+	InferOrgFromTeams bool
+	// CaptureClients records the user agent and a fingerprint of the client of every
+	// request in its decision.
+	CaptureClients bool
+	// TeamHierarchy, when set, grants the members of a team the label values of its
+	// descendant teams. It only applies to LabelSourceTeams.
+	TeamHierarchy TeamHierarchy
+	// TokenCache, when set, skips verifying the signature of tokens verified recently.
+	TokenCache *TokenCache
 }
 
+// ExtractLabel implements injectproxy.ExtractLabeler by chaining Authenticate,
+// ResolveTenants and InjectLabels, recording the decision taken for each request.
 func (gte GrafanaTeamsEnforcer) ExtractLabel(next http.HandlerFunc) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		signedToken := r.Header.Get("X-Grafana-Id")
-		if signedToken == "" {
-			slog.Error("no X-Grafana-Id header present")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+	h := gte.Authenticate(gte.ResolveTenants(gte.InjectLabels(next)))
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &statusWriter{ResponseWriter: rw}
+		ctx := r.Context()
+		var timer *requestTimer
+		if gte.Phases != nil || gte.ServerTiming {
+			timer = newRequestTimer()
+			ctx = context.WithValue(ctx, timingsKey, timer)
+			if gte.ServerTiming {
+				w.timer = timer
+			}
 		}
-
-		token, err := jwt.Parse(signedToken, gte.KeyFunc.Keyfunc)
-		if err != nil {
-			slog.Error("error while parsing token", "error", err)
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+		d := &Decision{Time: time.Now(), Method: r.Method, Path: r.URL.Path, Label: gte.Label}
+		d.Datasource, _ = r.Context().Value(datasourceKey).(string)
+		gte.captureClient(d, r)
+		if gte.HealthCheck != nil && gte.HealthCheck.matches(r) {
+			// the debug header is consumed once the label values are enforced
+			debug := r.Header.Get(DebugHeader) == DebugQuery
+			w.onHeader = func(h http.Header) {
+				gte.HealthCheck.writeTo(h, d, debug && gte.debugAllowed(d.Teams))
+			}
 		}
+		defer func() {
+			d.Status = w.status
+			if gte.Phases != nil {
+				gte.Phases.record(ctx, timer, d)
+			}
+			for _, rec := range gte.Recorders {
+				rec.Record(*d)
+			}
+			if gte.Outcomes != nil {
+				if d.forwarded {
+					gte.Outcomes.WithLabelValues(OutcomeEnforced).Inc()
+				} else {
+					gte.Outcomes.WithLabelValues(rejectedOutcome(d.Status)).Inc()
+				}
+			}
+		}()
 
-		// extract user id from subject
-		sub, err := token.Claims.GetSubject()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		userId := strings.Split(sub, ":")[1]
+		h.ServeHTTP(w, r.WithContext(context.WithValue(ctx, decisionKey, d)))
+	})
+}
 
-		aud, err := token.Claims.GetAudience()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// enforcedMatcher returns the matcher injectproxy enforces for values of label.
+func enforcedMatcher(label string, values []string) string {
+	return newEnforcedMatcher(label, values).String()
+}
 
-		// rfc7519 means that aud is generally an array, but in this case its just a string
-		if len(aud) != 1 {
-			http.Error(w, "aud claim must be a string, not an array", http.StatusInternalServerError)
-			return
-		}
-		orgId, err := strconv.ParseInt(strings.Split(aud[0], ":")[1], 0, 64)
-		if err != nil {
-			http.Error(w, "unable to parse aud claim to fetch orgId", http.StatusInternalServerError)
-			return
-		}
+// normalizedMatcher returns the matcher enforced for values of label in a canonical form,
+// its values sorted and deduplicated.
+func normalizedMatcher(label string, values []string) string {
+	return enforcedMatcher(label, slices.Compact(slices.Sorted(slices.Values(values))))
+}
 
-		teams, err := gte.fetchTeamsForUser(userId)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+// newEnforcedMatcher builds the matcher injectproxy enforces for values of label.
+func newEnforcedMatcher(label string, values []string) *labels.Matcher {
+	if len(values) == 1 {
+		return labels.MustNewMatcher(labels.MatchEqual, label, values[0])
+	}
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return labels.MustNewMatcher(labels.MatchRegexp, label, strings.Join(quoted, "|"))
+}
 
-		// filter only for teams in the same org
-		var teamNames []string
-		for _, t := range teams {
-			if t.OrgID == orgId {
-				teamNames = append(teamNames, t.Name)
-			}
-		}
+// resolveLabelValues returns the label values userId may access in orgId, derived from
+// the configured LabelSource. It returns nil when there are none.
+func (gte GrafanaTeamsEnforcer) resolveLabelValues(r *http.Request, userId string, orgId int64) ([]string, error) {
+	values, err := gte.fetchLabelValues(r, userId, orgId)
+	if err != nil {
+		return nil, err
+	}
+	if gte.RemovalGrace != nil {
+		values = gte.RemovalGrace.apply(fmt.Sprintf("%s@%d", userId, orgId), values)
+	}
+	return values, nil
+}
+
+func (gte GrafanaTeamsEnforcer) fetchLabelValues(r *http.Request, userId string, orgId int64) ([]string, error) {
+	if gte.labelSource() == LabelSourceFolders {
+		return gte.fetchFolderValuesForUser(r, userId)
+	}
+	if gte.labelSource() == LabelSourceClaims {
+		return gte.claimLabelValues(r)
+	}
+
+	teams, err := gte.fetchTeamsForUser(r, userId)
+	if err != nil {
+		return nil, err
+	}
 
-		if teamNames == nil {
-			http.Error(w, fmt.Sprintf("userId=%s is not a member of any teams in orgId=%d", userId, orgId), http.StatusNotFound)
-			return
+	// filter only for teams in the same org
+	var teamNames []string
+	for _, t := range teams {
+		if t.OrgID == orgId {
+			teamNames = append(teamNames, t.Name)
 		}
+	}
+	if gte.TeamHierarchy != nil && teamNames != nil {
+		teamNames = gte.TeamHierarchy.expand(teamNames)
+	}
+	return teamNames, nil
+}
 
-		next(w, r.WithContext(injectproxy.WithLabelValues(r.Context(), teamNames)))
-	})
+// inferOrg returns the org of the teams of userId, provided they all belong to the same
+// one.
+func (gte GrafanaTeamsEnforcer) inferOrg(r *http.Request, userId string) (int64, error) {
+	teams, err := gte.fetchTeamsForUser(r, userId)
+	if err != nil {
+		return 0, err
+	}
+	var orgs []int64
+	for _, t := range teams {
+		if !slices.Contains(orgs, t.OrgID) {
+			orgs = append(orgs, t.OrgID)
+		}
+	}
+	if len(orgs) != 1 {
+		return 0, fmt.Errorf("userId=%s has teams in %d orgs, the org cannot be inferred", userId, len(orgs))
+	}
+	slog.Debug("inferred org from teams", "userId", userId, "orgId", orgs[0])
+	return orgs[0], nil
 }
 
-func (gte GrafanaTeamsEnforcer) fetchTeamsForUser(userId string) ([]Team, error) {
+func (gte GrafanaTeamsEnforcer) fetchTeamsForUser(in *http.Request, userId string) ([]Team, error) {
 	// fetch from cache
-	if t, found := gte.Cache.Get(userId); found {
+	if t, found := gte.cacheGet(userId); found {
+		if timer := timerFromContext(in.Context()); timer != nil {
+			timer.observeCacheHit()
+		}
+		if gte.EmptyRevalidation != nil && len(t.([]Team)) == 0 {
+			gte.revalidateEmptyTeams(in, userId)
+		}
 		return t.([]Team), nil
 	}
 
-	path := fmt.Sprintf("/api/users/%s/teams", userId)
-	u := gte.GrafanaUrl.JoinPath(path)
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	start := time.Now()
+	t, err := gte.teamResolver().ResolveTeams(gte, in, userId)
+	gte.observeGrafana(in.Context(), start, err)
 	if err != nil {
-		return nil, fmt.Errorf("create request failed: %w", err)
+		return nil, gte.credentialsError(err)
+	}
+
+	// set cache
+	gte.cacheSet(userId, t)
+
+	return t, nil
+}
+
+// credentialsError returns ErrGrafanaCredentials in place of err, the error of a lookup,
+// when Grafana answered it with HTTP status code 401 or 403 as LookupAsAdmin, logging and
+// counting the rejection. Looking up as LookupAsSelf, such answers reject the user instead.
+func (gte GrafanaTeamsEnforcer) credentialsError(err error) error {
+	var se statusError
+	if gte.LookupIdentity == LookupAsSelf || !errors.As(err, &se) || int(se) != http.StatusUnauthorized && int(se) != http.StatusForbidden {
+		return err
+	}
+	slog.Error("Grafana rejected the credentials of the proxy, check GRAFANA_ADMIN_USER, GRAFANA_ADMIN_PASS or --grafana-token", "grafana", gte.GrafanaUrl.Redacted(), "status", int(se))
+	if gte.CredentialsRejected != nil {
+		gte.CredentialsRejected.Inc()
+	}
+	return fmt.Errorf("%w (HTTP status code %d)", ErrGrafanaCredentials, int(se))
+}
+
+// cacheGet reads key from the cache unless NoCache is set, recording its use with the
+// CacheRecency when one is set.
+func (gte GrafanaTeamsEnforcer) cacheGet(key string) (any, bool) {
+	if gte.NoCache {
+		return nil, false
+	}
+	v, found := gte.Cache.Get(key)
+	if found && gte.CacheRecency != nil {
+		gte.CacheRecency.Get(key)
+	}
+	return v, found
+}
+
+// cacheSet stores v in the cache unless NoCache is set, within the CacheBudget and the
+// CacheRecency when they are set.
+func (gte GrafanaTeamsEnforcer) cacheSet(key string, v any) {
+	if gte.NoCache {
+		return
+	}
+	if gte.CacheBudget != nil {
+		gte.CacheBudget.Set(key, v, cache.DefaultExpiration)
+	} else {
+		gte.Cache.Set(key, v, cache.DefaultExpiration)
+	}
+	if gte.CacheRecency != nil {
+		gte.CacheRecency.Set(key)
+	}
+}
+
+// getJSON sends req to Grafana and decodes the JSON response into v. Decode failures
+// are retried once when RetryOnDecodeError is set.
+func (gte GrafanaTeamsEnforcer) getJSON(req *http.Request, v any) error {
+	err := gte.fetchJSON(req, v)
+	var de decodeError
+	if gte.RetryOnDecodeError && errors.As(err, &de) && req.Context().Err() == nil {
+		slog.Warn("retrying Grafana request after decode failure", "path", req.URL.Path)
+		err = gte.fetchJSON(req, v)
 	}
-	req.SetBasicAuth(gte.GrafanaUser, gte.GrafanaPass)
+	return err
+}
+
+// decodeError is returned when a Grafana response cannot be decoded.
+type decodeError struct {
+	err error
+}
+
+func (e decodeError) Error() string { return fmt.Sprintf("unmarshal failed: %v", e.err) }
+
+func (e decodeError) Unwrap() error { return e.err }
+
+// statusError is returned when Grafana answers with a status code other than 200.
+type statusError int
+
+func (e statusError) Error() string { return fmt.Sprintf("unexepected status: %d", int(e)) }
+
+func (gte GrafanaTeamsEnforcer) fetchJSON(req *http.Request, v any) error {
 	r, err := gte.Client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return fmt.Errorf("request failed: %w", err)
 	}
 	defer r.Body.Close()
 
 	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexepected status: %d", r.StatusCode)
+		return statusError(r.StatusCode)
 	}
 
-	var t []Team
-	if err = json.NewDecoder(r.Body).Decode(&t); err != nil {
-		return nil, fmt.Errorf("unmarshal failed: %w", err)
+	if ct := r.Header.Get("Content-Type"); ct != "" && !isJSON(ct) {
+		snippet, _ := io.ReadAll(io.LimitReader(r.Body, maxDiagnosticBytes))
+		return fmt.Errorf("%w: Grafana API returned non-JSON (possible auth proxy interception), content type %q, body %q",
+			ErrGrafanaDependency, ct, snippet)
 	}
 
-	// set cache
-	gte.Cache.Set(userId, t, cache.DefaultExpiration)
+	var body io.Reader = r.Body
+	if gte.MaxResponseBytes > 0 {
+		// read one byte past the limit to tell a truncated body from one of exactly the limit
+		body = io.LimitReader(r.Body, gte.MaxResponseBytes+1)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return fmt.Errorf("read response failed: %w", err)
+	}
+	if gte.MaxResponseBytes > 0 && int64(len(b)) > gte.MaxResponseBytes {
+		return fmt.Errorf("response from %s exceeds the maximum size of %d bytes", req.URL.Path, gte.MaxResponseBytes)
+	}
 
-	return t, nil
+	if err = json.Unmarshal(b, v); err != nil {
+		slog.Error("unable to decode Grafana response", "path", req.URL.Path, "size", len(b), "body", string(b[:min(len(b), maxDiagnosticBytes)]), "error", err)
+		return decodeError{err: err}
+	}
+	return nil
+}
+
+// isJSON reports whether the media type of contentType is JSON.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// GrafanaVersion returns the version reported by Grafana's health endpoint.
+func (gte GrafanaTeamsEnforcer) GrafanaVersion(ctx context.Context) (string, error) {
+	u := gte.GrafanaUrl.JoinPath("/api/health")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("create request failed: %w", err)
+	}
+	var health struct {
+		Version string `json:"version"`
+	}
+	if err := gte.getJSON(req, &health); err != nil {
+		return "", err
+	}
+	return health.Version, nil
+}
+
+// newTeamsRequest builds the Grafana request listing the teams of userId, authenticated
+// according to the configured LookupIdentity.
+func (gte GrafanaTeamsEnforcer) newTeamsRequest(in *http.Request, userId string) (*http.Request, error) {
+	if gte.LookupIdentity == LookupAsSelf {
+		return gte.newLookupRequest(in, "/api/user/teams")
+	}
+	return gte.newLookupRequest(in, fmt.Sprintf("/api/users/%s/teams", userId))
+}
+
+// newLookupRequest builds a Grafana request to path on behalf of the request in,
+// authenticated according to the configured LookupIdentity.
+func (gte GrafanaTeamsEnforcer) newLookupRequest(in *http.Request, path string) (*http.Request, error) {
+	u := gte.GrafanaUrl.JoinPath(path)
+	req, err := http.NewRequestWithContext(in.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if gte.LookupIdentity == LookupAsSelf {
+		gte.forwardIdentity(in, req)
+		return req, nil
+	}
+
+	if gte.GrafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+gte.GrafanaToken)
+		return req, nil
+	}
+	pass := gte.GrafanaPass
+	if gte.GrafanaPassFile != nil {
+		pass = gte.GrafanaPassFile.Value()
+	}
+	req.SetBasicAuth(gte.GrafanaUser, pass)
+	return req, nil
+}
+
+// isCanceled reports whether err was caused by the request context going away
+// (client disconnect or shutdown) rather than by a genuine failure.
+func isCanceled(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled)
+}
+
+// forwardIdentity copies the TokenHeader and the forwardedIdentityHeaders of the request in
+// to req, a request to Grafana made as the caller.
+func (gte GrafanaTeamsEnforcer) forwardIdentity(in, req *http.Request) {
+	for _, h := range append([]string{gte.tokenHeader()}, forwardedIdentityHeaders...) {
+		if v := in.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
 }
@@ -0,0 +1,385 @@
+package teams_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestExtractLabel(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+
+	for _, tc := range []struct {
+		name    string
+		user    string
+		org     int64
+		status  int
+		tenants string
+	}{
+		{name: "teams of the org", user: "1", org: 1, status: http.StatusOK, tenants: "team-a\nteam-b\n"},
+		{name: "other org", user: "1", org: 2, status: http.StatusOK, tenants: "team-c\n"},
+		{name: "no team", user: "2", org: 1, status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, tc.user, tc.org))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.tenants {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+			}
+		})
+	}
+}
+
+func TestExtractLabelCancelled(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+	if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusServiceUnavailable, w.Body)
+	}
+}
+
+func TestExtractLabelRequiredClaims(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.RequiredClaims = []string{"email"}
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{name: "claim present", claims: jwt.MapClaims{"email": "user@example.com"}, status: http.StatusOK},
+		{name: "claim missing", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, tc.claims))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestExtractLabelMaxResponseBytes(t *testing.T) {
+	g := newGrafana(t)
+
+	for _, tc := range []struct {
+		name   string
+		max    int64
+		status int
+	}{
+		{name: "unbounded", status: http.StatusOK},
+		{name: "within the bound", max: 1 << 20, status: http.StatusOK},
+		{name: "over the bound", max: 16, status: http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.MaxResponseBytes = tc.max
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestExtractLabelExpectedAzp(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.ExpectedAzp = "grafana"
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{name: "expected party", claims: jwt.MapClaims{"azp": "grafana"}, status: http.StatusOK},
+		{name: "other party", claims: jwt.MapClaims{"azp": "other"}, status: http.StatusUnauthorized},
+		{name: "no azp claim", status: http.StatusUnauthorized},
+		{name: "not a string", claims: jwt.MapClaims{"azp": 1}, status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, tc.claims))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestExtractLabelMaxTokenAge(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.MaxTokenAge = time.Hour
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{name: "just issued", status: http.StatusOK},
+		{name: "just within the max age", claims: jwt.MapClaims{"iat": time.Now().Add(-time.Hour + time.Minute).Unix()}, status: http.StatusOK},
+		{name: "just beyond the max age", claims: jwt.MapClaims{"iat": time.Now().Add(-time.Hour - time.Minute).Unix()}, status: http.StatusUnauthorized},
+		{name: "no iat claim", claims: jwt.MapClaims{"iat": nil}, status: http.StatusUnauthorized},
+		{name: "invalid iat claim", claims: jwt.MapClaims{"iat": "yesterday"}, status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, tc.claims))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+
+	// tokens of any age are accepted when the age is unbounded
+	gte.MaxTokenAge = 0
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"iat": time.Now().Add(-24 * time.Hour).Unix()}))
+	if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != http.StatusOK {
+		t.Errorf("status = %d with the age unbounded, want 200: %s", w.Code, w.Body)
+	}
+}
+
+func TestMiddlewaresServeOnTheirOwn(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+
+	var principal teams.Principal
+	authenticated := gte.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = teams.PrincipalFromContext(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", token(t, g, "1", 2))
+	if w := serve(authenticated, r); w.Code != http.StatusOK {
+		t.Fatalf("Authenticate: status = %d: %s", w.Code, w.Body)
+	}
+	if principal.UserID != "1" || principal.OrgID != 2 || principal.Token == nil {
+		t.Errorf("Authenticate stored %+v, want user 1 of org 2 with its token", principal)
+	}
+
+	resolved := gte.Authenticate(gte.ResolveTenants(tenantsHandler))
+	if w := serve(resolved, r); w.Code != http.StatusOK || w.Body.String() != "team-c\n" {
+		t.Errorf("Authenticate and ResolveTenants: %d %q, want the teams of org 2", w.Code, w.Body)
+	}
+
+	unauthenticated := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	if w := serve(gte.ResolveTenants(tenantsHandler), unauthenticated); w.Code != http.StatusUnauthorized {
+		t.Errorf("ResolveTenants without Authenticate: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(gte.InjectLabels(tenantsHandler), unauthenticated); w.Code != http.StatusForbidden {
+		t.Errorf("InjectLabels without ResolveTenants: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// withGrafanaAPI points the team lookups of gte to a server answering with h.
+func withGrafanaAPI(t *testing.T, gte teams.GrafanaTeamsEnforcer, h http.HandlerFunc) teams.GrafanaTeamsEnforcer {
+	t.Helper()
+	s := httptest.NewServer(h)
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gte.GrafanaUrl = *u
+	return gte
+}
+
+func TestExtractLabelNonJSONGrafanaResponse(t *testing.T) {
+	g := newGrafana(t)
+	gte := withGrafanaAPI(t, newEnforcer(t, g), func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>Sign in</html>"))
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+	w := serve(gte.ExtractLabel(tenantsHandler), r)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusBadGateway)
+	}
+	if !strings.Contains(w.Body.String(), "text/html") {
+		t.Errorf("body = %q, want the content type reported", w.Body)
+	}
+}
+
+func TestExtractLabelRetryOnDecodeError(t *testing.T) {
+	g := newGrafana(t)
+
+	for _, tc := range []struct {
+		name     string
+		retry    bool
+		status   int
+		requests int
+	}{
+		{name: "retried", retry: true, status: http.StatusOK, requests: 2},
+		{name: "not retried", status: http.StatusInternalServerError, requests: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			gte := withGrafanaAPI(t, newEnforcer(t, g), func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Header().Set("Content-Type", "application/json")
+				if requests == 1 {
+					// truncated
+					w.Write([]byte(`[{"id": 1, "orgId": 1, "na`))
+					return
+				}
+				w.Write([]byte(`[{"id": 1, "orgId": 1, "name": "team-a"}]`))
+			})
+			gte.RetryOnDecodeError = tc.retry
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if requests != tc.requests {
+				t.Errorf("Grafana requested %d times, want %d", requests, tc.requests)
+			}
+		})
+	}
+}
+
+func TestExtractLabelRejectsOversizedTokens(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.MaxTokenBytes = 2048
+
+	manyClaims := jwt.MapClaims{}
+	for i := range 100 {
+		manyClaims[fmt.Sprintf("c%d", i)] = i
+	}
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "within the bounds", token: token(t, g, "1", 1), status: http.StatusOK},
+		{name: "too large", token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"pad": strings.Repeat("x", 2048)}), status: http.StatusUnauthorized},
+		{name: "too many claims", token: tokenWithClaims(t, g, "1", 1, manyClaims), status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tc.token)
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+		})
+	}
+}
+
+func FuzzExtractLabelToken(f *testing.F) {
+	g := newGrafana(f)
+	gte := newEnforcer(f, g)
+	gte.MaxTokenBytes = 4096
+
+	valid := token(f, g, "1", 1)
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add(strings.Repeat("a", 5000))
+	f.Add("a.b.c")
+	f.Add("eyJhbGciOiJub25lIn0.eyJzdWIiOiJ1c2VyOjEifQ.")
+	f.Fuzz(func(t *testing.T, s string) {
+		// tokens of unknown kids otherwise wait for the JWKS refresh to be allowed
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/query", nil)
+		r.Header["X-Grafana-Id"] = []string{s}
+		w := serve(gte.ExtractLabel(tenantsHandler), r)
+		if s != valid && w.Code == http.StatusOK {
+			t.Errorf("token %q accepted", s)
+		}
+		if len(s) > gte.MaxTokenBytes && w.Code != http.StatusUnauthorized {
+			t.Errorf("token of %d bytes answered %d, want %d", len(s), w.Code, http.StatusUnauthorized)
+		}
+	})
+}
+
+func TestExtractLabelInferOrgFromTeams(t *testing.T) {
+	g := newGrafana(t)
+	g.SetTeams("3", teams.Team{ID: 4, OrgID: 2, Name: "team-d"}, teams.Team{ID: 5, OrgID: 2, Name: "team-e"})
+
+	for _, tc := range []struct {
+		name   string
+		infer  bool
+		user   string
+		aud    any
+		status int
+		want   string
+	}{
+		{name: "teams in a single org", infer: true, user: "3", aud: "grafana", status: http.StatusOK, want: "team-d\nteam-e\n"},
+		{name: "no aud claim", infer: true, user: "3", status: http.StatusOK, want: "team-d\nteam-e\n"},
+		{name: "teams in several orgs", infer: true, user: "1", aud: "grafana", status: http.StatusUnauthorized},
+		{name: "no team", infer: true, user: "2", aud: "grafana", status: http.StatusUnauthorized},
+		{name: "aud claim parsed", infer: true, user: "1", aud: "org:2", status: http.StatusOK, want: "team-c\n"},
+		{name: "disabled", user: "3", aud: "grafana", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.InferOrgFromTeams = tc.infer
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			// a nil aud is removed from the claims
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, tc.user, 1, jwt.MapClaims{"aud": tc.aud}))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
+
+// BenchmarkAuthenticate verifies the same token over and over, as under high QPS, with and
+// without the TokenCache skipping the verification of its signature.
+func BenchmarkAuthenticate(b *testing.B) {
+	g := newGrafana(b)
+	signed := token(b, g, "1", 1)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, bc := range []struct {
+		name  string
+		cache *teams.TokenCache
+	}{
+		{name: "uncached"},
+		{name: "cached", cache: teams.NewTokenCache(time.Minute, prometheus.NewRegistry())},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			gte := newEnforcer(b, g)
+			gte.TokenCache = bc.cache
+			h := gte.Authenticate(ok)
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", signed)
+			b.ReportAllocs()
+			for b.Loop() {
+				if w := serve(h, r); w.Code != http.StatusOK {
+					b.Fatalf("status = %d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
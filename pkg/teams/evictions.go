@@ -0,0 +1,127 @@
+package teams
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reasons entries leave the cache for.
+const (
+	// EvictionExpired is recorded for entries removed by the janitor once expired.
+	EvictionExpired = "expired"
+	// EvictionBudget is recorded for entries removed to stay within the CacheBudget.
+	EvictionBudget = "budget"
+	// EvictionLRU is recorded for entries removed to stay within the maximum number of
+	// entries of the CacheRecency.
+	EvictionLRU = "lru"
+	// EvictionIdle is recorded for entries removed as they were not used within the idle
+	// timeout of the CacheRecency.
+	EvictionIdle = "idle"
+	// EvictionManual is recorded for entries removed through ServeHTTP.
+	EvictionManual = "manual"
+)
+
+// CacheEvictions logs and counts the entries leaving a cache, by reason. It owns the
+// OnEvicted callback of the cache, which go-cache only calls for entries deleted or
+// expired, not for entries replaced by Set.
+type CacheEvictions struct {
+	c *cache.Cache
+
+	mu sync.Mutex
+	// pending holds the reason of the deletions under way, by key
+	pending   map[string]string
+	listeners []func(key string)
+
+	evictions *prometheus.CounterVec
+}
+
+// NewCacheEvictions takes over the OnEvicted callback of c, registering its metrics with
+// reg.
+func NewCacheEvictions(c *cache.Cache, reg prometheus.Registerer) *CacheEvictions {
+	ce := &CacheEvictions{
+		c:       c,
+		pending: map[string]string{},
+		evictions: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_cache_evictions_total",
+			Help: "Total number of entries removed from the teams cache, by reason.",
+		}, []string{"reason"}),
+	}
+	for _, reason := range []string{EvictionExpired, EvictionBudget, EvictionLRU, EvictionIdle, EvictionManual} {
+		ce.evictions.WithLabelValues(reason)
+	}
+	c.OnEvicted(ce.evicted)
+	return ce
+}
+
+// Listen calls f with the key of every entry leaving the cache.
+func (ce *CacheEvictions) Listen(f func(key string)) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.listeners = append(ce.listeners, f)
+}
+
+// Delete removes key from the cache, recording reason as the cause of its eviction.
+func (ce *CacheEvictions) Delete(key, reason string) {
+	ce.mu.Lock()
+	ce.pending[key] = reason
+	ce.mu.Unlock()
+
+	// Delete calls the OnEvicted callback, which takes the lock again
+	ce.c.Delete(key)
+
+	ce.mu.Lock()
+	delete(ce.pending, key)
+	ce.mu.Unlock()
+}
+
+func (ce *CacheEvictions) evicted(key string, _ any) {
+	ce.mu.Lock()
+	reason, found := ce.pending[key]
+	if !found {
+		// the janitor is the only other caller of the callback
+		reason = EvictionExpired
+	}
+	listeners := ce.listeners
+	ce.mu.Unlock()
+
+	slog.Debug("cache entry evicted", "key", key, "reason", reason)
+	ce.evictions.WithLabelValues(reason).Inc()
+	for _, f := range listeners {
+		f(key)
+	}
+}
+
+// ServeHTTP evicts the cached teams and folders of the user at /cache/<userId>, so that
+// they are looked up again on their next request. Only DELETE requests are accepted.
+func (ce *CacheEvictions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userId := strings.TrimPrefix(r.URL.Path, "/cache/")
+	if userId == "" || strings.Contains(userId, "/") {
+		http.Error(w, "expected /cache/<userId>", http.StatusNotFound)
+		return
+	}
+
+	evicted := 0
+	for _, key := range []string{userId, folderCacheKey(userId)} {
+		if _, found := ce.c.Get(key); found {
+			ce.Delete(key, EvictionManual)
+			evicted++
+		}
+	}
+	if evicted == 0 {
+		http.Error(w, fmt.Sprintf("nothing cached for userId=%s", userId), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package teams
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCacheEvictionsExpired(t *testing.T) {
+	c := cache.New(time.Minute, 5*time.Millisecond)
+	ce := NewCacheEvictions(c, prometheus.NewRegistry())
+	evicted := make(chan string, 1)
+	ce.Listen(func(key string) { evicted <- key })
+
+	c.Set("1", []Team{{ID: 1, OrgID: 1, Name: "team-a"}}, 10*time.Millisecond)
+	select {
+	case key := <-evicted:
+		if key != "1" {
+			t.Errorf("evicted %q, want 1", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expired entry not evicted")
+	}
+	if got := testutil.ToFloat64(ce.evictions.WithLabelValues(EvictionExpired)); got != 1 {
+		t.Errorf("evictions by expiry = %v, want 1", got)
+	}
+}
+
+func TestCacheEvictionsServeHTTP(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	ce := NewCacheEvictions(c, prometheus.NewRegistry())
+	var evicted []string
+	ce.Listen(func(key string) { evicted = append(evicted, key) })
+	c.Set("1", []Team{{ID: 1, OrgID: 1, Name: "team-a"}}, time.Minute)
+	c.Set(folderCacheKey("1"), []string{"folder"}, time.Minute)
+	c.Set("2", []Team{}, time.Minute)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		// only DELETE evicts
+		{method: http.MethodGet, path: "/cache/1", status: http.StatusMethodNotAllowed},
+		{method: http.MethodPost, path: "/cache/2", status: http.StatusMethodNotAllowed},
+		{method: http.MethodDelete, path: "/cache/1", status: http.StatusNoContent},
+		{method: http.MethodDelete, path: "/cache/1", status: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/cache/3", status: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/cache/", status: http.StatusNotFound},
+		{method: http.MethodDelete, path: "/cache/2/teams", status: http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		ce.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.path, w.Code, tc.status)
+		}
+	}
+
+	// the teams and the folders of user 1 are evicted, user 2 is left alone
+	if len(evicted) != 2 || evicted[0] != "1" || evicted[1] != folderCacheKey("1") {
+		t.Errorf("evicted %q, want the teams and folders of user 1", evicted)
+	}
+	if _, found := c.Get("2"); !found {
+		t.Error("user 2 evicted")
+	}
+	if got := testutil.ToFloat64(ce.evictions.WithLabelValues(EvictionManual)); got != 2 {
+		t.Errorf("manual evictions = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(ce.evictions.WithLabelValues(EvictionExpired)); got != 0 {
+		t.Errorf("evictions by expiry = %v, want 0", got)
+	}
+}
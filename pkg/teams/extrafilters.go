@@ -0,0 +1,107 @@
+package teams
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// UpstreamFlavor is the kind of upstream the enforced requests are sent to.
+type UpstreamFlavor string
+
+const (
+	// UpstreamPrometheus enforces the label values by rewriting the selectors of the
+	// requests with injectproxy.
+	UpstreamPrometheus UpstreamFlavor = "prometheus"
+	// UpstreamVictoriaMetrics enforces the label values with the extra_filters[] parameter
+	// of VictoriaMetrics wherever it is supported, leaving the selectors untouched.
+	UpstreamVictoriaMetrics UpstreamFlavor = "victoriametrics"
+)
+
+// extraFiltersParam is the parameter VictoriaMetrics ANDs into every series selector of a
+// request. Several extra_filters[] are ORed together.
+const extraFiltersParam = "extra_filters[]"
+
+// clientFilterParams are the VictoriaMetrics parameters removed from the requests of the
+// clients, as they could widen or bypass the enforced filter.
+var clientFilterParams = []string{"extra_filters", extraFiltersParam, "extra_label", "extra_label[]"}
+
+// isExtraFiltersPath reports whether path is an endpoint enforced by injectproxy that
+// VictoriaMetrics applies extra_filters[] to. The labels endpoints are only enforced when
+// labelAPIs is set, as injectproxy does with --enable-label-apis.
+func isExtraFiltersPath(path string, labelAPIs bool) bool {
+	if isLabelsPath(path) {
+		return labelAPIs
+	}
+	return path == "/api/v1/query" || path == "/api/v1/query_range" || path == "/federate" || isMatchPath(path)
+}
+
+// ExtraFilters enforces the label values of the requests to the endpoints supporting
+// extra_filters[] by sending them to Upstream with a single extra_filters[] holding the
+// enforced matcher, once any extra_filters or extra_label sent by the client are removed.
+// Requests to any other endpoint go to Next, the injectproxy routes rewriting their
+// selectors.
+//
+// Selectors matching other values of the label are not rejected with error-on-replace:
+// VictoriaMetrics ANDs them with the filter, so they select nothing.
+type ExtraFilters struct {
+	// Enforcer resolves the label values of the requests, its Label set to the enforced
+	// label.
+	Enforcer GrafanaTeamsEnforcer
+	Upstream http.Handler
+	Next     http.Handler
+	// LabelAPIs enforces the labels endpoints with extra_filters[] as well, to be set along
+	// with --enable-label-apis. Otherwise their requests go to Next.
+	LabelAPIs bool
+}
+
+func (ef ExtraFilters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isExtraFiltersPath(r.URL.Path, ef.LabelAPIs) || r.Method != http.MethodGet && r.Method != http.MethodPost {
+		ef.Next.ServeHTTP(w, r)
+		return
+	}
+	ef.Enforcer.ExtractLabel(func(w http.ResponseWriter, r *http.Request) {
+		if err := setExtraFilters(r, enforcedMatcher(ef.Enforcer.Label, TenantsFromContext(r.Context()))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Debug("enforcing with extra_filters", "path", r.URL.Path, "filter", r.URL.Query().Get(extraFiltersParam))
+		ef.Upstream.ServeHTTP(w, r)
+	}).ServeHTTP(w, r)
+}
+
+// setExtraFilters removes the filter parameters of the client from the URL and the POST
+// body of r and sets the URL extra_filters[] to matcher, VictoriaMetrics merging both.
+func setExtraFilters(r *http.Request, matcher string) error {
+	q := r.URL.Query()
+	for _, p := range clientFilterParams {
+		q.Del(p)
+	}
+	q.Set(extraFiltersParam, "{"+matcher+"}")
+	r.URL.RawQuery = q.Encode()
+
+	if r.Method != http.MethodPost || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return err
+	}
+	if slices.ContainsFunc(clientFilterParams, form.Has) {
+		for _, p := range clientFilterParams {
+			form.Del(p)
+		}
+		body = []byte(form.Encode())
+	}
+	r.Body = io.NopCloser(strings.NewReader(string(body)))
+	r.ContentLength = int64(len(body))
+	return nil
+}
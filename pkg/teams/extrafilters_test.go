@@ -0,0 +1,79 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestExtraFilters(t *testing.T) {
+	g := newGrafana(t)
+
+	for _, tc := range []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		labelAPIs bool
+		// want is the extra_filters[] sent upstream, empty when the request goes to Next
+		want string
+	}{
+		{name: "query", method: "GET", path: "/api/v1/query?query=up&extra_filters[]={team=\"other\"}", want: `{team=~"team-a|team-b"}`},
+		{name: "query POST", method: "POST", path: "/api/v1/query", body: "query=up&extra_label=team=other", want: `{team=~"team-a|team-b"}`},
+		{name: "series", method: "GET", path: "/api/v1/series?match[]=up", want: `{team=~"team-a|team-b"}`},
+		{name: "labels", method: "GET", path: "/api/v1/labels", labelAPIs: true, want: `{team=~"team-a|team-b"}`},
+		{name: "label values", method: "GET", path: "/api/v1/label/job/values", labelAPIs: true, want: `{team=~"team-a|team-b"}`},
+		{name: "labels disabled", method: "GET", path: "/api/v1/labels"},
+		{name: "label values disabled", method: "GET", path: "/api/v1/label/job/values"},
+		{name: "other path", method: "GET", path: "/api/v1/rules"},
+		{name: "other method", method: "DELETE", path: "/api/v1/query"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var upstream *http.Request
+			var upstreamBody string
+			ef := teams.ExtraFilters{
+				Enforcer: newEnforcer(t, g),
+				Upstream: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					upstream = r
+					r.ParseForm()
+					upstreamBody = r.PostForm.Encode()
+				}),
+				Next:      http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusTeapot) }),
+				LabelAPIs: tc.labelAPIs,
+			}
+
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			w := serve(ef, r)
+
+			if tc.want == "" {
+				if w.Code != http.StatusTeapot {
+					t.Fatalf("status = %d, want the request handed to Next", w.Code)
+				}
+				return
+			}
+			if upstream == nil {
+				t.Fatalf("status = %d, want the request sent upstream", w.Code)
+			}
+			q := upstream.URL.Query()
+			if got := q["extra_filters[]"]; len(got) != 1 || got[0] != tc.want {
+				t.Errorf("extra_filters[] = %q, want %q", got, tc.want)
+			}
+			if q.Has("extra_label") || strings.Contains(upstreamBody, "extra_label") {
+				t.Errorf("extra_label of the client forwarded: query %q, body %q", upstream.URL.RawQuery, upstreamBody)
+			}
+			if tc.body != "" {
+				if form, _ := url.ParseQuery(upstreamBody); form.Get("query") != "up" {
+					t.Errorf("body = %q, want the query kept", upstreamBody)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package teams
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// LabelSource selects what the enforced label values are derived from.
+type LabelSource string
+
+const (
+	// LabelSourceTeams derives label values from the names of the user's teams.
+	LabelSourceTeams LabelSource = "teams"
+	// LabelSourceFolders derives label values from the folders the user can access.
+	LabelSourceFolders LabelSource = "folders"
+	// LabelSourceClaims derives the label value from the claims of the token of the user
+	// with a LabelValueTemplate.
+	LabelSourceClaims LabelSource = "claims"
+)
+
+// maxFolders is the page size used when listing the folders a user can access.
+const maxFolders = 1000
+
+type Folder struct {
+	ID    int64  `json:"id"`
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+func (gte GrafanaTeamsEnforcer) labelSource() LabelSource {
+	if gte.LabelSource == "" {
+		return LabelSourceTeams
+	}
+	return gte.LabelSource
+}
+
+// folderCacheKey is the cache key of the folder values of userId.
+func folderCacheKey(userId string) string {
+	return "folders:" + userId
+}
+
+// fetchFolderValuesForUser returns the titles (or UIDs) of the folders the requestor can
+// access. Folder permissions are evaluated by Grafana for the caller's own identity, so
+// the folders are always listed with the forwarded identity headers.
+func (gte GrafanaTeamsEnforcer) fetchFolderValuesForUser(in *http.Request, userId string) ([]string, error) {
+	key := folderCacheKey(userId)
+
+	// fetch from cache
+	if v, found := gte.cacheGet(key); found {
+		if t := timerFromContext(in.Context()); t != nil {
+			t.observeCacheHit()
+		}
+		return v.([]string), nil
+	}
+
+	u := gte.GrafanaUrl.JoinPath("/api/folders")
+	u.RawQuery = fmt.Sprintf("limit=%d", maxFolders)
+	req, err := http.NewRequestWithContext(in.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
+	gte.forwardIdentity(in, req)
+
+	var folders []Folder
+	if err := gte.getJSON(req, &folders); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, f := range folders {
+		if gte.FolderLabelField == "uid" {
+			values = append(values, f.UID)
+		} else {
+			values = append(values, f.Title)
+		}
+	}
+
+	// set cache
+	gte.cacheSet(key, values)
+
+	return values, nil
+}
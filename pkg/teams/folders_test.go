@@ -0,0 +1,68 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestExtractLabelFolders(t *testing.T) {
+	g := newGrafana(t)
+
+	for _, tc := range []struct {
+		name    string
+		field   string
+		user    string
+		status  int
+		tenants string
+	}{
+		{name: "folder titles", user: "1", status: http.StatusOK, tenants: "Ops\nDev\n"},
+		{name: "folder UIDs", field: "uid", user: "1", status: http.StatusOK, tenants: "ops\ndev\n"},
+		// Grafana only lists the folders the user has permission to view
+		{name: "no folder", user: "2", status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.LabelSource = teams.LabelSourceFolders
+			gte.FolderLabelField = tc.field
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, tc.user, 1))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.tenants {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+			}
+		})
+	}
+}
+
+func TestExtractLabelFoldersCached(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.LabelSource = teams.LabelSourceFolders
+
+	query := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+		w := serve(gte.ExtractLabel(tenantsHandler), r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+		}
+		return w.Body.String()
+	}
+	query()
+	// permissions changed in Grafana are picked up once the entry expires
+	g.SetFolders("1", teams.Folder{ID: 2, UID: "dev", Title: "Dev"})
+	if got := query(); got != "Ops\nDev\n" {
+		t.Errorf("tenants = %q, want the cached folders", got)
+	}
+	gte.Cache.Flush()
+	if got := query(); got != "Dev\n" {
+		t.Errorf("tenants = %q, want the folders listed again", got)
+	}
+}
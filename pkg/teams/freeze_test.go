@@ -0,0 +1,114 @@
+package teams_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFreezer(t *testing.T) {
+	g := newGrafana(t)
+	reg := prometheus.NewRegistry()
+	f := teams.NewFreezer(reg)
+	gte := newEnforcer(t, g)
+	gte.Freezer = f
+	h := gte.ExtractLabel(tenantsHandler)
+
+	request := func(orgID int64) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/api/v1/query", nil)
+		r.Header.Set("X-Grafana-Id", token(t, g, "1", orgID))
+		return serve(h, r)
+	}
+
+	if w := request(1); w.Code != http.StatusOK {
+		t.Fatalf("status = %d before any freeze, want %d", w.Code, http.StatusOK)
+	}
+
+	// a request for any frozen tenant is rejected
+	f.Freeze("team-b", time.Hour)
+	w := request(1)
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `tenant "team-b" is frozen`) {
+		t.Errorf("got %d %q, want team-b frozen", w.Code, w.Body.String())
+	}
+	// the tenants of other orgs are not
+	if w := request(2); w.Code != http.StatusOK || w.Body.String() != "team-c\n" {
+		t.Errorf("got %d %q for org 2, want team-c", w.Code, w.Body.String())
+	}
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP lbac_frozen_requests_total Total number of requests rejected because a tenant was frozen.
+# TYPE lbac_frozen_requests_total counter
+lbac_frozen_requests_total{tenant="team-b"} 1
+`), "lbac_frozen_requests_total"); err != nil {
+		t.Error(err)
+	}
+
+	if !f.Thaw("team-b") {
+		t.Error("Thaw(team-b) = false, want true")
+	}
+	if f.Thaw("team-b") {
+		t.Error("Thaw(team-b) = true once thawed, want false")
+	}
+	if w := request(1); w.Code != http.StatusOK {
+		t.Errorf("status = %d once thawed, want %d", w.Code, http.StatusOK)
+	}
+
+	// a freeze lifts itself once expired
+	f.Freeze("team-a", 50*time.Millisecond)
+	if w := request(1); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if w := request(1); w.Code != http.StatusOK {
+		t.Errorf("status = %d once expired, want %d", w.Code, http.StatusOK)
+	}
+	f.Freeze("team-a", 50*time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if f.Thaw("team-a") {
+		t.Error("Thaw(team-a) = true once expired, want false")
+	}
+}
+
+func TestFreezerAPI(t *testing.T) {
+	f := teams.NewFreezer(prometheus.NewRegistry())
+	f.Freeze("expired", time.Nanosecond)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{method: "PUT", path: "/freeze/team-a", body: "30m\n", status: http.StatusNoContent},
+		{method: "PUT", path: "/freeze/team-b", body: "1h", status: http.StatusNoContent},
+		{method: "PUT", path: "/freeze/team-c", body: "soon", status: http.StatusBadRequest},
+		{method: "PUT", path: "/freeze/team-c", body: "-1m", status: http.StatusBadRequest},
+		{method: "PUT", path: "/freeze/", body: "1h", status: http.StatusMethodNotAllowed},
+		{method: "DELETE", path: "/freeze/team-b", status: http.StatusNoContent},
+		{method: "DELETE", path: "/freeze/team-b", status: http.StatusNotFound},
+		{method: "POST", path: "/freeze/team-a", body: "1h", status: http.StatusMethodNotAllowed},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if w := serve(f, r); w.Code != tc.status {
+			t.Errorf("%s %s %q: status = %d, want %d", tc.method, tc.path, tc.body, w.Code, tc.status)
+		}
+	}
+
+	w := serve(f, httptest.NewRequest("GET", "/freeze/", nil))
+	var frozen map[string]time.Time
+	if err := json.Unmarshal(w.Body.Bytes(), &frozen); err != nil {
+		t.Fatal(err)
+	}
+	if len(frozen) != 1 {
+		t.Fatalf("frozen = %v, want team-a only", frozen)
+	}
+	if until, found := frozen["team-a"]; !found || time.Until(until) < 29*time.Minute || time.Until(until) > 30*time.Minute {
+		t.Errorf("team-a frozen until %v, want in 30m", until)
+	}
+}
@@ -0,0 +1,121 @@
+package teams
+
+import (
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RemovalGrace keeps honoring label values a user lost, e.g. after being removed from a
+// team, for a grace period. Added values take effect immediately. State is kept in
+// memory and is local to each replica.
+type RemovalGrace struct {
+	period time.Duration
+	// idle is how long the values of a user without requests are remembered
+	idle time.Duration
+	mu   sync.Mutex
+	// last holds the values resolved for each user the last time
+	last map[string]resolvedValues
+	// removed holds, for each user, the values that disappeared and until when they are honored
+	removed map[string]map[string]time.Time
+	// pruned is when the state of idle users was last forgotten
+	pruned time.Time
+	used   prometheus.Counter
+}
+
+// resolvedValues are the values resolved for a user and when.
+type resolvedValues struct {
+	values []string
+	at     time.Time
+}
+
+// NewRemovalGrace creates a RemovalGrace honoring removed values for period, registering
+// its metrics with reg. Users without requests for idle, the TTL of the teams cache, are
+// forgotten once their removed values expire, so that the state does not grow with every
+// user seen; values they lose while forgotten are not honored. A zero idle forgets them
+// after period.
+func NewRemovalGrace(period, idle time.Duration, reg prometheus.Registerer) *RemovalGrace {
+	if idle <= 0 {
+		idle = period
+	}
+	return &RemovalGrace{
+		period:  period,
+		idle:    idle,
+		last:    map[string]resolvedValues{},
+		removed: map[string]map[string]time.Time{},
+		used: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Name: "lbac_removal_grace_requests_total",
+			Help: "Total number of requests granted label values that were removed within the grace period.",
+		}),
+	}
+}
+
+// apply returns values extended with the values key lost within the grace period.
+func (g *RemovalGrace) apply(key string, values []string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+	removed := g.removed[key]
+	for _, v := range g.last[key].values {
+		if slices.Contains(values, v) {
+			continue
+		}
+		if removed == nil {
+			removed = map[string]time.Time{}
+			g.removed[key] = removed
+		}
+		if _, found := removed[v]; !found {
+			removed[v] = now.Add(g.period)
+			slog.Info("label value removed, honoring it during the grace period", "user", key, "value", v, "until", removed[v])
+		}
+	}
+	g.last[key] = resolvedValues{values: values, at: now}
+
+	var granted []string
+	for v, until := range removed {
+		if slices.Contains(values, v) || now.After(until) {
+			delete(removed, v)
+			continue
+		}
+		granted = append(granted, v)
+	}
+	if len(removed) == 0 {
+		delete(g.removed, key)
+	}
+	if granted == nil {
+		return values
+	}
+
+	slices.Sort(granted)
+	g.used.Inc()
+	slog.Info("granting removed label values within the grace period", "user", key, "values", granted)
+	return append(slices.Clip(values), granted...)
+}
+
+// prune forgets the users idle for longer than g.idle, unless they are still granted
+// removed values, at most once per g.idle. g.mu must be held.
+func (g *RemovalGrace) prune(now time.Time) {
+	if now.Sub(g.pruned) < g.idle {
+		return
+	}
+	g.pruned = now
+	for key, last := range g.last {
+		if now.Sub(last.at) < g.idle {
+			continue
+		}
+		granted := false
+		for _, until := range g.removed[key] {
+			granted = granted || now.Before(until)
+		}
+		if !granted {
+			delete(g.last, key)
+			delete(g.removed, key)
+		}
+	}
+}
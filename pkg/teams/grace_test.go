@@ -0,0 +1,50 @@
+package teams
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRemovalGrace(t *testing.T) {
+	g := NewRemovalGrace(50*time.Millisecond, time.Hour, prometheus.NewRegistry())
+
+	if got := g.apply("1@1", []string{"a", "b"}); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("apply() = %q, want the values resolved", got)
+	}
+	if got := g.apply("1@1", []string{"a", "c"}); !slices.Equal(got, []string{"a", "c", "b"}) {
+		t.Fatalf("apply() = %q, want the removed value b still granted", got)
+	}
+	if got := g.apply("2@1", nil); got != nil {
+		t.Fatalf("apply() = %q for another user, want nothing granted", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := g.apply("1@1", []string{"a", "c"}); !slices.Equal(got, []string{"a", "c"}) {
+		t.Fatalf("apply() = %q after the grace period, want b no longer granted", got)
+	}
+}
+
+func TestRemovalGracePrunesIdleUsers(t *testing.T) {
+	g := NewRemovalGrace(time.Hour, 10*time.Millisecond, prometheus.NewRegistry())
+	g.apply("idle@1", []string{"a"})
+	g.apply("granted@1", []string{"a", "b"})
+	g.apply("granted@1", []string{"a"})
+
+	time.Sleep(20 * time.Millisecond)
+	g.apply("active@1", []string{"a"})
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, found := g.last["idle@1"]; found {
+		t.Error("idle user still remembered")
+	}
+	if _, found := g.last["granted@1"]; !found {
+		t.Error("idle user granted a removed value forgotten")
+	}
+	if _, found := g.last["active@1"]; !found {
+		t.Error("active user forgotten")
+	}
+}
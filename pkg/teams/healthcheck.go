@@ -0,0 +1,75 @@
+package teams
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// EnforcementHeader tells whether the label values were enforced on a health check,
+	// "active", or it was rejected before, "inactive".
+	EnforcementHeader = "X-LBAC-Enforcement"
+	// TenantCountHeader carries the number of label values resolved for a health check.
+	TenantCountHeader = "X-LBAC-Tenant-Count"
+	// TenantsHeader carries the label values resolved for a health check, serialized with
+	// JoinTenants, when the caller may see debug headers.
+	TenantsHeader = "X-LBAC-Tenants"
+	// VersionHeader carries the version of the proxy answering a health check.
+	VersionHeader = "X-LBAC-Version"
+)
+
+// HealthCheck recognizes the queries Grafana sends to test a datasource ("Save & test")
+// and adds diagnostics to their responses: whether enforcement is active, the number of
+// label values resolved and the version of the proxy. The label values themselves are
+// only added for callers passing the debug header gate.
+type HealthCheck struct {
+	// Queries are the /api/v1/query queries answered with diagnostics, compared ignoring
+	// whitespace, e.g. 1+1.
+	Queries []string
+	Version string
+}
+
+// matches reports whether r is a health check.
+func (hc *HealthCheck) matches(r *http.Request) bool {
+	if r.URL.Path != "/api/v1/query" {
+		return false
+	}
+	query, err := requestQuery(r)
+	if err != nil {
+		return false
+	}
+	query = stripSpaces(query)
+	return slices.ContainsFunc(hc.Queries, func(q string) bool {
+		return stripSpaces(q) == query
+	})
+}
+
+// stripSpaces removes the whitespace of a query.
+func stripSpaces(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// writeTo sets the diagnostic headers of the health check described by d on h. showTenants
+// adds the label values.
+func (hc *HealthCheck) writeTo(h http.Header, d *Decision, showTenants bool) {
+	enforcement := "inactive"
+	if d.forwarded {
+		enforcement = "active"
+	}
+	h.Set(EnforcementHeader, enforcement)
+	h.Set(TenantCountHeader, strconv.Itoa(len(d.Teams)))
+	h.Set(VersionHeader, hc.Version)
+	if showTenants && len(d.Teams) > 0 {
+		if tenants, err := JoinTenants(d.Teams); err == nil {
+			h.Set(TenantsHeader, tenants)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package teams_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams/teamstest"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/patrickmn/go-cache"
+)
+
+// newGrafana starts a teamstest.Grafana where user 1 is a member of team-a and team-b in
+// org 1 and of team-c in org 2 and may view the Ops and Dev folders, and user 2 of no team
+// and folder, closed when t ends.
+func newGrafana(t testing.TB) *teamstest.Grafana {
+	t.Helper()
+	g, err := teamstest.NewGrafana()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	g.SetTeams("1",
+		teams.Team{ID: 1, OrgID: 1, Name: "team-a"},
+		teams.Team{ID: 2, OrgID: 1, Name: "team-b"},
+		teams.Team{ID: 3, OrgID: 2, Name: "team-c"},
+	)
+	g.SetTeams("2")
+	g.SetFolders("1",
+		teams.Folder{ID: 1, UID: "ops", Title: "Ops"},
+		teams.Folder{ID: 2, UID: "dev", Title: "Dev"},
+	)
+	return g
+}
+
+// newEnforcer returns an enforcer of the team label looking teams up in g as its admin.
+func newEnforcer(t testing.TB, g *teamstest.Grafana) teams.GrafanaTeamsEnforcer {
+	t.Helper()
+	k, err := teams.NewKeyfunc(context.Background(), []string{g.URL + "/api/signing-keys/keys"}, teams.JWKSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grafanaURL, err := url.Parse(g.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return teams.GrafanaTeamsEnforcer{
+		Label:       "team",
+		KeyFunc:     k,
+		Cache:       *cache.New(time.Minute, time.Minute),
+		GrafanaUrl:  *grafanaURL,
+		GrafanaUser: teamstest.AdminUser,
+		GrafanaPass: teamstest.AdminPass,
+	}
+}
+
+// token signs a token of userID in orgID with the key of g.
+func token(t testing.TB, g *teamstest.Grafana, userID string, orgID int64) string {
+	t.Helper()
+	s, err := g.Token(userID, orgID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// tokenWithClaims is like token but sets claims, removing those set to nil.
+func tokenWithClaims(t testing.TB, g *teamstest.Grafana, userID string, orgID int64, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := g.TokenWithClaims(userID, orgID, time.Hour, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// serve sends r to h and returns the response recorded.
+func serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// tenantsHandler answers the label values enforced on the requests it receives, one per
+// line.
+var tenantsHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	for _, v := range teams.TenantsFromContext(r.Context()) {
+		w.Write([]byte(v + "\n"))
+	}
+})
@@ -0,0 +1,45 @@
+package teams
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TeamHierarchy maps the names of parent teams to the names of their child teams. The
+// members of a parent team are granted the label values of its descendants.
+//
+// Teams are matched by name in the org of the request, so a team named after a parent in
+// any org grants the descendants there, and the expanded names count as teams of the user
+// wherever they are checked, e.g. for the break-glass and debug teams.
+type TeamHierarchy map[string][]string
+
+// ParseTeamHierarchy parses a comma-separated list of <parent>=<child> pairs. A parent
+// may be listed once per child, and a child may be the parent of other teams.
+func ParseTeamHierarchy(s string) (TeamHierarchy, error) {
+	h := TeamHierarchy{}
+	for _, pair := range strings.Split(s, ",") {
+		parent, child, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || parent == "" || child == "" || parent == child {
+			return nil, fmt.Errorf("invalid team hierarchy entry %q, expected <parent>=<child>", pair)
+		}
+		if !slices.Contains(h[parent], child) {
+			h[parent] = append(h[parent], child)
+		}
+	}
+	return h, nil
+}
+
+// expand returns names followed by the descendants of every name not already among
+// them, so that cycles end.
+func (h TeamHierarchy) expand(names []string) []string {
+	expanded := slices.Clone(names)
+	for i := 0; i < len(expanded); i++ {
+		for _, child := range h[expanded[i]] {
+			if !slices.Contains(expanded, child) {
+				expanded = append(expanded, child)
+			}
+		}
+	}
+	return expanded
+}
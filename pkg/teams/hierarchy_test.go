@@ -0,0 +1,52 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestExtractLabelTeamHierarchy(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	// team-a-2 is the parent of team-a again, the expansion must end
+	h, err := teams.ParseTeamHierarchy("team-a=team-a-1, team-a-1=team-a-2, team-a-2=team-a, team-c=team-c-1, team-z=team-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gte.TeamHierarchy = h
+
+	for _, tc := range []struct {
+		name    string
+		user    string
+		org     int64
+		status  int
+		tenants string
+	}{
+		{name: "descendants of a parent", user: "1", org: 1, status: http.StatusOK, tenants: "team-a\nteam-b\nteam-a-1\nteam-a-2\n"},
+		{name: "descendants in another org", user: "1", org: 2, status: http.StatusOK, tenants: "team-c\nteam-c-1\n"},
+		{name: "no team", user: "2", org: 1, status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, tc.user, tc.org))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.tenants {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+			}
+		})
+	}
+}
+
+func TestParseTeamHierarchy(t *testing.T) {
+	for _, s := range []string{"", "team-a", "team-a=", "=team-a", "team-a=team-a", "team-a=team-b,"} {
+		if _, err := teams.ParseTeamHierarchy(s); err == nil {
+			t.Errorf("ParseTeamHierarchy(%q) = nil error", s)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package teams
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+const (
+	jwksInitialBackoff = 500 * time.Millisecond
+	jwksMaxBackoff     = 30 * time.Second
+	// jwksMaxRetryAfter caps how long a single refresh waits on a 429 Retry-After.
+	jwksMaxRetryAfter = time.Minute
+)
+
+// JWKSOptions configures how the Grafana JWKS is fetched.
+type JWKSOptions struct {
+	// StartupRetries is the number of times the initial fetch is retried before giving up.
+	StartupRetries int
+	// StartupTimeout bounds the total time spent on the initial fetch and its retries.
+	StartupTimeout time.Duration
+	// MaxStaleness bounds how long the last fetched keys keep validating tokens while
+	// refreshes fail. Zero keeps them indefinitely and never fails Ready once they were
+	// fetched.
+	MaxStaleness time.Duration
+	// Registerer registers the JWKS metrics. Metrics are not registered when nil.
+	Registerer prometheus.Registerer
+	// Transport sends the JWKS requests. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+// JWKS is a keyfunc.Keyfunc that tracks the freshness of the keys it validates with.
+//
+// The underlying storage keeps serving the last fetched keys while refreshes fail, and
+// replaces them entirely once a refresh succeeds, so keys removed from Grafana are
+// dropped as soon as Grafana is reachable again. With several JWKS URLs, the key sets
+// are merged and each of them is refreshed on its own, so one URL failing leaves the
+// keys of the others untouched.
+type JWKS struct {
+	kf           keyfunc.Keyfunc
+	maxStaleness time.Duration
+	lastSuccess  atomic.Int64 // unix nanoseconds
+	stale        prometheus.Gauge
+	// failing holds whether the last refresh of each URL failed
+	failing   map[string]bool
+	failingMu sync.Mutex
+	// keys holds the keys last fetched from each URL, guarded by failingMu
+	keys map[string][]jwkset.JWK
+	// byKID holds the keys of the kids shared by several keys, rebuilt on every fetch
+	byKID      atomic.Pointer[map[string][]jwkset.JWK]
+	duplicates prometheus.Counter
+	// warnedKIDs holds the duplicate kids already logged
+	warnedKIDs sync.Map
+}
+
+// Keyfunc implements jwt.Keyfunc, refusing to validate once the keys are too stale.
+func (j *JWKS) Keyfunc(token *jwt.Token) (any, error) {
+	key, err := j.checkStaleness(j.kf.Keyfunc(token))
+	if err != nil {
+		return nil, err
+	}
+	return j.withDuplicates(token, key), nil
+}
+
+// KeyfuncCtx is like Keyfunc but uses ctx for refreshing unknown keys.
+func (j *JWKS) KeyfuncCtx(ctx context.Context) jwt.Keyfunc {
+	kf := j.kf.KeyfuncCtx(ctx)
+	return func(token *jwt.Token) (any, error) {
+		key, err := j.checkStaleness(kf(token))
+		if err != nil {
+			return nil, err
+		}
+		return j.withDuplicates(token, key), nil
+	}
+}
+
+// withDuplicates returns every key of the set sharing the kid of token, so that each of
+// them is tried in turn, when the set holds more than one. Otherwise it returns key.
+func (j *JWKS) withDuplicates(token *jwt.Token, key any) any {
+	byKID := j.byKID.Load()
+	if byKID == nil {
+		return key
+	}
+	kid, _ := token.Header[jwkset.HeaderKID].(string)
+	shared, ok := (*byKID)[kid]
+	if !ok {
+		return key
+	}
+
+	var keys []jwt.VerificationKey
+	for _, k := range shared {
+		if a := k.Marshal().ALG.String(); a != "" && a != token.Method.Alg() {
+			continue
+		}
+		pub := k.Key()
+		if pk, ok := pub.(interface{ Public() crypto.PublicKey }); ok {
+			pub = pk.Public()
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) < 2 {
+		return key
+	}
+
+	j.duplicates.Inc()
+	if _, warned := j.warnedKIDs.LoadOrStore(kid, true); !warned {
+		slog.Warn("JWKS holds several keys with the same kid, trying each of them in order", "kid", kid, "keys", len(keys))
+	}
+	return jwt.VerificationKeySet{Keys: keys}
+}
+
+// Storage returns the underlying JWK Set storage.
+func (j *JWKS) Storage() jwkset.Storage {
+	return j.kf.Storage()
+}
+
+// Ready returns an error when no keys were fetched yet or when they have not been
+// refreshed successfully within the configured maximum staleness.
+func (j *JWKS) Ready() error {
+	if j.lastSuccess.Load() == 0 {
+		return fmt.Errorf("JWKS has not been fetched yet")
+	}
+	_, err := j.checkStaleness(nil, nil)
+	return err
+}
+
+// checkStaleness passes through the result of a key lookup unless the keys are older
+// than the maximum staleness. The lookup runs first since it may refresh the keys.
+func (j *JWKS) checkStaleness(key any, err error) (any, error) {
+	if err != nil {
+		return nil, err
+	}
+	last := j.lastSuccess.Load()
+	if j.maxStaleness > 0 && last != 0 && time.Since(time.Unix(0, last)) > j.maxStaleness {
+		return nil, fmt.Errorf("JWKS has not been refreshed since %s", time.Unix(0, last).Format(time.RFC3339))
+	}
+	return key, nil
+}
+
+// observe wraps next to record successful fetches of jwksURL, those answering a key set
+// the storage accepts.
+func (j *JWKS) observe(jwksURL string, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		r, err := next.RoundTrip(req)
+		if err != nil || r.StatusCode != http.StatusOK {
+			return r, err
+		}
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		keys, err := parseJWKS(body)
+		if err != nil {
+			// left to the storage to report as a failed refresh
+			return r, nil
+		}
+		j.lastSuccess.Store(time.Now().UnixNano())
+		j.setKeys(jwksURL, keys)
+		return r, nil
+	})
+}
+
+// parseJWKS parses a JWK Set the way the storage does.
+func parseJWKS(body []byte) ([]jwkset.JWK, error) {
+	var set jwkset.JWKSMarshal
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWK Set: %w", err)
+	}
+	keys := make([]jwkset.JWK, len(set.Keys))
+	for i, m := range set.Keys {
+		k, err := jwkset.NewJWKFromMarshal(m, jwkset.JWKMarshalOptions{Private: true}, jwkset.JWKValidateOptions{})
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// setKeys records the keys last fetched from jwksURL, which is no longer failing, and
+// rebuilds the index of the kids shared by several keys of all URLs.
+func (j *JWKS) setKeys(jwksURL string, keys []jwkset.JWK) {
+	j.setFailing(jwksURL, false)
+
+	j.failingMu.Lock()
+	defer j.failingMu.Unlock()
+	j.keys[jwksURL] = keys
+	all := map[string][]jwkset.JWK{}
+	for _, keys := range j.keys {
+		for _, k := range keys {
+			kid := k.Marshal().KID
+			all[kid] = append(all[kid], k)
+		}
+	}
+	byKID := map[string][]jwkset.JWK{}
+	for kid, keys := range all {
+		if len(keys) > 1 {
+			byKID[kid] = keys
+		}
+	}
+	j.byKID.Store(&byKID)
+}
+
+// setFailing records whether the last refresh of jwksURL failed.
+func (j *JWKS) setFailing(jwksURL string, failing bool) {
+	j.failingMu.Lock()
+	defer j.failingMu.Unlock()
+	j.failing[jwksURL] = failing
+	n := 0
+	for _, f := range j.failing {
+		if f {
+			n++
+		}
+	}
+	j.stale.Set(float64(n))
+}
+
+// seededTransport answers the first request with the body of the JWK Set fetched at
+// startup, if any, so that the storage does not fetch it again.
+type seededTransport struct {
+	next http.RoundTripper
+	seed atomic.Pointer[[]byte]
+}
+
+func (t *seededTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if body := t.seed.Swap(nil); body != nil {
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": []string{"application/json"}},
+			Body:          io.NopCloser(bytes.NewReader(*body)),
+			ContentLength: int64(len(*body)),
+			Request:       req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// NewKeyfunc creates a keyfunc.Keyfunc backed by the JWKS at jwksURLs, validating tokens
+// signed by a key of any of them.
+//
+// The initial fetch of each URL is retried with jittered exponential backoff so that many
+// replicas starting at once converge instead of failing together. If it never succeeds,
+// the keyfunc is still returned and keys are fetched by the background refresh.
+// Both the startup fetch and later refreshes honor 429 Retry-After responses.
+func NewKeyfunc(ctx context.Context, jwksURLs []string, opts JWKSOptions) (*JWKS, error) {
+	if len(jwksURLs) == 0 {
+		return nil, fmt.Errorf("no JWKS URL")
+	}
+	factory := promauto.With(opts.Registerer)
+	j := &JWKS{
+		maxStaleness: opts.MaxStaleness,
+		failing:      make(map[string]bool, len(jwksURLs)),
+		keys:         make(map[string][]jwkset.JWK, len(jwksURLs)),
+		stale: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "lbac_jwks_refresh_failing",
+			Help: "Number of JWKS URLs whose last refresh failed, whose previously fetched keys keep validating tokens.",
+		}),
+	}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "lbac_jwks_last_success_timestamp_seconds",
+		Help: "Unix timestamp of the last successful JWKS fetch of any URL.",
+	}, func() float64 {
+		return float64(j.lastSuccess.Load()) / float64(time.Second)
+	})
+	j.duplicates = factory.NewCounter(prometheus.CounterOpts{
+		Name: "lbac_jwks_duplicate_kid_total",
+		Help: "Total number of tokens validated against several JWKS keys sharing their kid.",
+	})
+	refreshFailures := factory.NewCounter(prometheus.CounterOpts{
+		Name: "lbac_jwks_refresh_failures_total",
+		Help: "Total number of failed JWKS refreshes.",
+	})
+
+	transport := opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	storages := make(map[string]jwkset.Storage, len(jwksURLs))
+	for _, jwksURL := range jwksURLs {
+		seeded := &seededTransport{next: j.observe(jwksURL, retryAfterTransport{next: transport, maxWait: jwksMaxRetryAfter})}
+		client := &http.Client{Transport: seeded}
+
+		body, err := waitForJWKS(ctx, client, jwksURL, opts)
+		if err != nil {
+			slog.Warn("unable to fetch JWKS at startup, relying on background refresh", "url", jwksURL, "error", err)
+		} else {
+			// the storage starts from the keys fetched at startup
+			seeded.seed.Store(&body)
+		}
+
+		storage, err := jwkset.NewStorageFromHTTP(jwksURL, jwkset.HTTPClientStorageOptions{
+			Client:                    client,
+			Ctx:                       ctx,
+			NoErrorReturnFirstHTTPReq: true,
+			RefreshErrorHandler: func(ctx context.Context, err error) {
+				refreshFailures.Inc()
+				j.setFailing(jwksURL, true)
+				slog.ErrorContext(ctx, "failed to refresh JWKS, keeping previously fetched keys", "url", jwksURL, "error", err)
+			},
+			RefreshInterval: time.Hour,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("create JWKS storage for %s failed: %w", jwksURL, err)
+		}
+		storages[jwksURL] = storage
+	}
+
+	c, err := jwkset.NewHTTPClient(jwkset.HTTPClientOptions{
+		HTTPURLs:          storages,
+		RateLimitWaitMax:  time.Minute,
+		RefreshUnknownKID: rate.NewLimiter(rate.Every(5*time.Minute), 1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create JWKS client failed: %w", err)
+	}
+
+	j.kf, err = keyfunc.New(keyfunc.Options{Ctx: ctx, Storage: c})
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// waitForJWKS polls jwksURL until it answers a valid JWK Set, the retries are exhausted or
+// the startup timeout expires, and returns the JWK Set.
+func waitForJWKS(ctx context.Context, client *http.Client, jwksURL string, opts JWKSOptions) ([]byte, error) {
+	if opts.StartupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.StartupTimeout)
+		defer cancel()
+	}
+
+	backoff := jwksInitialBackoff
+	for attempt := 0; ; attempt++ {
+		body, retryAfter, err := probeJWKS(ctx, client, jwksURL)
+		if err == nil {
+			return body, nil
+		}
+		if attempt >= opts.StartupRetries {
+			return nil, err
+		}
+
+		// full jitter around the current backoff, but never sooner than the server asked for
+		wait := backoff/2 + rand.N(backoff)
+		wait = max(wait, retryAfter)
+		slog.Warn("JWKS fetch failed, retrying", "url", jwksURL, "attempt", attempt+1, "wait", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (last error: %w)", ctx.Err(), err)
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, jwksMaxBackoff)
+	}
+}
+
+// probeJWKS fetches the JWK Set at jwksURL once. On a 429 it returns the delay requested
+// by Retry-After.
+func probeJWKS(ctx context.Context, client *http.Client, jwksURL string) ([]byte, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("create request failed: %w", err)
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		retryAfter, _ := parseRetryAfter(r.Header.Get("Retry-After"))
+		return nil, retryAfter, fmt.Errorf("unexepected status: %d", r.StatusCode)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("read response failed: %w", err)
+	}
+	if _, err := parseJWKS(body); err != nil {
+		return nil, 0, err
+	}
+	return body, 0, nil
+}
+
+// retryAfterTransport retries a request once after the delay advertised by a 429
+// response, as long as that delay does not exceed maxWait.
+type retryAfterTransport struct {
+	next    http.RoundTripper
+	maxWait time.Duration
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r, err := t.next.RoundTrip(req)
+	if err != nil || r.StatusCode != http.StatusTooManyRequests || req.Body != nil {
+		return r, err
+	}
+
+	wait, ok := parseRetryAfter(r.Header.Get("Retry-After"))
+	if !ok || wait > t.maxWait {
+		return r, nil
+	}
+	r.Body.Close()
+
+	select {
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	case <-time.After(wait):
+	}
+	return t.next.RoundTrip(req)
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
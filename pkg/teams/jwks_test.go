@@ -0,0 +1,232 @@
+package teams
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newSigningKey generates an RSA key for signing test tokens.
+func newSigningKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// jwksDocument returns the JWK Set of the public keys of keys, all of them with kid.
+func jwksDocument(t *testing.T, kid string, keys ...*rsa.PrivateKey) []byte {
+	t.Helper()
+	st := jwkset.NewMemoryStorage()
+	for _, key := range keys {
+		jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{
+			Metadata: jwkset.JWKMetadataOptions{KID: kid, ALG: jwkset.AlgRS256},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.KeyWrite(context.Background(), jwk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	doc, err := st.JSONPublic(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// jwksServer serves doc after answering the first failures requests with a 503, counting
+// the requests it receives in requests.
+func jwksServer(t *testing.T, failures int64, doc []byte, requests *atomic.Int64) *httptest.Server {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// signToken signs a token with kid using key.
+func signToken(t *testing.T, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "user:1", "exp": time.Now().Add(time.Hour).Unix()})
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNewKeyfuncRetriesStartupFetch(t *testing.T) {
+	key := newSigningKey(t)
+	var requests atomic.Int64
+	s := jwksServer(t, 2, jwksDocument(t, "k", key), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL}, JWKSOptions{StartupRetries: 3, StartupTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Ready(); err != nil {
+		t.Fatalf("Ready() = %v, want nil", err)
+	}
+	if _, err := jwt.Parse(signToken(t, key, "k"), j.Keyfunc); err != nil {
+		t.Fatalf("token rejected: %v", err)
+	}
+	// the storage is seeded with the key set fetched at startup
+	if got := requests.Load(); got != 3 {
+		t.Errorf("JWKS requested %d times, want 3", got)
+	}
+}
+
+func TestNewKeyfuncGivesUpStartupFetch(t *testing.T) {
+	var requests atomic.Int64
+	s := jwksServer(t, 100, jwksDocument(t, "k", newSigningKey(t)), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL}, JWKSOptions{StartupRetries: 1})
+	if err != nil {
+		t.Fatalf("NewKeyfunc() = %v, want the background refresh relied upon", err)
+	}
+	if err := j.Ready(); err == nil {
+		t.Error("Ready() = nil before the JWKS was fetched")
+	}
+}
+
+func TestKeyfuncTriesKeysSharingTheKID(t *testing.T) {
+	first, second := newSigningKey(t), newSigningKey(t)
+	var requests atomic.Int64
+	s := jwksServer(t, 0, jwksDocument(t, "shared", first, second), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL}, JWKSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, key := range map[string]*rsa.PrivateKey{"first": first, "second": second} {
+		if _, err := jwt.Parse(signToken(t, key, "shared"), j.Keyfunc); err != nil {
+			t.Errorf("token signed by the %s key rejected: %v", name, err)
+		}
+	}
+	if _, err := jwt.Parse(signToken(t, newSigningKey(t), "shared"), j.Keyfunc); err == nil {
+		t.Error("token signed by an unknown key accepted")
+	}
+}
+
+func TestNewKeyfuncIgnoresInvalidKeySets(t *testing.T) {
+	var requests atomic.Int64
+	s := jwksServer(t, 0, []byte(`{"keys": [{"kty": "RSA", "kid": "k"}]}`), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL}, JWKSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Ready(); err == nil {
+		t.Error("Ready() = nil after fetching an invalid key set")
+	}
+}
+
+func TestKeyfuncRejectsStaleKeys(t *testing.T) {
+	key := newSigningKey(t)
+	var requests atomic.Int64
+	s := jwksServer(t, 0, jwksDocument(t, "k", key), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL}, JWKSOptions{MaxStaleness: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, key, "k")
+	if _, err := jwt.Parse(token, j.Keyfunc); err != nil {
+		t.Fatalf("token rejected with fresh keys: %v", err)
+	}
+
+	j.lastSuccess.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	if _, err := jwt.Parse(token, j.Keyfunc); err == nil {
+		t.Error("token accepted with stale keys")
+	}
+	if err := j.Ready(); err == nil {
+		t.Error("Ready() = nil with stale keys")
+	}
+
+	j.maxStaleness = 0
+	if _, err := jwt.Parse(token, j.Keyfunc); err != nil {
+		t.Errorf("token rejected with staleness unbounded: %v", err)
+	}
+}
+
+func TestKeyfuncCountsSharedKIDs(t *testing.T) {
+	first, second := newSigningKey(t), newSigningKey(t)
+	var requests atomic.Int64
+	s := jwksServer(t, 0, jwksDocument(t, "shared", first, second), &requests)
+	other := jwksServer(t, 0, jwksDocument(t, "other", newSigningKey(t)), &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{s.URL, other.URL}, JWKSOptions{Registerer: prometheus.NewRegistry()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(signToken(t, second, "shared"), j.Keyfunc); err != nil {
+		t.Fatalf("token rejected: %v", err)
+	}
+	if got := testutil.ToFloat64(j.duplicates); got != 1 {
+		t.Errorf("duplicate kid validations = %v, want 1", got)
+	}
+	if byKID := *j.byKID.Load(); len(byKID) != 1 || len(byKID["shared"]) != 2 {
+		t.Errorf("shared kids indexed = %v, want the 2 keys of kid shared only", byKID)
+	}
+}
+
+func TestKeyfuncMergesJWKSURLs(t *testing.T) {
+	old, current := newSigningKey(t), newSigningKey(t)
+	var requests atomic.Int64
+	oldServer := jwksServer(t, 0, jwksDocument(t, "old", old), &requests)
+	currentServer := jwksServer(t, 0, jwksDocument(t, "current", current), &requests)
+	// down never answers with a key set
+	down := jwksServer(t, 1<<20, nil, &requests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	j, err := NewKeyfunc(ctx, []string{oldServer.URL, down.URL, currentServer.URL}, JWKSOptions{StartupRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Ready(); err != nil {
+		t.Errorf("Ready() = %v with a URL down, want nil", err)
+	}
+	for kid, key := range map[string]*rsa.PrivateKey{"old": old, "current": current} {
+		if _, err := jwt.Parse(signToken(t, key, kid), j.Keyfunc); err != nil {
+			t.Errorf("token signed by the %s key rejected: %v", kid, err)
+		}
+	}
+	// keys are looked up by kid across the sources, not tried against any of them
+	if _, err := jwt.Parse(signToken(t, old, "current"), j.Keyfunc); err == nil {
+		t.Error("token signed by the old key with the current kid accepted")
+	}
+}
@@ -0,0 +1,231 @@
+package teams
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ClaimLabelRouter selects the label enforced on a request from a claim of its verified
+// X-Grafana-Id token. Only label names present in Routes can be selected; requests
+// without a valid token or without the claim are served by Default.
+type ClaimLabelRouter struct {
+	Enforcer GrafanaTeamsEnforcer
+	Claim    string
+	Routes   map[string]http.Handler
+	Default  http.Handler
+}
+
+func (clr ClaimLabelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, r, ok := clr.Enforcer.verifiedToken(r)
+	if !ok {
+		// the default routes reject the request the same way as any other request
+		clr.Default.ServeHTTP(w, r)
+		return
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	v, found := claims[clr.Claim]
+	if !found {
+		clr.Default.ServeHTTP(w, r)
+		return
+	}
+
+	name, _ := v.(string)
+	h, allowed := clr.Routes[name]
+	if !allowed {
+		slog.Error("label selected by token claim is not allowed", "claim", clr.Claim, "label", v)
+		http.Error(w, fmt.Sprintf("label %v selected by claim %q is not allowed", v, clr.Claim), http.StatusForbidden)
+		return
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// LabelHeader selects the label enforced on a request among the labels allowed for
+// HeaderLabelRouter.
+const LabelHeader = "X-LBAC-Label"
+
+// HeaderLabelRouter selects the label enforced on a request from its LabelHeader, e.g.
+// while migrating from one label name to another. Only label names present in Routes can
+// be selected; requests without the header are served by Default. The header is not sent
+// upstream.
+type HeaderLabelRouter struct {
+	Routes  map[string]http.Handler
+	Default http.Handler
+}
+
+func (hlr HeaderLabelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.Header.Get(LabelHeader)
+	if name == "" {
+		hlr.Default.ServeHTTP(w, r)
+		return
+	}
+	h, allowed := hlr.Routes[name]
+	if !allowed {
+		slog.Error("label selected by request header is not allowed", "label", name)
+		http.Error(w, fmt.Sprintf("label %q selected by header %s is not allowed", name, LabelHeader), http.StatusForbidden)
+		return
+	}
+
+	slog.Debug("enforcing label selected by request header", "label", name, "path", r.URL.Path)
+	r.Header.Del(LabelHeader)
+	h.ServeHTTP(w, r)
+}
+
+// OrgLabelRouter selects the label enforced on a request from the Grafana org of its
+// verified X-Grafana-Id token. Requests without a valid token, and requests from orgs
+// without a label in Labels unless RejectUnmapped is set, are served by Default.
+type OrgLabelRouter struct {
+	Enforcer GrafanaTeamsEnforcer
+	// Labels maps org IDs to the label name enforced for them.
+	Labels         map[int64]string
+	Routes         map[string]http.Handler
+	Default        http.Handler
+	RejectUnmapped bool
+}
+
+func (olr OrgLabelRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, r, ok := olr.Enforcer.verifiedToken(r)
+	if !ok {
+		// the default routes reject the request the same way as any other request
+		olr.Default.ServeHTTP(w, r)
+		return
+	}
+
+	orgId, err := orgIDFromToken(token)
+	if err != nil {
+		olr.Default.ServeHTTP(w, r)
+		return
+	}
+	name, found := olr.Labels[orgId]
+	if !found {
+		if olr.RejectUnmapped {
+			slog.Error("token of an org without a label", "orgId", orgId)
+			http.Error(w, fmt.Sprintf("orgId=%d has no label to enforce", orgId), http.StatusForbidden)
+			return
+		}
+		olr.Default.ServeHTTP(w, r)
+		return
+	}
+	olr.Routes[name].ServeHTTP(w, r)
+}
+
+// DatasourceRouter selects the upstream serving a request from a claim of its verified
+// X-Grafana-Id token identifying the Grafana datasource queried, e.g. azp. Requests
+// without a valid token, and requests for datasources not in Routes unless RejectUnknown
+// is set, are served by Default.
+type DatasourceRouter struct {
+	Enforcer GrafanaTeamsEnforcer
+	Claim    string
+	// Routes maps datasource UIDs to the routes of their upstream.
+	Routes        map[string]http.Handler
+	Default       http.Handler
+	RejectUnknown bool
+}
+
+func (dr DatasourceRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, r, ok := dr.Enforcer.verifiedToken(r)
+	if !ok {
+		// the default routes reject the request the same way as any other request
+		dr.Default.ServeHTTP(w, r)
+		return
+	}
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	uid, _ := claims[dr.Claim].(string)
+	h, found := dr.Routes[uid]
+	if !found {
+		if dr.RejectUnknown {
+			slog.Error("token identifies an unknown datasource", "claim", dr.Claim, "datasource", uid)
+			http.Error(w, fmt.Sprintf("datasource %q identified by claim %q is not served by this proxy", uid, dr.Claim), http.StatusForbidden)
+			return
+		}
+		dr.Default.ServeHTTP(w, r)
+		return
+	}
+
+	slog.Debug("routing request to datasource upstream", "datasource", uid, "path", r.URL.Path)
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), datasourceKey, uid)))
+}
+
+// IssuerRouter selects the Grafana instance authenticating a request from the iss claim
+// of its X-Grafana-Id token, before the token is verified with the keys of that instance.
+// Requests without a token, or with an opaque one, are served by Default; tokens issued
+// by none of the instances in Routes are rejected.
+type IssuerRouter struct {
+	// Routes maps issuers, Grafana root URLs, to the routes authenticating their tokens.
+	Routes  map[string]http.Handler
+	Default http.Handler
+	// TokenHeader is the header carrying the token. Defaults to DefaultTokenHeader.
+	TokenHeader string
+}
+
+func (ir IssuerRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	signedToken := tokenFromHeader(r, ir.TokenHeader)
+	if signedToken == "" {
+		ir.Default.ServeHTTP(w, r)
+		return
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(signedToken, jwt.MapClaims{})
+	if err != nil {
+		// the default routes reject the request the same way as any other request
+		ir.Default.ServeHTTP(w, r)
+		return
+	}
+
+	iss, _ := token.Claims.GetIssuer()
+	h, found := ir.Routes[NormalizeIssuer(iss)]
+	if !found {
+		slog.Error("token issued by an unknown Grafana instance", "iss", iss)
+		http.Error(w, fmt.Sprintf("token issuer %q is not a known Grafana instance", iss), http.StatusUnauthorized)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// NormalizeIssuer returns iss without its trailing slash, as Grafana issues tokens with
+// its root URL either way.
+func NormalizeIssuer(iss string) string {
+	return strings.TrimSuffix(iss, "/")
+}
+
+// verifiedToken returns the token verified earlier in the request chain, or verifies the
+// token of r read from TokenHeader and stores it in the context of the returned request. It
+// reports false when the request carries no valid token.
+func (gte GrafanaTeamsEnforcer) verifiedToken(r *http.Request) (*jwt.Token, *http.Request, bool) {
+	if token, ok := r.Context().Value(tokenKey).(*jwt.Token); ok {
+		return token, r, true
+	}
+
+	signedToken := tokenFromHeader(r, gte.TokenHeader)
+	if signedToken == "" {
+		return nil, r, false
+	}
+	token, err := gte.parseToken(r.Context(), signedToken)
+	if err != nil {
+		return nil, r, false
+	}
+	return token, r.WithContext(context.WithValue(r.Context(), tokenKey, token)), true
+}
+
+// orgIDFromToken returns the org ID carried by the "org:<id>" audience of token.
+func orgIDFromToken(token *jwt.Token) (int64, error) {
+	aud, err := token.Claims.GetAudience()
+	if err != nil {
+		return 0, err
+	}
+	if len(aud) != 1 {
+		return 0, fmt.Errorf("aud claim must be a string, not an array")
+	}
+	id, found := strings.CutPrefix(aud[0], "org:")
+	if !found {
+		return 0, fmt.Errorf("aud claim %q does not identify an org", aud[0])
+	}
+	return strconv.ParseInt(id, 10, 64)
+}
@@ -0,0 +1,253 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// labelHandler answers the name of the label it enforces.
+type labelHandler string
+
+func (h labelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(h))
+}
+
+func TestClaimLabelRouter(t *testing.T) {
+	g := newGrafana(t)
+	clr := teams.ClaimLabelRouter{
+		Enforcer: newEnforcer(t, g),
+		Claim:    "lbac_label",
+		// the allow list only, not the labels other routers select among
+		Routes:  map[string]http.Handler{"tenant": labelHandler("tenant")},
+		Default: labelHandler("team"),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+		label  string
+	}{
+		{name: "allowed label", claims: jwt.MapClaims{"lbac_label": "tenant"}, status: http.StatusOK, label: "tenant"},
+		{name: "no claim", status: http.StatusOK, label: "team"},
+		{name: "label not allowed", claims: jwt.MapClaims{"lbac_label": "namespace"}, status: http.StatusForbidden},
+		{name: "default label not allowed", claims: jwt.MapClaims{"lbac_label": "team"}, status: http.StatusForbidden},
+		{name: "not a string", claims: jwt.MapClaims{"lbac_label": 1}, status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, tc.claims))
+			w := serve(clr, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d", w.Code, tc.status)
+			}
+			if tc.label != "" && w.Body.String() != tc.label {
+				t.Errorf("routed to the label %q, want %q", w.Body.String(), tc.label)
+			}
+		})
+	}
+}
+
+func TestHeaderLabelRouter(t *testing.T) {
+	g := newGrafana(t)
+	// enforcedLabel answers the label recorded in the decision of the request, as logged
+	enforcedLabel := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(teams.LabelHeader) != "" {
+			t.Errorf("%s header sent upstream", teams.LabelHeader)
+		}
+		w.Write([]byte(teams.EnforcedLabel(r.Context())))
+	})
+	route := func(label string) http.Handler {
+		gte := newEnforcer(t, g)
+		gte.Label = label
+		return gte.ExtractLabel(enforcedLabel)
+	}
+	hlr := teams.HeaderLabelRouter{
+		Routes:  map[string]http.Handler{"namespace": route("namespace"), "k8s_namespace": route("k8s_namespace")},
+		Default: route("namespace"),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		header string
+		status int
+		label  string
+	}{
+		{name: "default", status: http.StatusOK, label: "namespace"},
+		{name: "allowed override", header: "k8s_namespace", status: http.StatusOK, label: "k8s_namespace"},
+		{name: "rejected override", header: "team", status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			if tc.header != "" {
+				r.Header.Set(teams.LabelHeader, tc.header)
+			}
+			w := serve(hlr, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.label != "" && w.Body.String() != tc.label {
+				t.Errorf("enforced the label %q, want %q", w.Body, tc.label)
+			}
+		})
+	}
+}
+
+func TestIssuerRouter(t *testing.T) {
+	prod, staging := newGrafana(t), newGrafana(t)
+	staging.SetTeams("1", teams.Team{ID: 1, OrgID: 1, Name: "team-staging"})
+	ir := teams.IssuerRouter{
+		Routes: map[string]http.Handler{
+			prod.URL:    newEnforcer(t, prod).ExtractLabel(tenantsHandler),
+			staging.URL: newEnforcer(t, staging).ExtractLabel(tenantsHandler),
+		},
+		Default: labelHandler("default"),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int
+		want   string
+	}{
+		{name: "prod token", token: token(t, prod, "1", 1), status: http.StatusOK, want: "team-a\nteam-b\n"},
+		{name: "staging token", token: token(t, staging, "1", 1), status: http.StatusOK, want: "team-staging\n"},
+		{name: "issuer with a trailing slash", token: tokenWithClaims(t, staging, "1", 1, jwt.MapClaims{"iss": staging.URL + "/"}), status: http.StatusOK, want: "team-staging\n"},
+		{name: "staging issuer signed by prod", token: tokenWithClaims(t, prod, "1", 1, jwt.MapClaims{"iss": staging.URL}), status: http.StatusUnauthorized},
+		{name: "unknown issuer", token: tokenWithClaims(t, prod, "1", 1, jwt.MapClaims{"iss": "https://grafana.example.com"}), status: http.StatusUnauthorized},
+		{name: "no issuer", token: tokenWithClaims(t, prod, "1", 1, jwt.MapClaims{"iss": nil}), status: http.StatusUnauthorized},
+		{name: "no token", status: http.StatusOK, want: "default"},
+		{name: "malformed token", token: "not-a-jwt", status: http.StatusOK, want: "default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Grafana-Id", tc.token)
+			}
+			w := serve(ir, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("answered %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrgLabelRouter(t *testing.T) {
+	g := newGrafana(t)
+	// route enforces label, answering it along with the label values enforced
+	route := func(label string) http.Handler {
+		gte := newEnforcer(t, g)
+		gte.Label = label
+		return gte.ExtractLabel(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(teams.EnforcedLabel(r.Context()) + ":"))
+			tenantsHandler(w, r)
+		}))
+	}
+	routes := map[string]http.Handler{"team": route("team"), "tenant": route("tenant")}
+
+	for _, tc := range []struct {
+		name           string
+		rejectUnmapped bool
+		token          string
+		status         int
+		want           string
+	}{
+		{name: "org 1", token: token(t, g, "1", 1), status: http.StatusOK, want: "team:team-a\nteam-b\n"},
+		{name: "org 2", token: token(t, g, "1", 2), status: http.StatusOK, want: "tenant:team-c\n"},
+		{name: "unmapped org", token: token(t, g, "1", 3), status: http.StatusOK, want: "default"},
+		{name: "unmapped org rejected", rejectUnmapped: true, token: token(t, g, "1", 3), status: http.StatusForbidden},
+		{name: "mapped org with unmapped orgs rejected", rejectUnmapped: true, token: token(t, g, "1", 2), status: http.StatusOK, want: "tenant:team-c\n"},
+		// the default routes reject the request the same way as any other request
+		{name: "no token", rejectUnmapped: true, status: http.StatusOK, want: "default"},
+		{name: "malformed aud claim", rejectUnmapped: true, token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"aud": "org"}), status: http.StatusOK, want: "default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			olr := teams.OrgLabelRouter{
+				Enforcer:       newEnforcer(t, g),
+				Labels:         map[int64]string{1: "team", 2: "tenant"},
+				Routes:         routes,
+				Default:        labelHandler("default"),
+				RejectUnmapped: tc.rejectUnmapped,
+			}
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Grafana-Id", tc.token)
+			}
+			w := serve(olr, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("answered %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestDatasourceRouter(t *testing.T) {
+	g := newGrafana(t)
+	rec := &decisionRecorder{}
+	// route enforces the team label on the requests to upstream, answering its name along
+	// with the label values enforced
+	route := func(upstream string) http.Handler {
+		gte := newEnforcer(t, g)
+		gte.Recorders = []teams.DecisionRecorder{rec}
+		return gte.ExtractLabel(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(upstream + ":"))
+			tenantsHandler(w, r)
+		}))
+	}
+	routes := map[string]http.Handler{"prometheus-uid": route("prometheus"), "thanos-uid": route("thanos")}
+
+	for _, tc := range []struct {
+		name          string
+		rejectUnknown bool
+		token         string
+		status        int
+		want          string
+		datasource    string
+	}{
+		{name: "prometheus", token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": "prometheus-uid"}), status: http.StatusOK, want: "prometheus:team-a\nteam-b\n", datasource: "prometheus-uid"},
+		{name: "thanos", token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": "thanos-uid"}), status: http.StatusOK, want: "thanos:team-a\nteam-b\n", datasource: "thanos-uid"},
+		{name: "unknown datasource", token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": "loki-uid"}), status: http.StatusOK, want: "default"},
+		{name: "unknown datasource rejected", rejectUnknown: true, token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": "loki-uid"}), status: http.StatusForbidden},
+		{name: "no datasource rejected", rejectUnknown: true, token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": nil}), status: http.StatusForbidden},
+		{name: "datasource not a string rejected", rejectUnknown: true, token: tokenWithClaims(t, g, "1", 1, jwt.MapClaims{"azp": 1}), status: http.StatusForbidden},
+		// the default routes reject the request the same way as any other request
+		{name: "no token", rejectUnknown: true, status: http.StatusOK, want: "default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec.decisions = nil
+			dr := teams.DatasourceRouter{
+				Enforcer:      newEnforcer(t, g),
+				Claim:         "azp",
+				Routes:        routes,
+				Default:       labelHandler("default"),
+				RejectUnknown: tc.rejectUnknown,
+			}
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Grafana-Id", tc.token)
+			}
+			w := serve(dr, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("answered %q, want %q", w.Body, tc.want)
+			}
+			// the datasource routed to is recorded in the decision
+			if tc.datasource != "" && (len(rec.decisions) != 1 || rec.decisions[0].Datasource != tc.datasource) {
+				t.Errorf("decisions = %+v, want 1 of datasource %q", rec.decisions, tc.datasource)
+			}
+		})
+	}
+}
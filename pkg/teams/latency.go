@@ -0,0 +1,60 @@
+package teams
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of the Grafana team lookups observed by the histogram returned by
+// NewGrafanaLatency.
+const (
+	GrafanaSuccess = "success"
+	GrafanaError   = "error"
+	GrafanaTimeout = "timeout"
+)
+
+// NewGrafanaLatency creates the histogram of the durations of the Grafana team lookups by
+// outcome, registered with reg.
+func NewGrafanaLatency(reg prometheus.Registerer) *prometheus.HistogramVec {
+	h := promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lbac_grafana_request_duration_seconds",
+		Help:    "Duration of the team lookups sent to Grafana on cache misses, by outcome.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"outcome"})
+	for _, o := range []string{GrafanaSuccess, GrafanaError, GrafanaTimeout} {
+		h.WithLabelValues(o)
+	}
+	return h
+}
+
+// NewCredentialsRejected creates the counter of the team lookups failing with
+// ErrGrafanaCredentials, registered with reg.
+func NewCredentialsRejected(reg prometheus.Registerer) prometheus.Counter {
+	return promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Name: "lbac_grafana_credentials_rejected_total",
+		Help: "Total number of team lookups Grafana rejected the credentials of the proxy for, answering with HTTP status code 401 or 403.",
+	})
+}
+
+// observeGrafana records the duration of a team lookup started at start that ended with
+// err. Lookups abandoned by the client are not Grafana's doing and are left out.
+func (gte GrafanaTeamsEnforcer) observeGrafana(ctx context.Context, start time.Time, err error) {
+	if gte.GrafanaLatency == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	outcome := GrafanaSuccess
+	var ne net.Error
+	switch {
+	case err == nil:
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() == context.DeadlineExceeded || errors.As(err, &ne) && ne.Timeout():
+		outcome = GrafanaTimeout
+	default:
+		outcome = GrafanaError
+	}
+	gte.GrafanaLatency.WithLabelValues(outcome).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,85 @@
+package teams_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lookupCounts returns the number of team lookups observed by the latency histogram in
+// reg, by outcome.
+func lookupCounts(t *testing.T, reg *prometheus.Registry) map[string]uint64 {
+	t.Helper()
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]uint64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "lbac_grafana_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetHistogram().GetSampleCount()
+		}
+	}
+	return counts
+}
+
+func TestGrafanaLatency(t *testing.T) {
+	g := newGrafana(t)
+	// slow stands for a Grafana answering after the timeout of the lookups
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		grafana http.HandlerFunc
+		cancel  bool
+		want    map[string]uint64
+	}{
+		{name: "success", want: map[string]uint64{teams.GrafanaSuccess: 1, teams.GrafanaError: 0, teams.GrafanaTimeout: 0}},
+		{
+			name:    "error",
+			grafana: func(w http.ResponseWriter, r *http.Request) { http.Error(w, "down", http.StatusInternalServerError) },
+			want:    map[string]uint64{teams.GrafanaSuccess: 0, teams.GrafanaError: 1, teams.GrafanaTimeout: 0},
+		},
+		{name: "timeout", grafana: slow, want: map[string]uint64{teams.GrafanaSuccess: 0, teams.GrafanaError: 0, teams.GrafanaTimeout: 1}},
+		{name: "cancelled by the client", grafana: slow, cancel: true, want: map[string]uint64{teams.GrafanaSuccess: 0, teams.GrafanaError: 0, teams.GrafanaTimeout: 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			if tc.grafana != nil {
+				gte = withGrafanaAPI(t, gte, tc.grafana)
+			}
+			gte.Client.Timeout = 50 * time.Millisecond
+			reg := prometheus.NewRegistry()
+			gte.GrafanaLatency = teams.NewGrafanaLatency(reg)
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			if tc.cancel {
+				ctx, cancel := context.WithCancel(r.Context())
+				time.AfterFunc(10*time.Millisecond, cancel)
+				r = r.WithContext(ctx)
+			}
+			serve(gte.ExtractLabel(tenantsHandler), r)
+
+			got := lookupCounts(t, reg)
+			for outcome, want := range tc.want {
+				if got[outcome] != want {
+					t.Errorf("%s lookups = %d, want %d", outcome, got[outcome], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package teams
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// matchersParam is the parameter carrying the series selectors of the metadata endpoints.
+const matchersParam = "match[]"
+
+// isMatchPath reports whether path is an endpoint whose match[] selectors injectproxy
+// enforces: /api/v1/series, /api/v1/labels and /api/v1/label/<name>/values.
+func isMatchPath(path string) bool {
+	return path == "/api/v1/series" || isLabelsPath(path)
+}
+
+// isLabelsPath reports whether path is /api/v1/labels or /api/v1/label/<name>/values.
+func isLabelsPath(path string) bool {
+	if path == "/api/v1/labels" {
+		return true
+	}
+	name, ok := strings.CutPrefix(path, "/api/v1/label/")
+	return ok && strings.HasSuffix(name, "/values")
+}
+
+// prepareMatch readies the match[] selectors of a request to an isMatchPath endpoint for
+// injectproxy, which ANDs the enforced matcher into every selector.
+//
+// injectproxy rewrites the selectors of the URL and of a POST body separately, and sets a
+// bare enforced matcher on whichever of them has none. The upstream takes the union of
+// both sets, so selectors sent in the body alone would be widened to every series of the
+// tenant. The selectors are therefore copied to the side that lacks them.
+//
+// With ErrorOnReplaceLabels, selectors of the labels endpoints that cannot match
+// anything once combined with the enforced matcher are rejected, as the query endpoints
+// do with error-on-replace.
+func (gte GrafanaTeamsEnforcer) prepareMatch(r *http.Request, values []string) error {
+	q := r.URL.Query()
+	var form url.Values
+	if r.Method == http.MethodPost && r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		r.Body.Close()
+		if form, err = url.ParseQuery(string(body)); err != nil {
+			return err
+		}
+
+		switch {
+		case len(q[matchersParam]) == 0 && len(form[matchersParam]) > 0:
+			q[matchersParam] = form[matchersParam]
+			r.URL.RawQuery = q.Encode()
+		case len(form[matchersParam]) == 0 && len(q[matchersParam]) > 0:
+			form[matchersParam] = q[matchersParam]
+		}
+		body = []byte(form.Encode())
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		r.ContentLength = int64(len(body))
+	}
+
+	if !gte.ErrorOnReplaceLabels || gte.Label == "" || !isLabelsPath(r.URL.Path) {
+		return nil
+	}
+	e := injectproxy.NewPromQLEnforcer(true, newEnforcedMatcher(gte.Label, values))
+	for _, s := range append(q[matchersParam], form[matchersParam]...) {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			// left for injectproxy to report
+			continue
+		}
+		if _, err := e.EnforceMatchers(ms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// matchUpstream starts an upstream answering the match[] selectors it receives in the URL
+// and in the body, separated by a pipe.
+func matchUpstream(t *testing.T) *url.URL {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()["match[]"]
+		r.ParseForm()
+		w.Write([]byte(strings.Join(query, ",") + "|" + strings.Join(r.PostForm["match[]"], ",")))
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestInjectLabelsMatchSelectors(t *testing.T) {
+	g := newGrafana(t)
+	u := matchUpstream(t)
+
+	const (
+		combined = `{__name__="up",team=~"team-a|team-b"}`
+		inTenant = `{team="team-a",__name__="up",team=~"team-a|team-b"}`
+		conflict = `{team="team-c",__name__="up",team=~"team-a|team-b"}`
+		bare     = `{team=~"team-a|team-b"}`
+	)
+	for _, tc := range []struct {
+		name           string
+		errorOnReplace bool
+		method         string
+		target         string
+		body           string
+		status         int
+		want           string
+	}{
+		{name: "selector without the label", method: "GET", target: "/api/v1/labels?match[]=up", status: http.StatusOK, want: combined + "|"},
+		{name: "selector with the label", method: "GET", target: "/api/v1/label/job/values?match[]=up{team=\"team-a\"}", status: http.StatusOK, want: inTenant + "|"},
+		{name: "selector with another label value", method: "GET", target: "/api/v1/labels?match[]=up{team=\"team-c\"}", status: http.StatusOK, want: conflict + "|"},
+		{name: "no selector", method: "GET", target: "/api/v1/labels", status: http.StatusOK, want: bare + "|"},
+		{name: "POST selector in the body", method: "POST", target: "/api/v1/labels", body: "match[]=up", status: http.StatusOK, want: combined + "|" + combined},
+		{name: "POST selector in the URL", method: "POST", target: "/api/v1/labels?match[]=up", status: http.StatusOK, want: combined + "|" + combined},
+		{name: "POST selector with the label", method: "POST", target: "/api/v1/labels", body: "match[]=up{team=\"team-a\"}", status: http.StatusOK, want: inTenant + "|" + inTenant},
+		{name: "error on replace of the label", errorOnReplace: true, method: "GET", target: "/api/v1/label/job/values?match[]=up{team=\"team-a\"}", status: http.StatusOK, want: inTenant + "|"},
+		{name: "error on replace of another label value", errorOnReplace: true, method: "GET", target: "/api/v1/labels?match[]=up{team=\"team-c\"}", status: http.StatusBadRequest},
+		{name: "error on replace of another label value in the body", errorOnReplace: true, method: "POST", target: "/api/v1/labels", body: "match[]=up{team=\"team-c\"}", status: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.ErrorOnReplaceLabels = tc.errorOnReplace
+			routes, err := injectproxy.NewRoutes(u, "team", gte, injectproxy.WithEnabledLabelsAPI())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.method == "POST" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			w := serve(routes, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("upstream selectors = %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package teams
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// MatcherStyle selects how the matcher of several label values is expressed in the
+// requests sent upstream. A single label value is always enforced with an equality
+// matcher.
+type MatcherStyle string
+
+const (
+	// MatcherStyleAuto keeps the matcher built by injectproxy, currently the same as
+	// MatcherStyleRegexPlain.
+	MatcherStyleAuto MatcherStyle = "auto"
+	// MatcherStyleRegexAnchored enforces label=~"^(?:a|b)$", for upstreams that do not
+	// anchor regular expressions, e.g. VictoriaMetrics with some settings. Prometheus
+	// anchors them anyway, so the anchors are redundant there.
+	MatcherStyleRegexAnchored MatcherStyle = "regex-anchored"
+	// MatcherStyleRegexPlain enforces label=~"a|b".
+	MatcherStyleRegexPlain MatcherStyle = "regex-plain"
+	// MatcherStyleRepeatEquals enforces one equality matcher per value: instant vector
+	// selectors are expanded into (x{label="a"} or x{label="b"}) and match[] selectors are
+	// repeated once per value, both of which select the same series as the regular
+	// expression. Queries with the matcher under a range vector selector or a subquery
+	// cannot be expanded and keep the regular expression.
+	MatcherStyleRepeatEquals MatcherStyle = "repeat-equals"
+)
+
+// EnforcedLabel returns the label name enforced on the request of ctx by ExtractLabel,
+// empty when there is none.
+func EnforcedLabel(ctx context.Context) string {
+	if d, ok := ctx.Value(decisionKey).(*Decision); ok {
+		return d.Label
+	}
+	return ""
+}
+
+// RestyleMatcher rewrites the matcher injectproxy enforced on the query and match[]
+// parameters of req, an upstream request, in style. Requests enforcing a single label
+// value are left untouched, as are expressions that fail to parse, which the upstream
+// rejects.
+func RestyleMatcher(req *http.Request, style MatcherStyle) error {
+	values := TenantsFromContext(req.Context())
+	label := EnforcedLabel(req.Context())
+	if style == "" || style == MatcherStyleAuto || style == MatcherStyleRegexPlain || len(values) < 2 || label == "" {
+		return nil
+	}
+	rs := restyler{style: style, injected: newEnforcedMatcher(label, values), values: values}
+	return rewriteParams(req, rs.params)
+}
+
+// rewriteParams applies rewrite to the parameters of the URL and of the POST form body of
+// req, an upstream request, re-encoding those it reports changed.
+func rewriteParams(req *http.Request, rewrite func(url.Values) bool) error {
+	q := req.URL.Query()
+	if rewrite(q) {
+		req.URL.RawQuery = q.Encode()
+	}
+
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	req.Body.Close()
+	if form, err := url.ParseQuery(string(body)); err == nil && rewrite(form) {
+		body = []byte(form.Encode())
+	}
+	req.Body = io.NopCloser(strings.NewReader(string(body)))
+	req.ContentLength = int64(len(body))
+	return nil
+}
+
+type restyler struct {
+	style    MatcherStyle
+	injected *labels.Matcher
+	values   []string
+}
+
+// params rewrites the query and match[] parameters of v, reporting whether any changed.
+func (rs restyler) params(v url.Values) bool {
+	changed := false
+	for i, q := range v["query"] {
+		if s, ok := rs.expr(q); ok {
+			v["query"][i], changed = s, true
+		}
+	}
+	if selectors, ok := rs.selectors(v[matchersParam]); ok {
+		v[matchersParam], changed = selectors, true
+	}
+	return changed
+}
+
+// expr rewrites the query q, reporting whether it changed.
+func (rs restyler) expr(q string) (string, bool) {
+	expr, err := parser.ParseExpr(q)
+	if err != nil {
+		return "", false
+	}
+	if rs.style == MatcherStyleRegexAnchored {
+		changed := false
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok {
+				changed = rs.anchor(vs.LabelMatchers) || changed
+			}
+			return nil
+		})
+		return expr.String(), changed
+	}
+
+	expanded, changed, ok := rs.expand(expr)
+	if !ok {
+		slog.Debug("query cannot be expanded into equality matchers, keeping the regular expression", "query", q)
+		return "", false
+	}
+	return expanded.String(), changed
+}
+
+// anchor replaces the injected matcher of ms with an anchored one, reporting whether ms
+// held it.
+func (rs restyler) anchor(ms []*labels.Matcher) bool {
+	i := rs.injectedIndex(ms)
+	if i < 0 {
+		return false
+	}
+	ms[i] = labels.MustNewMatcher(labels.MatchRegexp, rs.injected.Name, "^(?:"+rs.injected.Value+")$")
+	return true
+}
+
+// equals returns a copy of ms with the injected matcher at i replaced by an equality
+// matcher for each value in turn.
+func (rs restyler) equals(ms []*labels.Matcher, i int) [][]*labels.Matcher {
+	expanded := make([][]*labels.Matcher, len(rs.values))
+	for j, v := range rs.values {
+		expanded[j] = slices.Clone(ms)
+		expanded[j][i] = labels.MustNewMatcher(labels.MatchEqual, rs.injected.Name, v)
+	}
+	return expanded
+}
+
+func (rs restyler) injectedIndex(ms []*labels.Matcher) int {
+	return slices.IndexFunc(ms, func(m *labels.Matcher) bool {
+		return m.Name == rs.injected.Name && m.Type == rs.injected.Type && m.Value == rs.injected.Value
+	})
+}
+
+// expand replaces the instant vector selectors of e holding the injected matcher with an
+// or of one selector per value, reporting whether any was replaced. It fails when the
+// matcher is held by a selector that cannot be replaced.
+func (rs restyler) expand(e parser.Expr) (parser.Expr, bool, bool) {
+	switch n := e.(type) {
+	case *parser.VectorSelector:
+		i := rs.injectedIndex(n.LabelMatchers)
+		if i < 0 {
+			return n, false, true
+		}
+		var or parser.Expr
+		for _, ms := range rs.equals(n.LabelMatchers, i) {
+			vs := *n
+			vs.LabelMatchers = ms
+			if or == nil {
+				or = &vs
+				continue
+			}
+			or = &parser.BinaryExpr{Op: parser.LOR, LHS: or, RHS: &vs, VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany}}
+		}
+		return &parser.ParenExpr{Expr: or}, true, true
+
+	case *parser.MatrixSelector, *parser.SubqueryExpr:
+		held := false
+		parser.Inspect(n, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok && rs.injectedIndex(vs.LabelMatchers) >= 0 {
+				held = true
+			}
+			return nil
+		})
+		return n, false, !held
+
+	case *parser.AggregateExpr:
+		return rs.expandAll(n, &n.Expr, &n.Param)
+	case *parser.BinaryExpr:
+		return rs.expandAll(n, &n.LHS, &n.RHS)
+	case *parser.Call:
+		args := make([]*parser.Expr, len(n.Args))
+		for i := range n.Args {
+			args[i] = &n.Args[i]
+		}
+		return rs.expandAll(n, args...)
+	case *parser.ParenExpr:
+		return rs.expandAll(n, &n.Expr)
+	case *parser.UnaryExpr:
+		return rs.expandAll(n, &n.Expr)
+	case *parser.StepInvariantExpr:
+		return rs.expandAll(n, &n.Expr)
+	}
+	return e, false, true
+}
+
+// expandAll expands the children of e in place.
+func (rs restyler) expandAll(e parser.Expr, children ...*parser.Expr) (parser.Expr, bool, bool) {
+	changed := false
+	for _, c := range children {
+		if *c == nil {
+			continue
+		}
+		expanded, ch, ok := rs.expand(*c)
+		if !ok {
+			return e, false, false
+		}
+		*c, changed = expanded, changed || ch
+	}
+	return e, changed, true
+}
+
+// selectors rewrites the match[] selectors, reporting whether any changed.
+func (rs restyler) selectors(selectors []string) ([]string, bool) {
+	var restyled []string
+	changed := false
+	for _, s := range selectors {
+		ms, err := parser.ParseMetricSelector(s)
+		if err != nil {
+			restyled = append(restyled, s)
+			continue
+		}
+		if rs.style == MatcherStyleRegexAnchored {
+			if rs.anchor(ms) {
+				s, changed = (&parser.VectorSelector{LabelMatchers: ms}).String(), true
+			}
+			restyled = append(restyled, s)
+			continue
+		}
+
+		i := rs.injectedIndex(ms)
+		if i < 0 {
+			restyled = append(restyled, s)
+			continue
+		}
+		// the upstream takes the union of the series matched by every selector
+		for _, expanded := range rs.equals(ms, i) {
+			restyled = append(restyled, (&parser.VectorSelector{LabelMatchers: expanded}).String())
+		}
+		changed = true
+	}
+	return restyled, changed
+}
@@ -0,0 +1,103 @@
+package teams
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// upstreamRequest returns a request sent upstream with values of the team label enforced.
+func upstreamRequest(method, target, body string, values ...string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if method == http.MethodPost {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	ctx := context.WithValue(r.Context(), tenantsKey, values)
+	ctx = context.WithValue(ctx, decisionKey, &Decision{Label: "team"})
+	return r.WithContext(ctx)
+}
+
+func TestRestyleMatcherQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		style MatcherStyle
+		query string
+		want  string
+	}{
+		{name: "auto", style: MatcherStyleAuto, query: `up{team=~"a|b"}`, want: `up{team=~"a|b"}`},
+		{name: "regex plain", style: MatcherStyleRegexPlain, query: `up{team=~"a|b"}`, want: `up{team=~"a|b"}`},
+		{name: "regex anchored", style: MatcherStyleRegexAnchored, query: `sum(rate(http_requests_total{team=~"a|b"}[5m])) / up{team=~"a|b"}`,
+			want: `sum(rate(http_requests_total{team=~"^(?:a|b)$"}[5m])) / up{team=~"^(?:a|b)$"}`},
+		{name: "regex anchored leaves other matchers", style: MatcherStyleRegexAnchored, query: `up{job=~"a|b",team=~"a|b"}`, want: `up{job=~"a|b",team=~"^(?:a|b)$"}`},
+		{name: "repeat equals", style: MatcherStyleRepeatEquals, query: `up{team=~"a|b"}`, want: `(up{team="a"} or up{team="b"})`},
+		{name: "repeat equals in expressions", style: MatcherStyleRepeatEquals, query: `sum by (job) (up{job="x",team=~"a|b"}) > 1`,
+			want: `sum by (job) ((up{job="x",team="a"} or up{job="x",team="b"})) > 1`},
+		{name: "repeat equals in a function call", style: MatcherStyleRepeatEquals, query: `abs(-up{team=~"a|b"})`, want: `abs(-(up{team="a"} or up{team="b"}))`},
+		{name: "repeat equals under a range selector", style: MatcherStyleRepeatEquals, query: `rate(up{team=~"a|b"}[5m])`, want: `rate(up{team=~"a|b"}[5m])`},
+		{name: "repeat equals under a subquery", style: MatcherStyleRepeatEquals, query: `max_over_time(up{team=~"a|b"}[1h:5m])`, want: `max_over_time(up{team=~"a|b"}[1h:5m])`},
+		{name: "other regular expression", style: MatcherStyleRepeatEquals, query: `up{team=~"a|c"}`, want: `up{team=~"a|c"}`},
+		{name: "invalid query", style: MatcherStyleRegexAnchored, query: `up{`, want: `up{`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := upstreamRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {tc.query}}.Encode(), "", "a", "b")
+			if err := RestyleMatcher(r, tc.style); err != nil {
+				t.Fatal(err)
+			}
+			if got := r.URL.Query().Get("query"); got != tc.want {
+				t.Errorf("query = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRestyleMatcherSelectors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		style    MatcherStyle
+		selector string
+		want     []string
+	}{
+		{name: "regex anchored", style: MatcherStyleRegexAnchored, selector: `{__name__="up",team=~"a|b"}`, want: []string{`{__name__="up",team=~"^(?:a|b)$"}`}},
+		{name: "repeat equals", style: MatcherStyleRepeatEquals, selector: `{__name__="up",team=~"a|b"}`, want: []string{`{__name__="up",team="a"}`, `{__name__="up",team="b"}`}},
+		{name: "other selector", style: MatcherStyleRepeatEquals, selector: `{__name__="up"}`, want: []string{`{__name__="up"}`}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, method := range []string{http.MethodGet, http.MethodPost} {
+				form := url.Values{matchersParam: {tc.selector}}.Encode()
+				r := upstreamRequest(method, "/api/v1/series?"+form, form, "a", "b")
+				if err := RestyleMatcher(r, tc.style); err != nil {
+					t.Fatal(err)
+				}
+				if got := r.URL.Query()[matchersParam]; !slices.Equal(got, tc.want) {
+					t.Errorf("%s: URL selectors = %q, want %q", method, got, tc.want)
+				}
+				if method != http.MethodPost {
+					continue
+				}
+				body, _ := io.ReadAll(r.Body)
+				v, _ := url.ParseQuery(string(body))
+				if got := v[matchersParam]; !slices.Equal(got, tc.want) {
+					t.Errorf("body selectors = %q, want %q", got, tc.want)
+				}
+				if r.ContentLength != int64(len(body)) {
+					t.Errorf("Content-Length = %d, want %d", r.ContentLength, len(body))
+				}
+			}
+		})
+	}
+}
+
+func TestRestyleMatcherSingleValue(t *testing.T) {
+	r := upstreamRequest(http.MethodGet, "/api/v1/query?"+url.Values{"query": {`up{team="a"}`}}.Encode(), "", "a")
+	if err := RestyleMatcher(r, MatcherStyleRegexAnchored); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.URL.Query().Get("query"); got != `up{team="a"}` {
+		t.Errorf("query = %s, want the equality matcher kept", got)
+	}
+}
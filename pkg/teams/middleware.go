@@ -0,0 +1,319 @@
+package teams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+)
+
+// Principal is the Grafana user a request was authenticated as.
+type Principal struct {
+	UserID string
+	OrgID  int64
+	// OrgUnknown is set when the org could not be read from the token, in which case
+	// ResolveTenants infers it from the teams of the user.
+	OrgUnknown bool
+	Token      *jwt.Token
+}
+
+// PrincipalFromContext returns the principal stored by Authenticate.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey).(Principal)
+	return p, ok
+}
+
+// decisionFromContext returns the decision recorded by ExtractLabel, or a throwaway one
+// when the middlewares are used on their own.
+func decisionFromContext(ctx context.Context) *Decision {
+	if d, ok := ctx.Value(decisionKey).(*Decision); ok {
+		return d
+	}
+	return &Decision{}
+}
+
+// DefaultTokenHeader is the header carrying the token of the user, as sent by Grafana.
+const DefaultTokenHeader = "X-Grafana-Id"
+
+// bearerPrefix is trimmed from the tokens, so they can be read from Authorization-style
+// headers.
+const bearerPrefix = "Bearer "
+
+// tokenFromHeader returns the token carried by header of r, or by DefaultTokenHeader when
+// header is empty, without its "Bearer " prefix if any.
+func tokenFromHeader(r *http.Request, header string) string {
+	if header == "" {
+		header = DefaultTokenHeader
+	}
+	v := r.Header.Get(header)
+	if len(v) > len(bearerPrefix) && strings.EqualFold(v[:len(bearerPrefix)], bearerPrefix) {
+		return v[len(bearerPrefix):]
+	}
+	return v
+}
+
+// tokenHeader returns the header carrying the token of the user.
+func (gte GrafanaTeamsEnforcer) tokenHeader() string {
+	if gte.TokenHeader == "" {
+		return DefaultTokenHeader
+	}
+	return gte.TokenHeader
+}
+
+// maxClaims bounds the number of claims accepted in a token.
+const maxClaims = 64
+
+// parseToken verifies signedToken, rejecting tokens over MaxTokenBytes before decoding
+// them and tokens carrying an unreasonable number of claims. Tokens found in the
+// TokenCache are not verified again.
+func (gte GrafanaTeamsEnforcer) parseToken(ctx context.Context, signedToken string) (*jwt.Token, error) {
+	if gte.MaxTokenBytes > 0 && len(signedToken) > gte.MaxTokenBytes {
+		return nil, fmt.Errorf("token of %d bytes exceeds the maximum size of %d bytes", len(signedToken), gte.MaxTokenBytes)
+	}
+	if gte.TokenCache != nil {
+		if token, found := gte.TokenCache.get(signedToken); found {
+			return token, nil
+		}
+	}
+	token, err := jwt.Parse(signedToken, gte.KeyFunc.KeyfuncCtx(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok && len(claims) > maxClaims {
+		return nil, fmt.Errorf("token carries %d claims, more than the maximum of %d", len(claims), maxClaims)
+	}
+	if gte.TokenCache != nil {
+		gte.TokenCache.set(signedToken, token)
+	}
+	return token, nil
+}
+
+// Authenticate verifies the token of the request, read from TokenHeader, and stores the Principal
+// it identifies in the request context.
+func (gte GrafanaTeamsEnforcer) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		StartPhase(r.Context(), PhaseAuth)
+		token, ok := r.Context().Value(tokenKey).(*jwt.Token)
+		if !ok {
+			signedToken := tokenFromHeader(r, gte.TokenHeader)
+			if signedToken == "" {
+				slog.Error("no token header present", "header", gte.tokenHeader())
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			var err error
+			token, err = gte.parseToken(r.Context(), signedToken)
+			if err != nil {
+				if isCanceled(r.Context(), err) {
+					slog.Debug("token validation cancelled", "error", err)
+					http.Error(w, "token validation cancelled", http.StatusServiceUnavailable)
+					return
+				}
+				if gte.AllowOpaqueToken && errors.Is(err, jwt.ErrTokenMalformed) {
+					gte.authenticateOpaque(w, r, next, signedToken)
+					return
+				}
+				slog.Error("error while parsing token", "error", err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			for _, c := range gte.RequiredClaims {
+				if _, found := claims[c]; !found {
+					slog.Error("token is missing required claim", "claim", c)
+					http.Error(w, fmt.Sprintf("token is missing required claim %q", c), http.StatusUnauthorized)
+					return
+				}
+			}
+
+			if gte.ExpectedAzp != "" {
+				if azp, _ := claims["azp"].(string); azp != gte.ExpectedAzp {
+					slog.Error("token azp claim does not match", "azp", azp, "expected", gte.ExpectedAzp)
+					http.Error(w, fmt.Sprintf("token azp claim %q does not match the expected authorized party", azp), http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+
+		if gte.MaxTokenAge > 0 {
+			iat, err := token.Claims.GetIssuedAt()
+			if err != nil || iat == nil {
+				slog.Error("token carries no valid iat claim", "error", err)
+				http.Error(w, "token carries no valid iat claim to check its age against", http.StatusUnauthorized)
+				return
+			}
+			if age := time.Since(iat.Time); age > gte.MaxTokenAge {
+				slog.Error("token is too old", "age", age, "max", gte.MaxTokenAge)
+				http.Error(w, fmt.Sprintf("token issued %s ago exceeds the maximum age of %s", age.Round(time.Second), gte.MaxTokenAge), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		d := decisionFromContext(r.Context())
+
+		// extract user id from subject
+		sub, err := token.Claims.GetSubject()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userId, err := parseSubject(sub)
+		if err != nil {
+			slog.Error("rejecting token with malformed sub claim", "error", err)
+			gte.rejectClaim("sub")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		d.UserID = userId
+
+		orgId, err := orgIDFromToken(token)
+		orgUnknown := false
+		if err != nil {
+			if !gte.InferOrgFromTeams || gte.labelSource() != LabelSourceTeams {
+				slog.Error("rejecting token with malformed aud claim", "userId", userId, "error", err)
+				gte.rejectClaim("aud")
+				http.Error(w, fmt.Sprintf("unable to parse aud claim to fetch orgId: %v", err), http.StatusUnauthorized)
+				return
+			}
+			slog.Debug("unable to parse aud claim, inferring the org from the teams of the user", "error", err, "userId", userId)
+			orgUnknown = true
+		}
+		d.OrgID = orgId
+
+		p := Principal{UserID: userId, OrgID: orgId, OrgUnknown: orgUnknown, Token: token}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	})
+}
+
+// rejectClaim counts a token rejected for its malformed claim.
+func (gte GrafanaTeamsEnforcer) rejectClaim(claim string) {
+	if gte.RejectedClaims != nil {
+		gte.RejectedClaims.WithLabelValues(claim).Inc()
+	}
+}
+
+// ResolveTenants resolves the label values the authenticated Principal may access and
+// stores them in the request context. Requests without a Principal are rejected.
+func (gte GrafanaTeamsEnforcer) ResolveTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			slog.Error("resolving tenants of an unauthenticated request")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userId, orgId := p.UserID, p.OrgID
+
+		StartPhase(r.Context(), PhaseTeams)
+		if p.OrgUnknown {
+			var err error
+			if orgId, err = gte.inferOrg(r, userId); err != nil {
+				if !lookupFailed(w, r, userId, err) {
+					// the teams span several orgs or none, reject the aud claim as without InferOrgFromTeams
+					slog.Error("rejecting token with malformed aud claim", "userId", userId, "error", err)
+					gte.rejectClaim("aud")
+					http.Error(w, fmt.Sprintf("unable to parse aud claim to fetch orgId: %v", err), http.StatusUnauthorized)
+				}
+				return
+			}
+			decisionFromContext(r.Context()).OrgID = orgId
+		}
+		teamNames, err := gte.resolveLabelValues(r, userId, orgId)
+		if err != nil {
+			if errors.Is(err, ErrLabelValueTemplate) {
+				slog.Error("label value cannot be derived", "userId", userId, "error", err)
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if !lookupFailed(w, r, userId, err) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if teamNames == nil {
+			if gte.labelSource() == LabelSourceFolders {
+				http.Error(w, fmt.Sprintf("userId=%s cannot access any folders in orgId=%d", userId, orgId), http.StatusNotFound)
+				return
+			}
+			http.Error(w, fmt.Sprintf("userId=%s is not a member of any teams in orgId=%d", userId, orgId), http.StatusNotFound)
+			return
+		}
+
+		decisionFromContext(r.Context()).Teams = teamNames
+
+		for _, v := range teamNames {
+			if err := validLabelValue(v); err != nil {
+				slog.Error("label value cannot be enforced", "userId", userId, "error", err)
+				http.Error(w, fmt.Sprintf("cannot enforce label values of userId=%s: %v", userId, err), http.StatusForbidden)
+				return
+			}
+		}
+
+		if gte.Freezer != nil {
+			if tenant, until, frozen := gte.Freezer.check(teamNames); frozen {
+				slog.Info("rejecting request for frozen tenant", "userId", userId, "tenant", tenant)
+				http.Error(w, fmt.Sprintf("tenant %q is frozen until %s", tenant, until.Format(time.RFC3339)), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantsKey, teamNames)))
+	})
+}
+
+// lookupFailed answers the requests whose lookup in Grafana was cancelled or failed and
+// reports whether err was such a failure.
+func lookupFailed(w http.ResponseWriter, r *http.Request, userId string, err error) bool {
+	if isCanceled(r.Context(), err) {
+		slog.Debug("teams lookup cancelled", "userId", userId, "error", err)
+		http.Error(w, "teams lookup cancelled", http.StatusServiceUnavailable)
+		return true
+	}
+	if errors.Is(err, ErrGrafanaDependency) {
+		slog.Error("teams lookup failed", "userId", userId, "error", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return true
+	}
+	return false
+}
+
+// InjectLabels hands the resolved tenants to injectproxy as the label values to enforce.
+// Requests without resolved tenants are rejected.
+func (gte GrafanaTeamsEnforcer) InjectLabels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		StartPhase(r.Context(), PhaseEnforce)
+		teamNames := TenantsFromContext(r.Context())
+		if teamNames == nil {
+			slog.Error("injecting labels without resolved tenants")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if isMatchPath(r.URL.Path) {
+			if err := gte.prepareMatch(r, teamNames); err != nil {
+				slog.Debug("rejecting match[] selectors", "path", r.URL.Path, "error", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		d := decisionFromContext(r.Context())
+		d.forwarded = true
+		if gte.Label != "" {
+			d.Matcher = enforcedMatcher(gte.Label, teamNames)
+			d.EnforcedMatcher = normalizedMatcher(gte.Label, teamNames)
+		}
+		ctx := gte.withDebug(r, teamNames)
+		next.ServeHTTP(w, r.WithContext(injectproxy.WithLabelValues(ctx, teamNames)))
+	})
+}
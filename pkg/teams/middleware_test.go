@@ -0,0 +1,72 @@
+package teams
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestTokenFromHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header string
+		set    string
+		value  string
+		want   string
+	}{
+		{name: "default header", set: DefaultTokenHeader, value: "abc", want: "abc"},
+		{name: "custom header", header: "X-Id-Token", set: "X-Id-Token", value: "abc", want: "abc"},
+		{name: "other header ignored", header: "X-Id-Token", set: DefaultTokenHeader, value: "abc", want: ""},
+		{name: "bearer prefix", header: "Authorization", set: "Authorization", value: "Bearer abc", want: "abc"},
+		{name: "bearer prefix case insensitive", header: "Authorization", set: "Authorization", value: "bearer abc", want: "abc"},
+		{name: "bare prefix", header: "Authorization", set: "Authorization", value: "Bearer ", want: "Bearer "},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			r.Header.Set(tc.set, tc.value)
+			if got := tokenFromHeader(r, tc.header); got != tc.want {
+				t.Errorf("tokenFromHeader() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLookupAsSelfForwardsTokenHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		tokenHeader string
+		want        string
+	}{
+		{name: "default", want: DefaultTokenHeader},
+		{name: "custom", tokenHeader: "X-Id-Token", want: "X-Id-Token"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := GrafanaTeamsEnforcer{
+				GrafanaUrl:     url.URL{Scheme: "http", Host: "grafana"},
+				LookupIdentity: LookupAsSelf,
+				TokenHeader:    tc.tokenHeader,
+			}
+			in := httptest.NewRequest("GET", "/api/v1/query", nil)
+			in.Header.Set(tc.want, "token")
+			in.Header.Set("Cookie", "grafana_session=1")
+			in.Header.Set("X-Unrelated", "1")
+
+			req, err := gte.newTeamsRequest(in, "1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := req.Header.Get(tc.want); got != "token" {
+				t.Errorf("%s = %q, want the token of the caller", tc.want, got)
+			}
+			if got := req.Header.Get("Cookie"); got != "grafana_session=1" {
+				t.Errorf("Cookie = %q, want it forwarded", got)
+			}
+			if got := req.Header.Get("X-Unrelated"); got != "" {
+				t.Errorf("X-Unrelated = %q, want it left out", got)
+			}
+			if req.URL.Path != "/api/user/teams" {
+				t.Errorf("path = %q, want /api/user/teams", req.URL.Path)
+			}
+		})
+	}
+}
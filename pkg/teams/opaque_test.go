@@ -0,0 +1,89 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExtractLabelOpaqueToken(t *testing.T) {
+	g := newGrafana(t)
+	grafanaURL, err := url.Parse(g.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grafana := httputil.NewSingleHostReverseProxy(grafanaURL)
+	// introspections counts the requests to /api/user, which resolves the opaque tokens of
+	// user 1 in org 1 and of a token without an identity, the rest being served by g
+	var introspections atomic.Int64
+	introspect := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/user" {
+			grafana.ServeHTTP(w, r)
+			return
+		}
+		introspections.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Authorization") {
+		case "Bearer glsa_user1":
+			w.Write([]byte(`{"id": 1, "orgId": 1, "login": "user1"}`))
+		case "Bearer glsa_anonymous":
+			w.Write([]byte(`{"login": "anonymous"}`))
+		default:
+			http.Error(w, `{"message": "invalid API key"}`, http.StatusUnauthorized)
+		}
+	}
+
+	// a JWT failing verification is rejected, not introspected
+	expired, err := g.Token("1", 1, -time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		allow          bool
+		token          string
+		status         int
+		tenants        string
+		introspections int64
+	}{
+		{name: "valid opaque token", allow: true, token: "glsa_user1", status: http.StatusOK, tenants: "team-a\nteam-b\n", introspections: 1},
+		{name: "opaque token rejected by Grafana", allow: true, token: "glsa_revoked", status: http.StatusUnauthorized, introspections: 1},
+		{name: "opaque token without identity", allow: true, token: "glsa_anonymous", status: http.StatusUnauthorized, introspections: 1},
+		{name: "JWT", allow: true, token: token(t, g, "1", 2), status: http.StatusOK, tenants: "team-c\n"},
+		{name: "expired JWT", allow: true, token: expired, status: http.StatusUnauthorized},
+		{name: "opaque token not allowed", token: "glsa_user1", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			introspections.Store(0)
+			gte := withGrafanaAPI(t, newEnforcer(t, g), introspect)
+			gte.AllowOpaqueToken = tc.allow
+			gte.IntrospectionPath = "/api/user"
+
+			// the second request is served from the cache
+			for range 2 {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+				r.Header.Set("X-Grafana-Id", tc.token)
+				w := serve(gte.ExtractLabel(tenantsHandler), r)
+				if w.Code != tc.status {
+					t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+				}
+				if tc.status == http.StatusOK && w.Body.String() != tc.tenants {
+					t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+				}
+			}
+			want := tc.introspections
+			if tc.status != http.StatusOK {
+				// failed introspections are not cached
+				want *= 2
+			}
+			if got := introspections.Load(); got != want {
+				t.Errorf("%d introspections, want %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package teams
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of a request recorded by the counter returned by NewOutcomeCounter.
+const (
+	// OutcomeEnforced is recorded for requests forwarded with the label enforced.
+	OutcomeEnforced = "enforced"
+	// OutcomePassthrough is recorded for requests sent upstream on a passthrough path.
+	OutcomePassthrough = "passthrough"
+	// OutcomeDenied is recorded for requests refused access, answered with HTTP status code
+	// 403.
+	OutcomeDenied = "denied"
+	// OutcomeFailed is recorded for requests not forwarded for another reason, e.g. a
+	// missing or invalid token, a failed or cancelled lookup or a frozen tenant.
+	OutcomeFailed = "failed"
+	// OutcomeBypassed is recorded for requests deliberately exempted from enforcement.
+	OutcomeBypassed = "bypassed"
+)
+
+// NewOutcomeCounter creates the counter of request outcomes, registered with reg.
+func NewOutcomeCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	c := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "lbac_enforcement_outcome_total",
+		Help: "Total number of requests by enforcement outcome.",
+	}, []string{"outcome"})
+	for _, o := range []string{OutcomeEnforced, OutcomePassthrough, OutcomeDenied, OutcomeFailed, OutcomeBypassed} {
+		c.WithLabelValues(o)
+	}
+	return c
+}
+
+// rejectedOutcome returns the outcome of a request not forwarded, answered with status.
+func rejectedOutcome(status int) string {
+	if status == http.StatusForbidden {
+		return OutcomeDenied
+	}
+	return OutcomeFailed
+}
@@ -0,0 +1,56 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOutcomes(t *testing.T) {
+	g := newGrafana(t)
+	template, err := teams.ParseLabelValueTemplate("{{.tenant}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		source teams.LabelSource
+		user   string
+		want   string
+		status int
+	}{
+		{name: "enforced", user: "1", want: teams.OutcomeEnforced, status: http.StatusOK},
+		{name: "missing token", want: teams.OutcomeFailed, status: http.StatusUnauthorized},
+		{name: "no teams", user: "2", want: teams.OutcomeFailed, status: http.StatusNotFound},
+		{name: "label value not derivable", source: teams.LabelSourceClaims, user: "1", want: teams.OutcomeDenied, status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.Outcomes = teams.NewOutcomeCounter(prometheus.NewRegistry())
+			gte.LabelSource = tc.source
+			gte.LabelTemplate = template
+
+			r := httptest.NewRequest("GET", "/api/v1/query", nil)
+			if tc.user != "" {
+				r.Header.Set("X-Grafana-Id", token(t, g, tc.user, 1))
+			}
+			if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != tc.status {
+				t.Fatalf("status = %d, want %d", w.Code, tc.status)
+			}
+			for _, o := range []string{teams.OutcomeEnforced, teams.OutcomeDenied, teams.OutcomeFailed} {
+				want := 0.0
+				if o == tc.want {
+					want = 1
+				}
+				if got := testutil.ToFloat64(gte.Outcomes.WithLabelValues(o)); got != want {
+					t.Errorf("outcome %q counted %v times, want %v", o, got, want)
+				}
+			}
+		})
+	}
+}
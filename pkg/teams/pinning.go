@@ -0,0 +1,53 @@
+package teams
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ParsePin parses a SHA-256 fingerprint written in hex, with or without colons, or in
+// base64.
+func ParsePin(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if b, err := hex.DecodeString(strings.ReplaceAll(s, ":", "")); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%q is not a hex or base64 SHA-256 fingerprint", s)
+}
+
+// PinnedTransport returns a copy of http.DefaultTransport that, on top of the usual
+// verification, rejects TLS peers whose verified chain holds no certificate matching one
+// of pins. A certificate matches by the SHA-256 of either its SubjectPublicKeyInfo or its
+// whole DER encoding. It must be called before http.DefaultTransport is replaced.
+func PinnedTransport(pins [][]byte) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		// chains are only verified by the usual verification, which pinning builds upon
+		for _, chain := range cs.VerifiedChains {
+			for _, cert := range chain {
+				spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				der := sha256.Sum256(cert.Raw)
+				for _, pin := range pins {
+					if bytes.Equal(pin, spki[:]) || bytes.Equal(pin, der[:]) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no certificate of the peer matches a pinned fingerprint")
+	}
+	return t
+}
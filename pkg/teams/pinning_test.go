@@ -0,0 +1,88 @@
+package teams_test
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestPinnedTransport(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+	spki := sha256.Sum256(s.Certificate().RawSubjectPublicKeyInfo)
+	der := sha256.Sum256(s.Certificate().Raw)
+	other := sha256.Sum256([]byte("another certificate"))
+
+	for _, tc := range []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "SPKI pin", pins: []string{hex.EncodeToString(spki[:])}},
+		{name: "certificate pin", pins: []string{hex.EncodeToString(der[:])}},
+		{name: "base64 pin", pins: []string{base64.StdEncoding.EncodeToString(spki[:])}},
+		{name: "one of several pins", pins: []string{hex.EncodeToString(other[:]), hex.EncodeToString(spki[:])}},
+		{name: "non-matching pin", pins: []string{hex.EncodeToString(other[:])}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var pins [][]byte
+			for _, p := range tc.pins {
+				pin, err := teams.ParsePin(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pins = append(pins, pin)
+			}
+			transport := teams.PinnedTransport(pins)
+			// the usual verification still applies, trust the test server
+			transport.TLSClientConfig.RootCAs = x509.NewCertPool()
+			transport.TLSClientConfig.RootCAs.AddCert(s.Certificate())
+			defer transport.CloseIdleConnections()
+
+			resp, err := (&http.Client{Transport: transport}).Get(s.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tc.wantErr != (err != nil) {
+				t.Errorf("Get() = %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		// a pinned certificate is not trusted unless the usual verification succeeds
+		transport := teams.PinnedTransport([][]byte{spki[:]})
+		defer transport.CloseIdleConnections()
+		if resp, err := (&http.Client{Transport: transport}).Get(s.URL); err == nil {
+			resp.Body.Close()
+			t.Error("Get() succeeded with an untrusted certificate")
+		}
+	})
+}
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("certificate"))
+	hexPin := hex.EncodeToString(sum[:])
+	var colons []string
+	for i := 0; i < len(hexPin); i += 2 {
+		colons = append(colons, hexPin[i:i+2])
+	}
+
+	for _, s := range []string{hexPin, strings.ToUpper(strings.Join(colons, ":")), base64.StdEncoding.EncodeToString(sum[:]), " " + hexPin + "\n"} {
+		if pin, err := teams.ParsePin(s); err != nil || string(pin) != string(sum[:]) {
+			t.Errorf("ParsePin(%q) = %x, %v, want %x", s, pin, err, sum)
+		}
+	}
+	for _, s := range []string{"", "abc", hexPin[:32], base64.StdEncoding.EncodeToString(sum[:16])} {
+		if _, err := teams.ParsePin(s); err == nil {
+			t.Errorf("ParsePin(%q) = nil error", s)
+		}
+	}
+}
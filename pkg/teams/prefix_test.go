@@ -0,0 +1,83 @@
+package teams_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestExtractLabelGrafanaPathPrefix(t *testing.T) {
+	g := newGrafana(t)
+	// prefixed serves g under /grafana/ only, like Grafana behind a reverse proxy with
+	// serve_from_sub_path, recording the paths requested
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	prefixed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if !strings.HasPrefix(r.URL.Path, "/grafana/") {
+			http.NotFound(w, r)
+			return
+		}
+		http.StripPrefix("/grafana", g.Config.Handler).ServeHTTP(w, r)
+	}))
+	defer prefixed.Close()
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		identity teams.LookupIdentity
+		source   teams.LabelSource
+		tenants  string
+	}{
+		{name: "teams", url: prefixed.URL + "/grafana", tenants: "team-a\nteam-b\n"},
+		{name: "trailing slash", url: prefixed.URL + "/grafana/", tenants: "team-a\nteam-b\n"},
+		{name: "teams of the user", url: prefixed.URL + "/grafana", identity: teams.LookupAsSelf, tenants: "team-a\nteam-b\n"},
+		{name: "folders", url: prefixed.URL + "/grafana", source: teams.LabelSourceFolders, tenants: "Ops\nDev\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			paths = nil
+			grafanaURL, err := url.Parse(tc.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gte := newEnforcer(t, g)
+			gte.GrafanaUrl = *grafanaURL
+			gte.LookupIdentity = tc.identity
+			gte.LabelSource = tc.source
+			// as main.go derives the JWKS URL from --grafana-url
+			if gte.KeyFunc, err = teams.NewKeyfunc(context.Background(), []string{grafanaURL.JoinPath("/api/signing-keys/keys").String()}, teams.JWKSOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+			if w.Body.String() != tc.tenants {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(paths) < 2 {
+				t.Errorf("paths requested = %q, want the keys and the lookup", paths)
+			}
+			for _, p := range paths {
+				if !strings.HasPrefix(p, "/grafana/api/") || strings.Contains(p, "//") {
+					t.Errorf("path %q requested outside of /grafana/api/", p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package teams
+
+import (
+	"cmp"
+	"container/list"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// CacheRecency tracks when each entry of a cache was last used, read or set, to bound the
+// cache to max entries by evicting the least recently used ones and, with an idle timeout,
+// to evict the entries not used for that long whatever their expiration.
+type CacheRecency struct {
+	evictions *CacheEvictions
+	max       int
+	idle      time.Duration
+
+	mu sync.Mutex
+	// order holds the accounted entries, the most recently used first
+	order *list.List
+	elems map[string]*list.Element
+}
+
+type recencyEntry struct {
+	key  string
+	used time.Time
+}
+
+// NewCacheRecency tracks the entries stored in c, bounding them to max entries unless max
+// is zero. The entries leaving c are learned from evictions.
+func NewCacheRecency(c *cache.Cache, evictions *CacheEvictions, max int, idle time.Duration) *CacheRecency {
+	cr := &CacheRecency{
+		evictions: evictions,
+		max:       max,
+		idle:      idle,
+		order:     list.New(),
+		elems:     map[string]*list.Element{},
+	}
+	evictions.Listen(cr.forget)
+
+	// track the entries already cached, e.g. loaded from a state file, the oldest least
+	// recently used
+	items := c.Items()
+	keys := slices.SortedFunc(maps.Keys(items), func(a, b string) int {
+		return cmp.Compare(items[a].Expiration, items[b].Expiration)
+	})
+	for _, k := range keys {
+		cr.Set(k)
+	}
+	return cr
+}
+
+// Get records key was read from the cache.
+func (cr *CacheRecency) Get(key string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if e, found := cr.elems[key]; found {
+		e.Value.(*recencyEntry).used = time.Now()
+		cr.order.MoveToFront(e)
+	}
+}
+
+// Set records key was stored in the cache, evicting the least recently used entries while
+// the cache holds more than the maximum. The entry being set is never evicted.
+func (cr *CacheRecency) Set(key string) {
+	cr.mu.Lock()
+	if e, found := cr.elems[key]; found {
+		e.Value.(*recencyEntry).used = time.Now()
+		cr.order.MoveToFront(e)
+	} else {
+		cr.elems[key] = cr.order.PushFront(&recencyEntry{key: key, used: time.Now()})
+	}
+
+	var evict []string
+	if cr.max > 0 {
+		for e := cr.order.Back(); cr.order.Len()-len(evict) > cr.max; e = e.Prev() {
+			evict = append(evict, e.Value.(*recencyEntry).key)
+		}
+	}
+	cr.mu.Unlock()
+
+	// the eviction is forgotten through the listener, which takes the lock again, or right
+	// away when the entry already left the cache
+	for _, k := range evict {
+		cr.evictions.Delete(k, EvictionLRU)
+		cr.forget(k)
+	}
+}
+
+// Run evicts the entries not used within the idle timeout every interval until ctx is
+// done.
+func (cr *CacheRecency) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			cr.sweep()
+		}
+	}
+}
+
+// sweep evicts the entries not used within the idle timeout.
+func (cr *CacheRecency) sweep() {
+	since := time.Now().Add(-cr.idle)
+	var evict []string
+	cr.mu.Lock()
+	for e := cr.order.Back(); e != nil && e.Value.(*recencyEntry).used.Before(since); e = e.Prev() {
+		evict = append(evict, e.Value.(*recencyEntry).key)
+	}
+	cr.mu.Unlock()
+
+	for _, k := range evict {
+		cr.evictions.Delete(k, EvictionIdle)
+		cr.forget(k)
+	}
+}
+
+// forget stops tracking key once it left the cache.
+func (cr *CacheRecency) forget(key string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if e, found := cr.elems[key]; found {
+		cr.order.Remove(e)
+		delete(cr.elems, key)
+	}
+}
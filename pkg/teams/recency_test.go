@@ -0,0 +1,90 @@
+package teams
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// setRecent stores key in c and records it in cr, as the enforcer does.
+func setRecent(c *cache.Cache, cr *CacheRecency, key string) {
+	c.Set(key, []Team{}, time.Minute)
+	cr.Set(key)
+}
+
+// assertCached fails t unless exactly keys are cached in c and tracked by cr.
+func assertCached(t *testing.T, c *cache.Cache, cr *CacheRecency, keys ...string) {
+	t.Helper()
+	for _, k := range keys {
+		if _, found := c.Get(k); !found {
+			t.Errorf("%s evicted", k)
+		}
+	}
+	if n := c.ItemCount(); n != len(keys) {
+		t.Errorf("%d entries cached, want %d", n, len(keys))
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if len(cr.elems) != len(keys) || cr.order.Len() != len(keys) {
+		t.Errorf("%d entries tracked, want %d", len(cr.elems), len(keys))
+	}
+}
+
+func TestCacheRecencyMaxEntries(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	evictions := NewCacheEvictions(c, prometheus.NewRegistry())
+	cr := NewCacheRecency(c, evictions, 2, 0)
+
+	setRecent(c, cr, "u1")
+	setRecent(c, cr, "u2")
+	cr.Get("u1")
+	setRecent(c, cr, "u3")
+	// u2 is the least recently used, u1 was read since
+	assertCached(t, c, cr, "u1", "u3")
+
+	// replacing an entry counts it once
+	setRecent(c, cr, "u3")
+	assertCached(t, c, cr, "u1", "u3")
+
+	setRecent(c, cr, "u4")
+	assertCached(t, c, cr, "u3", "u4")
+	if got := testutil.ToFloat64(evictions.evictions.WithLabelValues(EvictionLRU)); got != 2 {
+		t.Errorf("LRU evictions = %v, want 2", got)
+	}
+
+	// entries leaving the cache otherwise are no longer tracked
+	evictions.Delete("u3", EvictionManual)
+	assertCached(t, c, cr, "u4")
+}
+
+func TestCacheRecencyIdle(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	evictions := NewCacheEvictions(c, prometheus.NewRegistry())
+	cr := NewCacheRecency(c, evictions, 0, 50*time.Millisecond)
+
+	setRecent(c, cr, "u1")
+	setRecent(c, cr, "u2")
+	time.Sleep(60 * time.Millisecond)
+	cr.Get("u2")
+	setRecent(c, cr, "u3")
+	cr.sweep()
+	assertCached(t, c, cr, "u2", "u3")
+	if got := testutil.ToFloat64(evictions.evictions.WithLabelValues(EvictionIdle)); got != 1 {
+		t.Errorf("idle evictions = %v, want 1", got)
+	}
+}
+
+func TestCacheRecencyTracksLoadedEntries(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	c.Set("u1", []Team{}, time.Minute)
+	c.Set("u2", []Team{}, 3*time.Minute)
+	c.Set("u3", []Team{}, 2*time.Minute)
+	evictions := NewCacheEvictions(c, prometheus.NewRegistry())
+
+	// the entries expiring first are taken for the least recently used
+	cr := NewCacheRecency(c, evictions, 2, 0)
+	assertCached(t, c, cr, "u2", "u3")
+}
@@ -0,0 +1,106 @@
+package teams_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestResolveTenantsRejectsUnenforceableValues(t *testing.T) {
+	g := newGrafana(t)
+	g.SetTeams("3", teams.Team{ID: 4, OrgID: 1, Name: "team-a"}, teams.Team{ID: 5, OrgID: 1, Name: "team-b|team-c"})
+	gte := newEnforcer(t, g)
+
+	r := httptest.NewRequest("GET", "/api/v1/query", nil)
+	r.Header.Set("X-Grafana-Id", token(t, g, "3", 1))
+	if w := serve(gte.ExtractLabel(tenantsHandler), r); w.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestBulkTeamResolver(t *testing.T) {
+	g := newGrafana(t)
+	const teamsJSON = `[{"id": 1, "orgId": 1, "name": "team-a"}, {"id": 3, "orgId": 2, "name": "team-c"}]`
+
+	for _, tc := range []struct {
+		name   string
+		bulk   func(w http.ResponseWriter, r *http.Request)
+		status int
+		want   string
+		paths  []string
+	}{
+		{
+			name: "combined endpoint",
+			bulk: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"user": {"id": %s}, "teams": %s}`, r.PathValue("id"), teamsJSON)
+			},
+			status: http.StatusOK,
+			want:   "team-a\n",
+			paths:  []string{"/api/users/1/combined", "/api/users/3/combined"},
+		},
+		{
+			name: "combined endpoint not found",
+			bulk: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			status: http.StatusOK,
+			want:   "team-a\n",
+			// the combined endpoint is not requested again once it was not found
+			paths: []string{"/api/users/1/combined", "/api/users/1/teams", "/api/users/3/teams"},
+		},
+		{
+			name: "answer about another user",
+			bulk: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"user": {"id": 42}, "teams": %s}`, teamsJSON)
+			},
+			status: http.StatusBadGateway,
+			paths:  []string{"/api/users/1/combined", "/api/users/3/combined"},
+		},
+		{
+			name: "answer without teams",
+			bulk: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintf(w, `{"user": {"id": %s}}`, r.PathValue("id"))
+			},
+			status: http.StatusBadGateway,
+			paths:  []string{"/api/users/1/combined", "/api/users/3/combined"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var paths []string
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /api/users/{id}/combined", tc.bulk)
+			mux.HandleFunc("GET /api/users/{id}/teams", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(teamsJSON))
+			})
+			gte := withGrafanaAPI(t, newEnforcer(t, g), func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "application/json")
+				mux.ServeHTTP(w, r)
+			})
+			gte.TeamResolver = teams.NewBulkTeamResolver("/api/users/{id}/combined")
+
+			for _, user := range []string{"1", "3"} {
+				r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+				r.Header.Set("X-Grafana-Id", token(t, g, user, 1))
+				w := serve(gte.ExtractLabel(tenantsHandler), r)
+				if w.Code != tc.status {
+					t.Fatalf("user %s: status = %d, want %d: %s", user, w.Code, tc.status, w.Body)
+				}
+				if tc.status == http.StatusOK && w.Body.String() != tc.want {
+					t.Errorf("user %s: tenants = %q, want %q", user, w.Body, tc.want)
+				}
+			}
+			if !slices.Equal(paths, tc.paths) {
+				t.Errorf("Grafana requests = %q, want %q", paths, tc.paths)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package teams
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// TeamResolver looks up the teams a user is a member of in Grafana.
+type TeamResolver interface {
+	// ResolveTeams returns the teams of userId, across all orgs, looked up by gte on behalf
+	// of the request in.
+	ResolveTeams(gte GrafanaTeamsEnforcer, in *http.Request, userId string) ([]Team, error)
+}
+
+// RESTTeamResolver lists the teams of a user with the team endpoints of the Grafana API,
+// /api/users/{id}/teams or /api/user/teams depending on the LookupIdentity.
+type RESTTeamResolver struct{}
+
+func (RESTTeamResolver) ResolveTeams(gte GrafanaTeamsEnforcer, in *http.Request, userId string) ([]Team, error) {
+	req, err := gte.newTeamsRequest(in, userId)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
+	var t []Team
+	if err := gte.getJSON(req, &t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// BulkTeamResolver fetches a user along with their teams in a single call to an endpoint
+// answering {"user": {"id": ...}, "teams": [...]}, as exposed by some Grafana deployments
+// through a plugin or an API gateway. Once the endpoint answers with HTTP status code 404,
+// the teams are looked up with Fallback instead.
+type BulkTeamResolver struct {
+	// Path is the Grafana path of the endpoint. {id} is replaced with the user id.
+	Path     string
+	Fallback TeamResolver
+
+	unsupported *atomic.Bool
+}
+
+// NewBulkTeamResolver creates a BulkTeamResolver for the endpoint at path, falling back to
+// the REST team endpoints.
+func NewBulkTeamResolver(path string) BulkTeamResolver {
+	return BulkTeamResolver{Path: path, Fallback: RESTTeamResolver{}, unsupported: &atomic.Bool{}}
+}
+
+func (b BulkTeamResolver) ResolveTeams(gte GrafanaTeamsEnforcer, in *http.Request, userId string) ([]Team, error) {
+	if b.unsupported.Load() {
+		return b.Fallback.ResolveTeams(gte, in, userId)
+	}
+
+	path := strings.ReplaceAll(b.Path, "{id}", userId)
+	req, err := gte.newLookupRequest(in, path)
+	if err != nil {
+		return nil, fmt.Errorf("create request failed: %w", err)
+	}
+	var body struct {
+		User *struct {
+			ID int64 `json:"id"`
+		} `json:"user"`
+		Teams []Team `json:"teams"`
+	}
+	err = gte.getJSON(req, &body)
+	var se statusError
+	if errors.As(err, &se) && int(se) == http.StatusNotFound {
+		if b.unsupported.CompareAndSwap(false, true) {
+			slog.Warn("bulk teams endpoint not found, falling back to the team endpoints", "path", b.Path)
+		}
+		return b.Fallback.ResolveTeams(gte, in, userId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// an answer about someone else or without teams must not be cached as the teams of userId
+	if body.User != nil && fmt.Sprint(body.User.ID) != userId {
+		return nil, fmt.Errorf("%w: %s answered for userId=%d", ErrGrafanaDependency, req.URL.Path, body.User.ID)
+	}
+	if body.Teams == nil {
+		return nil, fmt.Errorf("%w: %s answered without teams", ErrGrafanaDependency, req.URL.Path)
+	}
+	return body.Teams, nil
+}
+
+// teamResolver returns the configured TeamResolver, RESTTeamResolver by default.
+func (gte GrafanaTeamsEnforcer) teamResolver() TeamResolver {
+	if gte.TeamResolver == nil {
+		return RESTTeamResolver{}
+	}
+	return gte.TeamResolver
+}
@@ -0,0 +1,88 @@
+package teams
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// EmptyRevalidation refreshes cached empty team sets in the background when they are
+// used, at most once per interval for each user, so that a user denied because of a
+// transient bad answer from Grafana recovers before the entry expires. The request
+// using the empty set is still served from the cache.
+type EmptyRevalidation struct {
+	interval time.Duration
+	mu       sync.Mutex
+	// last holds when each user was last revalidated
+	last    map[string]time.Time
+	results *prometheus.CounterVec
+}
+
+// NewEmptyRevalidation creates an EmptyRevalidation revalidating each user at most once
+// per interval, registering its metrics with reg.
+func NewEmptyRevalidation(interval time.Duration, reg prometheus.Registerer) *EmptyRevalidation {
+	er := &EmptyRevalidation{
+		interval: interval,
+		last:     map[string]time.Time{},
+		results: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_empty_teams_revalidations_total",
+			Help: "Total number of background revalidations of cached empty team sets, by result.",
+		}, []string{"result"}),
+	}
+	for _, result := range []string{"healed", "unchanged", "failed"} {
+		er.results.WithLabelValues(result)
+	}
+	return er
+}
+
+// allow reports whether key may be revalidated now, and if so records the attempt.
+func (er *EmptyRevalidation) allow(key string) bool {
+	er.mu.Lock()
+	defer er.mu.Unlock()
+
+	now := time.Now()
+	if last, found := er.last[key]; found && now.Sub(last) < er.interval {
+		return false
+	}
+	er.last[key] = now
+	// forget users whose rate limit has passed, so the map does not grow with every user seen
+	for k, last := range er.last {
+		if now.Sub(last) >= er.interval {
+			delete(er.last, k)
+		}
+	}
+	return true
+}
+
+// revalidateEmptyTeams refetches the teams of userId in the background, replacing the
+// cached empty set. in is the request that used the empty set.
+func (gte GrafanaTeamsEnforcer) revalidateEmptyTeams(in *http.Request, userId string) {
+	if !gte.EmptyRevalidation.allow(userId) {
+		return
+	}
+
+	// the request may be over before the revalidation is, and its headers may change meanwhile
+	in = in.Clone(context.WithoutCancel(in.Context()))
+	go func() {
+		t, err := gte.teamResolver().ResolveTeams(gte, in, userId)
+		if err != nil {
+			err = gte.credentialsError(err)
+			slog.Warn("failed to revalidate empty teams", "userId", userId, "error", err)
+			gte.EmptyRevalidation.results.WithLabelValues("failed").Inc()
+			return
+		}
+
+		gte.cacheSet(userId, t)
+		if len(t) == 0 {
+			gte.EmptyRevalidation.results.WithLabelValues("unchanged").Inc()
+			return
+		}
+		slog.Info("revalidation replaced cached empty teams", "userId", userId, "teams", len(t))
+		gte.EmptyRevalidation.results.WithLabelValues("healed").Inc()
+	}()
+}
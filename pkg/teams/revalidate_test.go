@@ -0,0 +1,57 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEmptyRevalidationHeals(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	reg := prometheus.NewRegistry()
+	gte.EmptyRevalidation = teams.NewEmptyRevalidation(time.Hour, reg)
+	h := gte.ExtractLabel(tenantsHandler)
+
+	query := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("X-Grafana-Id", token(t, g, "2", 1))
+		return serve(h, r)
+	}
+	// user 2 has no team, the empty set is cached
+	if w := query(); w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", w.Code)
+	}
+
+	g.SetTeams("2", teams.Team{ID: 1, OrgID: 1, Name: "team-a"})
+	// the request using the cached empty set is still denied, and revalidates it
+	if w := query(); w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d from the cache, want 404", w.Code)
+	}
+	var w *httptest.ResponseRecorder
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if w = query(); w.Code == http.StatusOK {
+			break
+		}
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "team-a\n" {
+		t.Fatalf("status = %d, tenants %q after the revalidation, want team-a", w.Code, w.Body)
+	}
+
+	err := testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP lbac_empty_teams_revalidations_total Total number of background revalidations of cached empty team sets, by result.
+# TYPE lbac_empty_teams_revalidations_total counter
+lbac_empty_teams_revalidations_total{result="failed"} 0
+lbac_empty_teams_revalidations_total{result="healed"} 1
+lbac_empty_teams_revalidations_total{result="unchanged"} 0
+`), "lbac_empty_teams_revalidations_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,151 @@
+package teams
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ScopeOrgIDHeader selects the tenant of the requests to Mimir and Cortex.
+	ScopeOrgIDHeader = "X-Scope-OrgID"
+	// TargetTenantHeader selects which of their label values a caller with several manages
+	// the rules of.
+	TargetTenantHeader = "X-LBAC-Target-Tenant"
+)
+
+// maxTenantIDLength bounds the length of the tenant IDs of Mimir and Cortex.
+const maxTenantIDLength = 150
+
+// validTenantID reports whether id is a valid tenant ID of Mimir and Cortex: at most
+// maxTenantIDLength characters among letters, digits and !-_.*'(), other than "." and "..".
+func validTenantID(id string) error {
+	if id == "" {
+		return fmt.Errorf("empty tenant ID")
+	}
+	if len(id) > maxTenantIDLength {
+		return fmt.Errorf("tenant ID of %d characters exceeds the maximum length of %d", len(id), maxTenantIDLength)
+	}
+	if id == "." || id == ".." {
+		return fmt.Errorf("tenant ID %q is not allowed", id)
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!-_.*'()", c)) {
+			return fmt.Errorf("tenant ID %q holds the unsupported character %q", id, c)
+		}
+	}
+	return nil
+}
+
+// isRulerPath reports whether path is an endpoint of the ruler configuration API of
+// Mimir, /prometheus/config/v1/rules and below, or of Cortex, below /api/v1/rules. The
+// bare /api/v1/rules is the rules endpoint of the Prometheus API, enforced by injectproxy.
+func isRulerPath(path string) bool {
+	return path == "/prometheus/config/v1/rules" || strings.HasPrefix(path, "/prometheus/config/v1/rules/") ||
+		strings.HasPrefix(path, "/api/v1/rules/")
+}
+
+// RulerAPI sends the requests to the ruler configuration API to Upstream with the
+// X-Scope-OrgID header set to the label value of the caller, so that they only see and
+// change the rules of their own tenant. Callers with several label values select one of
+// them with the TargetTenantHeader. Label values that are not valid tenant IDs of Mimir
+// and Cortex are rejected. The rule groups created or updated must set the enforced label
+// of every rule to the tenant selected.
+//
+// Requests to any other endpoint go to Next.
+type RulerAPI struct {
+	// Enforcer resolves the label values of the requests, its Label set to the enforced
+	// label.
+	Enforcer GrafanaTeamsEnforcer
+	Upstream http.Handler
+	Next     http.Handler
+}
+
+func (ra RulerAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isRulerPath(r.URL.Path) {
+		ra.Next.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, fmt.Sprintf("method %s is not allowed on the ruler API", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	ra.Enforcer.ExtractLabel(func(w http.ResponseWriter, r *http.Request) {
+		values := TenantsFromContext(r.Context())
+		tenant := r.Header.Get(TargetTenantHeader)
+		switch {
+		case tenant == "" && len(values) == 1:
+			tenant = values[0]
+		case tenant == "":
+			http.Error(w, fmt.Sprintf("the %s header must select one of the %d tenants of the caller", TargetTenantHeader, len(values)), http.StatusBadRequest)
+			return
+		case !slices.Contains(values, tenant):
+			http.Error(w, fmt.Sprintf("tenant %q is not one of the tenants of the caller", tenant), http.StatusForbidden)
+			return
+		}
+
+		if err := validTenantID(tenant); err != nil {
+			slog.Debug("rejecting ruler request for invalid tenant", "path", r.URL.Path, "error", err)
+			http.Error(w, fmt.Sprintf("tenant %q cannot be used with the ruler: %v", tenant, err), http.StatusForbidden)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			if err := ra.validateGroup(r, tenant); err != nil {
+				slog.Debug("rejecting rule group", "path", r.URL.Path, "error", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		r.Header.Del(TargetTenantHeader)
+		r.Header.Set(ScopeOrgIDHeader, tenant)
+		slog.Debug("sending ruler request", "path", r.URL.Path, "tenant", tenant)
+		ra.Upstream.ServeHTTP(w, r)
+	}).ServeHTTP(w, r)
+}
+
+// rulerGroup is the part of a rule group validated by RulerAPI.
+type rulerGroup struct {
+	Name  string `yaml:"name"`
+	Rules []struct {
+		Record string            `yaml:"record"`
+		Alert  string            `yaml:"alert"`
+		Labels map[string]string `yaml:"labels"`
+	} `yaml:"rules"`
+}
+
+// validateGroup checks every rule of the rule group in the body of r sets the enforced
+// label to tenant, leaving the body readable.
+func (ra RulerAPI) validateGroup(r *http.Request, tenant string) error {
+	if r.Body == nil {
+		return fmt.Errorf("missing rule group")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var g rulerGroup
+	if err := yaml.Unmarshal(body, &g); err != nil {
+		return fmt.Errorf("invalid rule group: %w", err)
+	}
+	for i, rule := range g.Rules {
+		if v, ok := rule.Labels[ra.Enforcer.Label]; !ok || v != tenant {
+			name := rule.Record
+			if rule.Alert != "" {
+				name = rule.Alert
+			}
+			return fmt.Errorf("rule %d (%s) of group %q must set the label %s to the tenant %q", i, name, g.Name, ra.Enforcer.Label, tenant)
+		}
+	}
+	return nil
+}
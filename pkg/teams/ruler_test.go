@@ -0,0 +1,70 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestRulerAPI(t *testing.T) {
+	g := newGrafana(t)
+	g.SetTeams("3", teams.Team{ID: 4, OrgID: 1, Name: "team a"})
+
+	group := func(value string) string {
+		return "name: g\nrules:\n- record: r\n  expr: up\n  labels:\n    team: " + value + "\n"
+	}
+	for _, tc := range []struct {
+		name   string
+		user   string
+		method string
+		target string
+		body   string
+		status int
+		// tenant is the X-Scope-OrgID sent upstream
+		tenant string
+	}{
+		{name: "list", user: "1", method: "GET", target: "team-b", status: http.StatusOK, tenant: "team-b"},
+		{name: "several tenants without target", user: "1", method: "GET", status: http.StatusBadRequest},
+		{name: "target of another tenant", user: "1", method: "GET", target: "team-c", status: http.StatusForbidden},
+		{name: "create", user: "1", method: "POST", target: "team-a", body: group("team-a"), status: http.StatusOK, tenant: "team-a"},
+		{name: "create for another of the tenants of the caller", user: "1", method: "POST", target: "team-a", body: group("team-b"), status: http.StatusBadRequest},
+		{name: "create without the label", user: "1", method: "POST", target: "team-a", body: "name: g\nrules:\n- record: r\n  expr: up\n", status: http.StatusBadRequest},
+		{name: "invalid tenant ID", user: "3", method: "GET", status: http.StatusForbidden},
+		{name: "unsupported method", user: "1", method: "PUT", target: "team-a", status: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var upstream *http.Request
+			ra := teams.RulerAPI{
+				Enforcer: newEnforcer(t, g),
+				Upstream: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { upstream = r }),
+				Next:     http.NotFoundHandler(),
+			}
+			r := httptest.NewRequest(tc.method, "/prometheus/config/v1/rules/ns", strings.NewReader(tc.body))
+			r.Header.Set("X-Grafana-Id", token(t, g, tc.user, 1))
+			r.Header.Set(teams.ScopeOrgIDHeader, "spoofed")
+			if tc.target != "" {
+				r.Header.Set(teams.TargetTenantHeader, tc.target)
+			}
+
+			w := serve(ra, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d %q, want %d", w.Code, w.Body.String(), tc.status)
+			}
+			if tc.tenant == "" {
+				if upstream != nil {
+					t.Fatal("request sent upstream")
+				}
+				return
+			}
+			if got := upstream.Header.Values(teams.ScopeOrgIDHeader); len(got) != 1 || got[0] != tc.tenant {
+				t.Errorf("%s = %q, want %q", teams.ScopeOrgIDHeader, got, tc.tenant)
+			}
+			if got := upstream.Header.Get(teams.TargetTenantHeader); got != "" {
+				t.Errorf("%s = %q forwarded upstream", teams.TargetTenantHeader, got)
+			}
+		})
+	}
+}
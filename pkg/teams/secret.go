@@ -0,0 +1,71 @@
+package teams
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretFile holds a secret read from a file and re-read periodically so rotated
+// secrets are picked up without a restart.
+type SecretFile struct {
+	path  string
+	mu    sync.RWMutex
+	value string
+}
+
+// NewSecretFile reads the secret in path.
+func NewSecretFile(path string) (*SecretFile, error) {
+	s := &SecretFile{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Value returns the last secret read.
+func (s *SecretFile) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// Run re-reads the file every interval until ctx is done. The previous secret is kept
+// when the file cannot be read, e.g. while it is being replaced.
+func (s *SecretFile) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			if err := s.reload(); err != nil {
+				slog.Warn("unable to re-read secret file, keeping the previous value", "path", s.path, "error", err)
+			}
+		}
+	}
+}
+
+func (s *SecretFile) reload() error {
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read secret file failed: %w", err)
+	}
+	value := strings.TrimRight(string(b), "\r\n")
+	if value == "" {
+		return fmt.Errorf("secret file %s is empty", s.path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.value != "" && s.value != value {
+		slog.Info("secret file changed, using the new value", "path", s.path)
+	}
+	s.value = value
+	return nil
+}
@@ -0,0 +1,67 @@
+package teams
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pass")
+	if _, err := NewSecretFile(path); err == nil {
+		t.Error("NewSecretFile() accepted a missing file")
+	}
+	if err := os.WriteFile(path, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSecretFile(path); err == nil {
+		t.Error("NewSecretFile() accepted an empty file")
+	}
+
+	if err := os.WriteFile(path, []byte("first\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSecretFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Value(); got != "first" {
+		t.Fatalf("Value() = %q, want first", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, 10*time.Millisecond)
+
+	// waitFor polls Value until it returns want
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for s.Value() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Value() = %q, want %q", s.Value(), want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("second\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("second")
+
+	// the previous value is kept while the file is missing
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := s.Value(); got != "second" {
+		t.Errorf("Value() = %q after the file was removed, want second", got)
+	}
+	if err := os.WriteFile(path, []byte("third"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("third")
+}
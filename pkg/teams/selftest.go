@@ -0,0 +1,225 @@
+package teams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// selfTestTenants names the two canary tenants of a SelfTest in its report.
+var selfTestTenants = [2]string{"A", "B"}
+
+// SelfTest proves enforcement works end to end by querying a canary metric through the
+// full handler chain of the proxy with the tokens of two canary users, each in a distinct
+// tenant holding series of the metric. It passes when each user sees series of its own
+// tenant and none of the other one, even when asking for them.
+type SelfTest struct {
+	// TokenHeader is the header the tokens are sent in. Defaults to DefaultTokenHeader.
+	TokenHeader string
+
+	handler http.Handler
+	label   string
+	metric  string
+	tokens  [2]*SecretFile
+
+	// mu serializes the runs
+	mu      sync.Mutex
+	success prometheus.Gauge
+	lastRun prometheus.Gauge
+}
+
+// SelfTestReport is the outcome of a SelfTest run.
+type SelfTestReport struct {
+	Time    time.Time       `json:"time"`
+	Success bool            `json:"success"`
+	Checks  []SelfTestCheck `json:"checks"`
+}
+
+// SelfTestCheck is the outcome of an assertion of a SelfTest run.
+type SelfTestCheck struct {
+	Name    string `json:"name"`
+	Success bool   `json:"success"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// NewSelfTest creates a SelfTest querying metric through handler with the tokens read
+// from the two tokenFiles, label being the label enforced on them. Its metrics are
+// registered with reg.
+func NewSelfTest(handler http.Handler, label, metric string, tokenFiles []string, reg prometheus.Registerer) (*SelfTest, error) {
+	if len(tokenFiles) != 2 {
+		return nil, fmt.Errorf("expected the token files of 2 tenants, got %d", len(tokenFiles))
+	}
+	st := &SelfTest{
+		handler: handler,
+		label:   label,
+		metric:  metric,
+		success: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "lbac_selftest_success",
+			Help: "Whether the last enforcement self-test passed.",
+		}),
+		lastRun: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Name: "lbac_selftest_last_run_timestamp_seconds",
+			Help: "Unix timestamp of the last enforcement self-test.",
+		}),
+	}
+	for i, path := range tokenFiles {
+		token, err := NewSecretFile(path)
+		if err != nil {
+			return nil, err
+		}
+		st.tokens[i] = token
+	}
+	return st, nil
+}
+
+// Run runs the self-test every interval until ctx is done, re-reading the token files
+// each time so they can be rotated.
+func (st *SelfTest) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			report := st.run(ctx)
+			if !report.Success && ctx.Err() == nil {
+				slog.Error("enforcement self-test failed", "checks", report.Checks)
+			}
+		}
+	}
+}
+
+// ServeHTTP runs the self-test on POST requests and answers with its report, with HTTP
+// status code 500 when it failed. Other methods are rejected so that scrapers and
+// browsers do not send queries with the self-test tokens.
+func (st *SelfTest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := st.run(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Success {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+func (st *SelfTest) run(ctx context.Context) SelfTestReport {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, token := range st.tokens {
+		if err := token.reload(); err != nil {
+			slog.Warn("unable to re-read self-test token file, keeping the previous token", "path", token.path, "error", err)
+		}
+	}
+
+	report := SelfTestReport{Time: time.Now(), Success: true}
+	check := func(name string, err error) {
+		c := SelfTestCheck{Name: name, Success: err == nil}
+		if err != nil {
+			c.Detail = err.Error()
+			report.Success = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	var own [2][]string
+	for i, token := range st.tokens {
+		values, status, err := st.query(ctx, token.Value(), fmt.Sprintf("count by (%s) (%s)", st.label, st.metric))
+		if err == nil && status != http.StatusOK {
+			err = fmt.Errorf("query answered with HTTP status code %d", status)
+		}
+		if err == nil && len(values) == 0 {
+			err = fmt.Errorf("no series of %s, the test would prove nothing", st.metric)
+		}
+		own[i] = values
+		check(fmt.Sprintf("tenant %s sees its own series", selfTestTenants[i]), err)
+	}
+
+	for i := range st.tokens {
+		other := own[1-i]
+		name := fmt.Sprintf("tenant %s cannot see the series of tenant %s", selfTestTenants[i], selfTestTenants[1-i])
+		if len(other) == 0 {
+			check(name, fmt.Errorf("the series of tenant %s are unknown", selfTestTenants[1-i]))
+			continue
+		}
+		quoted := make([]string, len(other))
+		for j, v := range other {
+			quoted[j] = regexp.QuoteMeta(v)
+		}
+		q := fmt.Sprintf("count by (%s) (%s{%s=~%q})", st.label, st.metric, st.label, strings.Join(quoted, "|"))
+		values, status, err := st.query(ctx, st.tokens[i].Value(), q)
+		switch {
+		case status >= 400 && status < 500:
+			// rejected, e.g. with error-on-replace
+			err = nil
+		case err == nil && status != http.StatusOK:
+			err = fmt.Errorf("query answered with HTTP status code %d", status)
+		case err == nil:
+			if leaked := slices.DeleteFunc(values, func(v string) bool { return !slices.Contains(other, v) }); len(leaked) > 0 {
+				err = fmt.Errorf("series of %s=%q are visible", st.label, leaked)
+			}
+		}
+		check(name, err)
+	}
+
+	st.lastRun.Set(float64(report.Time.Unix()))
+	if report.Success {
+		st.success.Set(1)
+	} else {
+		st.success.Set(0)
+	}
+	return report
+}
+
+// query sends the instant query q with token through the handler, returning the values
+// of the label of the series of the result along with the HTTP status code. Only the
+// failures to decode a successful response are returned as errors.
+func (st *SelfTest) query(ctx context.Context, token, q string) ([]string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/api/v1/query?"+url.Values{"query": {q}}.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	header := st.TokenHeader
+	if header == "" {
+		header = DefaultTokenHeader
+	}
+	req.Header.Set(header, token)
+	req.Header.Set("User-Agent", "prom-grafana-lbac-selftest")
+	rec := httptest.NewRecorder()
+	st.handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		return nil, rec.Code, nil
+	}
+
+	var resp struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		return nil, rec.Code, fmt.Errorf("invalid query response: %w", err)
+	}
+	var values []string
+	for _, r := range resp.Data.Result {
+		values = append(values, r.Metric[st.label])
+	}
+	return values, rec.Code, nil
+}
@@ -0,0 +1,191 @@
+package teams_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// canaryUpstream starts a Prometheus holding a series of the canary metric for each of
+// team-a, team-b and team-c, answering instant queries with those matching the team
+// matchers of the query, and counting the queries it receives in queries.
+func canaryUpstream(t *testing.T, queries *atomic.Int64) *url.URL {
+	t.Helper()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries.Add(1)
+		expr, err := parser.ParseExpr(r.FormValue("query"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		type sample struct {
+			Metric map[string]string `json:"metric"`
+			Value  []any             `json:"value"`
+		}
+		result := []sample{}
+		for _, team := range []string{"team-a", "team-b", "team-c"} {
+			matches := true
+			parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+				if vs, ok := node.(*parser.VectorSelector); ok {
+					for _, m := range vs.LabelMatchers {
+						if m.Name == "team" && !m.Matches(team) {
+							matches = false
+						}
+					}
+				}
+				return nil
+			})
+			if matches {
+				result = append(result, sample{Metric: map[string]string{"team": team}, Value: []any{0, "1"}})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"status": "success", "data": map[string]any{"resultType": "vector", "result": result}})
+	}))
+	t.Cleanup(s.Close)
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// tokenFiles writes each of tokens to a file, returning their paths.
+func tokenFiles(t *testing.T, tokens ...string) []string {
+	t.Helper()
+	var paths []string
+	for i, token := range tokens {
+		path := filepath.Join(t.TempDir(), string(rune('a'+i)))
+		if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func TestSelfTest(t *testing.T) {
+	g := newGrafana(t)
+	// tenant A is user 1 in org 1, of team-a and team-b, and tenant B user 1 in org 2, of
+	// team-c
+	files := tokenFiles(t, token(t, g, "1", 1), token(t, g, "1", 2))
+
+	for _, tc := range []struct {
+		name    string
+		handler func(*url.URL) http.Handler
+		success bool
+		status  int
+	}{
+		{
+			name: "enforced",
+			handler: func(u *url.URL) http.Handler {
+				routes, err := injectproxy.NewRoutes(u, "team", newEnforcer(t, g))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return routes
+			},
+			success: true,
+			status:  http.StatusOK,
+		},
+		{
+			name: "enforced with error on replace",
+			handler: func(u *url.URL) http.Handler {
+				routes, err := injectproxy.NewRoutes(u, "team", newEnforcer(t, g), injectproxy.WithErrorOnReplace())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return routes
+			},
+			success: true,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "not enforced",
+			handler: func(u *url.URL) http.Handler { return httputil.NewSingleHostReverseProxy(u) },
+			status:  http.StatusInternalServerError,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var queries atomic.Int64
+			reg := prometheus.NewRegistry()
+			st, err := teams.NewSelfTest(tc.handler(canaryUpstream(t, &queries)), "team", "canary", files, reg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := serve(st, httptest.NewRequest(http.MethodPost, "/selftest/enforcement", nil))
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			var report teams.SelfTestReport
+			if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+			if report.Success != tc.success || len(report.Checks) != 4 {
+				t.Errorf("report = %+v, want success %v of 4 checks", report, tc.success)
+			}
+			if !tc.success && !strings.Contains(w.Body.String(), "are visible") {
+				t.Errorf("report = %s, want the leaked series reported", w.Body)
+			}
+
+			success := 0
+			if tc.success {
+				success = 1
+			}
+			want := fmt.Sprintf(`
+# HELP lbac_selftest_success Whether the last enforcement self-test passed.
+# TYPE lbac_selftest_success gauge
+lbac_selftest_success %d
+`, success)
+			if err := testutil.GatherAndCompare(reg, strings.NewReader(want), "lbac_selftest_success"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSelfTestOnlyRunsOnPost(t *testing.T) {
+	g := newGrafana(t)
+	var queries atomic.Int64
+	u := canaryUpstream(t, &queries)
+	st, err := teams.NewSelfTest(httputil.NewSingleHostReverseProxy(u), "team", "canary",
+		tokenFiles(t, token(t, g, "1", 1), token(t, g, "1", 2)), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPut} {
+		w := serve(st, httptest.NewRequest(method, "/selftest/enforcement", nil))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s: status = %d, Allow = %q, want 405 allowing POST", method, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	if got := queries.Load(); got != 0 {
+		t.Errorf("%d queries sent upstream, want none", got)
+	}
+}
+
+func TestNewSelfTestTokenFiles(t *testing.T) {
+	if _, err := teams.NewSelfTest(http.NotFoundHandler(), "team", "canary", tokenFiles(t, "a"), prometheus.NewRegistry()); err == nil {
+		t.Error("NewSelfTest() = nil error with the token file of a single tenant")
+	}
+	missing := []string{filepath.Join(t.TempDir(), "missing"), filepath.Join(t.TempDir(), "missing")}
+	if _, err := teams.NewSelfTest(http.NotFoundHandler(), "team", "canary", missing, prometheus.NewRegistry()); err == nil {
+		t.Error("NewSelfTest() = nil error with missing token files")
+	}
+}
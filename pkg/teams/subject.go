@@ -0,0 +1,42 @@
+package teams
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// subjectKinds are the kinds of principals Grafana issues X-Grafana-Id tokens for, the
+// prefix of their sub claim.
+var subjectKinds = []string{"user", "service-account"}
+
+// parseSubject returns the ID of the principal identified by sub, a "<kind>:<id>" claim
+// with kind one of subjectKinds.
+func parseSubject(sub string) (string, error) {
+	kind, id, found := strings.Cut(sub, ":")
+	if !found {
+		return "", fmt.Errorf("sub claim %q is not of the form <kind>:<id>", sub)
+	}
+	if !slices.Contains(subjectKinds, kind) {
+		return "", fmt.Errorf("sub claim %q identifies neither a user nor a service account", sub)
+	}
+	if id == "" || strings.Contains(id, ":") {
+		return "", fmt.Errorf("sub claim %q does not carry a valid ID", sub)
+	}
+	return id, nil
+}
+
+// NewRejectedClaimsCounter creates the counter of tokens rejected for a malformed sub or
+// aud claim, by claim, registered with reg.
+func NewRejectedClaimsCounter(reg prometheus.Registerer) *prometheus.CounterVec {
+	c := promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Name: "lbac_rejected_token_claims_total",
+		Help: "Total number of tokens rejected for a malformed claim, by claim.",
+	}, []string{"claim"})
+	c.WithLabelValues("sub")
+	c.WithLabelValues("aud")
+	return c
+}
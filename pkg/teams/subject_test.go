@@ -0,0 +1,28 @@
+package teams
+
+import "testing"
+
+func TestParseSubject(t *testing.T) {
+	for _, tc := range []struct {
+		sub     string
+		want    string
+		wantErr bool
+	}{
+		{sub: "user:1", want: "1"},
+		{sub: "service-account:42", want: "42"},
+		{sub: "", wantErr: true},
+		{sub: "1", wantErr: true},
+		{sub: "user", wantErr: true},
+		{sub: "user:", wantErr: true},
+		{sub: ":1", wantErr: true},
+		{sub: "user:1:2", wantErr: true},
+		{sub: "user:org:1", wantErr: true},
+		{sub: "team:1", wantErr: true},
+		{sub: "User:1", wantErr: true},
+	} {
+		got, err := parseSubject(tc.sub)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("parseSubject(%q) = %q, %v, want %q and error %t", tc.sub, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package teamstest provides a fake Grafana serving the team and signing key APIs used
+// by the teams enforcer, for exercising the proxy without a real Grafana.
+package teamstest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/MicahParks/jwkset"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// AdminUser and AdminPass are the admin credentials accepted by the fake Grafana.
+	AdminUser = "admin"
+	AdminPass = "admin"
+
+	keyID = "teamstest"
+)
+
+// BulkTeamsPath is the path of the endpoint of the fake Grafana answering a user along with
+// their teams, for teams.BulkTeamResolver.
+const BulkTeamsPath = "/api/users/{id}/bulk-teams"
+
+// Grafana is a fake Grafana serving /api/signing-keys/keys, /api/users/{id}/teams,
+// /api/user/teams, BulkTeamsPath and /api/folders, signing X-Grafana-Id tokens with its
+// own key.
+type Grafana struct {
+	*httptest.Server
+
+	key *rsa.PrivateKey
+	// keys is the JWKS document served at /api/signing-keys/keys
+	keys []byte
+
+	mu      sync.RWMutex
+	teams   map[string][]teams.Team
+	folders map[string][]teams.Folder
+}
+
+// NewGrafana starts a fake Grafana. Callers must call Close when done.
+func NewGrafana() (*Grafana, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key: %w", err)
+	}
+	jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{
+		Metadata: jwkset.JWKMetadataOptions{KID: keyID, ALG: jwkset.AlgRS256},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create JWK: %w", err)
+	}
+	st := jwkset.NewMemoryStorage()
+	if err := st.KeyWrite(context.Background(), jwk); err != nil {
+		return nil, fmt.Errorf("store JWK: %w", err)
+	}
+	keys, err := st.JSONPublic(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("encode JWKS: %w", err)
+	}
+
+	g := &Grafana{key: key, keys: keys, teams: map[string][]teams.Team{}, folders: map[string][]teams.Folder{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/signing-keys/keys", g.serveKeys)
+	mux.HandleFunc("GET /api/users/{id}/teams", g.serveUserTeams)
+	mux.HandleFunc("GET /api/user/teams", g.serveSelfTeams)
+	mux.HandleFunc("GET "+BulkTeamsPath, g.serveBulkTeams)
+	mux.HandleFunc("GET /api/folders", g.serveFolders)
+	g.Server = httptest.NewServer(mux)
+	return g, nil
+}
+
+// SetTeams sets the teams userID is a member of, across all orgs.
+func (g *Grafana) SetTeams(userID string, t ...teams.Team) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.teams[userID] = t
+}
+
+// SetFolders sets the folders userID has permission to view, listed at /api/folders to
+// the X-Grafana-Id tokens of userID.
+func (g *Grafana) SetFolders(userID string, f ...teams.Folder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.folders[userID] = f
+}
+
+// Token returns an X-Grafana-Id token for userID in orgID, valid for ttl.
+func (g *Grafana) Token(userID string, orgID int64, ttl time.Duration) (string, error) {
+	return g.TokenWithClaims(userID, orgID, ttl, nil)
+}
+
+// TokenWithClaims is like Token but adds claims to the token, replacing its own claims of
+// the same names and removing those set to nil.
+func (g *Grafana) TokenWithClaims(userID string, orgID int64, ttl time.Duration, claims jwt.MapClaims) (string, error) {
+	now := time.Now()
+	c := jwt.MapClaims{
+		"sub": "user:" + userID,
+		"aud": fmt.Sprintf("org:%d", orgID),
+		"iss": g.URL,
+		"iat": now.Unix(),
+		"exp": now.Add(ttl).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	t.Header["kid"] = keyID
+	return t.SignedString(g.key)
+}
+
+func (g *Grafana) serveKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(g.keys)
+}
+
+func (g *Grafana) serveUserTeams(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != AdminUser || pass != AdminPass {
+		http.Error(w, "invalid admin credentials", http.StatusUnauthorized)
+		return
+	}
+	g.writeTeams(w, r.PathValue("id"))
+}
+
+func (g *Grafana) serveSelfTeams(w http.ResponseWriter, r *http.Request) {
+	userID, err := g.tokenUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	g.writeTeams(w, userID)
+}
+
+func (g *Grafana) serveFolders(w http.ResponseWriter, r *http.Request) {
+	userID, err := g.tokenUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	g.mu.RLock()
+	f := g.folders[userID]
+	g.mu.RUnlock()
+	if f == nil {
+		f = []teams.Folder{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// tokenUser returns the ID of the user of the X-Grafana-Id token of r.
+func (g *Grafana) tokenUser(r *http.Request) (string, error) {
+	token, err := jwt.Parse(r.Header.Get("X-Grafana-Id"), func(*jwt.Token) (any, error) {
+		return g.key.Public(), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sub, _ := token.Claims.GetSubject()
+	userID, found := strings.CutPrefix(sub, "user:")
+	if !found {
+		return "", fmt.Errorf("sub claim %q does not identify a user", sub)
+	}
+	return userID, nil
+}
+
+func (g *Grafana) serveBulkTeams(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != AdminUser || pass != AdminPass {
+		http.Error(w, "invalid admin credentials", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.mu.RLock()
+	t := g.teams[r.PathValue("id")]
+	g.mu.RUnlock()
+	if t == nil {
+		t = []teams.Team{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"user":  map[string]any{"id": id},
+		"teams": t,
+	})
+}
+
+func (g *Grafana) writeTeams(w http.ResponseWriter, userID string) {
+	g.mu.RLock()
+	t := g.teams[userID]
+	g.mu.RUnlock()
+	if t == nil {
+		t = []teams.Team{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
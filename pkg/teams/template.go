@@ -0,0 +1,73 @@
+package teams
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrLabelValueTemplate is wrapped by the errors of tokens the LabelValueTemplate cannot
+// be rendered for, e.g. as they lack a claim it references.
+var ErrLabelValueTemplate = errors.New("cannot derive the label value from the token claims")
+
+// LabelValueTemplate renders the label value of LabelSourceClaims from the claims of the
+// token of the user, e.g. {{.org}}-{{.team}}, composing tenant identities from the token
+// alone without looking them up in Grafana.
+type LabelValueTemplate struct {
+	tmpl *template.Template
+}
+
+// ParseLabelValueTemplate parses a text/template over the claims of the token.
+func ParseLabelValueTemplate(s string) (*LabelValueTemplate, error) {
+	t, err := template.New("label-value").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return &LabelValueTemplate{tmpl: t}, nil
+}
+
+// Execute renders the label value from claims. Claims the template references must be
+// present and not null, and the value rendered must not be empty.
+func (lt *LabelValueTemplate) Execute(claims jwt.MapClaims) (string, error) {
+	data := make(map[string]any, len(claims))
+	for k, v := range claims {
+		switch v := v.(type) {
+		case nil:
+			// left out so that referencing it fails
+		case float64:
+			// JSON numbers, rendered as integers when they are
+			data[k] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			data[k] = v
+		}
+	}
+
+	var b strings.Builder
+	if err := lt.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrLabelValueTemplate, err)
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("%w: the template rendered an empty value", ErrLabelValueTemplate)
+	}
+	return b.String(), nil
+}
+
+// claimLabelValues returns the label value rendered by LabelTemplate from the token of
+// the Principal of r.
+func (gte GrafanaTeamsEnforcer) claimLabelValues(r *http.Request) ([]string, error) {
+	p, _ := PrincipalFromContext(r.Context())
+	if p.Token == nil {
+		return nil, fmt.Errorf("%w: the token is not a JWT", ErrLabelValueTemplate)
+	}
+	claims, _ := p.Token.Claims.(jwt.MapClaims)
+	v, err := gte.LabelTemplate.Execute(claims)
+	if err != nil {
+		return nil, err
+	}
+	return []string{v}, nil
+}
@@ -0,0 +1,85 @@
+package teams_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestLabelValueTemplate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		template string
+		claims   jwt.MapClaims
+		want     string
+	}{
+		{name: "single claim", template: "{{.team}}", claims: jwt.MapClaims{"team": "team-a"}, want: "team-a"},
+		{name: "several claims", template: "{{.org}}-{{.team}}", claims: jwt.MapClaims{"org": "acme", "team": "team-a"}, want: "acme-team-a"},
+		{name: "number claim", template: "org-{{.org}}", claims: jwt.MapClaims{"org": float64(12)}, want: "org-12"},
+		{name: "fractional number claim", template: "{{.weight}}", claims: jwt.MapClaims{"weight": 1.5}, want: "1.5"},
+		{name: "missing claim", template: "{{.org}}-{{.team}}", claims: jwt.MapClaims{"team": "team-a"}},
+		{name: "null claim", template: "{{.team}}", claims: jwt.MapClaims{"team": nil}},
+		{name: "empty value", template: "{{.team}}", claims: jwt.MapClaims{"team": ""}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lt, err := teams.ParseLabelValueTemplate(tc.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := lt.Execute(tc.claims)
+			if tc.want == "" {
+				if !errors.Is(err, teams.ErrLabelValueTemplate) {
+					t.Errorf("Execute() = %q, %v, want ErrLabelValueTemplate", got, err)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("Execute() = %q, %v, want %q", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseLabelValueTemplateInvalid(t *testing.T) {
+	if _, err := teams.ParseLabelValueTemplate("{{.org"); err == nil {
+		t.Error("ParseLabelValueTemplate() = nil error for an unterminated action")
+	}
+}
+
+func TestExtractLabelLabelValueTemplate(t *testing.T) {
+	g := newGrafana(t)
+	template, err := teams.ParseLabelValueTemplate("{{.org}}-{{.team}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		claims  jwt.MapClaims
+		status  int
+		tenants string
+	}{
+		{name: "claims present", claims: jwt.MapClaims{"org": "acme", "team": "ops"}, status: http.StatusOK, tenants: "acme-ops\n"},
+		{name: "claim missing", claims: jwt.MapClaims{"team": "ops"}, status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gte := newEnforcer(t, g)
+			gte.LabelSource = teams.LabelSourceClaims
+			gte.LabelTemplate = template
+
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", tokenWithClaims(t, g, "1", 1, tc.claims))
+			w := serve(gte.ExtractLabel(tenantsHandler), r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.tenants {
+				t.Errorf("tenants = %q, want %q", w.Body, tc.tenants)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package teams
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TenantSeparator separates the label values serialized by JoinTenants.
+const TenantSeparator = ","
+
+// maxLabelValueBytes bounds the size of the label values enforced.
+const maxLabelValueBytes = 1024
+
+// JoinTenants serializes label values into a single string. Each value is
+// percent-encoded, so values containing the separator, '%' or characters not allowed in
+// header values are recovered by splitting on the separator and unescaping each entry.
+// Values that cannot be enforced are rejected.
+func JoinTenants(tenants []string) (string, error) {
+	escaped := make([]string, len(tenants))
+	for i, t := range tenants {
+		if err := validLabelValue(t); err != nil {
+			return "", err
+		}
+		escaped[i] = url.PathEscape(t)
+	}
+	return strings.Join(escaped, TenantSeparator), nil
+}
+
+// validLabelValue reports whether v can be enforced as a Prometheus label value. Besides
+// being valid UTF-8, it must not hold '|', which separates the values of the matchers
+// enforcing several of them and the tenants of multi-tenant upstream requests, nor control
+// characters, and must not exceed maxLabelValueBytes.
+func validLabelValue(v string) error {
+	if v == "" {
+		return fmt.Errorf("empty label value")
+	}
+	if len(v) > maxLabelValueBytes {
+		return fmt.Errorf("label value of %d bytes exceeds the maximum size of %d bytes", len(v), maxLabelValueBytes)
+	}
+	if !utf8.ValidString(v) {
+		return fmt.Errorf("label value %q is not valid UTF-8", v)
+	}
+	if strings.Contains(v, "|") {
+		return fmt.Errorf("label value %q holds the separator '|'", v)
+	}
+	if strings.ContainsFunc(v, unicode.IsControl) {
+		return fmt.Errorf("label value %q holds control characters", v)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package teams
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidLabelValue(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		valid bool
+	}{
+		{value: "team-a", valid: true},
+		{value: "Équipe ops, EU", valid: true},
+		{value: strings.Repeat("a", maxLabelValueBytes), valid: true},
+		{value: ""},
+		{value: strings.Repeat("a", maxLabelValueBytes+1)},
+		{value: "\xff"},
+		{value: "team-a|team-b"},
+		{value: "team\n"},
+		{value: "team\x00"},
+		{value: "team\u0085"},
+	} {
+		if err := validLabelValue(tc.value); (err == nil) != tc.valid {
+			t.Errorf("validLabelValue(%q) = %v, want valid %t", tc.value, err, tc.valid)
+		}
+	}
+}
+
+func TestJoinTenants(t *testing.T) {
+	tenants := []string{"team-a", "ops, EU", "50%", "a/b"}
+	joined, err := JoinTenants(tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var split []string
+	for _, s := range strings.Split(joined, TenantSeparator) {
+		v, err := url.PathUnescape(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		split = append(split, v)
+	}
+	if !slices.Equal(split, tenants) {
+		t.Errorf("JoinTenants(%q) = %q, split back into %q", tenants, joined, split)
+	}
+
+	if joined, err := JoinTenants([]string{"team-a", "team-b|team-c"}); err == nil {
+		t.Errorf("JoinTenants() = %q, want values holding '|' rejected", joined)
+	}
+}
@@ -0,0 +1,183 @@
+package teams
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ServerTimingHeader carries the durations of the phases of a request when ServerTiming
+// is enabled.
+const ServerTimingHeader = "Server-Timing"
+
+// Phases of a request, in the order they run.
+const (
+	// PhaseAuth validates the token.
+	PhaseAuth = "auth"
+	// PhaseTeams resolves the label values from Grafana or the cache.
+	PhaseTeams = "teams"
+	// PhaseEnforce rewrites the request with the label values.
+	PhaseEnforce = "enforce"
+	// PhaseUpstream waits for the headers of the upstream response.
+	PhaseUpstream = "upstream"
+	// PhaseWrite filters and copies the upstream response to the client.
+	PhaseWrite = "write"
+)
+
+var phases = []string{PhaseAuth, PhaseTeams, PhaseEnforce, PhaseUpstream, PhaseWrite}
+
+// PhaseMetrics records the durations of the phases of every request, along with the phase
+// requests were cancelled in, and logs requests slower than SlowThreshold.
+type PhaseMetrics struct {
+	// SlowThreshold is the duration past which requests are logged with their phases. Zero
+	// disables the log.
+	SlowThreshold time.Duration
+
+	durations     *prometheus.HistogramVec
+	cancellations *prometheus.CounterVec
+}
+
+// NewPhaseMetrics creates a PhaseMetrics registered with reg.
+func NewPhaseMetrics(slowThreshold time.Duration, reg prometheus.Registerer) *PhaseMetrics {
+	factory := promauto.With(reg)
+	pm := &PhaseMetrics{
+		SlowThreshold: slowThreshold,
+		durations: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lbac_request_phase_duration_seconds",
+			Help:    "Duration of the phases of the enforced requests.",
+			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"phase"}),
+		cancellations: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_request_phase_cancellations_total",
+			Help: "Total number of enforced requests cancelled or timed out, by the phase they were in.",
+		}, []string{"phase"}),
+	}
+	for _, p := range phases {
+		pm.durations.WithLabelValues(p)
+		pm.cancellations.WithLabelValues(p)
+	}
+	return pm
+}
+
+// record observes the phases measured by t once the request of ctx is over.
+func (pm *PhaseMetrics) record(ctx context.Context, t *requestTimer, d *Decision) {
+	current, durations, total := t.finish()
+	for p, dur := range durations {
+		pm.durations.WithLabelValues(p).Observe(dur.Seconds())
+	}
+	if ctx.Err() != nil && current != "" {
+		pm.cancellations.WithLabelValues(current).Inc()
+	}
+
+	if pm.SlowThreshold > 0 && total > pm.SlowThreshold {
+		attrs := []any{"method", d.Method, "path", d.Path, "userId", d.UserID, "status", d.Status, "duration", total.String()}
+		for _, p := range phases {
+			if dur, found := durations[p]; found {
+				attrs = append(attrs, p, dur.String())
+			}
+		}
+		if ctx.Err() != nil {
+			attrs = append(attrs, "cancelled_in", current)
+		}
+		slog.Warn("slow request", attrs...)
+	}
+}
+
+// requestTimer measures the phases of a request. Phases run one after the other, starting
+// one ends the previous one.
+type requestTimer struct {
+	mu        sync.Mutex
+	start     time.Time
+	current   string
+	since     time.Time
+	durations map[string]time.Duration
+	cacheHit  bool
+}
+
+func newRequestTimer() *requestTimer {
+	now := time.Now()
+	return &requestTimer{start: now, since: now, durations: map[string]time.Duration{}}
+}
+
+// timerFromContext returns the timer of the request, or nil when phases are not measured.
+func timerFromContext(ctx context.Context) *requestTimer {
+	t, _ := ctx.Value(timingsKey).(*requestTimer)
+	return t
+}
+
+// StartPhase ends the current phase of the request of ctx and starts phase.
+func StartPhase(ctx context.Context, phase string) {
+	if t := timerFromContext(ctx); t != nil {
+		t.startPhase(phase)
+	}
+}
+
+func (t *requestTimer) startPhase(phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endPhase()
+	t.current, t.since = phase, time.Now()
+}
+
+// endPhase adds the time spent in the current phase to it. t.mu must be held.
+func (t *requestTimer) endPhase() {
+	if t.current != "" {
+		t.durations[t.current] += time.Since(t.since)
+	}
+}
+
+func (t *requestTimer) observeCacheHit() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cacheHit = true
+}
+
+// finish ends the current phase, returning its name along with the duration of every
+// phase that ran and of the whole request.
+func (t *requestTimer) finish() (string, map[string]time.Duration, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endPhase()
+	current := t.current
+	t.current = ""
+	return current, t.durations, time.Since(t.start)
+}
+
+// header formats the phases that are over as a Server-Timing header value, with durations
+// in milliseconds.
+func (t *requestTimer) header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var metrics []string
+	for _, p := range phases {
+		dur, found := t.durations[p]
+		if !found || p == t.current {
+			continue
+		}
+		m := fmt.Sprintf("%s;dur=%.3f", p, float64(dur)/float64(time.Millisecond))
+		if p == PhaseTeams {
+			desc := "cache miss"
+			if t.cacheHit {
+				desc = "cache hit"
+			}
+			m += fmt.Sprintf(";desc=%q", desc)
+		}
+		metrics = append(metrics, m)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// writeTo sets the Server-Timing header of h, unless no phase is over.
+func (t *requestTimer) writeTo(h http.Header) {
+	if v := t.header(); v != "" {
+		h.Set(ServerTimingHeader, v)
+	}
+}
@@ -0,0 +1,55 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+// upstreamPhasesHandler goes through the phases the proxy transport measures before
+// answering.
+var upstreamPhasesHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	teams.StartPhase(r.Context(), teams.PhaseUpstream)
+	teams.StartPhase(r.Context(), teams.PhaseWrite)
+	w.Write([]byte("ok"))
+})
+
+func TestExtractLabelServerTiming(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	gte.ServerTiming = true
+	h := gte.ExtractLabel(upstreamPhasesHandler)
+
+	const dur = `;dur=\d+\.\d{3}`
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{name: "cache miss", want: `^auth` + dur + `, teams` + dur + `;desc="cache miss", enforce` + dur + `, upstream` + dur + `$`},
+		{name: "cache hit", want: `^auth` + dur + `, teams` + dur + `;desc="cache hit", enforce` + dur + `, upstream` + dur + `$`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			w := serve(h, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get(teams.ServerTimingHeader); !regexp.MustCompile(tc.want).MatchString(got) {
+				t.Errorf("%s = %q, want it to match %q", teams.ServerTimingHeader, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		gte.ServerTiming = false
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+		r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+		if got := serve(gte.ExtractLabel(upstreamPhasesHandler), r).Header().Get(teams.ServerTimingHeader); got != "" {
+			t.Errorf("%s = %q with the header disabled", teams.ServerTimingHeader, got)
+		}
+	})
+}
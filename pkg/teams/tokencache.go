@@ -0,0 +1,90 @@
+package teams
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxCachedTokens bounds the number of tokens held by a TokenCache.
+const maxCachedTokens = 10000
+
+// TokenCache holds the tokens whose signature was verified, by hash of the signed token,
+// so that a token presented again within TTL is not verified again. An entry never
+// outlives the exp claim of its token. Tokens signed with a key removed from the JWKS
+// remain accepted until their entry expires, so TTL should stay short.
+type TokenCache struct {
+	TTL time.Duration
+
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]cachedToken
+
+	requests *prometheus.CounterVec
+}
+
+type cachedToken struct {
+	token   *jwt.Token
+	expires time.Time
+}
+
+// NewTokenCache creates a TokenCache registering its metrics with reg.
+func NewTokenCache(ttl time.Duration, reg prometheus.Registerer) *TokenCache {
+	tc := &TokenCache{
+		TTL:    ttl,
+		tokens: map[[sha256.Size]byte]cachedToken{},
+		requests: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Name: "lbac_token_cache_requests_total",
+			Help: "Total number of token verifications looked up in the token cache, by result.",
+		}, []string{"result"}),
+	}
+	tc.requests.WithLabelValues("hit")
+	tc.requests.WithLabelValues("miss")
+	return tc
+}
+
+// get returns the token verified earlier for signedToken, if its entry has not expired.
+func (tc *TokenCache) get(signedToken string) (*jwt.Token, bool) {
+	key := sha256.Sum256([]byte(signedToken))
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	ct, found := tc.tokens[key]
+	if !found || !time.Now().Before(ct.expires) {
+		delete(tc.tokens, key)
+		tc.requests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	tc.requests.WithLabelValues("hit").Inc()
+	return ct.token, true
+}
+
+// set records token was verified from signedToken. Tokens without an exp claim are not
+// cached.
+func (tc *TokenCache) set(signedToken string, token *jwt.Token) {
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(tc.TTL)
+	if exp.Time.Before(expires) {
+		expires = exp.Time
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if len(tc.tokens) >= maxCachedTokens {
+		for k, ct := range tc.tokens {
+			if !now.Before(ct.expires) {
+				delete(tc.tokens, k)
+			}
+		}
+		if len(tc.tokens) >= maxCachedTokens {
+			return
+		}
+	}
+	tc.tokens[sha256.Sum256([]byte(signedToken))] = cachedToken{token: token, expires: expires}
+}
@@ -0,0 +1,55 @@
+package teams
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenCache(t *testing.T) {
+	tc := NewTokenCache(time.Minute, prometheus.NewRegistry())
+	token := func(exp time.Time) *jwt.Token {
+		return jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"exp": float64(exp.Unix())})
+	}
+	// expires returns when the entry of signedToken expires
+	expires := func(signedToken string) time.Time {
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		return tc.tokens[sha256.Sum256([]byte(signedToken))].expires
+	}
+
+	tc.set("long", token(time.Now().Add(time.Hour)))
+	if _, found := tc.get("long"); !found {
+		t.Error("verified token not cached")
+	}
+	if d := time.Until(expires("long")); d > time.Minute || d < 59*time.Second {
+		t.Errorf("entry expires in %s, want the TTL", d)
+	}
+	if _, found := tc.get("other"); found {
+		t.Error("token never verified found")
+	}
+
+	// an entry never outlives the exp claim of its token, whatever the TTL
+	exp := time.Now().Add(10 * time.Second).Truncate(time.Second)
+	tc.set("expiring", token(exp))
+	if got := expires("expiring"); !got.Equal(exp) {
+		t.Errorf("entry expires at %s, want the exp claim %s", got, exp)
+	}
+	tc.set("expired", token(time.Now().Add(-time.Second)))
+	if _, found := tc.get("expired"); found {
+		t.Error("token found past its exp claim")
+	}
+
+	tc.set("no exp", jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{}))
+	if _, found := tc.get("no exp"); found {
+		t.Error("token without exp claim cached")
+	}
+
+	if hits, misses := testutil.ToFloat64(tc.requests.WithLabelValues("hit")), testutil.ToFloat64(tc.requests.WithLabelValues("miss")); hits != 1 || misses != 3 {
+		t.Errorf("%v hits and %v misses, want 1 and 3", hits, misses)
+	}
+}
@@ -0,0 +1,72 @@
+package teams
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// apiPaths are the paths enforced or rejected by injectproxy, which UI paths may not
+// overlap.
+var apiPaths = []string{"/api", "/federate"}
+
+// ValidateUIPaths checks paths can be given to UIPassthrough: they must be absolute and
+// clean, neither the root nor under the API paths. Paths ending with a slash match every
+// path below them, any other path only matches itself.
+func ValidateUIPaths(paths []string) error {
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") || p == "/" || path.Clean(p) != strings.TrimSuffix(p, "/") {
+			return fmt.Errorf("UI path %q must be an absolute, clean path other than /", p)
+		}
+		for _, api := range apiPaths {
+			if p == api || strings.HasPrefix(p, api+"/") {
+				return fmt.Errorf("UI path %q overlaps the enforced path %s", p, api)
+			}
+		}
+	}
+	return nil
+}
+
+// UIPassthrough sends GET and HEAD requests to the Paths of the Prometheus web UI to
+// Upstream once their token is authenticated, without enforcing label values on them or
+// on their responses. Any other request goes to Next, so the API requests the UI makes
+// remain enforced.
+type UIPassthrough struct {
+	Enforcer GrafanaTeamsEnforcer
+	// Paths are the UI paths passed through, as accepted by ValidateUIPaths.
+	Paths    []string
+	Next     http.Handler
+	Upstream http.Handler
+}
+
+func (up UIPassthrough) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !up.matches(r) {
+		up.Next.ServeHTTP(w, r)
+		return
+	}
+	up.Enforcer.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := PrincipalFromContext(r.Context())
+		slog.Debug("passing UI request through", "path", r.URL.Path, "userId", principal.UserID)
+		up.Upstream.ServeHTTP(w, r)
+	})).ServeHTTP(w, r)
+}
+
+// matches reports whether r is a UI request. Paths that are not clean or carry encoded
+// characters never match, so they cannot reach the API through the passthrough.
+func (up UIPassthrough) matches(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	p := r.URL.Path
+	if r.URL.RawPath != "" || path.Clean(p) != strings.TrimSuffix(p, "/") {
+		return false
+	}
+	for _, ui := range up.Paths {
+		if p == ui || strings.HasSuffix(ui, "/") && strings.HasPrefix(p, ui) {
+			return true
+		}
+	}
+	return false
+}
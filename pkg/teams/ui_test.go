@@ -0,0 +1,76 @@
+package teams_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestUIPassthrough(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	up := teams.UIPassthrough{
+		Enforcer: gte,
+		Paths:    []string{"/graph", "/static/"},
+		// the requests not passed through are enforced
+		Next:     gte.ExtractLabel(tenantsHandler),
+		Upstream: labelHandler("ui"),
+	}
+	const enforced = "team-a\nteam-b\n"
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		target  string
+		noToken bool
+		status  int
+		want    string
+	}{
+		{name: "UI page", method: "GET", target: "/graph", status: http.StatusOK, want: "ui"},
+		{name: "UI page HEAD", method: "HEAD", target: "/graph", status: http.StatusOK, want: "ui"},
+		{name: "UI asset", method: "GET", target: "/static/js/main.js", status: http.StatusOK, want: "ui"},
+		{name: "UI page without token", method: "GET", target: "/graph", noToken: true, status: http.StatusUnauthorized},
+		{name: "API call of the UI", method: "GET", target: "/api/v1/query?query=up", status: http.StatusOK, want: enforced},
+		{name: "below a path without slash", method: "GET", target: "/graph/x", status: http.StatusOK, want: enforced},
+		{name: "path sharing a prefix", method: "GET", target: "/graphs", status: http.StatusOK, want: enforced},
+		{name: "POST to a UI path", method: "POST", target: "/graph", status: http.StatusOK, want: enforced},
+		{name: "dot segments", method: "GET", target: "/static/../api/v1/query", status: http.StatusOK, want: enforced},
+		{name: "encoded slashes", method: "GET", target: "/static/..%2Fapi%2Fv1%2Fquery", status: http.StatusOK, want: enforced},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.target, nil)
+			if !tc.noToken {
+				r.Header.Set("X-Grafana-Id", token(t, g, "1", 1))
+			}
+			w := serve(up, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.want {
+				t.Errorf("answered %q, want %q", w.Body, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateUIPaths(t *testing.T) {
+	for p, valid := range map[string]bool{
+		"/graph":        true,
+		"/static/":      true,
+		"/consoles/x/":  true,
+		"/":             false,
+		"graph":         false,
+		"/static/../x":  false,
+		"//graph":       false,
+		"/api":          false,
+		"/api/v1/query": false,
+		"/federate":     false,
+		"/apidocs":      true,
+	} {
+		if err := teams.ValidateUIPaths([]string{p}); (err == nil) != valid {
+			t.Errorf("ValidateUIPaths(%q) = %v, want valid %t", p, err, valid)
+		}
+	}
+}
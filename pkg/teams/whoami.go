@@ -0,0 +1,73 @@
+package teams
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// WhoAmIPath is the path answering callers with the scope of their own access.
+const WhoAmIPath = "/whoami"
+
+// WhoAmI answers GET requests to WhoAmIPath with the user, org, teams and label values
+// resolved for the X-Grafana-Id token of the caller, validated and resolved as by
+// ExtractLabel but without recording a decision nor sending anything upstream. Requests
+// to any other path go to Next.
+type WhoAmI struct {
+	// Enforcer resolves the label values of the requests, its Label set to the enforced
+	// label.
+	Enforcer GrafanaTeamsEnforcer
+	Next     http.Handler
+}
+
+type whoAmIResponse struct {
+	UserID         string   `json:"userId"`
+	OrgID          int64    `json:"orgId"`
+	Teams          []string `json:"teams"`
+	EnforcedLabel  string   `json:"enforcedLabel"`
+	EnforcedValues []string `json:"enforcedValues"`
+}
+
+func (wai WhoAmI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WhoAmIPath {
+		wai.Next.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// the decision collects the org, inferred by ResolveTenants when the token lacks it
+	d := &Decision{Time: time.Now(), Method: r.Method, Path: r.URL.Path, Label: wai.Enforcer.Label}
+	wai.Enforcer.Authenticate(wai.Enforcer.ResolveTenants(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PrincipalFromContext(r.Context())
+		resp := whoAmIResponse{
+			UserID:         p.UserID,
+			OrgID:          d.OrgID,
+			Teams:          []string{},
+			EnforcedLabel:  wai.Enforcer.Label,
+			EnforcedValues: TenantsFromContext(r.Context()),
+		}
+		if wai.Enforcer.labelSource() == LabelSourceTeams {
+			// served from the cache filled by ResolveTenants
+			teams, err := wai.Enforcer.fetchTeamsForUser(r, p.UserID)
+			if err != nil {
+				if !lookupFailed(w, r, p.UserID, err) {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			for _, t := range teams {
+				if t.OrgID == resp.OrgID {
+					resp.Teams = append(resp.Teams, t.Name)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))).ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), decisionKey, d)))
+}
@@ -0,0 +1,89 @@
+package teams_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+)
+
+func TestWhoAmI(t *testing.T) {
+	g := newGrafana(t)
+	gte := newEnforcer(t, g)
+	h, err := teams.ParseTeamHierarchy("team-a=team-a-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gte.TeamHierarchy = h
+	var upstream []string
+	wai := teams.WhoAmI{Enforcer: gte, Next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = append(upstream, r.URL.Path)
+	})}
+
+	type response struct {
+		UserID         string   `json:"userId"`
+		OrgID          int64    `json:"orgId"`
+		Teams          []string `json:"teams"`
+		EnforcedLabel  string   `json:"enforcedLabel"`
+		EnforcedValues []string `json:"enforcedValues"`
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		user   string
+		org    int64
+		status int
+		want   response
+	}{
+		{
+			name: "teams of the org", method: "GET", user: "1", org: 1, status: http.StatusOK,
+			// the label values include the descendants of the teams
+			want: response{UserID: "1", OrgID: 1, Teams: []string{"team-a", "team-b"}, EnforcedLabel: "team", EnforcedValues: []string{"team-a", "team-b", "team-a-1"}},
+		},
+		{
+			name: "teams of another org left out", method: "GET", user: "1", org: 2, status: http.StatusOK,
+			want: response{UserID: "1", OrgID: 2, Teams: []string{"team-c"}, EnforcedLabel: "team", EnforcedValues: []string{"team-c"}},
+		},
+		{name: "no team", method: "GET", user: "2", org: 1, status: http.StatusNotFound},
+		{name: "no token", method: "GET", status: http.StatusUnauthorized},
+		{name: "POST", method: "POST", user: "1", org: 1, status: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, teams.WhoAmIPath, nil)
+			if tc.user != "" {
+				r.Header.Set("X-Grafana-Id", token(t, g, tc.user, tc.org))
+			}
+			w := serve(wai, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", cc)
+			}
+			var got response
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.UserID != tc.want.UserID || got.OrgID != tc.want.OrgID || got.EnforcedLabel != tc.want.EnforcedLabel ||
+				!slices.Equal(got.Teams, tc.want.Teams) || !slices.Equal(got.EnforcedValues, tc.want.EnforcedValues) {
+				t.Errorf("answered %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+	if upstream != nil {
+		t.Errorf("requests to %s sent upstream", teams.WhoAmIPath)
+	}
+
+	// other paths go to Next
+	r := httptest.NewRequest("GET", "/api/v1/query", nil)
+	serve(wai, r)
+	if !slices.Equal(upstream, []string{"/api/v1/query"}) {
+		t.Errorf("requests sent upstream = %q, want /api/v1/query", upstream)
+	}
+}
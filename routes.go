@@ -0,0 +1,389 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/proxy"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/prometheus-community/prom-label-proxy/injectproxy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeLabels are the labels the enforced routes select among.
+type routeLabels struct {
+	// names lists every label enforced, --label first.
+	names []string
+	// claim lists the labels --label-claim may select.
+	claim []string
+	// overrides lists the labels --allowed-label-overrides lets requests select.
+	overrides []string
+	// byOrg maps the orgs of --org-labels to the label enforced on their requests.
+	byOrg map[int64]string
+}
+
+// parseRouteLabels parses the labels enforced according to the flags of o.
+func parseRouteLabels(o *options) (routeLabels, error) {
+	rl := routeLabels{names: []string{o.label}, byOrg: map[int64]string{}}
+	add := func(l string) {
+		if !slices.Contains(rl.names, l) {
+			rl.names = append(rl.names, l)
+		}
+	}
+
+	if o.labelClaim != "" {
+		if len(o.labelClaimAllowedLabels) == 0 {
+			return routeLabels{}, errors.New("--label-claim requires --label-claim-allowed-labels")
+		}
+		for _, l := range strings.Split(o.labelClaimAllowedLabels, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				rl.claim = append(rl.claim, l)
+				add(l)
+			}
+		}
+	}
+
+	for _, l := range strings.Split(o.allowedLabelOverrides, ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			rl.overrides = append(rl.overrides, l)
+			add(l)
+		}
+	}
+
+	if o.orgLabels != "" {
+		for _, pair := range strings.Split(o.orgLabels, ",") {
+			org, l, found := strings.Cut(strings.TrimSpace(pair), "=")
+			orgId, err := strconv.ParseInt(org, 10, 64)
+			if !found || err != nil || l == "" {
+				return routeLabels{}, fmt.Errorf("invalid --org-labels entry %q, expected <orgId>=<label>", pair)
+			}
+			rl.byOrg[orgId] = l
+			add(l)
+		}
+	}
+	if o.rejectUnmappedOrgs && len(rl.byOrg) == 0 {
+		return routeLabels{}, errors.New("--reject-unmapped-orgs requires --org-labels")
+	}
+	return rl, nil
+}
+
+// routeBuilder composes the handler of the proxied requests from the flags of o and the
+// settings parsed from them.
+type routeBuilder struct {
+	o      *options
+	labels routeLabels
+
+	upstream  *url.URL
+	secondary *url.URL
+	// ruler is the upstream of the ruler API, if any.
+	ruler *url.URL
+	// datasources maps the datasource UIDs of --datasource-upstreams to their upstream.
+	datasources map[string]*url.URL
+	// sources are the Grafana instances of --grafana-sources-file.
+	sources []grafanaSource
+
+	strictPaths []string
+	opts        []injectproxy.Option
+	uiPaths     []string
+	trusted     []netip.Prefix
+	markerPeers []netip.Prefix
+
+	// transport sends the enforced requests upstream, raw the requests skipping enforcement
+	// and base the requests to anything else.
+	transport, raw, base http.RoundTripper
+
+	outcomes *proxy.EnforcementOutcomes
+	reg      prometheus.Registerer
+}
+
+// upstreamProxy returns a reverse proxy to u sending requests through the transports of
+// enforced requests, as injectproxy does.
+func (b *routeBuilder) upstreamProxy(u *url.URL) *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(u)
+	p.Transport = b.transport
+	return p
+}
+
+// rawProxy returns a reverse proxy to --upstream for the requests skipping enforcement.
+func (b *routeBuilder) rawProxy() *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(b.upstream)
+	p.Transport = b.raw
+	return p
+}
+
+// sourceRegisterer returns the registerer of the metrics of the Grafana instance source,
+// told apart by label when there are several.
+func (b *routeBuilder) sourceRegisterer(source string) prometheus.Registerer {
+	if len(b.sources) == 0 {
+		return b.reg
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"grafana": source}, b.reg)
+}
+
+// metricLabels returns the labels of the handler metrics of the routes enforcing l on the
+// requests to route authenticated by source. Every routes instance registers the same
+// handler metrics, so they are told apart by label.
+func (b *routeBuilder) metricLabels(source, route, l string) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if len(b.sources) > 0 {
+		labels["grafana"] = source
+	}
+	if len(b.labels.names) > 1 || b.o.secondaryPathPrefix != "" {
+		labels["label"] = l
+	}
+	if b.o.secondaryPathPrefix != "" || len(b.datasources) > 0 {
+		labels["route"] = route
+	}
+	return labels
+}
+
+// labelRoutes returns the injectproxy routes enforcing the label of el on the requests
+// to u, along with those of the endpoints the upstream flavor supports natively and
+// --enable-whoami.
+func (b *routeBuilder) labelRoutes(el teams.GrafanaTeamsEnforcer, source string, u *url.URL, route string) (http.Handler, error) {
+	routes, err := newRoutes(u, el.Label, el, b.reg, b.metricLabels(source, route, el.Label), b.strictPaths, b.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create injectproxy routes: %w", err)
+	}
+	if teams.UpstreamFlavor(b.o.upstreamFlavor) == teams.UpstreamVictoriaMetrics {
+		routes = teams.ExtraFilters{Enforcer: el, Upstream: b.upstreamProxy(u), Next: routes, LabelAPIs: b.o.enableLabelAPIs}
+	}
+	if b.o.enableWhoAmI {
+		routes = teams.WhoAmI{Enforcer: el, Next: routes}
+	}
+	return b.outcomes.Instrument(el.Label, routes), nil
+}
+
+// enforcedRoutes returns the routes enforcing the selected label on requests to u
+// authenticated by the Grafana instance of enforcer.
+func (b *routeBuilder) enforcedRoutes(enforcer teams.GrafanaTeamsEnforcer, source string, u *url.URL, route string) (http.Handler, error) {
+	routesByLabel := make(map[string]http.Handler, len(b.labels.names))
+	for _, l := range b.labels.names {
+		el := enforcer
+		el.Label = l
+		routes, err := b.labelRoutes(el, source, u, route)
+		if err != nil {
+			return nil, err
+		}
+		routesByLabel[l] = routes
+	}
+
+	routes := routesByLabel[b.o.label]
+	if len(b.labels.byOrg) > 0 {
+		routes = teams.OrgLabelRouter{
+			Enforcer:       enforcer,
+			Labels:         b.labels.byOrg,
+			Routes:         routesByLabel,
+			Default:        routes,
+			RejectUnmapped: b.o.rejectUnmappedOrgs,
+		}
+	}
+	if b.o.labelClaim != "" {
+		// the claim selects among its allow list only, not the labels of the orgs or of the
+		// header
+		routesByClaim := make(map[string]http.Handler, len(b.labels.claim))
+		for _, l := range b.labels.claim {
+			routesByClaim[l] = routesByLabel[l]
+		}
+		routes = teams.ClaimLabelRouter{
+			Enforcer: enforcer,
+			Claim:    b.o.labelClaim,
+			Routes:   routesByClaim,
+			Default:  routes,
+		}
+	}
+	if len(b.labels.overrides) > 0 {
+		routesByOverride := make(map[string]http.Handler, len(b.labels.overrides))
+		for _, l := range b.labels.overrides {
+			routesByOverride[l] = routesByLabel[l]
+		}
+		routes = teams.HeaderLabelRouter{Routes: routesByOverride, Default: routes}
+	}
+	return routes, nil
+}
+
+// sourceRoutes returns the routes of the requests authenticated by the Grafana instance
+// of enforcer.
+func (b *routeBuilder) sourceRoutes(enforcer teams.GrafanaTeamsEnforcer, source string) (http.Handler, error) {
+	routes, err := b.enforcedRoutes(enforcer, source, b.upstream, "primary")
+	if err != nil {
+		return nil, err
+	}
+	if len(b.datasources) > 0 {
+		routesByDatasource := make(map[string]http.Handler, len(b.datasources))
+		for _, uid := range slices.Sorted(maps.Keys(b.datasources)) {
+			if routesByDatasource[uid], err = b.enforcedRoutes(enforcer, source, b.datasources[uid], "datasource-"+uid); err != nil {
+				return nil, err
+			}
+		}
+		routes = teams.DatasourceRouter{
+			Enforcer:      enforcer,
+			Claim:         b.o.datasourceClaim,
+			Routes:        routesByDatasource,
+			Default:       routes,
+			RejectUnknown: b.o.rejectUnknownDatasource,
+		}
+	}
+
+	if b.ruler != nil {
+		el := enforcer
+		el.Label = b.o.label
+		routes = teams.RulerAPI{Enforcer: el, Upstream: b.upstreamProxy(b.ruler), Next: routes}
+	}
+	if b.o.breakGlassTeams != "" {
+		bg := teams.NewBreakGlass(enforcer, strings.Split(b.o.breakGlassTeams, ","), b.o.breakGlassWebhook, routes, b.rawProxy(), b.sourceRegisterer(source))
+		bg.Client.Transport = b.base
+		routes = bg
+	}
+	if len(b.uiPaths) > 0 {
+		// UI requests go through the transports like other requests sent upstream without
+		// enforcement
+		routes = teams.UIPassthrough{Enforcer: enforcer, Paths: b.uiPaths, Next: routes, Upstream: b.upstreamProxy(b.upstream)}
+	}
+	return routes, nil
+}
+
+// routes returns the routes of the requests authenticated by enforcer, the Grafana of
+// --grafana-url, or by sourceEnforcers, those of the Grafana sources, along with the
+// routes of --secondary-path-prefix.
+func (b *routeBuilder) routes(enforcer teams.GrafanaTeamsEnforcer, sourceEnforcers []teams.GrafanaTeamsEnforcer) (*http.ServeMux, error) {
+	routes, err := b.sourceRoutes(enforcer, "default")
+	if err != nil {
+		return nil, err
+	}
+	if len(b.sources) > 0 {
+		routesByIssuer := map[string]http.Handler{teams.NormalizeIssuer(b.o.grafanaIssuer): routes}
+		for i, src := range b.sources {
+			if routesByIssuer[src.Issuer], err = b.sourceRoutes(sourceEnforcers[i], src.Name); err != nil {
+				return nil, err
+			}
+		}
+		routes = teams.IssuerRouter{Routes: routesByIssuer, Default: routes, TokenHeader: b.o.jwtHeader}
+	}
+
+	var secondaryRoutes http.Handler
+	if b.o.secondaryPathPrefix != "" {
+		el := enforcer
+		el.Label = b.o.secondaryLabel
+		if secondaryRoutes, err = b.labelRoutes(el, "default", b.secondary, "secondary"); err != nil {
+			return nil, err
+		}
+	}
+	return mountRoutes(routes, b.o.secondaryPathPrefix, secondaryRoutes), nil
+}
+
+// handler wraps routes in the handlers applying to every proxied request, counting the
+// requests they reject in outcomes.
+func (b *routeBuilder) handler(routes http.Handler, outcomes *prometheus.CounterVec) http.Handler {
+	o := b.o
+	var handler http.Handler = proxy.NewUnknownPaths(o.enableLandingPage, version, routes, b.reg)
+	if o.allowBearerToken {
+		handler = teams.BearerToken{TokenHeader: o.jwtHeader, Next: handler}
+	}
+	if o.notFoundIsolation {
+		handler = proxy.NotFoundIsolation{Next: handler}
+	}
+	if o.streamFlushInterval != 0 {
+		handler = proxy.Flush{Interval: o.streamFlushInterval, Next: handler}
+	}
+	handler = proxy.Methods{Strict: o.strictRequests, Next: handler}
+	if o.defaultSeriesLimit > 0 || o.maxSeriesLimit > 0 || o.rejectUnlimitedSeries {
+		handler = proxy.SeriesLimit{
+			Default:         o.defaultSeriesLimit,
+			Max:             o.maxSeriesLimit,
+			RejectUnlimited: o.rejectUnlimitedSeries,
+			Next:            handler,
+		}
+	}
+
+	if o.maxQueryRange > 0 || o.minQueryStep > 0 {
+		handler = proxy.QueryRangeBounds{
+			MaxRange: o.maxQueryRange,
+			MinStep:  o.minQueryStep,
+			Next:     handler,
+		}
+	}
+
+	if o.enableCORS {
+		handler = proxy.CORS{
+			AllowedOrigins: strings.Split(o.corsAllowedOrigins, ","),
+			AllowedMethods: strings.Split(o.corsAllowedMethods, ","),
+			AllowedHeaders: strings.Split(o.corsAllowedHeaders, ","),
+			Outcomes:       outcomes,
+			Next:           handler,
+		}
+	}
+	if o.trustForwardedHeaders {
+		handler = proxy.ForwardedHeaders{Trusted: b.trusted, Next: handler}
+	}
+	handler = proxy.EnforcementMarker{Trusted: b.markerPeers, Upstream: b.rawProxy(), Next: handler, Outcomes: outcomes}
+	if o.maxClientConcurrency > 0 {
+		var forwarders []netip.Prefix
+		if o.trustForwardedHeaders {
+			forwarders = b.trusted
+		}
+		handler = proxy.NewClientConcurrency(o.maxClientConcurrency, forwarders, handler, b.reg)
+	}
+	return handler
+}
+
+// mountRoutes serves routes and, when prefix is set, secondary for the requests under
+// prefix, with the prefix stripped.
+func mountRoutes(routes http.Handler, prefix string, secondary http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/", routes)
+	if prefix != "" {
+		mux.Handle(prefix+"/", http.StripPrefix(prefix, secondary))
+	}
+	return mux
+}
+
+// newRoutes builds the injectproxy routes enforcing label. Requests for strictPaths are
+// served by a second routes instance with error-on-replace enabled. metricLabels are
+// attached to the handler metrics so that several instances can share reg.
+func newRoutes(upstreamURL *url.URL, label string, el injectproxy.ExtractLabeler, reg prometheus.Registerer, metricLabels prometheus.Labels, strictPaths []string, opts ...injectproxy.Option) (http.Handler, error) {
+	if strictPaths == nil {
+		routes, err := injectproxy.NewRoutes(upstreamURL, label, el, append(opts,
+			injectproxy.WithPrometheusRegistry(prometheus.WrapRegistererWith(metricLabels, reg)))...)
+		if err != nil {
+			return nil, err
+		}
+		return routes, nil
+	}
+
+	// Both route sets register the same handler metrics, so tell them apart by label.
+	lenientLabels, strictLabels := maps.Clone(metricLabels), maps.Clone(metricLabels)
+	if lenientLabels == nil {
+		lenientLabels, strictLabels = prometheus.Labels{}, prometheus.Labels{}
+	}
+	lenientLabels["error_on_replace"] = "false"
+	strictLabels["error_on_replace"] = "true"
+
+	routes, err := injectproxy.NewRoutes(upstreamURL, label, el, append(opts,
+		injectproxy.WithPrometheusRegistry(prometheus.WrapRegistererWith(lenientLabels, reg)))...)
+	if err != nil {
+		return nil, err
+	}
+	strictRoutes, err := injectproxy.NewRoutes(upstreamURL, label, el, append(opts,
+		injectproxy.WithErrorOnReplace(),
+		injectproxy.WithPrometheusRegistry(prometheus.WrapRegistererWith(strictLabels, reg)))...)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", routes)
+	for _, path := range strictPaths {
+		mux.Handle(path, strictRoutes)
+		mux.Handle(path+"/", strictRoutes)
+	}
+	return mux, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/proxy"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams/teamstest"
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+)
+
+// newTestEnforcer starts a teamstest.Grafana where user 1 is a member of team-a and team-b
+// in org 1 and of team-c in org 2, returning it along with an enforcer of the team label
+// looking teams up in it.
+func newTestEnforcer(t *testing.T) (*teamstest.Grafana, teams.GrafanaTeamsEnforcer) {
+	t.Helper()
+	g, err := teamstest.NewGrafana()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	g.SetTeams("1",
+		teams.Team{ID: 1, OrgID: 1, Name: "team-a"},
+		teams.Team{ID: 2, OrgID: 1, Name: "team-b"},
+		teams.Team{ID: 3, OrgID: 2, Name: "team-c"},
+	)
+	k, err := teams.NewKeyfunc(context.Background(), []string{g.URL + grafanaJWKSPath}, teams.JWKSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grafanaURL, err := url.Parse(g.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, teams.GrafanaTeamsEnforcer{
+		Label:       "team",
+		KeyFunc:     k,
+		Cache:       *cache.New(time.Minute, time.Minute),
+		GrafanaUrl:  *grafanaURL,
+		GrafanaUser: teamstest.AdminUser,
+		GrafanaPass: teamstest.AdminPass,
+	}
+}
+
+// parseFlags returns the options of the command line args.
+func parseFlags(t *testing.T, args ...string) *options {
+	t.Helper()
+	o := &options{}
+	app := &cli.App{Flags: newFlags(o), Action: func(*cli.Context) error { return nil }}
+	if err := app.Run(append([]string{"prom-grafana-lbac"}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+// newTestRouteBuilder returns a routeBuilder of the command line args proxying every
+// request to u.
+func newTestRouteBuilder(t *testing.T, u *url.URL, args ...string) *routeBuilder {
+	t.Helper()
+	o := parseFlags(t, args...)
+	rl, err := parseRouteLabels(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := prometheus.NewRegistry()
+	return &routeBuilder{
+		o:         o,
+		labels:    rl,
+		upstream:  u,
+		secondary: u,
+		transport: http.DefaultTransport,
+		raw:       http.DefaultTransport,
+		base:      http.DefaultTransport,
+		outcomes:  proxy.NewEnforcementOutcomes(reg),
+		reg:       reg,
+	}
+}
+
+func TestParseRouteLabels(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		args  []string
+		want  routeLabels
+		error bool
+	}{
+		{
+			name: "label only",
+			args: []string{"--label=team"},
+			want: routeLabels{names: []string{"team"}, byOrg: map[int64]string{}},
+		},
+		{
+			name: "every source of labels",
+			args: []string{
+				"--label=team", "--label-claim=lbac_label", "--label-claim-allowed-labels=namespace, team",
+				"--allowed-label-overrides=namespace,cluster", "--org-labels=2=tenant, 3=namespace",
+			},
+			want: routeLabels{
+				names:     []string{"team", "namespace", "cluster", "tenant"},
+				claim:     []string{"namespace", "team"},
+				overrides: []string{"namespace", "cluster"},
+				byOrg:     map[int64]string{2: "tenant", 3: "namespace"},
+			},
+		},
+		{name: "claim without allowed labels", args: []string{"--label=team", "--label-claim=lbac_label"}, error: true},
+		{name: "org labels without org", args: []string{"--label=team", "--org-labels==tenant"}, error: true},
+		{name: "org labels without label", args: []string{"--label=team", "--org-labels=2="}, error: true},
+		{name: "rejecting unmapped orgs without org labels", args: []string{"--label=team", "--reject-unmapped-orgs"}, error: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl, err := parseRouteLabels(parseFlags(t, tc.args...))
+			if tc.error {
+				if err == nil {
+					t.Errorf("parseRouteLabels() = %+v, want an error", rl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(rl.names, tc.want.names) || !slices.Equal(rl.claim, tc.want.claim) ||
+				!slices.Equal(rl.overrides, tc.want.overrides) || !maps.Equal(rl.byOrg, tc.want.byOrg) {
+				t.Errorf("parseRouteLabels() = %+v, want %+v", rl, tc.want)
+			}
+		})
+	}
+}
+
+func TestRouteBuilderRoutes(t *testing.T) {
+	g, el := newTestEnforcer(t)
+	var query string
+	u := newUpstream(t, &query)
+	b := newTestRouteBuilder(t, u,
+		"--label=team", "--org-labels=2=tenant", "--allowed-label-overrides=namespace",
+		"--secondary-path-prefix=/metrics-b", "--secondary-label=cluster",
+	)
+	mux, err := b.routes(el, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token1, err := g.Token("1", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2, err := g.Token("1", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		path   string
+		token  string
+		label  string
+		status int
+		query  string
+	}{
+		{name: "label", path: "/api/v1/query", token: token1, status: http.StatusOK, query: `up{team=~"team-a|team-b"}`},
+		{name: "org label", path: "/api/v1/query", token: token2, status: http.StatusOK, query: `up{tenant="team-c"}`},
+		{name: "label override", path: "/api/v1/query", token: token1, label: "namespace", status: http.StatusOK, query: `up{namespace=~"team-a|team-b"}`},
+		{name: "label override not allowed", path: "/api/v1/query", token: token1, label: "tenant", status: http.StatusForbidden},
+		{name: "secondary prefix", path: "/metrics-b/api/v1/query", token: token1, status: http.StatusOK, query: `up{cluster=~"team-a|team-b"}`},
+		{name: "no token", path: "/api/v1/query", status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query = ""
+			r := httptest.NewRequest(http.MethodGet, tc.path+"?query=up", nil)
+			if tc.token != "" {
+				r.Header.Set("X-Grafana-Id", tc.token)
+			}
+			if tc.label != "" {
+				r.Header.Set(teams.LabelHeader, tc.label)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if query != tc.query {
+				t.Errorf("upstream query = %q, want %q", query, tc.query)
+			}
+		})
+	}
+}
+
+func TestRouteBuilderDatasources(t *testing.T) {
+	g, el := newTestEnforcer(t)
+	var query, datasourceQuery string
+	u := newUpstream(t, &query)
+	b := newTestRouteBuilder(t, u, "--label=team", "--datasource-claim=datasource")
+	b.datasources = map[string]*url.URL{"ds-b": newUpstream(t, &datasourceQuery)}
+	mux, err := b.routes(el, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name            string
+		datasource      any
+		status          int
+		query           string
+		datasourceQuery string
+	}{
+		{name: "no datasource", status: http.StatusOK, query: `up{team=~"team-a|team-b"}`},
+		{name: "datasource", datasource: "ds-b", status: http.StatusOK, datasourceQuery: `up{team=~"team-a|team-b"}`},
+		{name: "unknown datasource", datasource: "ds-c", status: http.StatusOK, query: `up{team=~"team-a|team-b"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query, datasourceQuery = "", ""
+			token, err := g.TokenWithClaims("1", 1, time.Hour, map[string]any{"datasource": tc.datasource})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+			r.Header.Set("X-Grafana-Id", token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if query != tc.query || datasourceQuery != tc.datasourceQuery {
+				t.Errorf("upstream queries = %q and %q, want %q and %q", query, datasourceQuery, tc.query, tc.datasourceQuery)
+			}
+		})
+	}
+}
+
+func TestRouteBuilderHandler(t *testing.T) {
+	g, el := newTestEnforcer(t)
+	var query string
+	u := newUpstream(t, &query)
+	b := newTestRouteBuilder(t, u, "--label=team", "--max-query-range=1h", "--allow-bearer-token")
+	mux, err := b.routes(el, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := b.handler(mux, nil)
+
+	token, err := g.Token("1", 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		path   string
+		status int
+		query  string
+	}{
+		{name: "range query", path: "/api/v1/query_range?query=up&start=0&end=3600&step=60", status: http.StatusOK, query: `up{team=~"team-a|team-b"}`},
+		{name: "range too wide", path: "/api/v1/query_range?query=up&start=0&end=7200&step=60", status: http.StatusBadRequest},
+		{name: "unknown path", path: "/api/v2/query?query=up", status: http.StatusNotFound},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			query = ""
+			r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			// the token is taken from the Authorization header with --allow-bearer-token
+			r.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tc.status, w.Body)
+			}
+			if query != tc.query {
+				t.Errorf("upstream query = %q, want %q", query, tc.query)
+			}
+		})
+	}
+}
+
+func TestNewFlagsFresh(t *testing.T) {
+	// every set of flags stores its values apart, so repeated flags do not accumulate
+	for range 2 {
+		o := parseFlags(t, "--always-matcher=env=prod")
+		if got := o.alwaysMatchers.Value(); !slices.Equal(got, []string{"env=prod"}) {
+			t.Errorf("--always-matcher = %q, want [env=prod]", got)
+		}
+	}
+}
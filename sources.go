@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// grafanaSource is an additional Grafana instance authenticating requests, as listed in
+// the --grafana-sources-file.
+type grafanaSource struct {
+	// Name tells the instance apart in metrics and logs.
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Issuer is the iss claim of the tokens of the instance, its root URL. Defaults to URL.
+	Issuer string `json:"issuer"`
+	// JWKSPath defaults to --grafana-jwks-path.
+	JWKSPath      string `json:"jwksPath"`
+	AdminUser     string `json:"adminUser"`
+	AdminPassFile string `json:"adminPassFile"`
+	// PinnedSHA256 lists the certificate fingerprints pinned as with --grafana-pinned-sha256.
+	PinnedSHA256 []string `json:"pinnedSha256"`
+
+	url  *url.URL
+	pins [][]byte
+}
+
+// loadGrafanaSources reads the Grafana instances listed in the JSON file at path.
+// primaryIssuer is the issuer of --grafana-url, which no other instance may reuse.
+func loadGrafanaSources(path, primaryIssuer, defaultJWKSPath string, lookup teams.LookupIdentity) ([]grafanaSource, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sources []grafanaSource
+	if err := json.Unmarshal(b, &sources); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	names := map[string]bool{"default": true}
+	issuers := map[string]bool{teams.NormalizeIssuer(primaryIssuer): true}
+	for i := range sources {
+		src := &sources[i]
+		if src.Name == "" || names[src.Name] {
+			return nil, fmt.Errorf("source %d: name %q is empty, reserved or already used", i, src.Name)
+		}
+		names[src.Name] = true
+
+		if src.url, err = url.Parse(src.URL); err != nil {
+			return nil, fmt.Errorf("source %q: %w", src.Name, err)
+		}
+		if src.url.Scheme != "http" && src.url.Scheme != "https" {
+			return nil, fmt.Errorf("source %q: invalid scheme for URL %q, only 'http' and 'https' are supported", src.Name, src.URL)
+		}
+
+		if len(src.PinnedSHA256) > 0 && src.url.Scheme != "https" {
+			return nil, fmt.Errorf("source %q: pinnedSha256 requires an https URL", src.Name)
+		}
+		for _, fp := range src.PinnedSHA256 {
+			pin, err := teams.ParsePin(fp)
+			if err != nil {
+				return nil, fmt.Errorf("source %q: %w", src.Name, err)
+			}
+			src.pins = append(src.pins, pin)
+		}
+
+		if src.Issuer == "" {
+			src.Issuer = src.URL
+		}
+		src.Issuer = teams.NormalizeIssuer(src.Issuer)
+		if issuers[src.Issuer] {
+			return nil, fmt.Errorf("source %q: issuer %q is already used", src.Name, src.Issuer)
+		}
+		issuers[src.Issuer] = true
+
+		if src.JWKSPath == "" {
+			src.JWKSPath = defaultJWKSPath
+		}
+		if lookup == teams.LookupAsAdmin && (src.AdminUser == "" || src.AdminPassFile == "") {
+			return nil, fmt.Errorf("source %q: adminUser and adminPassFile are required with --teams-lookup-identity=admin", src.Name)
+		}
+	}
+	return sources, nil
+}
+
+// enforcer returns the enforcer of the requests authenticated by src along with its keys.
+// It shares the settings of el, the enforcer of --grafana-url, but not its keys,
+// credentials, cache and the state kept per user, and sends its requests through
+// transport unless src pins certificates. Its metrics are registered with reg.
+func (src grafanaSource) enforcer(el teams.GrafanaTeamsEnforcer, o *options, transport http.RoundTripper, reg prometheus.Registerer) (teams.GrafanaTeamsEnforcer, *teams.JWKS, error) {
+	el.GrafanaUrl = *src.url
+	el.Client.Transport = transport
+	if len(src.pins) > 0 {
+		el.Client.Transport = teams.PinnedTransport(src.pins)
+	}
+	keys, err := teams.NewKeyfunc(context.Background(), []string{src.url.JoinPath(src.JWKSPath).String()}, teams.JWKSOptions{
+		StartupRetries: o.jwksStartupRetries,
+		StartupTimeout: o.jwksStartupTimeout,
+		MaxStaleness:   o.jwksMaxStaleness,
+		Registerer:     reg,
+		Transport:      el.Client.Transport,
+	})
+	if err != nil {
+		return teams.GrafanaTeamsEnforcer{}, nil, fmt.Errorf("failed to create a keyfunc.Keyfunc: %w", err)
+	}
+	el.KeyFunc = keys
+
+	c := cache.New(o.teamsCacheTTL, o.cacheCleanupInterval)
+	evictions := teams.NewCacheEvictions(c, reg)
+	el.Cache = *c
+	el.GrafanaUser, el.GrafanaPass, el.GrafanaPassFile, el.GrafanaToken = src.AdminUser, "", nil, ""
+	if src.AdminPassFile != "" {
+		if el.GrafanaPassFile, err = teams.NewSecretFile(src.AdminPassFile); err != nil {
+			return teams.GrafanaTeamsEnforcer{}, nil, fmt.Errorf("failed to read the admin password: %w", err)
+		}
+	}
+	if o.bulkTeamsPath != "" {
+		el.TeamResolver = teams.NewBulkTeamResolver(o.bulkTeamsPath)
+	}
+	el.GrafanaLatency = teams.NewGrafanaLatency(reg)
+	el.CredentialsRejected = teams.NewCredentialsRejected(reg)
+	if o.cacheMaxBytes > 0 {
+		el.CacheBudget = teams.NewCacheBudget(c, evictions, o.cacheMaxBytes, reg)
+	}
+	if o.cacheMaxEntries > 0 || o.cacheIdleTimeout > 0 {
+		el.CacheRecency = teams.NewCacheRecency(c, evictions, o.cacheMaxEntries, o.cacheIdleTimeout)
+	}
+	if o.emptyTeamsRevalidation > 0 {
+		el.EmptyRevalidation = teams.NewEmptyRevalidation(o.emptyTeamsRevalidation, reg)
+	}
+	if o.accessRemovalGrace > 0 {
+		el.RemovalGrace = teams.NewRemovalGrace(o.accessRemovalGrace, o.teamsCacheTTL, reg)
+	}
+	return el, keys, nil
+}
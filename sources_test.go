@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams"
+	"github.com/Amoolaa/prom-grafana-lbac/pkg/teams/teamstest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLoadGrafanaSources(t *testing.T) {
+	const pin = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	for _, tc := range []struct {
+		name    string
+		lookup  teams.LookupIdentity
+		file    string
+		wantErr string
+	}{
+		{name: "valid", file: `[{"name": "staging", "url": "https://staging.example.com/", "adminUser": "admin", "adminPassFile": "/pass"}]`},
+		{name: "self lookup without credentials", lookup: teams.LookupAsSelf, file: `[{"name": "staging", "url": "https://staging.example.com"}]`},
+		{name: "admin lookup without credentials", file: `[{"name": "staging", "url": "https://staging.example.com"}]`, wantErr: "adminUser and adminPassFile are required"},
+		{name: "reserved name", lookup: teams.LookupAsSelf, file: `[{"name": "default", "url": "https://staging.example.com"}]`, wantErr: "reserved or already used"},
+		{name: "duplicate name", lookup: teams.LookupAsSelf, file: `[{"name": "a", "url": "https://a.example.com"}, {"name": "a", "url": "https://b.example.com"}]`, wantErr: "reserved or already used"},
+		{name: "issuer of --grafana-url", lookup: teams.LookupAsSelf, file: `[{"name": "staging", "url": "https://staging.example.com", "issuer": "https://grafana.example.com/"}]`, wantErr: "already used"},
+		{name: "duplicate issuer", lookup: teams.LookupAsSelf, file: `[{"name": "a", "url": "https://a.example.com", "issuer": "https://x.example.com"}, {"name": "b", "url": "https://b.example.com", "issuer": "https://x.example.com/"}]`, wantErr: "already used"},
+		{name: "invalid scheme", lookup: teams.LookupAsSelf, file: `[{"name": "staging", "url": "ftp://staging.example.com"}]`, wantErr: "invalid scheme"},
+		{name: "pins over http", lookup: teams.LookupAsSelf, file: `[{"name": "staging", "url": "http://staging.example.com", "pinnedSha256": ["` + pin + `"]}]`, wantErr: "requires an https URL"},
+		{name: "invalid pin", lookup: teams.LookupAsSelf, file: `[{"name": "staging", "url": "https://staging.example.com", "pinnedSha256": ["abc"]}]`, wantErr: "fingerprint"},
+		{name: "invalid JSON", file: `{`, wantErr: "decode"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sources.json")
+			if err := os.WriteFile(path, []byte(tc.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			lookup := tc.lookup
+			if lookup == "" {
+				lookup = teams.LookupAsAdmin
+			}
+
+			sources, err := loadGrafanaSources(path, "https://grafana.example.com", "/api/signing-keys/keys", lookup)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("loadGrafanaSources() = %v, want an error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the issuer defaults to the URL without its trailing slash, the JWKS path to the default
+			if src := sources[0]; src.Issuer != "https://staging.example.com" || src.JWKSPath != "/api/signing-keys/keys" || src.url.Host != "staging.example.com" {
+				t.Errorf("source = %+v", src)
+			}
+		})
+	}
+}
+
+func TestGrafanaSourceEnforcer(t *testing.T) {
+	primary, el := newTestEnforcer(t)
+	el.GrafanaToken = "glsa_primary"
+	staging, err := teamstest.NewGrafana()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staging.Close()
+	staging.SetTeams("1", teams.Team{ID: 7, OrgID: 1, Name: "team-x"})
+	stagingURL, err := url.Parse(staging.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passFile := filepath.Join(t.TempDir(), "pass")
+	if err := os.WriteFile(passFile, []byte(teamstest.AdminPass), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	src := grafanaSource{Name: "staging", JWKSPath: grafanaJWKSPath, AdminUser: teamstest.AdminUser, AdminPassFile: passFile, url: stagingURL}
+	srcEl, keys, err := src.enforcer(el, parseFlags(t, "--label=team", "--teams-cache-max-entries=10"), http.DefaultTransport, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Ready(); err != nil {
+		t.Errorf("keys not ready: %v", err)
+	}
+	if srcEl.GrafanaToken != "" || srcEl.CacheRecency == nil {
+		t.Errorf("enforcer of the source keeps the token of --grafana-url or lacks the cache settings")
+	}
+
+	var tenants []string
+	h := srcEl.ExtractLabel(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = teams.TenantsFromContext(r.Context())
+	}))
+	for _, tc := range []struct {
+		name    string
+		g       *teamstest.Grafana
+		status  int
+		tenants []string
+	}{
+		{name: "token of the source", g: staging, status: http.StatusOK, tenants: []string{"team-x"}},
+		{name: "token of --grafana-url", g: primary, status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tenants = nil
+			token, err := tc.g.Token("1", 1, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			r.Header.Set("X-Grafana-Id", token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tc.status || !slices.Equal(tenants, tc.tenants) {
+				t.Errorf("got %d with tenants %q, want %d with %q: %s", w.Code, tenants, tc.status, tc.tenants, w.Body)
+			}
+		})
+	}
+	// the teams of the source are cached apart from those of --grafana-url
+	if n := el.Cache.ItemCount(); n != 0 {
+		t.Errorf("%d entries cached by the enforcer of --grafana-url, want 0", n)
+	}
+}